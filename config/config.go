@@ -20,6 +20,8 @@ package config
 
 import   "fmt"
 import   "bytes"
+import   "crypto/sha1"
+import   "encoding/hex"
 import   "log"
 import   "io"
 import   "path"
@@ -84,6 +86,12 @@ type EnrichmentFiles struct {
   Components        TargetFile
   Coverage          TargetFile
   CoverageCnts      TargetFile
+  // control coverage file (control-ratio method only)
+  Control           TargetFile
+  // calibration map (only if calibration is enabled)
+  Calibration       TargetFile
+  // gene annotation (GTF) for gene-level RNA enrichment
+  Annotation        TargetFile
   // H3K4me3 source coverage and counts files
   SrcCoverage     []TargetFile
   SrcCoverageCnts []TargetFile
@@ -95,6 +103,15 @@ func (obj EnrichmentFiles) Dependencies() []string {
   filenames  = append(filenames, obj.Coverage    .Filename)
   filenames  = append(filenames, obj.CoverageCnts.Filename)
   filenames  = append(filenames, obj.Components  .Filename)
+  if obj.Control.Filename != "" {
+    filenames = append(filenames, obj.Control.Filename)
+  }
+  if obj.Calibration.Filename != "" {
+    filenames = append(filenames, obj.Calibration.Filename)
+  }
+  if obj.Annotation.Filename != "" {
+    filenames = append(filenames, obj.Annotation.Filename)
+  }
   return filenames
 }
 
@@ -335,6 +352,23 @@ func (config *ConfigEnrichmentParameters) GetParameters(feature string) []float6
   return parameters
 }
 
+func (config *ConfigEnrichmentParameters) SetParameters(feature string, parameters []float64) {
+  switch strings.ToLower(feature) {
+  case "open"    : config.Open     = parameters
+  case "atac"    : config.Open     = parameters
+  case "dnase"   : config.Open     = parameters
+  case "h3k27ac" : config.H3k27ac  = parameters
+  case "h3k27me3": config.H3k27me3 = parameters
+  case "h3k9me3" : config.H3k9me3  = parameters
+  case "h3k4me1" : config.H3k4me1  = parameters
+  case "h3k4me3" : config.H3k4me3  = parameters
+  case "rna"     : config.Rna      = parameters
+  case "control" : config.Control  = parameters
+  default:
+    panic("internal error")
+  }
+}
+
 /* -------------------------------------------------------------------------- */
 
 type ConfigChromatinStatePaths struct {
@@ -384,6 +418,19 @@ type ConfigModHmm struct {
   OpenChromatinAssay      string                     `json:"Open Chromatin Assay"`
   BamDir                  string                     `json:"Bam Directory"`
   Bam                     ConfigBam                  `json:"Bam Files"`
+  EncodeUrl               string                     `json:"ENCODE URL"`
+  CacheDir                string                     `json:"Cache Directory"`
+  S3Endpoint              string                     `json:"S3 Endpoint"`
+  S3Region                string                     `json:"S3 Region"`
+  S3AccessKey             string                     `json:"S3 Access Key"`
+  S3SecretKey             string                     `json:"S3 Secret Key"`
+  DownloadRetries         int                        `json:"Download Retries"`
+  ReferenceFasta          string                     `json:"Reference FASTA"`
+  GenomeFasta             string                     `json:"Genome FASTA"`
+  Mappability             string                     `json:"Mappability"`
+  MappabilityThreshold    float64                    `json:"Mappability Threshold"`
+  RnaAnnotation           string                     `json:"RNA Annotation"`
+  RnaTpmThreshold         float64                    `json:"RNA TPM Threshold"`
   CoverageBinSize         int                        `json:"Coverage Bin Size`
   CoverageThreads         int                        `json:"Coverage Threads"`
   CoverageDir             string                     `json:"Coverage Directory"`
@@ -391,11 +438,25 @@ type ConfigModHmm struct {
   CoverageCnts            ConfigCoveragePaths        `json:"Coverage Counts Files"`
   CoverageFraglen         bool                       `json:"Coverage Fraglen"`
   CoverageMAPQ            int                        `json:"Coverage MAPQ"`
+  CoverageTargetDepth     int                        `json:"Coverage Target Depth"`
+  CoverageSeed            int64                      `json:"Coverage Seed"`
   EnrichmentMethod        string                     `json:"Enrichment Method"`
+  ControlRatioThreshold   float64                    `json:"Control Ratio Threshold"`
+  ControlRatioWindows     []int                      `json:"Control Ratio Windows"`
+  EnrichmentBroad         []string                   `json:"Enrichment Broad Domains"`
+  EnrichmentBroadScales   []int                      `json:"Enrichment Broad Domain Scales"`
   EnrichmentModelDir      string                     `json:"Enrichment Model Directory"`
   EnrichmentModel         ConfigEnrichmentPaths      `json:"Enrichment Model Files"`
   EnrichmentComp          ConfigEnrichmentPaths      `json:"Enrichment Model Component Files"`
   EnrichmentModelStatic   bool                       `json:"Enrichment Model Static"`
+  EnrichmentModelSeed     int64                      `json:"Enrichment Model Seed"`
+  EnrichmentModelRestarts int                        `json:"Enrichment Model Restarts"`
+  EnrichmentModelData     string                     `json:"Enrichment Model Estimation"`
+  EnrichmentModelSample   int                        `json:"Enrichment Model Subsample Size"`
+  EnrichmentModelMaxIter  int                        `json:"Enrichment Model Max Iterations"`
+  EnrichmentNormalization string                     `json:"Enrichment Normalization"`
+  EnrichmentCalibration   bool                       `json:"Enrichment Calibration"`
+  EnrichmentCalib         ConfigEnrichmentPaths      `json:"Enrichment Calibration Files"`
   EnrichmentDir           string                     `json:"Enrichment Directory"`
   EnrichmentProb          ConfigEnrichmentPaths      `json:"Enrichment Probabilities"`
   EnrichmentPeak          ConfigEnrichmentPaths      `json:"Enrichment Peaks"`
@@ -403,16 +464,21 @@ type ConfigModHmm struct {
   ChromatinStateDir       string                     `json:"Chromatin-State Directory"`
   ChromatinStateProb      ConfigChromatinStatePaths  `json:"Chromatin-State Probabilities"`
   ChromatinStatePeak      ConfigChromatinStatePaths  `json:"Chromatin-State Peaks"`
+  ChromatinStateTrained   bool                       `json:"Chromatin-State Trained Classifiers"`
+  ChromatinStateModel     ConfigChromatinStatePaths  `json:"Chromatin-State Classifier Files"`
   PosteriorProb           ConfigChromatinStatePaths  `json:"Posterior Marginals"`
   PosteriorPeak           ConfigChromatinStatePaths  `json:"Posterior Marginals Peaks"`
   PosteriorDir            string                     `json:"Posterior Marginals Directory"`
   ModelEstimate           bool                       `json:"Model Estimate"`
   ModelFallback           string                     `json:"Model Fallback"`
+  ModelFallbackDistance   string                     `json:"Model Fallback Distance"`
   ModelUnconstrained      bool                       `json:"Model Unconstrained"`
   Model                   TargetFile                 `json:"Model File"`
   ModelDir                string                     `json:"Model Directory"`
   Segmentation            TargetFile                 `json:"Segmentation File"`
   SegmentationDir         string                     `json:"Segmentation Directory"`
+  // maps local cache files to remote URIs
+  RemoteFiles             map[string]string          `json:"-"`
   Directory               string
   Description             string
   FontSize                float64
@@ -447,10 +513,27 @@ func DefaultModHmmConfig() ConfigModHmm {
   config.CoverageFraglen      = false
   config.CoverageBinSize      = 10
   config.CoverageMAPQ         = 30
+  config.EncodeUrl            = "https://www.encodeproject.org"
+  config.DownloadRetries      = 5
+  config.CoverageTargetDepth  = 0
+  config.CoverageSeed         = 1
+  config.EnrichmentModelSeed     = 1
+  config.EnrichmentModelRestarts = 1
+  config.EnrichmentModelData     = "histogram"
+  config.EnrichmentModelSample   = 1000000
+  config.EnrichmentModelMaxIter  = 10000
+  config.EnrichmentNormalization = "quantile"
+  config.MappabilityThreshold = 0.5
+  config.RnaTpmThreshold      = 1.0
   config.ModelFallback        = "mm10"
+  config.ModelFallbackDistance = "wasserstein"
   config.FontSize             = 12
   config.OpenChromatinAssay   = ""
   config.EnrichmentMethod     = "heuristic"
+  config.ControlRatioThreshold = 5.0
+  config.ControlRatioWindows   = []int{1000, 10000}
+  config.EnrichmentBroad       = []string{}
+  config.EnrichmentBroadScales = []int{2000, 10000}
   config.Threads              = 1
   config.Verbose              = 0
   // default parameters for assigning enrichment probabilities
@@ -549,6 +632,7 @@ func (config *ConfigModHmm) SetOpenChromatinAssay(assay string) {
     config.CoverageCnts   .Open = config.CoverageCnts   .Atac
     config.EnrichmentModel.Open = config.EnrichmentModel.Atac
     config.EnrichmentComp .Open = config.EnrichmentComp .Atac
+    config.EnrichmentCalib.Open = config.EnrichmentCalib.Atac
     config.EnrichmentPeak .Open = config.EnrichmentPeak .Atac
     config.EnrichmentProb .Open = config.EnrichmentProb .Atac
   case "dnase":
@@ -556,6 +640,7 @@ func (config *ConfigModHmm) SetOpenChromatinAssay(assay string) {
     config.CoverageCnts   .Open = config.CoverageCnts   .Dnase
     config.EnrichmentModel.Open = config.EnrichmentModel.Dnase
     config.EnrichmentComp .Open = config.EnrichmentComp .Dnase
+    config.EnrichmentCalib.Open = config.EnrichmentCalib.Dnase
     config.EnrichmentPeak .Open = config.EnrichmentPeak .Dnase
     config.EnrichmentProb .Open = config.EnrichmentProb .Dnase
   default:
@@ -576,16 +661,39 @@ func (config *ConfigModHmm) CompletePaths(prefix string) {
   config.Model.Filename         = completePath(config.ModelDir, "", config.Model.Filename, "segmentation.json")
   config.Segmentation.Filename  = completePath(config.SegmentationDir, "", config.Segmentation.Filename, "segmentation.bed.gz")
   config.Bam                    .CompletePaths(config.BamDir, "", "")
+  if config.ReferenceFasta != "" && !path.IsAbs(config.ReferenceFasta) {
+    config.ReferenceFasta = path.Join(prefix, config.ReferenceFasta)
+  }
+  if config.GenomeFasta != "" && !path.IsAbs(config.GenomeFasta) {
+    config.GenomeFasta = path.Join(prefix, config.GenomeFasta)
+  }
+  if config.Mappability != "" && !path.IsAbs(config.Mappability) {
+    config.Mappability = path.Join(prefix, config.Mappability)
+  }
+  if config.RnaAnnotation != "" && !path.IsAbs(config.RnaAnnotation) {
+    config.RnaAnnotation = path.Join(prefix, config.RnaAnnotation)
+  }
+  if config.ModelFallback != "" && !config.ModelFallbackBuiltin() && !config.ModelFallbackAuto() && !path.IsAbs(config.ModelFallback) {
+    config.ModelFallback = path.Join(prefix, config.ModelFallback)
+  }
   config.Coverage               .CompletePaths(config.CoverageDir, "coverage-", ".bw")
   config.CoverageCnts           .CompletePaths(config.EnrichmentModelDir, "", ".counts.json")
   config.EnrichmentModel        .CompletePaths(config.EnrichmentModelDir, "", ".json")
   config.EnrichmentComp         .CompletePaths(config.EnrichmentModelDir, "", ".components.json")
+  config.EnrichmentCalib        .CompletePaths(config.EnrichmentModelDir, "", ".calibration.json")
   config.EnrichmentPeak         .CompletePaths(config.EnrichmentDir, "enrichment-peaks-", ".table")
   config.EnrichmentProb         .CompletePaths(config.EnrichmentDir, "enrichment-", ".bw")
   config.ChromatinStateProb     .CompletePaths(config.ChromatinStateDir, "chromatin-state-", ".bw")
   config.ChromatinStatePeak     .CompletePaths(config.ChromatinStateDir, "chromatin-state-", ".table")
+  config.ChromatinStateModel    .CompletePaths(config.ModelDir, "classifier-", ".json")
   config.PosteriorProb          .CompletePaths(config.PosteriorDir, "posterior-marginal-", ".bw")
   config.PosteriorPeak          .CompletePaths(config.PosteriorDir, "posterior-marginal-peaks-", ".table")
+  if config.CacheDir == "" {
+    config.CacheDir = path.Join(config.setDefaultDir(prefix, "", config.BamDir), ".cache")
+  } else {
+    config.CacheDir = config.setDefaultDir(prefix, config.CacheDir, "")
+  }
+  config.completeRemotePaths()
   config.SetOpenChromatinAssay(config.DetectOpenChromatinAssay())
   if config.EnrichmentModelStatic {
     config.CoverageCnts   .SetStatic(true)
@@ -594,6 +702,40 @@ func (config *ConfigModHmm) CompletePaths(prefix string) {
   }
 }
 
+// Replace remote URIs of input files by paths to the local cache. Remote
+// files are fetched only when required.
+func (config *ConfigModHmm) completeRemotePaths() {
+  if config.RemoteFiles == nil {
+    config.RemoteFiles = make(map[string]string)
+  }
+  remote := func(uri string) string {
+    if !IsRemoteFile(uri) {
+      return uri
+    }
+    name := uri
+    if i := strings.IndexAny(name, "?#"); i != -1 {
+      name = name[:i]
+    }
+    _, name  = path.Split(name)
+    hash    := sha1.Sum([]byte(uri))
+    filename := path.Join(config.CacheDir, fmt.Sprintf("%s-%s", hex.EncodeToString(hash[:6]), name))
+    config.RemoteFiles[filename] = uri
+    return filename
+  }
+  for _, files := range []*[]string{
+    &config.Bam.Atac, &config.Bam.Dnase, &config.Bam.H3k27ac, &config.Bam.H3k27me3, &config.Bam.H3k9me3,
+    &config.Bam.H3k4me1, &config.Bam.H3k4me3, &config.Bam.Rna, &config.Bam.Control } {
+    for i := range *files {
+      (*files)[i] = remote((*files)[i])
+    }
+  }
+  for _, file := range []*TargetFile{
+    &config.Coverage.Atac, &config.Coverage.Dnase, &config.Coverage.H3k27ac, &config.Coverage.H3k27me3, &config.Coverage.H3k9me3,
+    &config.Coverage.H3k4me1, &config.Coverage.H3k4me3, &config.Coverage.Rna, &config.Coverage.Control } {
+    file.Filename = remote(file.Filename)
+  }
+}
+
 func (config *ConfigModHmm) EnrichmentFiles(feature string) EnrichmentFiles {
 
   if !EnrichmentList.Contains(strings.ToLower(feature)) {
@@ -607,9 +749,65 @@ func (config *ConfigModHmm) EnrichmentFiles(feature string) EnrichmentFiles {
   files.Components    = config.EnrichmentComp .GetTargetFile(feature)
   files.Coverage      = config.Coverage       .GetTargetFile(feature)
   files.CoverageCnts  = config.CoverageCnts   .GetTargetFile(feature)
+  if config.EnrichmentControlRatio(files.Feature) {
+    files.Control     = config.Coverage       .GetTargetFile("control")
+  }
+  if config.EnrichmentCalibration {
+    files.Calibration = config.EnrichmentCalib.GetTargetFile(feature)
+  }
+  if files.Feature == "rna" && config.RnaAnnotation != "" {
+    files.Annotation  = TargetFile{Filename: config.RnaAnnotation, Static: true}
+  }
   return files
 }
 
+// Returns true if enrichment of the given feature is computed relative to
+// the control coverage. RNA-seq and control data are always evaluated
+// with the heuristic method.
+func (config *ConfigModHmm) EnrichmentControlRatio(feature string) bool {
+  if strings.ToLower(config.EnrichmentMethod) != "control-ratio" {
+    return false
+  }
+  switch strings.ToLower(feature) {
+  case "rna"    : return false
+  case "control": return false
+  default       : return true
+  }
+}
+
+// Returns true if the given feature forms broad domains, in which case
+// enrichment probabilities are smoothed at multiple scales.
+func (config *ConfigModHmm) EnrichmentBroadDomains(feature string) bool {
+  for _, f := range config.EnrichmentBroad {
+    if strings.ToLower(f) == strings.ToLower(feature) {
+      return true
+    }
+  }
+  return false
+}
+
+// Models compiled into ModHMM that are available as fallback
+var ModelFallbackList = StringList{
+  "mm10", "mm10-liver-embryo-day12.5", "grch38"}
+
+// Returns true if the fallback model is selected automatically for each
+// feature among all compiled models
+func (config ConfigModHmm) ModelFallbackAuto() bool {
+  return strings.ToLower(config.ModelFallback) == "auto"
+}
+
+// Returns true if the model fallback refers to one of the models compiled
+// into ModHMM. Otherwise the fallback is a path to a model pack, i.e. a
+// directory or an archive.
+func (config ConfigModHmm) ModelFallbackBuiltin() bool {
+  switch strings.ToLower(config.ModelFallback) {
+  case "mm10"  : return true
+  case "mm10-liver-embryo-day12.5": return true
+  case "grch38": return true
+  default      : return false
+  }
+}
+
 func (config ConfigModHmm) ModelFallbackPath() string {
   switch strings.ToLower(config.ModelFallback) {
   case "mm10"  :
@@ -619,8 +817,7 @@ func (config ConfigModHmm) ModelFallbackPath() string {
   case "grch38":
     return "GRCh38-gastrocnemius-medialis"
   default:
-    log.Fatalf("invalid single-feature model fallback `%s'", config.ModelFallback)
-    panic("internal error")
+    return config.ModelFallback
   }
 }
 
@@ -725,13 +922,36 @@ func (config ConfigModHmm) String() string {
   if config.Verbose > 0 {
     fmt.Fprintf(&buffer, "%v", config.SessionConfig.String())
     fmt.Fprintf(&buffer, " -> Open Chromatin Assay   : %s\n"  , config.OpenChromatinAssay)
-    fmt.Fprintf(&buffer, " -> Coverage Bin Size      : %d\n\n", config.CoverageBinSize)
-    fmt.Fprintf(&buffer, "Alignment files (BAM):\n")
+    fmt.Fprintf(&buffer, " -> Coverage Bin Size      : %d\n"  , config.CoverageBinSize)
+    fmt.Fprintf(&buffer, " -> Coverage Target Depth  : %d\n"  , config.CoverageTargetDepth)
+    fmt.Fprintf(&buffer, " -> Cache Directory        : %s\n"  , config.CacheDir)
+    fmt.Fprintf(&buffer, " -> Reference FASTA        : %s\n"  , config.ReferenceFasta)
+    fmt.Fprintf(&buffer, " -> Genome FASTA           : %s\n"  , config.GenomeFasta)
+    fmt.Fprintf(&buffer, " -> Mappability            : %s\n"  , config.Mappability)
+    fmt.Fprintf(&buffer, " -> Mappability Threshold  : %v\n"  , config.MappabilityThreshold)
+    if config.RnaAnnotation != "" {
+      fmt.Fprintf(&buffer, " -> RNA Annotation         : %s\n"  , config.RnaAnnotation)
+      fmt.Fprintf(&buffer, " -> RNA TPM Threshold      : %v\n"  , config.RnaTpmThreshold)
+    }
+    fmt.Fprintf(&buffer, "\n")
+    fmt.Fprintf(&buffer, "Alignment files (BAM/SAM/CRAM):\n")
     fmt.Fprintf(&buffer, "%v\n", config.Bam.String(config.OpenChromatinAssay))
     fmt.Fprintf(&buffer, "Coverage files (bigWig):\n")
     fmt.Fprintf(&buffer, "%v\n", config.Coverage.String(config.OpenChromatinAssay))
   }
   if config.Verbose > 1 && config.EnrichmentMethod == "model" {
+    fmt.Fprintf(&buffer, "Enrichment mixture estimation:\n")
+    fmt.Fprintf(&buffer, " -> Seed                 : %v\n"  , config.EnrichmentModelSeed)
+    fmt.Fprintf(&buffer, " -> Restarts             : %v\n"  , config.EnrichmentModelRestarts)
+    fmt.Fprintf(&buffer, " -> Estimation           : %v\n"  , config.EnrichmentModelData)
+    if strings.ToLower(config.EnrichmentModelData) == "subsample" {
+      fmt.Fprintf(&buffer, " -> Subsample Size       : %v\n"  , config.EnrichmentModelSample)
+    }
+    if strings.ToLower(config.EnrichmentModelData) == "histogram" {
+      fmt.Fprintf(&buffer, " -> Max Iterations       : %v\n"  , config.EnrichmentModelMaxIter)
+    }
+    fmt.Fprintf(&buffer, " -> Normalization        : %v\n"  , config.EnrichmentNormalization)
+    fmt.Fprintf(&buffer, "\n")
     fmt.Fprintf(&buffer, "Enrichment mixture distributions:\n")
     fmt.Fprintf(&buffer, "%v\n", config.EnrichmentModel.String(config.OpenChromatinAssay))
     fmt.Fprintf(&buffer, "Enrichment count statistics:\n")
@@ -751,6 +971,20 @@ func (config ConfigModHmm) String() string {
     fmt.Fprintf(&buffer, "Enrichment parameters:\n")
     fmt.Fprintf(&buffer, "%v\n", config.EnrichmentParameters.String())
   }
+  if config.Verbose > 1 && config.EnrichmentCalibration {
+    fmt.Fprintf(&buffer, "Enrichment calibration maps:\n")
+    fmt.Fprintf(&buffer, "%v\n", config.EnrichmentCalib.String(config.OpenChromatinAssay))
+  }
+  if config.Verbose > 1 && strings.ToLower(config.EnrichmentMethod) == "control-ratio" {
+    fmt.Fprintf(&buffer, "Control ratio parameters:\n")
+    fmt.Fprintf(&buffer, " -> Threshold            : %v\n"  , config.ControlRatioThreshold)
+    fmt.Fprintf(&buffer, " -> Windows              : %v\n\n", config.ControlRatioWindows)
+  }
+  if config.Verbose > 1 && len(config.EnrichmentBroad) > 0 {
+    fmt.Fprintf(&buffer, "Broad domain parameters:\n")
+    fmt.Fprintf(&buffer, " -> Features             : %v\n"  , config.EnrichmentBroad)
+    fmt.Fprintf(&buffer, " -> Scales               : %v\n\n", config.EnrichmentBroadScales)
+  }
   if config.Verbose > 0 {
     fmt.Fprintf(&buffer, "Chromatin state probabilities:\n")
     fmt.Fprintf(&buffer, "%v\n", config.ChromatinStateProb.String())
@@ -759,6 +993,10 @@ func (config ConfigModHmm) String() string {
     fmt.Fprintf(&buffer, "Chromatin state peaks:\n")
     fmt.Fprintf(&buffer, "%v\n", config.ChromatinStatePeak.String())
   }
+  if config.Verbose > 1 && config.ChromatinStateTrained {
+    fmt.Fprintf(&buffer, "Trained chromatin state classifiers:\n")
+    fmt.Fprintf(&buffer, "%v\n", config.ChromatinStateModel.String())
+  }
   if config.Verbose > 0 {
     fmt.Fprintf(&buffer, "Posterior marginals:\n")
     fmt.Fprintf(&buffer, "%v\n", config.PosteriorProb.String())
@@ -774,6 +1012,9 @@ func (config ConfigModHmm) String() string {
     fmt.Fprintf(&buffer, " ->  ModHmm Model File            : %v\n", config.Model)
     fmt.Fprintf(&buffer, " ->  ModHmm Model Directory       : %v\n", config.ModelDir)
     fmt.Fprintf(&buffer, " ->  ModHMM Model Fallback        : %s\n", config.ModelFallback)
+    if config.ModelFallbackAuto() {
+      fmt.Fprintf(&buffer, " ->  ModHMM Fallback Distance     : %s\n", config.ModelFallbackDistance)
+    }
     fmt.Fprintf(&buffer, " ->  ModHmm Segmentation File     : %v\n", config.Segmentation)
     fmt.Fprintf(&buffer, " ->  ModHmm Segmentation Directory: %v\n", config.SegmentationDir)
   }
@@ -71,8 +71,17 @@ func main() {
     "     eval-posterior-marginals [stage 5]   - compute posterior marginals of hidden states\n\n" +
     " ModHMM commands are structured in stages. Executing a command also executes all commands with\n" +
     " lower stage number.\n\n" +
+    " Quality control commands:\n" +
+    "     qc                                   - compute quality control reports for bam files\n" +
+    "     calibrate-enrichment                 - calibrate enrichment probabilities using trusted peaks\n" +
+    "     diagnose-enrichment-model            - goodness-of-fit diagnostics of enrichment models\n" +
+    "     tune-enrichment-parameters           - tune parameters of the heuristic enrichment method\n" +
+    " Model commands:\n" +
+    "     export-model-pack                    - bundle estimated models into a model pack\n" +
+    "     train-classifier                     - train chromatin state classifier on labelled regions\n" +
     " Printing commands:\n" +
     "     print-transition-matrix              - print estimated transition rates\n" +
+    "     explain                              - print classifier factors and HMM states at a locus\n" +
     " Peak calling commands:\n" +
     "     call-enrichment-peaks                - call peaks of single-feature enrichment analysis\n" +
     "     call-chromatin-state-peaks           - call peaks of multi-feature classifications\n" +
@@ -129,14 +138,28 @@ func main() {
   switch command {
   case "coverage":
     modhmm_coverage_main(config, options.Args())
+  case "qc":
+    modhmm_qc_main(config, options.Args())
   case "estimate-enrichment-model":
     modhmm_enrichment_estimate_main(config, options.Args())
   case "plot-enrichment-model":
     modhmm_enrichment_plot_main(config, options.Args())
+  case "calibrate-enrichment":
+    modhmm_enrichment_calibrate_main(config, options.Args())
+  case "diagnose-enrichment-model":
+    modhmm_enrichment_diagnose_main(config, options.Args())
+  case "export-model-pack":
+    modhmm_export_model_pack_main(config, options.Args())
+  case "train-classifier":
+    modhmm_train_classifier_main(config, options.Args())
+  case "tune-enrichment-parameters":
+    modhmm_enrichment_tune_main(config, options.Args())
   case "print-enrichment-model":
     modhmm_enrichment_print_main(config, options.Args())
   case "print-transition-matrix":
     modhmm_transition_matrix_print_main(config, options.Args())
+  case "explain":
+    modhmm_explain_main(config, options.Args())
   case "eval-enrichment":
     modhmm_enrichment_eval_main(config, options.Args())
   case "eval-chromatin-state":
@@ -0,0 +1,370 @@
+/* Copyright (C) 2020 Philipp Benner
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+/* -------------------------------------------------------------------------- */
+
+import   "fmt"
+import   "bufio"
+import   "compress/gzip"
+import   "io"
+import   "os"
+import   "os/exec"
+import   "strconv"
+import   "strings"
+
+import . "github.com/pbenner/gonetics"
+
+import . "github.com/pbenner/modhmm/config"
+
+/* alignment file formats
+ * -------------------------------------------------------------------------- */
+
+func alignmentFormat(filename string) string {
+  filename = strings.ToLower(filename)
+  switch {
+  case strings.HasSuffix(filename, ".cram"  ): return "cram"
+  case strings.HasSuffix(filename, ".sam"   ): return "sam"
+  case strings.HasSuffix(filename, ".sam.gz"): return "sam"
+  default:
+    return "bam"
+  }
+}
+
+func alignmentIsBam(filenames ...string) bool {
+  for _, filename := range filenames {
+    if alignmentFormat(filename) != "bam" {
+      return false
+    }
+  }
+  return true
+}
+
+/* SAM records
+ * -------------------------------------------------------------------------- */
+
+type samRecord struct {
+  Name     string
+  Flag     BamFlag
+  Seqname  string
+  Position int
+  MapQ     int
+  Length   int
+}
+
+func samCigarLength(cigar string) (int, error) {
+  if cigar == "*" {
+    return 0, nil
+  }
+  length := 0
+  n      := 0
+  for i := 0; i < len(cigar); i++ {
+    c := cigar[i]
+    if c >= '0' && c <= '9' {
+      n = 10*n + int(c-'0')
+      continue
+    }
+    switch c {
+    case 'M', 'D', 'N', '=', 'X':
+      length += n
+    case 'I', 'S', 'H', 'P':
+    default:
+      return 0, fmt.Errorf("invalid cigar string `%s'", cigar)
+    }
+    n = 0
+  }
+  return length, nil
+}
+
+func samParseRecord(line string) (samRecord, error) {
+  r := samRecord{}
+  fields := strings.SplitN(line, "\t", 7)
+  if len(fields) < 6 {
+    return r, fmt.Errorf("invalid SAM record `%s'", line)
+  }
+  flag, err := strconv.ParseUint(fields[1], 10, 16); if err != nil {
+    return r, fmt.Errorf("invalid SAM flag `%s'", fields[1])
+  }
+  position, err := strconv.ParseInt(fields[3], 10, 64); if err != nil {
+    return r, fmt.Errorf("invalid SAM position `%s'", fields[3])
+  }
+  mapq, err := strconv.ParseInt(fields[4], 10, 64); if err != nil {
+    return r, fmt.Errorf("invalid SAM mapping quality `%s'", fields[4])
+  }
+  length, err := samCigarLength(fields[5]); if err != nil {
+    return r, err
+  }
+  r.Name     = fields[0]
+  r.Flag     = BamFlag(flag)
+  r.Seqname  = fields[2]
+  // SAM positions are 1-based
+  r.Position = int(position)-1
+  r.MapQ     = int(mapq)
+  r.Length   = length
+  return r, nil
+}
+
+// Secondary (0x100) and supplementary (0x800) alignments are additional
+// records of reads that are already represented by a primary alignment
+func (r samRecord) primary() bool {
+  return !r.Flag.SecondaryAlignment() && !r.Flag.Bit(11)
+}
+
+func (r samRecord) read(paired bool) Read {
+  strand := byte('+')
+  if r.Flag.ReverseStrand() {
+    strand = '-'
+  }
+  return Read{GRange{r.Seqname, Range{r.Position, r.Position+r.Length}, strand}, r.MapQ, r.Flag.Duplicate(), paired}
+}
+
+/* alignment file
+ * -------------------------------------------------------------------------- */
+
+// Alignment file in BAM, SAM, or CRAM format. CRAM files are decoded with
+// samtools, which requires the reference sequence given in the config file.
+type AlignmentFile struct {
+  Genome  Genome
+  bam    *BamFile
+  reader *bufio.Reader
+  record  string
+  closers []func() error
+  // first error encountered while reading records
+  err     error
+}
+
+func OpenAlignmentFile(config ConfigModHmm, filename string) (*AlignmentFile, error) {
+  return openAlignmentFile(config, filename, false)
+}
+
+// If headerOnly is true, CRAM files are opened without decoding any records
+func openAlignmentFile(config ConfigModHmm, filename string, headerOnly bool) (*AlignmentFile, error) {
+  r := AlignmentFile{}
+  switch alignmentFormat(filename) {
+  case "bam":
+    if bam, err := OpenBamFile(filename, BamReaderOptions{}); err != nil {
+      return nil, err
+    } else {
+      r.bam    = bam
+      r.Genome = bam.Genome
+      return &r, nil
+    }
+  case "sam":
+    f, err := os.Open(filename); if err != nil {
+      return nil, err
+    }
+    r.closers = append(r.closers, f.Close)
+    if strings.HasSuffix(strings.ToLower(filename), ".gz") {
+      if g, err := gzip.NewReader(f); err != nil {
+        r.Close(); return nil, err
+      } else {
+        r.closers = append([]func() error{g.Close}, r.closers...)
+        r.reader  = bufio.NewReader(g)
+      }
+    } else {
+      r.reader = bufio.NewReader(f)
+    }
+  case "cram":
+    if config.ReferenceFasta == "" {
+      return nil, fmt.Errorf("decoding CRAM file `%s' requires a reference sequence (config option `Reference FASTA')", filename)
+    }
+    option := "-h"
+    if headerOnly {
+      option = "-H"
+    }
+    cmd := exec.Command("samtools", "view", option, "-T", config.ReferenceFasta, filename)
+    cmd.Stderr = os.Stderr
+    stdout, err := cmd.StdoutPipe(); if err != nil {
+      return nil, err
+    }
+    if err := cmd.Start(); err != nil {
+      return nil, fmt.Errorf("decoding CRAM file `%s' requires samtools: %v", filename, err)
+    }
+    r.closers = append(r.closers, func() error {
+      // terminate samtools if the output was not read completely, which
+      // is not an error
+      cmd.Process.Kill()
+      if err := cmd.Wait(); err != nil && cmd.ProcessState.Exited() {
+        return err
+      }
+      return nil
+    })
+    r.reader = bufio.NewReader(stdout)
+  }
+  if err := r.readHeader(); err != nil {
+    r.Close()
+    return nil, fmt.Errorf("reading header of `%s' failed: %v", filename, err)
+  }
+  return &r, nil
+}
+
+func (obj *AlignmentFile) readLine() (string, error) {
+  line, err := obj.reader.ReadString('\n')
+  if err == io.EOF && line != "" {
+    err = nil
+  }
+  return strings.TrimRight(line, "\r\n"), err
+}
+
+func (obj *AlignmentFile) readHeader() error {
+  seqnames := []string{}
+  lengths  := []int{}
+  for {
+    line, err := obj.readLine()
+    if err == io.EOF {
+      break
+    }
+    if err != nil {
+      return err
+    }
+    if !strings.HasPrefix(line, "@") {
+      // first alignment record
+      obj.record = line; break
+    }
+    if !strings.HasPrefix(line, "@SQ\t") {
+      continue
+    }
+    seqname := ""
+    length  := -1
+    for _, field := range strings.Split(line, "\t")[1:] {
+      switch {
+      case strings.HasPrefix(field, "SN:"):
+        seqname = field[3:]
+      case strings.HasPrefix(field, "LN:"):
+        if n, err := strconv.ParseInt(field[3:], 10, 64); err != nil {
+          return fmt.Errorf("invalid sequence length in header line `%s'", line)
+        } else {
+          length = int(n)
+        }
+      }
+    }
+    if seqname == "" || length < 0 {
+      return fmt.Errorf("invalid header line `%s'", line)
+    }
+    seqnames = append(seqnames, seqname)
+    lengths  = append(lengths,  length)
+  }
+  if len(seqnames) == 0 {
+    return fmt.Errorf("header does not define any reference sequences")
+  }
+  obj.Genome = NewGenome(seqnames, lengths)
+  return nil
+}
+
+// Read single- and paired-end reads with the same semantics as
+// BamReader.ReadSimple
+func (obj *AlignmentFile) ReadSimple(joinPairs, pairedEndStrandSpecific bool) ReadChannel {
+  if obj.bam != nil {
+    return obj.bam.ReadSimple(joinPairs, pairedEndStrandSpecific)
+  }
+  channel := make(chan Read)
+  go func() {
+    cache := make(map[string]samRecord)
+    line  := obj.record
+    for err := error(nil); ; line, err = obj.readLine() {
+      if err == io.EOF {
+        break
+      }
+      if err != nil {
+        obj.err = err; break
+      }
+      if line == "" {
+        continue
+      }
+      r, err := samParseRecord(line); if err != nil {
+        obj.err = err; break
+      }
+      if !r.primary() {
+        continue
+      }
+      if r.Flag.ReadPaired() {
+        if mate, ok := cache[r.Name]; !ok {
+          // mate not found
+          cache[r.Name] = r
+        } else {
+          delete(cache, r.Name)
+          r1, r2 := mate, r
+          if r2.Position < r1.Position {
+            r1, r2 = r2, r1
+          }
+          if joinPairs {
+            if !r1.Flag.Unmapped() && r1.Flag.ReadMappedProperPaired() && !r2.Flag.Unmapped() && r2.Flag.ReadMappedProperPaired() {
+              strand := byte('*')
+              if pairedEndStrandSpecific {
+                if r1.Flag.SecondInPair() {
+                  if r1.Flag.ReverseStrand() { strand = '-' } else { strand = '+' }
+                } else {
+                  if r2.Flag.ReverseStrand() { strand = '-' } else { strand = '+' }
+                }
+              }
+              mapq := r1.MapQ
+              if r2.MapQ < mapq {
+                mapq = r2.MapQ
+              }
+              channel <- Read{GRange{r1.Seqname, Range{r1.Position, r2.Position+r2.Length}, strand}, mapq, r1.Flag.Duplicate() || r2.Flag.Duplicate(), true}
+            }
+          } else {
+            if !r1.Flag.Unmapped() {
+              channel <- r1.read(true)
+            }
+            if !r2.Flag.Unmapped() {
+              channel <- r2.read(true)
+            }
+          }
+        }
+      } else {
+        if !r.Flag.Unmapped() {
+          channel <- r.read(false)
+        }
+      }
+    }
+    close(channel)
+  }()
+  return channel
+}
+
+// Error that terminated ReadSimple, the read channel is closed on errors
+func (obj *AlignmentFile) Err() error {
+  return obj.err
+}
+
+func (obj *AlignmentFile) Close() error {
+  if obj.bam != nil {
+    return obj.bam.Close()
+  }
+  result := obj.err
+  for _, f := range obj.closers {
+    if err := f(); err != nil && result == nil {
+      result = err
+    }
+  }
+  return result
+}
+
+/* -------------------------------------------------------------------------- */
+
+func ImportAlignmentGenome(config ConfigModHmm, filename string) (Genome, error) {
+  if alignmentFormat(filename) == "bam" {
+    return BamImportGenome(filename)
+  }
+  if f, err := openAlignmentFile(config, filename, true); err != nil {
+    return Genome{}, err
+  } else {
+    defer f.Close()
+    return f.Genome, nil
+  }
+}
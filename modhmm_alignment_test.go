@@ -0,0 +1,177 @@
+/* Copyright (C) 2020 Philipp Benner
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+/* -------------------------------------------------------------------------- */
+
+import   "io/ioutil"
+import   "os"
+import   "path/filepath"
+import   "strings"
+import   "testing"
+
+import . "github.com/pbenner/gonetics"
+
+import . "github.com/pbenner/modhmm/config"
+
+/* -------------------------------------------------------------------------- */
+
+const testSamHeader = "@HD\tVN:1.6\n@SQ\tSN:chr1\tLN:10000\n@SQ\tSN:chr2\tLN:5000\n"
+
+func testTempDir(t *testing.T) (string, func()) {
+  dir, err := ioutil.TempDir("", "modhmm-test"); if err != nil {
+    t.Fatal(err)
+  }
+  return dir, func() { os.RemoveAll(dir) }
+}
+
+func testSamReads(t *testing.T, records []string, joinPairs bool) ([]Read, error) {
+  dir, cleanup := testTempDir(t)
+  defer cleanup()
+  filename := filepath.Join(dir, "test.sam")
+  if err := ioutil.WriteFile(filename, []byte(testSamHeader+strings.Join(records, "\n")+"\n"), 0666); err != nil {
+    t.Fatal(err)
+  }
+  f, err := OpenAlignmentFile(DefaultModHmmConfig(), filename); if err != nil {
+    t.Fatal(err)
+  }
+  reads := []Read{}
+  for r := range f.ReadSimple(joinPairs, false) {
+    reads = append(reads, r)
+  }
+  return reads, f.Close()
+}
+
+/* -------------------------------------------------------------------------- */
+
+func TestSamCigar(t *testing.T) {
+  for cigar, length := range map[string]int{"*": 0, "36M": 36, "5S30M2I4M": 34, "10M100N20M3D": 133, "4H10=2X": 12} {
+    if n, err := samCigarLength(cigar); err != nil || n != length {
+      t.Errorf("test failed for cigar `%s': %d", cigar, n)
+    }
+  }
+  if _, err := samCigarLength("10M5Q"); err == nil {
+    t.Error("test failed")
+  }
+}
+
+func TestSamHeader(t *testing.T) {
+  dir, cleanup := testTempDir(t)
+  defer cleanup()
+  filename := filepath.Join(dir, "test.sam")
+  if err := ioutil.WriteFile(filename, []byte(testSamHeader), 0666); err != nil {
+    t.Fatal(err)
+  }
+  genome, err := ImportAlignmentGenome(DefaultModHmmConfig(), filename); if err != nil {
+    t.Fatal(err)
+  }
+  if genome.Length() != 2 || genome.Seqnames[1] != "chr2" || genome.Lengths[1] != 5000 {
+    t.Error("test failed")
+  }
+}
+
+func TestSamSingleEnd(t *testing.T) {
+  reads, err := testSamReads(t, []string{
+    "r1\t0\tchr1\t101\t30\t36M\t*\t0\t0\t*\t*",
+    "r2\t16\tchr1\t201\t10\t5S31M\t*\t0\t0\t*\t*",
+    "r3\t4\t*\t0\t0\t*\t*\t0\t0\t*\t*",
+    "r4\t1024\tchr2\t11\t30\t36M\t*\t0\t0\t*\t*" }, false)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(reads) != 3 {
+    t.Fatalf("test failed: %d reads", len(reads))
+  }
+  if r := reads[0]; r.Seqname != "chr1" || r.Range.From != 100 || r.Range.To != 136 || r.Strand != '+' || r.MapQ != 30 {
+    t.Errorf("test failed: %v", r)
+  }
+  if r := reads[1]; r.Range.From != 200 || r.Range.To != 231 || r.Strand != '-' {
+    t.Errorf("test failed: %v", r)
+  }
+  if r := reads[2]; r.Seqname != "chr2" || !r.Duplicate {
+    t.Errorf("test failed: %v", r)
+  }
+}
+
+func TestSamSecondary(t *testing.T) {
+  // secondary and supplementary records must neither be counted nor
+  // interfere with mate pairing
+  reads, err := testSamReads(t, []string{
+    "p1\t99\tchr1\t101\t30\t50M\t=\t301\t250\t*\t*",
+    "p1\t355\tchr1\t5001\t0\t50M\t=\t301\t0\t*\t*",
+    "p1\t2145\tchr2\t101\t0\t20M\t=\t101\t0\t*\t*",
+    "p1\t147\tchr1\t301\t20\t50M\t=\t101\t-250\t*\t*",
+    "s1\t256\tchr1\t1001\t0\t36M\t*\t0\t0\t*\t*",
+    "s1\t0\tchr1\t2001\t30\t36M\t*\t0\t0\t*\t*" }, true)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(reads) != 2 {
+    t.Fatalf("test failed: %d reads", len(reads))
+  }
+  if r := reads[0]; r.Seqname != "chr1" || r.Range.From != 100 || r.Range.To != 350 || r.MapQ != 20 || !r.PairedEnd {
+    t.Errorf("test failed: %v", r)
+  }
+  if r := reads[1]; r.Range.From != 2000 || r.PairedEnd {
+    t.Errorf("test failed: %v", r)
+  }
+}
+
+func TestSamMalformed(t *testing.T) {
+  reads, err := testSamReads(t, []string{
+    "r1\t0\tchr1\t101\t30\t36M\t*\t0\t0\t*\t*",
+    "r2\t0\tchr1\tx\t30\t36M\t*\t0\t0\t*\t*",
+    "r3\t0\tchr1\t301\t30\t36M\t*\t0\t0\t*\t*" }, false)
+  if err == nil {
+    t.Error("test failed: malformed record not reported")
+  }
+  if len(reads) != 1 {
+    t.Errorf("test failed: %d reads", len(reads))
+  }
+}
+
+func TestCramHeader(t *testing.T) {
+  dir, cleanup := testTempDir(t)
+  defer cleanup()
+  // samtools substitute that never terminates unless only the header is
+  // requested
+  script := "#!/bin/sh\nprintf '" + strings.Replace(testSamHeader, "\t", "\\t", -1) + "'\n" +
+    "if [ \"$2\" = \"-H\" ]; then exit 0; fi\n" +
+    "while true; do printf 'r1\\t0\\tchr1\\t101\\t30\\t36M\\t*\\t0\\t0\\t*\\t*\\n'; done\n"
+  if err := ioutil.WriteFile(filepath.Join(dir, "samtools"), []byte(script), 0777); err != nil {
+    t.Fatal(err)
+  }
+  t.Setenv("PATH", dir + string(os.PathListSeparator) + os.Getenv("PATH"))
+
+  config := DefaultModHmmConfig()
+  config.ReferenceFasta = filepath.Join(dir, "genome.fa")
+  filename := filepath.Join(dir, "test.cram")
+
+  genome, err := ImportAlignmentGenome(config, filename); if err != nil {
+    t.Fatal(err)
+  }
+  if genome.Length() != 2 || genome.Lengths[0] != 10000 {
+    t.Error("test failed")
+  }
+  // closing the file before all records are read terminates samtools
+  f, err := OpenAlignmentFile(config, filename); if err != nil {
+    t.Fatal(err)
+  }
+  if err := f.Close(); err != nil {
+    t.Errorf("test failed: %v", err)
+  }
+}
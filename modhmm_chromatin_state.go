@@ -20,6 +20,7 @@ package main
 
 import   "fmt"
 import   "log"
+import   "math"
 import   "os"
 import   "strings"
 
@@ -36,17 +37,70 @@ import   "github.com/pborman/getopt"
 
 /* -------------------------------------------------------------------------- */
 
+// Features required for identifying a state, i.e. its classifier requires
+// a peak of these features
+var chromatinStateRequiredFeatures = map[string][]string{
+  "bi": {"h3k27me3"},
+  "r1": {"h3k27me3"},
+  "r2": {"h3k9me3"},
+  "cl": {"control"} }
+
+// Optional features without data, which are treated as unknown
+func chromatin_state_missing_features(config ConfigModHmm) []bool {
+  r := make([]bool, len(EnrichmentList))
+  for i, feature := range EnrichmentList {
+    r[i] = EnrichmentIsOptional(feature) && !FileExists(config.EnrichmentProb.GetTargetFile(feature).Filename)
+  }
+  return r
+}
+
+// Missing features required for identifying the given state
+func chromatin_state_missing_required(config ConfigModHmm, state string) []string {
+  missing := chromatin_state_missing_features(config)
+  r := []string{}
+  for _, feature := range chromatinStateRequiredFeatures[strings.ToLower(state)] {
+    if missing[EnrichmentList.Index(feature)] {
+      r = append(r, feature)
+    }
+  }
+  return r
+}
+
+// States that cannot be identified because of missing data
+func chromatin_state_unidentifiable(config ConfigModHmm) []string {
+  r := []string{}
+  for _, state := range ChromatinStateList {
+    if len(chromatin_state_missing_required(config, state)) > 0 {
+      r = append(r, strings.ToUpper(state))
+    }
+  }
+  return r
+}
+
 func get_chromatin_state_model(config ConfigModHmm, state string) MatrixBatchClassifier {
+  if features := chromatin_state_missing_required(config, state); len(features) > 0 {
+    printStderr(config, 1, "Warning: state `%s' cannot be identified without data for %s and is dropped from the segmentation\n", strings.ToUpper(state), strings.Join(features, ", "))
+    return ClassifierUnidentifiable{}
+  }
+  missing := chromatin_state_missing_features(config)
+  // use trained classifier if available
+  if config.ChromatinStateTrained {
+    filename := config.ChromatinStateModel.GetTargetFile(state).Filename
+    if FileExists(filename) {
+      return ImportTrainedClassifier(config, filename, missing)
+    }
+    printStderr(config, 1, "Warning: trained classifier `%s' does not exist. Using default classifier for state `%s'.\n", filename, strings.ToUpper(state))
+  }
   switch strings.ToLower(state) {
-  case "pa": return ClassifierPA{}
-  case "ea": return ClassifierEA{}
-  case "bi": return ClassifierBI{}
-  case "pr": return ClassifierPR{}
-  case "tr": return ClassifierTR{}
-  case "r1": return ClassifierR1{}
-  case "r2": return ClassifierR2{}
-  case "cl": return ClassifierCL{}
-  case "ns": return ClassifierNS{}
+  case "pa": return NewClassifierPA(config.BinSize, missing)
+  case "ea": return NewClassifierEA(config.BinSize, missing)
+  case "bi": return NewClassifierBI(config.BinSize, missing)
+  case "pr": return NewClassifierPR(config.BinSize, missing)
+  case "tr": return NewClassifierTR(missing)
+  case "r1": return NewClassifierR1(missing)
+  case "r2": return NewClassifierR2(missing)
+  case "cl": return NewClassifierCL(missing)
+  case "ns": return NewClassifierNS(missing)
   default:
     log.Fatalf("unknown state: %s", state)
   }
@@ -55,30 +109,45 @@ func get_chromatin_state_model(config ConfigModHmm, state string) MatrixBatchCla
 
 /* -------------------------------------------------------------------------- */
 
-func chromatin_state_eval(config ConfigModHmm, classifier MatrixBatchClassifier, trackFiles []string, tracks []Track, filenameResult string) []Track {
-  if len(tracks) != len(trackFiles) {
-    tracks  = make([]Track, len(trackFiles))
-    genome := Genome{}
-    empty  := []int{}
-    for i, filename := range trackFiles {
-      if !FileExists(filename) && EnrichmentIsOptional(EnrichmentList[i]) {
-        empty = append(empty, i)
-        continue
-      }
-      if t, err := ImportTrack(config.SessionConfig, filename); err != nil {
+// Import enrichment probabilities of all features, missing optional
+// features are replaced by an empty track (classifiers marginalize over
+// these features)
+func chromatin_state_import_tracks(config ConfigModHmm, trackFiles []string) []Track {
+  tracks := make([]Track, len(trackFiles))
+  genome := Genome{}
+  empty  := []int{}
+  for i, filename := range trackFiles {
+    if !FileExists(filename) && EnrichmentIsOptional(EnrichmentList[i]) {
+      empty = append(empty, i)
+      continue
+    }
+    if t, err := ImportTrack(config.SessionConfig, filename); err != nil {
+      log.Fatal(err)
+    } else {
+      // propagate bins with low mappability as missing data
+      if err := mappabilityMask(config, t, math.NaN()); err != nil {
         log.Fatal(err)
-      } else {
-        tracks[i] = t
-        genome    = t.GetGenome()
       }
+      tracks[i] = t
+      genome    = t.GetGenome()
     }
-    if len(empty) > 0 {
-      t := AllocSimpleTrack("classification", genome, config.BinSize)
-      for _, i := range empty {
-        tracks[i] = t
-      }
+  }
+  if len(empty) > 0 {
+    t := AllocSimpleTrack("classification", genome, config.BinSize)
+    if err := mappabilityMask(config, t, math.NaN()); err != nil {
+      log.Fatal(err)
+    }
+    for _, i := range empty {
+      tracks[i] = t
     }
   }
+  return tracks
+}
+
+func chromatin_state_eval(config ConfigModHmm, classifier MatrixBatchClassifier, trackFiles []string, tracks []Track, filenameResult string) []Track {
+  if len(tracks) != len(trackFiles) {
+    tracks = chromatin_state_import_tracks(config, trackFiles)
+  }
   result, err := BatchClassifyMultiTrack(config.SessionConfig, classifier, tracks, false); if err != nil {
     log.Fatal(err)
   }
@@ -111,6 +180,9 @@ func modhmm_chromatin_state_eval(config ConfigModHmm, state string, tracks []Tra
   dependencies    = append(dependencies, modhmm_chromatin_state_eval_dep(config)...)
   dependencies    = append(dependencies, modhmm_enrichment_eval_dep(config)...)
   dependencies    = append(dependencies, modhmm_coverage_dep(config)...)
+  if config.ChromatinStateTrained {
+    dependencies  = append(dependencies, config.ChromatinStateModel.GetTargetFile(state).Filename)
+  }
 
   trackFiles     := modhmm_chromatin_state_eval_dep(config)
   filenameResult := config.ChromatinStateProb.GetTargetFile(state)
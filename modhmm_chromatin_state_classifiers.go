@@ -19,6 +19,7 @@ package main
 /* -------------------------------------------------------------------------- */
 
 //import   "fmt"
+import   "math"
 
 import . "github.com/pbenner/autodiff"
 import . "github.com/pbenner/autodiff/statistics"
@@ -41,12 +42,122 @@ func checkNumerics(r float64) float64 {
 
 /* -------------------------------------------------------------------------- */
 
+type classifierFactor struct {
+  Name  string
+  Value float64
+}
+
+// Factors of a classifier are recorded only if the list is not nil
+type classifierFactors []classifierFactor
+
+func (obj *classifierFactors) Add(name string, value float64) float64 {
+  if obj != nil {
+    *obj = append(*obj, classifierFactor{name, value})
+  }
+  return value
+}
+
+/* -------------------------------------------------------------------------- */
+
+/* Classifier windows are defined in base pairs and translated into bins
+ * using the bin size of enrichment tracks, such that patterns have the
+ * same genomic width at any resolution. Widths are given as the distance
+ * between the center bin and the window boundary. Classifiers of
+ * transcribed, repressed, control and no signal states only evaluate the
+ * center bin.
+ * -------------------------------------------------------------------------- */
+
+// window of promoter and enhancer classifiers (PA, EA)
+const classifierWidthWide   = 800
+// window of bivalent and primed classifiers (BI, PR)
+const classifierWidthNarrow = 600
+// central region within windows
+const classifierWidthInner  = 400
+// margin at window boundaries excluded from symmetric patterns
+const classifierWidthMargin = 200
+
+type classifierWindow struct {
+  // number of bins
+  n  int
+  // central region [k1, k2)
+  k1 int
+  k2 int
+  // margin in bins
+  k0 int
+}
+
+// Number of bins closest to the given width in base pairs
+func classifier_bins(width, binSize int) int {
+  return int(math.Floor(float64(width)/float64(binSize) + 0.5))
+}
+
+func newClassifierWindow(binSize, width int) classifierWindow {
+  h := classifier_bins(width, binSize)
+  c := classifier_bins(classifierWidthInner,  binSize)
+  m := classifier_bins(classifierWidthMargin, binSize)
+  if c > h {
+    c = h
+  }
+  if m > h {
+    m = h
+  }
+  return classifierWindow{n: 2*h+1, k1: h-c, k2: h+c+1, k0: m}
+}
+
+/* -------------------------------------------------------------------------- */
+
+/* Optional features without data are treated as unknown. Factors of such
+ * features are marginalized out, i.e. they are uninformative and set to
+ * one. States that require a peak of a missing feature cannot be
+ * identified and are dropped (see ClassifierUnidentifiable).
+ *
+ * Bins with low mappability are missing data (NaN) and are marginalized
+ * in the same way, i.e. a missing bin is compatible with a peak as well as
+ * with no peak. Factors therefore remain defined for all bins next to
+ * masked regions.
+ * -------------------------------------------------------------------------- */
+
 type BasicClassifier struct {
+  // features without data
+  missing []bool
+}
+
+func (obj BasicClassifier) Missing(i int) bool {
+  return i < len(obj.missing) && obj.missing[i]
+}
+
+// Probability of a peak, missing values are uninformative
+func classifierPeak(p float64) float64 {
+  if math.IsNaN(p) {
+    return 1.0
+  }
+  return p
+}
+
+// Probability of no peak, missing values are uninformative
+func classifierNoPeak(p float64) float64 {
+  if math.IsNaN(p) {
+    return 1.0
+  }
+  return 1.0-p
+}
+
+// Sums over patterns may exceed one if missing values are compatible with
+// several patterns
+func classifierBound(r float64, missing bool) float64 {
+  if missing && r > 1.0 {
+    return 1.0
+  }
+  return checkNumerics(r)
 }
 
 func (obj BasicClassifier) PeakSym_(x ConstMatrix, m, min, k0 int) float64 {
-  _, n := x.Dims()
-  r    := 0.0
+  if obj.Missing(m) {
+    return 1.0
+  }
+  _, n    := x.Dims()
+  r       := 0.0
+  missing := false
   // pattern:
   //
   // 0   1   2   3   4
@@ -64,26 +175,31 @@ func (obj BasicClassifier) PeakSym_(x ConstMatrix, m, min, k0 int) float64 {
       }
       xi := x.Float64At(m, i)
       xj := x.Float64At(m, j)
+      if math.IsNaN(xi) || math.IsNaN(xj) {
+        missing = true
+      }
       if i >= k {
         // positive
         if i == j {
-          t *= xi
+          t *= classifierPeak(xi)
         } else {
-          t *= xi
-          t *= xj
+          t *= classifierPeak(xi)
+          t *= classifierPeak(xj)
         }
       } else {
         // negative
         if i == j {
-          t *= 1.0 - xi
-        } else {
+          t *= classifierNoPeak(xi)
+        } else if !math.IsNaN(xi) && !math.IsNaN(xj) {
+          // not both positions have a peak (always possible if one of
+          // them is missing)
           t *= xi*(1.0-xj) + (1.0-xi)*xj + (1.0-xi)*(1.0-xj)
         }
       }
     }
     r += t
   }
-  return checkNumerics(r)
+  return classifierBound(r, missing)
 }
 
 func (obj BasicClassifier) PeakSym(x ConstMatrix, m, min int) float64 {
@@ -92,19 +208,20 @@ func (obj BasicClassifier) PeakSym(x ConstMatrix, m, min int) float64 {
 
 func (obj BasicClassifier) PeakAny(x ConstMatrix, i int) float64 {
   _, n := x.Dims()
-  r    :=     x.Float64At(i, 0)
-  t    := 1.0-x.Float64At(i, 0)
-  for k := 1; k < n; k++ {
-    r +=   t*x.Float64At(i, k)
-    t *= 1.0-x.Float64At(i, k)
-  }
-  return checkNumerics(r)
+  return obj.PeakAnyRange(x, i, 0, n)
 }
 
 func (obj BasicClassifier) PeakAnyRange(x ConstMatrix, i, k1, k2 int) float64 {
+  if obj.Missing(i) {
+    return 1.0
+  }
   r    := 0.0
   t    := 1.0
   for k := k1; k < k2; k++ {
+    if math.IsNaN(x.Float64At(i, k)) {
+      // a peak may be located at the missing position
+      return 1.0
+    }
     r +=   t*x.Float64At(i, k)
     t *= 1.0-x.Float64At(i, k)
   }
@@ -112,196 +229,254 @@ func (obj BasicClassifier) PeakAnyRange(x ConstMatrix, i, k1, k2 int) float64 {
 }
 
 func (obj BasicClassifier) PeakAt(x ConstMatrix, i, k int) float64 {
-  return x.Float64At(i, k)
+  if obj.Missing(i) {
+    return 1.0
+  }
+  return classifierPeak(x.Float64At(i, k))
 }
 
 func (obj BasicClassifier) PeakAtCenter(x ConstMatrix, i int) float64 {
   _, n := x.Dims()
-  return x.Float64At(i, n/2)
+  return obj.PeakAt(x, i, n/2)
 }
 
 func (obj BasicClassifier) PeakAll(x ConstMatrix, i int) float64 {
   _, n := x.Dims()
-  r    := 1.0
-  for k := 0; k < n; k++ {
-    r *= x.Float64At(i, k)
-  }
-  return r
+  return obj.PeakRange(x, i, 0, n)
 }
 
 func (obj BasicClassifier) PeakRange(x ConstMatrix, i, k1, k2 int) float64 {
+  if obj.Missing(i) {
+    return 1.0
+  }
   r := 1.0
   for j := k1; j < k2; j++ {
-    r *= x.Float64At(i, j)
+    r *= classifierPeak(x.Float64At(i, j))
+  }
+  return r
+}
+
+// Probability of a peak at all positions within negated patterns, where
+// missing values are compatible with no peak
+func (obj BasicClassifier) PeakAllNegated(x ConstMatrix, i int) float64 {
+  if obj.Missing(i) {
+    return 0.0
+  }
+  _, n := x.Dims()
+  r    := 1.0
+  for k := 0; k < n; k++ {
+    p := x.Float64At(i, k)
+    if math.IsNaN(p) {
+      return 0.0
+    }
+    r *= p
   }
   return r
 }
 
 func (obj BasicClassifier) NoPeakRange(x ConstMatrix, i, k1, k2 int) float64 {
+  if obj.Missing(i) {
+    return 1.0
+  }
   r := 1.0
   for j := k1; j < k2; j++ {
-    r *= 1.0-x.Float64At(i, j)
+    r *= classifierNoPeak(x.Float64At(i, j))
   }
   return checkNumerics(r)
 }
 
 func (obj BasicClassifier) NoPeakAt(x ConstMatrix, i, k int) float64 {
-  return 1.0-x.Float64At(i, k)
+  if obj.Missing(i) {
+    return 1.0
+  }
+  return checkNumerics(classifierNoPeak(x.Float64At(i, k)))
 }
 
 func (obj BasicClassifier) NoPeakAtCenter(x ConstMatrix, i int) float64 {
   _, n := x.Dims()
-  return checkNumerics(1.0-x.Float64At(i, n/2))
+  return obj.NoPeakAt(x, i, n/2)
 }
 
 func (obj BasicClassifier) NoPeakAll(x ConstMatrix, i int) float64 {
   _, n := x.Dims()
-  r    := 1.0
-  for k := 0; k < n; k++ {
-    r *= 1.0-x.Float64At(i, k)
-  }
-  return checkNumerics(r)
+  return obj.NoPeakRange(x, i, 0, n)
 }
 
 /* -------------------------------------------------------------------------- */
 
 type ClassifierPA struct {
   BasicClassifier
+  classifierWindow
+}
+
+func NewClassifierPA(binSize int, missing []bool) ClassifierPA {
+  return ClassifierPA{BasicClassifier{missing}, newClassifierWindow(binSize, classifierWidthWide)}
 }
 
 func (obj ClassifierPA) Eval(s Scalar, x ConstMatrix) error {
+  s.SetFloat64(obj.Factors(x, nil))
+  return nil
+}
+
+func (obj ClassifierPA) Factors(x ConstMatrix, f *classifierFactors) float64 {
   r := 1.0
   { // atac peak at the center
-    r *= obj.PeakAtCenter(x, jOpen)
+    r *= f.Add("open peak at center", obj.PeakAtCenter(x, jOpen))
   }
   { // h3k27ac peak at any position
-    r *= obj.PeakSym(x, jH3k27ac, 0)
+    r *= f.Add("h3k27ac symmetric peak", obj.PeakSym(x, jH3k27ac, 0))
   }
   { // h3k4me1 peak at any position
-    r *= obj.PeakAny(x, jH3k4me1)
+    r *= f.Add("h3k4me1 peak at any position", obj.PeakAny(x, jH3k4me1))
   }
   { // h3k4me3 peak at any position
-    r *= obj.PeakAny(x, jH3k4me3)
+    r *= f.Add("h3k4me3 peak at any position", obj.PeakAny(x, jH3k4me3))
   }
   { // no control peak at all positions
-    r *= obj.NoPeakAll(x, jControl)
+    r *= f.Add("no control peak", obj.NoPeakAll(x, jControl))
   }
-  s.SetFloat64(r)
-  return nil
+  return r
 }
 
-func (ClassifierPA) Dims() (int, int) {
-  return 8, 9
+func (obj ClassifierPA) Dims() (int, int) {
+  return 8, obj.n
 }
 
-func (ClassifierPA) CloneMatrixBatchClassifier() MatrixBatchClassifier {
-  return ClassifierPA{}
+func (obj ClassifierPA) CloneMatrixBatchClassifier() MatrixBatchClassifier {
+  return obj
 }
 
 /* -------------------------------------------------------------------------- */
 
 type ClassifierEA struct {
   BasicClassifier
+  classifierWindow
+}
+
+func NewClassifierEA(binSize int, missing []bool) ClassifierEA {
+  return ClassifierEA{BasicClassifier{missing}, newClassifierWindow(binSize, classifierWidthWide)}
 }
 
 func (obj ClassifierEA) Eval(s Scalar, x ConstMatrix) error {
+  s.SetFloat64(obj.Factors(x, nil))
+  return nil
+}
+
+func (obj ClassifierEA) Factors(x ConstMatrix, f *classifierFactors) float64 {
   r := 1.0
   { // atac peak at the center
-    r *= obj.PeakAtCenter(x, jOpen)
+    r *= f.Add("open peak at center", obj.PeakAtCenter(x, jOpen))
   }
   { // h3k27ac peak at any position
-    r *= obj.PeakSym_(x, jH3k27ac, 0, 1)
+    r *= f.Add("h3k27ac symmetric peak", obj.PeakSym_(x, jH3k27ac, 0, obj.k0))
   }
   { // h3k4me1 peak at any position
-    r *= obj.PeakAnyRange(x, jH3k4me1, 2, 7)
+    r *= f.Add("h3k4me1 peak near center", obj.PeakAnyRange(x, jH3k4me1, obj.k1, obj.k2))
   }
   { // no h3k4me3 peak at all positions
-    r *= obj.NoPeakAll(x, jH3k4me3)
+    r *= f.Add("no h3k4me3 peak", obj.NoPeakAll(x, jH3k4me3))
   }
   { // no control peak at all positions
-    r *= obj.NoPeakAll(x, jControl)
+    r *= f.Add("no control peak", obj.NoPeakAll(x, jControl))
   }
-  s.SetFloat64(r)
-  return nil
+  return r
 }
 
-func (ClassifierEA) Dims() (int, int) {
-  return 8, 9
+func (obj ClassifierEA) Dims() (int, int) {
+  return 8, obj.n
 }
 
-func (ClassifierEA) CloneMatrixBatchClassifier() MatrixBatchClassifier {
-  return ClassifierEA{}
+func (obj ClassifierEA) CloneMatrixBatchClassifier() MatrixBatchClassifier {
+  return obj
 }
 
 /* -------------------------------------------------------------------------- */
 
 type ClassifierBI struct {
   BasicClassifier
+  classifierWindow
+}
+
+func NewClassifierBI(binSize int, missing []bool) ClassifierBI {
+  return ClassifierBI{BasicClassifier{missing}, newClassifierWindow(binSize, classifierWidthNarrow)}
 }
 
 func (obj ClassifierBI) Eval(s Scalar, x ConstMatrix) error {
+  s.SetFloat64(obj.Factors(x, nil))
+  return nil
+}
+
+func (obj ClassifierBI) Factors(x ConstMatrix, f *classifierFactors) float64 {
   r := 1.0
   { // atac peak at the center
     //r *= obj.PeakAtCenter(x, jOpen)
   }
   { // h3k27me3 peak at any position
-    r *= obj.PeakSym_(x, jH3k27me3, 0, 1)
+    r *= f.Add("h3k27me3 symmetric peak", obj.PeakSym_(x, jH3k27me3, 0, obj.k0))
   }
   { // symmetric jH3k4me1 peak or h3k4me3 peak at any position
     t1 := obj.PeakSym  (x, jH3k4me1, 0)
-    t2 := obj.PeakRange(x, jH3k4me3, 1, 6)
-    r  *= t1 + (1.0-t1)*t2
+    t2 := obj.PeakRange(x, jH3k4me3, obj.k1, obj.k2)
+    r  *= f.Add("h3k4me1 symmetric peak or h3k4me3 peak", t1 + (1.0-t1)*t2)
   }
   { // no control peak at all positions
-    r *= obj.NoPeakRange(x, jControl, 1, 6)
+    r *= f.Add("no control peak", obj.NoPeakRange(x, jControl, obj.k1, obj.k2))
   }
-  s.SetFloat64(r)
-  return nil
+  return r
 }
 
-func (ClassifierBI) Dims() (int, int) {
-  return 8, 7
+func (obj ClassifierBI) Dims() (int, int) {
+  return 8, obj.n
 }
 
-func (ClassifierBI) CloneMatrixBatchClassifier() MatrixBatchClassifier {
-  return ClassifierBI{}
+func (obj ClassifierBI) CloneMatrixBatchClassifier() MatrixBatchClassifier {
+  return obj
 }
 
 /* -------------------------------------------------------------------------- */
 
 type ClassifierPR struct {
   BasicClassifier
+  classifierWindow
+}
+
+func NewClassifierPR(binSize int, missing []bool) ClassifierPR {
+  return ClassifierPR{BasicClassifier{missing}, newClassifierWindow(binSize, classifierWidthNarrow)}
 }
 
 func (obj ClassifierPR) Eval(s Scalar, x ConstMatrix) error {
+  s.SetFloat64(obj.Factors(x, nil))
+  return nil
+}
+
+func (obj ClassifierPR) Factors(x ConstMatrix, f *classifierFactors) float64 {
   r := 1.0
   { // atac peak at the center
-    r *= obj.PeakAtCenter(x, jOpen)
+    r *= f.Add("open peak at center", obj.PeakAtCenter(x, jOpen))
   }
   { // no h3k27ac peak
-    r *= obj.NoPeakRange(x, jH3k27ac, 1, 6)
+    r *= f.Add("no h3k27ac peak", obj.NoPeakRange(x, jH3k27ac, obj.k1, obj.k2))
   }
   { // no h3k27me3 peak
-    r *= obj.NoPeakRange(x, jH3k27me3, 1, 6)
+    r *= f.Add("no h3k27me3 peak", obj.NoPeakRange(x, jH3k27me3, obj.k1, obj.k2))
   }
   { // symmetric jH3k4me1 peak or h3k4me3 peak at any position
     t1 := obj.PeakSym  (x, jH3k4me1, 0)
-    t2 := obj.PeakRange(x, jH3k4me3, 1, 6)
-    r  *= t1 + (1.0-t1)*t2
+    t2 := obj.PeakRange(x, jH3k4me3, obj.k1, obj.k2)
+    r  *= f.Add("h3k4me1 symmetric peak or h3k4me3 peak", t1 + (1.0-t1)*t2)
   }
   { // no control peak at all positions
-    r *= obj.NoPeakRange(x, jControl, 1, 6)
+    r *= f.Add("no control peak", obj.NoPeakRange(x, jControl, obj.k1, obj.k2))
   }
-  s.SetFloat64(r)
-  return nil
+  return r
 }
 
-func (ClassifierPR) Dims() (int, int) {
-  return 8, 7
+func (obj ClassifierPR) Dims() (int, int) {
+  return 8, obj.n
 }
 
-func (ClassifierPR) CloneMatrixBatchClassifier() MatrixBatchClassifier {
-  return ClassifierPR{}
+func (obj ClassifierPR) CloneMatrixBatchClassifier() MatrixBatchClassifier {
+  return obj
 }
 
 /* -------------------------------------------------------------------------- */
@@ -310,29 +485,37 @@ type ClassifierTR struct {
   BasicClassifier
 }
 
+func NewClassifierTR(missing []bool) ClassifierTR {
+  return ClassifierTR{BasicClassifier{missing}}
+}
+
 func (obj ClassifierTR) Eval(s Scalar, x ConstMatrix) error {
+  s.SetFloat64(obj.Factors(x, nil))
+  return nil
+}
+
+func (obj ClassifierTR) Factors(x ConstMatrix, f *classifierFactors) float64 {
   r := 1.0
   { // no atac and h3k4me1 peak
-    t := obj.PeakAll(x, jOpen)
-    t *= obj.PeakAll(x, jH3k4me1)
-    r  = 1.0 - t
+    t := obj.PeakAllNegated(x, jOpen)
+    t *= obj.PeakAllNegated(x, jH3k4me1)
+    r  = f.Add("no open and h3k4me1 peak", 1.0 - t)
   }
   { // no h3k4me3 peak at center
-    r *= obj.NoPeakAll(x, jH3k4me3)
+    r *= f.Add("no h3k4me3 peak", obj.NoPeakAll(x, jH3k4me3))
   }
   { // rna peak at center
-    r *= obj.PeakAtCenter(x, jRna)
+    r *= f.Add("rna peak at center", obj.PeakAtCenter(x, jRna))
   }
-  s.SetFloat64(r)
-  return nil
+  return r
 }
 
 func (ClassifierTR) Dims() (int, int) {
   return 8, 1
 }
 
-func (ClassifierTR) CloneMatrixBatchClassifier() MatrixBatchClassifier {
-  return ClassifierTR{}
+func (obj ClassifierTR) CloneMatrixBatchClassifier() MatrixBatchClassifier {
+  return obj
 }
 
 /* -------------------------------------------------------------------------- */
@@ -341,27 +524,35 @@ type ClassifierR1 struct {
   BasicClassifier
 }
 
+func NewClassifierR1(missing []bool) ClassifierR1 {
+  return ClassifierR1{BasicClassifier{missing}}
+}
+
 func (obj ClassifierR1) Eval(s Scalar, x ConstMatrix) error {
+  s.SetFloat64(obj.Factors(x, nil))
+  return nil
+}
+
+func (obj ClassifierR1) Factors(x ConstMatrix, f *classifierFactors) float64 {
   r := 1.0
   { // h3k27me3 peak at any position
-    r *= obj.PeakAny(x, jH3k27me3)
+    r *= f.Add("h3k27me3 peak at any position", obj.PeakAny(x, jH3k27me3))
   }
   { // no h3k4me3 peak at all positions
-    r *= obj.NoPeakAll(x, jH3k4me3)
+    r *= f.Add("no h3k4me3 peak", obj.NoPeakAll(x, jH3k4me3))
   }
   { // no control peak at all positions
-    r *= obj.NoPeakAll(x, jControl)
+    r *= f.Add("no control peak", obj.NoPeakAll(x, jControl))
   }
-  s.SetFloat64(r)
-  return nil
+  return r
 }
 
 func (ClassifierR1) Dims() (int, int) {
   return 8, 1
 }
 
-func (ClassifierR1) CloneMatrixBatchClassifier() MatrixBatchClassifier {
-  return ClassifierR1{}
+func (obj ClassifierR1) CloneMatrixBatchClassifier() MatrixBatchClassifier {
+  return obj
 }
 
 /* -------------------------------------------------------------------------- */
@@ -370,27 +561,35 @@ type ClassifierR2 struct {
   BasicClassifier
 }
 
+func NewClassifierR2(missing []bool) ClassifierR2 {
+  return ClassifierR2{BasicClassifier{missing}}
+}
+
 func (obj ClassifierR2) Eval(s Scalar, x ConstMatrix) error {
+  s.SetFloat64(obj.Factors(x, nil))
+  return nil
+}
+
+func (obj ClassifierR2) Factors(x ConstMatrix, f *classifierFactors) float64 {
   r := 1.0
   { // h3k9me3 peak at any position
-    r *= obj.PeakAny(x, jH3k9me3)
+    r *= f.Add("h3k9me3 peak at any position", obj.PeakAny(x, jH3k9me3))
   }
   { // no h3k4me3 peak at all positions
-    r *= obj.NoPeakAll(x, jH3k4me3)
+    r *= f.Add("no h3k4me3 peak", obj.NoPeakAll(x, jH3k4me3))
   }
   { // no control peak at all positions
-    r *= obj.NoPeakAll(x, jControl)
+    r *= f.Add("no control peak", obj.NoPeakAll(x, jControl))
   }
-  s.SetFloat64(r)
-  return nil
+  return r
 }
 
 func (ClassifierR2) Dims() (int, int) {
   return 8, 1
 }
 
-func (ClassifierR2) CloneMatrixBatchClassifier() MatrixBatchClassifier {
-  return ClassifierR2{}
+func (obj ClassifierR2) CloneMatrixBatchClassifier() MatrixBatchClassifier {
+  return obj
 }
 
 /* -------------------------------------------------------------------------- */
@@ -399,21 +598,29 @@ type ClassifierCL struct {
   BasicClassifier
 }
 
+func NewClassifierCL(missing []bool) ClassifierCL {
+  return ClassifierCL{BasicClassifier{missing}}
+}
+
 func (obj ClassifierCL) Eval(s Scalar, x ConstMatrix) error {
+  s.SetFloat64(obj.Factors(x, nil))
+  return nil
+}
+
+func (obj ClassifierCL) Factors(x ConstMatrix, f *classifierFactors) float64 {
   r := 1.0
   { // control peak at any position
-    r *= obj.PeakAny(x, jControl)
+    r *= f.Add("control peak at any position", obj.PeakAny(x, jControl))
   }
-  s.SetFloat64(r)
-  return nil
+  return r
 }
 
 func (ClassifierCL) Dims() (int, int) {
   return 8, 1
 }
 
-func (ClassifierCL) CloneMatrixBatchClassifier() MatrixBatchClassifier {
-  return ClassifierCL{}
+func (obj ClassifierCL) CloneMatrixBatchClassifier() MatrixBatchClassifier {
+  return obj
 }
 
 /* -------------------------------------------------------------------------- */
@@ -422,39 +629,73 @@ type ClassifierNS struct {
   BasicClassifier
 }
 
+func NewClassifierNS(missing []bool) ClassifierNS {
+  return ClassifierNS{BasicClassifier{missing}}
+}
+
 func (obj ClassifierNS) Eval(s Scalar, x ConstMatrix) error {
+  s.SetFloat64(obj.Factors(x, nil))
+  return nil
+}
+
+func (obj ClassifierNS) Factors(x ConstMatrix, f *classifierFactors) float64 {
   r := 1.0
   { // no atac and h3k4me1 peak
-    t := obj.PeakAll(x, jOpen)
-    t *= obj.PeakAll(x, jH3k4me1)
-    r  = 1.0 - t
+    t := obj.PeakAllNegated(x, jOpen)
+    t *= obj.PeakAllNegated(x, jH3k4me1)
+    r  = f.Add("no open and h3k4me1 peak", 1.0 - t)
   }
   { // no h3k27ac peak at any position
-    r *= obj.NoPeakAll(x, jH3k27ac)
+    r *= f.Add("no h3k27ac peak", obj.NoPeakAll(x, jH3k27ac))
   }
   { // no h3k27me3 peak at any position
-    r *= obj.NoPeakAll(x, jH3k27me3)
+    r *= f.Add("no h3k27me3 peak", obj.NoPeakAll(x, jH3k27me3))
   }
   { // no h3k9me3 peak at any position
-    r *= obj.NoPeakAll(x, jH3k9me3)
+    r *= f.Add("no h3k9me3 peak", obj.NoPeakAll(x, jH3k9me3))
   }
   { // no h3k4me3 peak at all positions
-    r *= obj.NoPeakAll(x, jH3k4me3)
+    r *= f.Add("no h3k4me3 peak", obj.NoPeakAll(x, jH3k4me3))
   }
   { // no rna peak at all positions
-    r *= obj.NoPeakAll(x, jRna)
+    r *= f.Add("no rna peak", obj.NoPeakAll(x, jRna))
   }
   { // no control peak at all positions
-    r *= obj.NoPeakAll(x, jControl)
+    r *= f.Add("no control peak", obj.NoPeakAll(x, jControl))
   }
-  s.SetFloat64(r)
-  return nil
+  return r
 }
 
 func (ClassifierNS) Dims() (int, int) {
   return 8, 1
 }
 
-func (ClassifierNS) CloneMatrixBatchClassifier() MatrixBatchClassifier {
-  return ClassifierNS{}
+func (obj ClassifierNS) CloneMatrixBatchClassifier() MatrixBatchClassifier {
+  return obj
+}
+
+/* -------------------------------------------------------------------------- */
+
+// Classifier of states that cannot be identified, because features required
+// by the classifier of this state are missing. The state probability is
+// zero at all bins, including bins with low mappability, which removes the
+// state from the HMM.
+type ClassifierUnidentifiable struct {
+}
+
+func (obj ClassifierUnidentifiable) Eval(s Scalar, x ConstMatrix) error {
+  s.SetFloat64(obj.Factors(x, nil))
+  return nil
+}
+
+func (obj ClassifierUnidentifiable) Factors(x ConstMatrix, f *classifierFactors) float64 {
+  return f.Add("unidentifiable (missing data)", 0.0)
+}
+
+func (ClassifierUnidentifiable) Dims() (int, int) {
+  return 8, 1
+}
+
+func (ClassifierUnidentifiable) CloneMatrixBatchClassifier() MatrixBatchClassifier {
+  return ClassifierUnidentifiable{}
 }
@@ -19,10 +19,16 @@ package main
 /* -------------------------------------------------------------------------- */
 
 //import   "fmt"
+import   "io/ioutil"
 import   "math"
 import   "testing"
 
 import . "github.com/pbenner/autodiff"
+import . "github.com/pbenner/autodiff/statistics"
+import . "github.com/pbenner/gonetics"
+import . "github.com/pbenner/ngstat/track"
+
+import . "github.com/pbenner/modhmm/config"
 
 /* -------------------------------------------------------------------------- */
 
@@ -58,3 +64,175 @@ func TestCl3(t *testing.T) {
     t.Error("test failed")
   }
 }
+
+/* -------------------------------------------------------------------------- */
+
+func testClassifierWindow(n int) Matrix {
+  x := NullDenseMatrix(Float64Type, 8, n)
+  for i := 0; i < 8; i++ {
+    for k := 0; k < n; k++ {
+      _, f := math.Modf(0.37*float64(i) + 0.13*float64(k))
+      x.At(i, k).SetFloat64(0.05 + 0.9*f)
+    }
+  }
+  return x
+}
+
+func TestClMissingBins(t *testing.T) {
+  m := BasicClassifier{}
+  x := NewDenseFloat64Matrix([]float64{
+    0.5, math.NaN(), 0.5, 0.2 }, 1, 4)
+  if r := m.NoPeakAll(x, 0); math.Abs(r - 0.2) > 1e-8 {
+    t.Errorf("test failed: %f", r)
+  }
+  if r := m.PeakAll(x, 0); math.Abs(r - 0.05) > 1e-8 {
+    t.Errorf("test failed: %f", r)
+  }
+  if r := m.PeakAny(x, 0); r != 1.0 {
+    t.Errorf("test failed: %f", r)
+  }
+  if r := m.PeakAnyRange(x, 0, 2, 4); math.Abs(r - 0.6) > 1e-8 {
+    t.Errorf("test failed: %f", r)
+  }
+  if r := m.PeakSym(x, 0, 0); math.IsNaN(r) || r > 1.0 {
+    t.Errorf("test failed: %f", r)
+  }
+}
+
+func TestClMaskedCenter(t *testing.T) {
+  // classifiers of single bins must not exclude a state at bins with low
+  // mappability
+  for _, c := range []MatrixBatchClassifier{NewClassifierTR(nil), NewClassifierR1(nil), NewClassifierR2(nil), NewClassifierCL(nil), NewClassifierNS(nil)} {
+    x := NullDenseMatrix(Float64Type, 8, 1)
+    for i := 0; i < 8; i++ {
+      x.At(i, 0).SetFloat64(math.NaN())
+    }
+    r := NullFloat64()
+    if err := c.Eval(r, x); err != nil {
+      t.Fatal(err)
+    }
+    if r.GetFloat64() != 1.0 {
+      t.Errorf("test failed for %T: %f", c, r.GetFloat64())
+    }
+  }
+}
+
+func TestClMaskedWindow(t *testing.T) {
+  // classifiers must remain defined next to bins with low mappability,
+  // and missing bins can only increase the value of a classifier
+  classifiers := []MatrixBatchClassifier{
+    NewClassifierPA(200, nil), NewClassifierEA(200, nil), NewClassifierBI(200, nil), NewClassifierPR(200, nil),
+    NewClassifierPA(100, nil), NewClassifierBI(50, nil) }
+  for _, c := range classifiers {
+    _, n := c.Dims()
+    for k := 0; k < n; k++ {
+      if k == n/2 {
+        continue
+      }
+      x  := testClassifierWindow(n)
+      r0 := NullFloat64()
+      r1 := NullFloat64()
+      if err := c.Eval(r0, x); err != nil {
+        t.Fatal(err)
+      }
+      for i := 0; i < 8; i++ {
+        x.At(i, k).SetFloat64(math.NaN())
+      }
+      if err := c.Eval(r1, x); err != nil {
+        t.Fatal(err)
+      }
+      if math.IsNaN(r1.GetFloat64()) || r1.GetFloat64() > 1.0 || r1.GetFloat64() < r0.GetFloat64() - 1e-12 {
+        t.Errorf("test failed for %T with missing column %d: %f (%f without missing data)", c, k, r1.GetFloat64(), r0.GetFloat64())
+      }
+    }
+  }
+}
+
+func TestClassifierWindow(t *testing.T) {
+  // windows at the default bin size of 200 bp are the original windows of
+  // nine and seven bins
+  for _, r := range []struct {
+    binSize, width int
+    window         classifierWindow
+  }{
+    {200, classifierWidthWide,   classifierWindow{n:  9, k1: 2, k2:  7, k0: 1}},
+    {200, classifierWidthNarrow, classifierWindow{n:  7, k1: 1, k2:  6, k0: 1}},
+    {100, classifierWidthWide,   classifierWindow{n: 17, k1: 4, k2: 13, k0: 2}},
+    {100, classifierWidthNarrow, classifierWindow{n: 13, k1: 2, k2: 11, k0: 2}},
+    { 50, classifierWidthWide,   classifierWindow{n: 33, k1: 8, k2: 25, k0: 4}},
+    { 50, classifierWidthNarrow, classifierWindow{n: 25, k1: 4, k2: 21, k0: 4}},
+    // the central region of large bins is the center bin
+    {1000, classifierWidthWide,  classifierWindow{n:  3, k1: 1, k2:  2, k0: 0}} } {
+    if w := newClassifierWindow(r.binSize, r.width); w != r.window {
+      t.Errorf("test failed for bin size %d and width %d: %v", r.binSize, r.width, w)
+    }
+  }
+  // windows of classifiers cover the same genomic width at all bin sizes
+  for _, binSize := range []int{50, 100, 200} {
+    if _, n := NewClassifierPA(binSize, nil).Dims(); n*binSize != 2*classifierWidthWide + binSize {
+      t.Errorf("test failed for bin size %d: %d bins", binSize, n)
+    }
+    if _, n := NewClassifierBI(binSize, nil).Dims(); n*binSize != 2*classifierWidthNarrow + binSize {
+      t.Errorf("test failed for bin size %d: %d bins", binSize, n)
+    }
+  }
+}
+
+func TestClUnidentifiable(t *testing.T) {
+  dir, cleanup := testTempDir(t)
+  defer cleanup()
+
+  config := DefaultModHmmConfig()
+  config.Directory = dir
+  config.CompletePaths("")
+  // no data for h3k27me3
+  for _, feature := range EnrichmentList {
+    if feature != "h3k27me3" {
+      if err := ioutil.WriteFile(config.EnrichmentProb.GetTargetFile(feature).Filename, nil, 0666); err != nil {
+        t.Fatal(err)
+      }
+    }
+  }
+  if r := chromatin_state_unidentifiable(config); len(r) != 2 || r[0] != "BI" || r[1] != "R1" {
+    t.Errorf("test failed: %v", r)
+  }
+  for _, state := range []string{"bi", "r1", "tr", "ea"} {
+    c    := get_chromatin_state_model(config, state)
+    _, n := c.Dims()
+    // bin with low mappability
+    x := testClassifierWindow(n)
+    for i := 0; i < 8; i++ {
+      x.At(i, n/2).SetFloat64(math.NaN())
+    }
+    r := NullFloat64()
+    if err := c.Eval(r, x); err != nil {
+      t.Fatal(err)
+    }
+    switch state {
+    case "bi", "r1":
+      if r.GetFloat64() != 0.0 {
+        t.Errorf("test failed for state `%s': %f", state, r.GetFloat64())
+      }
+    default:
+      if math.IsNaN(r.GetFloat64()) || r.GetFloat64() <= 0.0 || r.GetFloat64() > 1.0 {
+        t.Errorf("test failed for state `%s': %f", state, r.GetFloat64())
+      }
+    }
+  }
+  // tracks of unidentifiable states are zero, also at bins with low
+  // mappability and if computed before data was removed
+  track := AllocSimpleTrack("bi", NewGenome([]string{"chr1"}, []int{1000}), config.BinSize)
+  seq, _ := track.GetMutableSequence("chr1")
+  seq.SetBin(0, 0.5)
+  seq.SetBin(1, math.NaN())
+  filename := config.ChromatinStateProb.GetTargetFile("bi").Filename
+  if err := ExportTrack(config.SessionConfig, track, filename); err != nil {
+    t.Fatal(err)
+  }
+  r, _ := import_chromatin_state_tracks(config, nil, []string{filename})[0].GetSequence("chr1")
+  for i := 0; i < r.NBins(); i++ {
+    if r.AtBin(i) != 0.0 {
+      t.Errorf("test failed for bin %d: %f", i, r.AtBin(i))
+    }
+  }
+}
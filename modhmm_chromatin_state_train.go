@@ -0,0 +1,773 @@
+/* Copyright (C) 2019 Philipp Benner
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+/* -------------------------------------------------------------------------- */
+
+import   "fmt"
+import   "io"
+import   "log"
+import   "math"
+import   "math/rand"
+import   "os"
+import   "strconv"
+import   "strings"
+
+import . "github.com/pbenner/autodiff"
+import . "github.com/pbenner/autodiff/statistics"
+import . "github.com/pbenner/gonetics"
+import . "github.com/pbenner/ngstat/config"
+
+import . "github.com/pbenner/modhmm/config"
+
+import   "github.com/pborman/getopt"
+
+/* Supervised chromatin state classifiers. Enrichment probabilities of all
+ * features within a window around each bin (the window of promoter and
+ * enhancer classifiers, i.e. 9 bins at the default bin size of 200 bp) are
+ * extracted at bins within labelled regions.
+ * Bins labelled with the given state are positive examples, while bins of
+ * all other labelled states and randomly selected background bins are
+ * negative examples. Positive and negative examples are weighted equally.
+ * Optional features without data at training time are recorded and not
+ * used by the classifier. Missing values at evaluation time (bins with low
+ * mappability or optional features without data) are marginalized by
+ * replacing them with the mean enrichment probability of the feature in
+ * the training data.
+ * Classifiers are either
+ *  - logistic: logistic regression with L2 penalty, fitted with Newton's
+ *              method
+ *  - stumps  : gradient boosted decision stumps with logistic loss
+ * Trained classifiers replace the default classifiers if enabled in the
+ * config file.
+ * -------------------------------------------------------------------------- */
+
+// Number of candidate thresholds of decision stumps
+const classifierStumpBins = 20
+
+/* -------------------------------------------------------------------------- */
+
+type classifierStump struct {
+  Feature   int
+  Threshold float64
+  // values for inputs below and above the threshold
+  Left      float64
+  Right     float64
+}
+
+type classifierTrainingReport struct {
+  Positives int
+  Negatives int
+  LogLoss   float64
+  Accuracy  float64
+}
+
+type ClassifierTrained struct {
+  State      string
+  Method     string
+  Features []string
+  Bins       int
+  BinSize    int
+  // features without data at training time
+  Missing  []bool
+  // mean enrichment probability of each feature in the training data
+  Means    []float64
+  Intercept  float64
+  // weights of logistic regression, stored row by row (feature by feature)
+  Weights  []float64         `json:",omitempty"`
+  Stumps   []classifierStump `json:",omitempty"`
+  Regions  []string
+  Training   classifierTrainingReport
+  // features without data at evaluation time
+  missing  []bool
+}
+
+func (obj *ClassifierTrained) Import(reader io.Reader, args... interface{}) error {
+  return JsonImport(reader, obj)
+}
+
+func (obj *ClassifierTrained) Export(writer io.Writer) error {
+  return JsonExport(writer, obj)
+}
+
+/* -------------------------------------------------------------------------- */
+
+// Classifier score (log odds) of a vector of enrichment probabilities
+func (obj ClassifierTrained) Score(x []float64) float64 {
+  r := obj.Intercept
+  switch obj.Method {
+  case "logistic":
+    for i := range obj.Weights {
+      r += obj.Weights[i]*x[i]
+    }
+  case "stumps":
+    for _, s := range obj.Stumps {
+      if x[s.Feature] < s.Threshold {
+        r += s.Left
+      } else {
+        r += s.Right
+      }
+    }
+  default:
+    log.Fatalf("invalid classifier method `%s'", obj.Method)
+  }
+  return r
+}
+
+func (obj ClassifierTrained) Eval(s Scalar, x ConstMatrix) error {
+  s.SetFloat64(obj.Factors(x, nil))
+  return nil
+}
+
+// Classifier probability, where factors are the contributions of the
+// intercept and of each feature to the log odds
+func (obj ClassifierTrained) Factors(x ConstMatrix, f *classifierFactors) float64 {
+  n, m := x.Dims()
+  v    := make([]float64, n*m)
+  for i := 0; i < n; i++ {
+    for j := 0; j < m; j++ {
+      // marginalize missing data
+      if v[i*m+j] = x.Float64At(i, j); math.IsNaN(v[i*m+j]) || (i < len(obj.missing) && obj.missing[i]) {
+        v[i*m+j] = obj.Means[i]
+      }
+    }
+  }
+  if f != nil {
+    c := make([]float64, n)
+    switch obj.Method {
+    case "logistic":
+      for i := range obj.Weights {
+        c[i/m] += obj.Weights[i]*v[i]
+      }
+    case "stumps":
+      for _, s := range obj.Stumps {
+        if v[s.Feature] < s.Threshold {
+          c[s.Feature/m] += s.Left
+        } else {
+          c[s.Feature/m] += s.Right
+        }
+      }
+    }
+    f.Add("intercept (log odds)", obj.Intercept)
+    for i := 0; i < n; i++ {
+      f.Add(fmt.Sprintf("%s (log odds)", obj.Features[i]), c[i])
+    }
+  }
+  return 1.0/(1.0 + math.Exp(-obj.Score(v)))
+}
+
+func (obj ClassifierTrained) Dims() (int, int) {
+  return len(obj.Features), obj.Bins
+}
+
+func (obj ClassifierTrained) CloneMatrixBatchClassifier() MatrixBatchClassifier {
+  return obj
+}
+
+/* -------------------------------------------------------------------------- */
+
+// Import trained classifier, where missing are the features without data
+func ImportTrainedClassifier(config ConfigModHmm, filename string, missing []bool) ClassifierTrained {
+  classifier := ClassifierTrained{}
+  printStderr(config, 1, "Importing trained classifier from `%s'... ", filename)
+  if err := ImportFile(&classifier, filename); err != nil {
+    printStderr(config, 1, "failed\n")
+    log.Fatal(err)
+  }
+  printStderr(config, 1, "done\n")
+  if len(classifier.Features) != len(EnrichmentList) || len(classifier.Missing) != len(EnrichmentList) || len(classifier.Means) != len(EnrichmentList) {
+    log.Fatalf("trained classifier `%s' has invalid number of features", filename)
+  }
+  if classifier.BinSize != config.BinSize {
+    log.Fatalf("trained classifier `%s' was trained with a bin size of %d bp, but the current bin size is %d bp", filename, classifier.BinSize, config.BinSize)
+  }
+  for i, feature := range classifier.Features {
+    switch {
+    case missing[i] && !classifier.Missing[i]:
+      printStderr(config, 1, "Warning: data for %s is missing and marginalized by trained classifier `%s'\n", feature, filename)
+    case !missing[i] && classifier.Missing[i]:
+      printStderr(config, 1, "Warning: data for %s is not used by trained classifier `%s'\n", feature, filename)
+    }
+  }
+  classifier.missing = missing
+  return classifier
+}
+
+func ExportTrainedClassifier(config ConfigModHmm, filename string, classifier ClassifierTrained) {
+  printStderr(config, 1, "Exporting trained classifier to `%s'... ", filename)
+  if err := ExportFile(&classifier, filename); err != nil {
+    printStderr(config, 1, "failed\n")
+    log.Fatal(err)
+  }
+  printStderr(config, 1, "done\n")
+}
+
+/* -------------------------------------------------------------------------- */
+
+type classifierTrainingData struct {
+  X [][]float64
+  Y []float64
+  W []float64
+  // inputs excluded from fitting
+  Exclude []bool
+}
+
+// Mean of all inputs of each feature
+func (data classifierTrainingData) Means(features int) []float64 {
+  r := make([]float64, features)
+  if len(data.X) == 0 {
+    return r
+  }
+  bins := len(data.X[0])/features
+  for _, x := range data.X {
+    for i := range x {
+      r[i/bins] += x[i]
+    }
+  }
+  for j := range r {
+    r[j] /= float64(len(data.X)*bins)
+  }
+  return r
+}
+
+// Enrichment probabilities of all features within the window centered at
+// bin i, returns false if the window exceeds the sequence or contains
+// missing values
+func classifier_training_window(sequences []TrackSequence, i, bins int) ([]float64, bool) {
+  r := make([]float64, len(sequences)*bins)
+  for j, seq := range sequences {
+    for k := 0; k < bins; k++ {
+      l := i-bins/2+k
+      if l < 0 || l >= seq.NBins() {
+        return nil, false
+      }
+      if r[j*bins+k] = seq.AtBin(l); math.IsNaN(r[j*bins+k]) {
+        return nil, false
+      }
+    }
+  }
+  return r, true
+}
+
+func classifier_training_sequences(tracks []Track, seqname string) ([]TrackSequence, bool) {
+  r := make([]TrackSequence, len(tracks))
+  for j, track := range tracks {
+    if seq, err := track.GetSequence(seqname); err != nil {
+      return nil, false
+    } else {
+      r[j] = seq
+    }
+  }
+  return r, true
+}
+
+// Bins with centers within regions, or the bin at the center of regions
+// smaller than a bin
+func classifier_training_bins(region [2]int, binSize int) []int {
+  r := []int{}
+  for i := region[0]/binSize; i*binSize < region[1]; i++ {
+    if c := i*binSize+binSize/2; c >= region[0] && c < region[1] {
+      r = append(r, i)
+    }
+  }
+  if len(r) == 0 {
+    r = append(r, (region[0]+region[1])/2/binSize)
+  }
+  return r
+}
+
+func classifier_training_data(config ConfigModHmm, tracks []Track, missing []bool, state string, labels map[string]peakRegions, background int, seed int64) classifierTrainingData {
+  positives := [][]float64{}
+  negatives := [][]float64{}
+  binSize   := tracks[0].GetBinSize()
+  bins      := newClassifierWindow(binSize, classifierWidthWide).n
+  // labelled regions
+  for _, label := range ChromatinStateList {
+    regions, ok := labels[label]; if !ok {
+      continue
+    }
+    for _, seqname := range tracks[0].GetSeqNames() {
+      sequences, ok := classifier_training_sequences(tracks, seqname); if !ok {
+        continue
+      }
+      for _, region := range regions[seqname] {
+        for _, i := range classifier_training_bins(region, binSize) {
+          x, ok := classifier_training_window(sequences, i, bins); if !ok {
+            continue
+          }
+          switch {
+          case label == state:
+            positives = append(positives, x)
+          // bins may be labelled with multiple states
+          case !labels[state].Contains(seqname, i*binSize+binSize/2):
+            negatives = append(negatives, x)
+          }
+        }
+      }
+    }
+  }
+  // random background bins outside of labelled regions
+  genome := tracks[0].GetGenome()
+  total  := 0
+  for _, length := range genome.Lengths {
+    total += length/binSize
+  }
+  rng := rand.New(rand.NewSource(seed))
+  for n, k := 0, 0; n < background && k < 100*background && total > 0; k++ {
+    i := rng.Intn(total)
+    j := 0
+    for ; i >= genome.Lengths[j]/binSize; j++ {
+      i -= genome.Lengths[j]/binSize
+    }
+    seqname  := genome.Seqnames[j]
+    labelled := false
+    for _, regions := range labels {
+      if regions.Contains(seqname, i*binSize+binSize/2) {
+        labelled = true
+      }
+    }
+    if labelled {
+      continue
+    }
+    sequences, ok := classifier_training_sequences(tracks, seqname); if !ok {
+      continue
+    }
+    if x, ok := classifier_training_window(sequences, i, bins); ok {
+      negatives = append(negatives, x); n++
+    }
+  }
+  if len(positives) == 0 {
+    log.Fatalf("no bins labelled with state `%s' found", strings.ToUpper(state))
+  }
+  if len(negatives) == 0 {
+    log.Fatal("no negative examples found")
+  }
+  // positive and negative examples are weighted equally, such that the sum
+  // of weights is the number of examples
+  n  := float64(len(positives) + len(negatives))
+  w1 := n/(2.0*float64(len(positives)))
+  w0 := n/(2.0*float64(len(negatives)))
+  r  := classifierTrainingData{Exclude: make([]bool, len(tracks)*bins)}
+  for i := range r.Exclude {
+    r.Exclude[i] = missing[i/bins]
+  }
+  for _, x := range positives {
+    r.X = append(r.X, x); r.Y = append(r.Y, 1.0); r.W = append(r.W, w1)
+  }
+  for _, x := range negatives {
+    r.X = append(r.X, x); r.Y = append(r.Y, 0.0); r.W = append(r.W, w0)
+  }
+  return r
+}
+
+/* -------------------------------------------------------------------------- */
+
+// Solve A x = b for a symmetric positive definite matrix A
+func classifier_solve_cholesky(a [][]float64, b []float64) ([]float64, error) {
+  n := len(b)
+  l := make([][]float64, n)
+  for i := range l {
+    l[i] = make([]float64, n)
+  }
+  for i := 0; i < n; i++ {
+    for j := 0; j <= i; j++ {
+      s := a[i][j]
+      for k := 0; k < j; k++ {
+        s -= l[i][k]*l[j][k]
+      }
+      if i == j {
+        if s <= 0.0 {
+          return nil, fmt.Errorf("matrix is not positive definite")
+        }
+        l[i][i] = math.Sqrt(s)
+      } else {
+        l[i][j] = s/l[j][j]
+      }
+    }
+  }
+  // forward and backward substitution
+  y := make([]float64, n)
+  for i := 0; i < n; i++ {
+    s := b[i]
+    for k := 0; k < i; k++ {
+      s -= l[i][k]*y[k]
+    }
+    y[i] = s/l[i][i]
+  }
+  x := make([]float64, n)
+  for i := n-1; i >= 0; i-- {
+    s := y[i]
+    for k := i+1; k < n; k++ {
+      s -= l[k][i]*x[k]
+    }
+    x[i] = s/l[i][i]
+  }
+  return x, nil
+}
+
+// Weighted logistic loss of log odds t
+func classifier_log_loss(t, y, w float64) float64 {
+  return w*(y*math.Log1p(math.Exp(-t)) + (1.0-y)*math.Log1p(math.Exp(t)))
+}
+
+// Logistic regression with L2 penalty (the intercept is not penalized),
+// where the first parameter is the intercept
+func classifier_fit_logistic(data classifierTrainingData, lambda float64) (float64, []float64) {
+  m := len(data.X[0])+1
+  z := func(x []float64, i int) float64 {
+    if i == 0 {
+      return 1.0
+    }
+    return x[i-1]
+  }
+  score := func(beta []float64, x []float64) float64 {
+    r := beta[0]
+    for i := 1; i < m; i++ {
+      r += beta[i]*x[i-1]
+    }
+    return r
+  }
+  loss := func(beta []float64) float64 {
+    r := 0.0
+    for d, x := range data.X {
+      r += classifier_log_loss(score(beta, x), data.Y[d], data.W[d])
+    }
+    for i := 1; i < m; i++ {
+      r += 0.5*lambda*beta[i]*beta[i]
+    }
+    return r
+  }
+  beta := make([]float64, m)
+  l    := loss(beta)
+  for iter := 0; iter < 100; iter++ {
+    g := make([]float64, m)
+    h := make([][]float64, m)
+    for i := range h {
+      h[i] = make([]float64, m)
+    }
+    for d, x := range data.X {
+      p := 1.0/(1.0 + math.Exp(-score(beta, x)))
+      r := data.W[d]*(data.Y[d] - p)
+      w := data.W[d]*p*(1.0-p)
+      for i := 0; i < m; i++ {
+        zi := z(x, i)
+        g[i] += r*zi
+        for j := 0; j <= i; j++ {
+          h[i][j] += w*zi*z(x, j)
+        }
+      }
+    }
+    for i := 0; i < m; i++ {
+      for j := i+1; j < m; j++ {
+        h[i][j] = h[j][i]
+      }
+      // excluded inputs keep a weight of zero
+      if i > 0 && data.Exclude[i-1] {
+        for j := 0; j < m; j++ {
+          h[i][j], h[j][i] = 0.0, 0.0
+        }
+        g[i] = 0.0
+      }
+      if i > 0 {
+        g[i]    -= lambda*beta[i]
+        h[i][i] += lambda
+      }
+      // small ridge for numerical stability
+      h[i][i] += 1e-8
+    }
+    step, err := classifier_solve_cholesky(h, g); if err != nil {
+      break
+    }
+    // step halving
+    s := 1.0
+    for ; s > 1e-8; s /= 2.0 {
+      b := make([]float64, m)
+      for i := range b {
+        b[i] = beta[i] + s*step[i]
+      }
+      if lnew := loss(b); lnew <= l {
+        beta, l = b, lnew
+        break
+      }
+    }
+    d := 0.0
+    for i := range step {
+      d = math.Max(d, math.Abs(s*step[i]))
+    }
+    if s <= 1e-8 || d < 1e-8 {
+      break
+    }
+  }
+  return beta[0], beta[1:]
+}
+
+// Gradient boosting of decision stumps with logistic loss, where leaf values
+// are given by regularized Newton steps
+func classifier_fit_stumps(data classifierTrainingData, rounds int, eta, lambda float64) (float64, []classifierStump) {
+  n := len(data.X)
+  m := len(data.X[0])
+  // discretize inputs for finding thresholds
+  q := make([][]uint8, n)
+  for d, x := range data.X {
+    q[d] = make([]uint8, m)
+    for i := range x {
+      k := int(x[i]*classifierStumpBins)
+      if k < 0 {
+        k = 0
+      }
+      if k >= classifierStumpBins {
+        k = classifierStumpBins-1
+      }
+      q[d][i] = uint8(k)
+    }
+  }
+  // initialize with log odds of the weighted data
+  s1, s0 := 0.0, 0.0
+  for d := range data.Y {
+    s1 += data.W[d]*data.Y[d]
+    s0 += data.W[d]*(1.0-data.Y[d])
+  }
+  f0 := math.Log(s1/s0)
+  f  := make([]float64, n)
+  for d := range f {
+    f[d] = f0
+  }
+  stumps := []classifierStump{}
+  g := make([]float64, n)
+  h := make([]float64, n)
+  for round := 0; round < rounds; round++ {
+    gt, ht := 0.0, 0.0
+    for d := range f {
+      p   := 1.0/(1.0 + math.Exp(-f[d]))
+      g[d] = data.W[d]*(data.Y[d] - p)
+      h[d] = data.W[d]*p*(1.0-p)
+      gt  += g[d]
+      ht  += h[d]
+    }
+    best     := classifierStump{}
+    bestGain := math.Inf(-1)
+    for i := 0; i < m; i++ {
+      if data.Exclude[i] {
+        continue
+      }
+      gb := make([]float64, classifierStumpBins)
+      hb := make([]float64, classifierStumpBins)
+      for d := range q {
+        gb[q[d][i]] += g[d]
+        hb[q[d][i]] += h[d]
+      }
+      gl, hl := 0.0, 0.0
+      for k := 1; k < classifierStumpBins; k++ {
+        gl += gb[k-1]
+        hl += hb[k-1]
+        gr := gt-gl
+        hr := ht-hl
+        if gain := gl*gl/(hl+lambda) + gr*gr/(hr+lambda); gain > bestGain {
+          bestGain = gain
+          best     = classifierStump{
+            Feature  : i,
+            Threshold: float64(k)/classifierStumpBins,
+            Left     : eta*gl/(hl+lambda),
+            Right    : eta*gr/(hr+lambda) }
+        }
+      }
+    }
+    for d, x := range data.X {
+      if x[best.Feature] < best.Threshold {
+        f[d] += best.Left
+      } else {
+        f[d] += best.Right
+      }
+    }
+    stumps = append(stumps, best)
+  }
+  return f0, stumps
+}
+
+func classifier_training_report(classifier ClassifierTrained, data classifierTrainingData) classifierTrainingReport {
+  r := classifierTrainingReport{}
+  w := 0.0
+  for d, x := range data.X {
+    t := classifier.Score(x)
+    if data.Y[d] == 1.0 {
+      r.Positives++
+    } else {
+      r.Negatives++
+    }
+    r.LogLoss += classifier_log_loss(t, data.Y[d], data.W[d])
+    if (t > 0.0) == (data.Y[d] == 1.0) {
+      r.Accuracy += data.W[d]
+    }
+    w += data.W[d]
+  }
+  r.LogLoss  /= w
+  r.Accuracy /= w
+  return r
+}
+
+/* -------------------------------------------------------------------------- */
+
+func classifier_trained_print(classifier ClassifierTrained) {
+  fmt.Printf("Trained classifier for state `%s' (method: %s)\n", classifier.State, classifier.Method)
+  fmt.Printf(": %-20s %d\n",   "Positive examples", classifier.Training.Positives)
+  fmt.Printf(": %-20s %d\n",   "Negative examples", classifier.Training.Negatives)
+  fmt.Printf(": %-20s %f\n",   "Log loss",          classifier.Training.LogLoss)
+  fmt.Printf(": %-20s %f\n\n", "Balanced accuracy", classifier.Training.Accuracy)
+  if classifier.Method == "logistic" {
+    fmt.Printf("Weights (intercept: %f)\n", classifier.Intercept)
+    fmt.Printf(": %-8s", "")
+    for k := 0; k < classifier.Bins; k++ {
+      fmt.Printf(" %8d", k-classifier.Bins/2)
+    }
+    fmt.Println()
+    for j, feature := range classifier.Features {
+      fmt.Printf(": %-8s", feature)
+      for k := 0; k < classifier.Bins; k++ {
+        fmt.Printf(" %8.3f", classifier.Weights[j*classifier.Bins+k])
+      }
+      fmt.Println()
+    }
+  }
+}
+
+/* -------------------------------------------------------------------------- */
+
+func modhmm_train_classifier(config ConfigModHmm, state, method string, labelFiles map[string]string, background, rounds int, lambda float64, seed int64) ClassifierTrained {
+  labels := make(map[string]peakRegions)
+  for label, filename := range labelFiles {
+    if regions, err := importPeakRegions(filename); err != nil {
+      log.Fatal(err)
+    } else {
+      labels[label] = regions
+    }
+  }
+  if _, ok := labels[state]; !ok {
+    log.Fatalf("no regions labelled with state `%s' given", strings.ToUpper(state))
+  }
+  // compute enrichment probabilities if required
+  modhmm_enrichment_eval_all(config)
+
+  localConfig := config
+  localConfig.BinSummaryStatistics = "mean"
+
+  tracks := chromatin_state_import_tracks(localConfig, modhmm_chromatin_state_eval_dep(config))
+
+  printStderr(config, 1, "==> Training Chromatin State Classifier (%s) <==\n", strings.ToUpper(state))
+  missing := chromatin_state_missing_features(config)
+  for i, feature := range EnrichmentList {
+    if missing[i] {
+      printStderr(config, 1, "Warning: data for %s is missing and not used by the classifier\n", feature)
+    }
+  }
+  data := classifier_training_data(config, tracks, missing, state, labels, background, seed)
+
+  classifier := ClassifierTrained{State: strings.ToUpper(state), Method: method, Features: append([]string{}, EnrichmentList...), BinSize: config.BinSize}
+  classifier.Missing = missing
+  classifier.Means   = data.Means(len(EnrichmentList))
+  classifier.Bins = newClassifierWindow(config.BinSize, classifierWidthWide).n
+  for _, label := range ChromatinStateList {
+    if filename, ok := labelFiles[label]; ok {
+      classifier.Regions = append(classifier.Regions, fmt.Sprintf("%s:%s", strings.ToUpper(label), filename))
+    }
+  }
+  printStderr(config, 1, "Fitting classifier (%s) to %d examples... ", method, len(data.X))
+  switch method {
+  case "logistic":
+    classifier.Intercept, classifier.Weights = classifier_fit_logistic(data, lambda)
+  case "stumps":
+    classifier.Intercept, classifier.Stumps  = classifier_fit_stumps(data, rounds, 0.1, lambda)
+  default:
+    printStderr(config, 1, "failed\n")
+    log.Fatalf("invalid classifier method `%s' [logistic, stumps]", method)
+  }
+  printStderr(config, 1, "done\n")
+
+  classifier.Training = classifier_training_report(classifier, data)
+
+  return classifier
+}
+
+/* -------------------------------------------------------------------------- */
+
+func modhmm_train_classifier_main(config ConfigModHmm, args []string) {
+
+  options := getopt.New()
+  options.SetProgram(fmt.Sprintf("%s train-classifier", os.Args[0]))
+  options.SetParameters("STATE LABEL:FILE...\n\n" +
+    " Each LABEL is a chromatin state and FILE a BED file or ModHMM peak table\n" +
+    " with regions of this state. Regions labelled with STATE are positive\n" +
+    " examples, all other regions are negative examples.\n")
+
+  optMethod     := options.StringLong("method",     0 , "logistic", "classifier [logistic, stumps]")
+  optBackground := options.   IntLong("background", 0 ,  10000,     "number of random background bins used as negative examples")
+  optLambda     := options.StringLong("lambda",     0 , "1.0",      "L2 penalty (logistic) or leaf regularization (stumps)")
+  optRounds     := options.   IntLong("rounds",     0 ,  200,       "number of boosting rounds (stumps)")
+  optSeed       := options.   IntLong("seed",       0 ,  1,         "seed for sampling background bins")
+  optSave       := options.StringLong("save",       0 , "",         "save classifier to file [default: classifier file of STATE in config]")
+  optHelp       := options.  BoolLong("help",      'h',             "print help")
+
+  options.Parse(args)
+
+  // command options
+  if *optHelp {
+    options.PrintUsage(os.Stdout)
+    os.Exit(0)
+  }
+  if len(options.Args()) < 2 {
+    options.PrintUsage(os.Stderr)
+    os.Exit(1)
+  }
+  state := strings.ToLower(options.Args()[0])
+  if !ChromatinStateList.Contains(state) {
+    log.Fatalf("unknown state: %s", options.Args()[0])
+  }
+  method := strings.ToLower(*optMethod)
+  if method != "logistic" && method != "stumps" {
+    log.Fatalf("invalid classifier method `%s' [logistic, stumps]", *optMethod)
+  }
+  lambda, err := strconv.ParseFloat(*optLambda, 64); if err != nil || lambda < 0.0 {
+    log.Fatalf("invalid penalty `%s'", *optLambda)
+  }
+  labels := make(map[string]string)
+  for _, arg := range options.Args()[1:] {
+    i := strings.Index(arg, ":")
+    if i == -1 {
+      log.Fatalf("invalid labelled regions `%s' (expected LABEL:FILE)", arg)
+    }
+    label := strings.ToLower(arg[0:i])
+    if !ChromatinStateList.Contains(label) {
+      log.Fatalf("unknown state: %s", arg[0:i])
+    }
+    if _, ok := labels[label]; ok {
+      log.Fatalf("regions of state `%s' given more than once", arg[0:i])
+    }
+    labels[label] = arg[i+1:]
+  }
+  filename := *optSave
+  if filename == "" {
+    filename = config.ChromatinStateModel.GetTargetFile(state).Filename
+  }
+  classifier := modhmm_train_classifier(config, state, method, labels, *optBackground, *optRounds, lambda, int64(*optSeed))
+
+  classifier_trained_print(classifier)
+
+  ExportTrainedClassifier(config, filename, classifier)
+
+  if !config.ChromatinStateTrained {
+    printStderr(config, 1, "Warning: trained classifiers are not applied unless `Chromatin-State Trained Classifiers' is enabled in the config file.\n")
+  }
+}
@@ -0,0 +1,137 @@
+/* Copyright (C) 2020 Philipp Benner
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+/* -------------------------------------------------------------------------- */
+
+import   "math"
+import   "math/rand"
+import   "testing"
+
+import . "github.com/pbenner/autodiff"
+
+import . "github.com/pbenner/modhmm/config"
+
+/* -------------------------------------------------------------------------- */
+
+// Training data with two features of one bin, where the label depends
+// only on the first feature and the second feature is excluded
+func testClassifierTrainingData() classifierTrainingData {
+  rng  := rand.New(rand.NewSource(1))
+  data := classifierTrainingData{Exclude: []bool{false, true}}
+  for d := 0; d < 1000; d++ {
+    x := []float64{rng.Float64(), rng.Float64()}
+    y := 0.0
+    if x[0] + 0.2*rng.NormFloat64() > 0.5 {
+      y = 1.0
+    }
+    data.X = append(data.X, x)
+    data.Y = append(data.Y, y)
+    data.W = append(data.W, 1.0)
+  }
+  return data
+}
+
+/* -------------------------------------------------------------------------- */
+
+func TestClassifierFitExclude(t *testing.T) {
+  data := testClassifierTrainingData()
+  if _, w := classifier_fit_logistic(data, 1.0); w[0] < 1.0 || w[1] != 0.0 {
+    t.Errorf("test failed: %v", w)
+  }
+  _, stumps := classifier_fit_stumps(data, 50, 0.1, 1.0)
+  for _, s := range stumps {
+    if s.Feature != 0 {
+      t.Errorf("test failed: %v", s)
+    }
+  }
+  if m := data.Means(2); math.Abs(m[0]-0.5) > 0.05 || math.Abs(m[1]-0.5) > 0.05 {
+    t.Errorf("test failed: %v", m)
+  }
+}
+
+func TestClassifierTrainedMissing(t *testing.T) {
+  n := len(EnrichmentList)
+  classifier := ClassifierTrained{Method: "logistic", Features: EnrichmentList, Bins: 3, Intercept: -1.0}
+  classifier.Missing = make([]bool, n)
+  classifier.Means   = make([]float64, n)
+  classifier.Weights = make([]float64, n*3)
+  for i := range classifier.Weights {
+    classifier.Weights[i] = 1.0
+  }
+  for i := range classifier.Means {
+    classifier.Means[i] = 0.2
+  }
+  values := make([]float64, n*3)
+  for i := range values {
+    values[i] = 0.5
+  }
+  eval := func(c ClassifierTrained, values []float64) float64 {
+    r := NullFloat64()
+    if err := c.Eval(r, NewDenseFloat64Matrix(values, n, 3)); err != nil {
+      t.Fatal(err)
+    }
+    return r.GetFloat64()
+  }
+  p := func(score float64) float64 {
+    return 1.0/(1.0 + math.Exp(-score))
+  }
+  if r := eval(classifier, values); math.Abs(r - p(-1.0+0.5*float64(3*n))) > 1e-12 {
+    t.Errorf("test failed: %f", r)
+  }
+  // missing bins are replaced by the mean of the feature
+  values[1] = math.NaN()
+  if r := eval(classifier, values); math.IsNaN(r) || math.Abs(r - p(-1.0+0.5*float64(3*n-1)+0.2)) > 1e-12 {
+    t.Errorf("test failed: %f", r)
+  }
+  // features without data are marginalized in the same way, i.e. an empty
+  // track is not treated as no enrichment
+  values[1] = 0.0
+  values[3], values[4], values[5] = 0.0, 0.0, 0.0
+  classifier.missing = make([]bool, n)
+  classifier.missing[0] = true
+  classifier.missing[1] = true
+  if r := eval(classifier, values); math.Abs(r - p(-1.0+0.5*float64(3*n-6)+6*0.2)) > 1e-12 {
+    t.Errorf("test failed: %f", r)
+  }
+}
+
+func TestClassifierTrainedImport(t *testing.T) {
+  dir, cleanup := testTempDir(t)
+  defer cleanup()
+
+  config := DefaultModHmmConfig()
+  config.Directory = dir
+  config.CompletePaths("")
+
+  n := len(EnrichmentList)
+  classifier := ClassifierTrained{Method: "logistic", Features: EnrichmentList, Bins: 1, BinSize: config.BinSize}
+  classifier.Missing = make([]bool, n)
+  classifier.Means   = make([]float64, n)
+  classifier.Weights = make([]float64, n)
+  classifier.Missing[2] = true
+  classifier.Means  [3] = 0.3
+  filename := config.ChromatinStateModel.GetTargetFile("ea").Filename
+  ExportTrainedClassifier(config, filename, classifier)
+
+  missing := make([]bool, n)
+  missing[3] = true
+  r := ImportTrainedClassifier(config, filename, missing)
+  if !r.Missing[2] || r.Means[3] != 0.3 || !r.missing[3] {
+    t.Error("test failed")
+  }
+}
@@ -22,7 +22,6 @@ package main
 import   "io"
 import   "log"
 import   "math"
-import   "path"
 import   "sort"
 
 import . "github.com/pbenner/ngstat/config"
@@ -37,9 +36,6 @@ func ImportCounts(config ConfigModHmm, filename string) Counts {
   printStderr(config, 1, "Importing reference counts from `%s'... ", filename)
   if err := counts.ImportFile(filename); err != nil {
     printStderr(config, 1, "failed\n")
-    // remove directory from filename
-    _, filename = path.Split(filename)
-    filename = path.Join(config.ModelFallbackPath(), filename)
     printStderr(config, 1, "Importing counts from `%s' fallback model... ", config.ModelFallback)
     if err := ImportDefaultFile(config, &counts, filename); err != nil {
       printStderr(config, 1, "failed\n")
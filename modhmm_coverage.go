@@ -20,8 +20,10 @@ package main
 
 import   "fmt"
 import   "bufio"
+import   "encoding/json"
 import   "errors"
 import   "log"
+import   "net/http"
 import   "os"
 import   "path/filepath"
 import   "regexp"
@@ -43,19 +45,60 @@ import   "gonum.org/v1/plot/vg"
 
 /* -------------------------------------------------------------------------- */
 
-func bam_download(config ConfigModHmm, path string) {
+type encodeFileMetadata struct {
+  Href   string `json:"href"`
+  MD5Sum string `json:"md5sum"`
+}
+
+func encode_metadata(config ConfigModHmm, accession string) (encodeFileMetadata, error) {
+  r   := encodeFileMetadata{}
+  url := fmt.Sprintf("%s/files/%s/?format=json", strings.TrimRight(config.EncodeUrl, "/"), accession)
+  req, err := http.NewRequest("GET", url, nil); if err != nil {
+    return r, err
+  }
+  req.Header.Set("Accept", "application/json")
+  resp, err := HttpClient.Do(req); if err != nil {
+    return r, err
+  }
+  defer resp.Body.Close()
+  if resp.StatusCode != http.StatusOK {
+    return r, fmt.Errorf("retrieving metadata from `%s' failed: %s", url, resp.Status)
+  }
+  if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+    return r, fmt.Errorf("retrieving metadata from `%s' failed: %v", url, err)
+  }
+  return r, nil
+}
+
+func bam_download(config ConfigModHmm, path string) error {
   _, filename := filepath.Split(path)
-  if r, _ := regexp.Compile("(ENC[0-9A-Z]{8})\\.bam"); r.MatchString(filename) {
+  if r, _ := regexp.Compile("(ENC[0-9A-Z]{8})\\.(bam|cram)"); r.MatchString(filename) {
     // probably ENCODE file, trying to download...
-    accession := r.FindStringSubmatch(filename)[1]
-    url       := fmt.Sprintf("https://www.encodeproject.org/files/%s/@@download/%s.bam", accession, accession)
-    printStderr(config, 1, "Attempting to download BAM file `%s' from ENCODE... ", path)
-    if err := DownloadFile(path, url); err != nil {
-      printStderr(config, 1, "failed\n")
+    match     := r.FindStringSubmatch(filename)
+    accession := match[1]
+    format    := strings.ToUpper(match[2])
+    baseUrl   := strings.TrimRight(config.EncodeUrl, "/")
+    url       := fmt.Sprintf("%s/files/%s/@@download/%s.%s", baseUrl, accession, accession, match[2])
+    options   := DefaultDownloadOptions()
+    options.Retries = config.DownloadRetries
+    options.Logger  = func(format string, args ...interface{}) {
+      printStderr(config, 1, format, args...)
+    }
+    if metadata, err := encode_metadata(config, accession); err != nil {
+      printStderr(config, 1, "Warning: %v. The md5 checksum of `%s' will not be verified.\n", err, path)
     } else {
-      printStderr(config, 1, "done\n")
+      if metadata.Href != "" {
+        url = baseUrl + metadata.Href
+      }
+      options.MD5 = metadata.MD5Sum
     }
+    printStderr(config, 1, "Attempting to download %s file `%s' from ENCODE...\n", format, path)
+    if err := DownloadFile(path, url, options); err != nil {
+      return fmt.Errorf("downloading %s file `%s' from ENCODE failed: %v", format, path, err)
+    }
+    printStderr(config, 1, "Downloaded %s file `%s'\n", format, path)
   }
+  return nil
 }
 
 /* fragment length estimation
@@ -177,10 +220,10 @@ func modhmm_coverage_dep(config ConfigModHmm, features ...string) []string {
 func coverage(config ConfigModHmm, feature string, filenameBam []string, filenameData string, optionsList []interface{}) error {
   fraglen := make([]int, len(filenameBam))
 
-  // download bams that do not exist
+  // fetch bams that do not exist locally
   for _, filename := range filenameBam {
-    if !FileExists(filename) {
-      bam_download(config, filename)
+    if err := fetch_alignment_file(config, filename); err != nil {
+      return err
     }
   }
   // import fragment length
@@ -188,7 +231,19 @@ func coverage(config ConfigModHmm, feature string, filenameBam []string, filenam
     fraglen[i] = importFraglen(config, feature, filename)
   }
   //////////////////////////////////////////////////////////////////////////////
-  result, fraglenEstimate, _, err := BamCoverage(filenameData, filenameBam, nil, fraglen, nil, optionsList...)
+  var result SimpleTrack
+  var fraglenEstimate []coverageFraglenEstimate
+  var err error
+  if alignmentIsBam(filenameBam...) && config.CoverageTargetDepth <= 0 {
+    r, estimates, _, e := BamCoverage(filenameData, filenameBam, nil, fraglen, nil, optionsList...)
+    for _, estimate := range estimates {
+      fraglenEstimate = append(fraglenEstimate, coverageFraglenEstimate{estimate.Fraglen, estimate.X, estimate.Y, estimate.Error})
+    }
+    result, err = r, e
+  } else {
+    // SAM and CRAM files as well as downsampling are not supported by BamCoverage
+    result, fraglenEstimate, err = readsCoverage(config, filenameBam, fraglen, optionsList)
+  }
 
   // save fraglen estimates
   //////////////////////////////////////////////////////////////////////////////
@@ -209,6 +264,14 @@ func coverage(config ConfigModHmm, feature string, filenameBam []string, filenam
   if err != nil {
     return err
   } else {
+    if err := mappabilityRescale(config, result); err != nil {
+      return err
+    }
+    if config.GenomeFasta != "" {
+      if err := coverageCorrectGC(config, feature, result, filenameData); err != nil {
+        return err
+      }
+    }
     configLocal := config
     configLocal.Verbose = 0
     printStderr(config, 1, "Attempting to write track `%s'\n", filenameData)
@@ -222,6 +285,19 @@ func coverage(config ConfigModHmm, feature string, filenameBam []string, filenam
 
 /* -------------------------------------------------------------------------- */
 
+// Parameters of coverage tracks that are not stored in alignment files
+func coverage_parameters(config ConfigModHmm) string {
+  r := ""
+  if config.CoverageTargetDepth > 0 {
+    r += fmt.Sprintf("Coverage Target Depth: %d\nCoverage Seed: %d\n", config.CoverageTargetDepth, config.CoverageSeed)
+  }
+  // coverage is rescaled by the mappability of bins above the threshold
+  if config.Mappability != "" {
+    r += fmt.Sprintf("Mappability Threshold: %v\n", config.MappabilityThreshold)
+  }
+  return r
+}
+
 func modhmm_coverage(config ConfigModHmm, feature string) error {
 
   if !CoverageList.Contains(strings.ToLower(feature)) {
@@ -273,8 +349,32 @@ func modhmm_coverage(config ConfigModHmm, feature string) error {
   optionsList = append(optionsList, OptionBinSize{config.CoverageBinSize})
   optionsList = append(optionsList, OptionFilterMapQ{config.CoverageMAPQ})
   optionsList = append(optionsList, OptionFilterDuplicates{true})
+  if config.CoverageTargetDepth > 0 {
+    optionsList = append(optionsList, OptionTargetDepth{config.CoverageTargetDepth})
+    optionsList = append(optionsList, OptionSeed{config.CoverageSeed})
+  }
 
-  if updateRequired(config, filenameData, filenameBam...) {
+  // coverage files given as remote URIs are fetched instead of computed
+  if _, ok := config.RemoteFiles[filenameData.Filename]; ok {
+    return remote_fetch(config, filenameData.Filename)
+  }
+  // update cached copies of remote bams, which are fetched only if
+  // required
+  for _, filename := range filenameBam {
+    if _, ok := config.RemoteFiles[filename]; ok && FileExists(filename) {
+      if err := remote_fetch(config, filename); err != nil {
+        return err
+      }
+    }
+  }
+  dependencies := append([]string{}, filenameBam...)
+  if config.GenomeFasta != "" {
+    dependencies = append(dependencies, config.GenomeFasta)
+  }
+  if config.Mappability != "" {
+    dependencies = append(dependencies, config.Mappability)
+  }
+  if updateRequired(config, filenameData, dependencies...) || updateRequiredParameters(config, filenameData, coverage_parameters) {
     if len(filenameBam) == 0 {
       if EnrichmentIsOptional(feature) {
         printStderr(config, 1, "Warning: no bam files specified for optional feature `%s'. This feature will be ignored.\n", logPrefix)
@@ -293,6 +393,7 @@ func modhmm_coverage(config ConfigModHmm, feature string) error {
           return err
         }
       }
+      saveTargetParameters(config, filenameData, coverage_parameters)
     }
   }
   return nil
@@ -0,0 +1,194 @@
+/* Copyright (C) 2020 Philipp Benner
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+/* -------------------------------------------------------------------------- */
+
+import   "fmt"
+import   "math"
+import   "os"
+import   "path/filepath"
+import   "strings"
+import   "sync"
+
+import . "github.com/pbenner/gonetics"
+
+import . "github.com/pbenner/modhmm/config"
+import . "github.com/pbenner/modhmm/utility"
+
+/* -------------------------------------------------------------------------- */
+
+// number of GC bins used for fitting the GC-coverage curve (percent GC)
+const gcBins = 101
+// half width of the running mean used for smoothing the GC-coverage curve
+const gcSmoothing = 2
+// minimal number of coverage bins required for estimating a correction factor
+const gcMinBins = 1000
+
+/* -------------------------------------------------------------------------- */
+
+type gcContent struct {
+  BinSize int
+  Seqs    map[string][]float64
+}
+
+var gcContentOnce   sync.Once
+var gcContentResult gcContent
+var gcContentError  error
+
+func computeGCContent(filename string, binSize int) (gcContent, error) {
+  genome := StringSet{}
+  if err := genome.ImportFasta(filename); err != nil {
+    return gcContent{}, err
+  }
+  if len(genome) == 0 {
+    return gcContent{}, fmt.Errorf("no sequences found")
+  }
+  r := gcContent{binSize, make(map[string][]float64)}
+  for name, seq := range genome {
+    n := DivIntUp(len(seq), binSize)
+    s := make([]float64, n)
+    for i := 0; i < n; i++ {
+      gc := 0
+      at := 0
+      for j := i*binSize; j < (i+1)*binSize && j < len(seq); j++ {
+        switch seq[j] {
+        case 'G', 'C', 'g', 'c', 'S', 's':
+          gc++
+        case 'A', 'T', 'a', 't', 'W', 'w':
+          at++
+        }
+      }
+      if gc+at == 0 {
+        // region consists only of unknown nucleotides
+        s[i] = math.NaN()
+      } else {
+        s[i] = float64(gc)/float64(gc+at)
+      }
+    }
+    r.Seqs[name] = s
+    // free memory as soon as possible
+    delete(genome, name)
+  }
+  return r, nil
+}
+
+// GC content is computed only once for all features
+func importGCContent(config ConfigModHmm) (gcContent, error) {
+  gcContentOnce.Do(func() {
+    printStderr(config, 1, "Computing GC content from `%s'\n", config.GenomeFasta)
+    gcContentResult, gcContentError = computeGCContent(config.GenomeFasta, config.BinSize)
+    if gcContentError != nil {
+      gcContentError = fmt.Errorf("computing GC content from `%s' failed: %v", config.GenomeFasta, gcContentError)
+    }
+  })
+  return gcContentResult, gcContentError
+}
+
+/* -------------------------------------------------------------------------- */
+
+func saveGCCurve(config ConfigModHmm, feature, filename string, n []int, mean, factor []float64) {
+  basename := strings.TrimSuffix(filename, filepath.Ext(filename))
+  filename  = fmt.Sprintf("%s.gc.table", basename)
+
+  f, err := os.Create(filename)
+  if err != nil {
+    printStderr(config, 1, "[%s] Warning: opening `%s' failed: %v\n", feature, filename, err)
+    return
+  }
+  defer f.Close()
+
+  fmt.Fprintf(f, "%4s %12s %12s %12s\n", "gc", "bins", "mean", "factor")
+  for i := 0; i < len(n); i++ {
+    fmt.Fprintf(f, "%4d %12d %12e %12e\n", i, n[i], mean[i], factor[i])
+  }
+}
+
+// Fit a binned GC-coverage curve and rescale coverage values so that the mean
+// coverage is the same for all levels of GC content.
+func coverageCorrectGC(config ConfigModHmm, feature string, track SimpleTrack, filenameData string) error {
+  gc, err := importGCContent(config); if err != nil {
+    return err
+  }
+  gcIndex := func(name string, i, binSize int) int {
+    if s, ok := gc.Seqs[name]; ok {
+      if j := i*binSize/gc.BinSize; j < len(s) && !math.IsNaN(s[j]) {
+        return int(math.Floor(float64(gcBins-1)*s[j] + 0.5))
+      }
+    }
+    return -1
+  }
+  printStderr(config, 1, "[%s] Fitting GC-coverage curve\n", feature)
+  sum := make([]float64, gcBins)
+  n   := make([]int,     gcBins)
+  for _, name := range track.GetSeqNames() {
+    s, err := track.GetSequence(name); if err != nil {
+      return err
+    }
+    for i := 0; i < s.NBins(); i++ {
+      if v := s.AtBin(i); !math.IsNaN(v) {
+        if k := gcIndex(name, i, s.GetBinSize()); k != -1 {
+          sum[k] += v; n[k]++
+        }
+      }
+    }
+  }
+  // global mean coverage
+  sumAll := 0.0
+  nAll   := 0
+  for k := 0; k < gcBins; k++ {
+    sumAll += sum[k]
+    nAll   += n  [k]
+  }
+  if nAll == 0 {
+    return fmt.Errorf("GC correction failed: no coverage bins with known GC content (do sequence names in `%s' match the alignment files?)", config.GenomeFasta)
+  }
+  meanAll := sumAll/float64(nAll)
+  // smoothed GC-coverage curve and correction factors
+  mean   := make([]float64, gcBins)
+  factor := make([]float64, gcBins)
+  for k := 0; k < gcBins; k++ {
+    s := 0.0
+    m := 0
+    for j := k-gcSmoothing; j <= k+gcSmoothing; j++ {
+      if j >= 0 && j < gcBins {
+        s += sum[j]; m += n[j]
+      }
+    }
+    factor[k] = 1.0
+    if m > 0 {
+      mean[k] = s/float64(m)
+    }
+    if m >= gcMinBins && mean[k] > 0.0 {
+      factor[k] = meanAll/mean[k]
+    }
+  }
+  saveGCCurve(config, feature, filenameData, n, mean, factor)
+
+  printStderr(config, 1, "[%s] Correcting coverage for GC content\n", feature)
+  for _, name := range track.GetSeqNames() {
+    s, err := track.GetMutableSequence(name); if err != nil {
+      return err
+    }
+    for i := 0; i < s.NBins(); i++ {
+      if k := gcIndex(name, i, s.GetBinSize()); k != -1 {
+        s.SetBin(i, factor[k]*s.AtBin(i))
+      }
+    }
+  }
+  return nil
+}
@@ -0,0 +1,101 @@
+/* Copyright (C) 2020 Philipp Benner
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+/* -------------------------------------------------------------------------- */
+
+import   "bytes"
+import   "io/ioutil"
+import   "math"
+import   "path/filepath"
+import   "strings"
+import   "testing"
+
+import . "github.com/pbenner/gonetics"
+
+import . "github.com/pbenner/modhmm/config"
+import . "github.com/pbenner/modhmm/utility"
+
+/* -------------------------------------------------------------------------- */
+
+func TestGCContent(t *testing.T) {
+  dir, cleanup := testTempDir(t)
+  defer cleanup()
+
+  filename := filepath.Join(dir, "genome.fa")
+  if err := ioutil.WriteFile(filename, []byte(">chr1\nGGCCAATTNNNNNNNNsgta\n"), 0666); err != nil {
+    t.Fatal(err)
+  }
+  gc, err := computeGCContent(filename, 4); if err != nil {
+    t.Fatal(err)
+  }
+  r := []float64{1.0, 0.0, math.NaN(), math.NaN(), 0.5}
+  if s := gc.Seqs["chr1"]; len(s) != len(r) {
+    t.Fatalf("test failed: %v", s)
+  } else {
+    for i := range r {
+      if s[i] != r[i] && !(math.IsNaN(s[i]) && math.IsNaN(r[i])) {
+        t.Errorf("test failed: %v", s)
+      }
+    }
+  }
+}
+
+func TestCoverageCorrectGC(t *testing.T) {
+  dir, cleanup := testTempDir(t)
+  defer cleanup()
+
+  config := DefaultModHmmConfig()
+  config.Directory   = dir
+  config.GenomeFasta = filepath.Join(dir, "genome.fa")
+  config.CompletePaths("")
+  // two regions of 2000 bins with 20% and 80% GC content
+  n := 2000
+  b := bytes.NewBufferString(">chr1\n")
+  for i := 0; i < 2*n; i++ {
+    if i < n {
+      b.WriteString(strings.Repeat("GATTA", config.BinSize/5) + "\n")
+    } else {
+      b.WriteString(strings.Repeat("GCCTC", config.BinSize/5) + "\n")
+    }
+  }
+  if err := ioutil.WriteFile(config.GenomeFasta, b.Bytes(), 0666); err != nil {
+    t.Fatal(err)
+  }
+  // coverage depends on GC content
+  track := AllocSimpleTrack("coverage", NewGenome([]string{"chr1"}, []int{2*n*config.BinSize}), config.BinSize)
+  seq, _ := track.GetMutableSequence("chr1")
+  for i := 0; i < 2*n; i++ {
+    if i < n {
+      seq.SetBin(i, 10.0)
+    } else {
+      seq.SetBin(i, 30.0)
+    }
+  }
+  filename := filepath.Join(dir, "coverage-h3k27ac.bw")
+  if err := coverageCorrectGC(config, "h3k27ac", track, filename); err != nil {
+    t.Fatal(err)
+  }
+  for _, i := range []int{0, n-1, n, 2*n-1} {
+    if v := seq.AtBin(i); math.Abs(v - 20.0) > 1e-8 {
+      t.Errorf("test failed for bin %d: %f", i, v)
+    }
+  }
+  if !FileExists(filepath.Join(dir, "coverage-h3k27ac.gc.table")) {
+    t.Error("test failed")
+  }
+}
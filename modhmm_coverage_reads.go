@@ -0,0 +1,309 @@
+/* Copyright (C) 2020 Philipp Benner
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+/* -------------------------------------------------------------------------- */
+
+import   "fmt"
+import   "io/ioutil"
+import   "log"
+import   "math/rand"
+
+import . "github.com/pbenner/gonetics"
+
+import . "github.com/pbenner/modhmm/config"
+import . "github.com/pbenner/modhmm/utility"
+
+/* -------------------------------------------------------------------------- */
+
+type coverageFraglenEstimate struct {
+  Fraglen   int
+  X       []int
+  Y       []float64
+  Error     error
+}
+
+// Options specific to readsCoverage, which are not supported by BamCoverage
+type OptionTargetDepth struct {
+  Value int
+}
+
+type OptionSeed struct {
+  Value int64
+}
+
+type readsCoverageConfig struct {
+  BamCoverageConfig
+  TargetDepth int
+  Seed        int64
+}
+
+/* read filters
+ * -------------------------------------------------------------------------- */
+
+func readsFilter(logger *log.Logger, chanIn ReadChannel, what string, keep func(Read) bool) ReadChannel {
+  chanOut := make(chan Read)
+  go func() {
+    n := 0
+    m := 0
+    for r := range chanIn {
+      if keep(r) {
+        chanOut <- r; m++
+      }
+      n++
+    }
+    if n != 0 {
+      logger.Printf("Filtered out %d %s (%.2f%%)", n-m, what, 100.0*float64(n-m)/float64(n))
+    }
+    close(chanOut)
+  }()
+  return chanOut
+}
+
+func readsPairedAsSingleEnd(chanIn ReadChannel) ReadChannel {
+  chanOut := make(chan Read)
+  go func() {
+    for r := range chanIn {
+      r.PairedEnd = false; chanOut <- r
+    }
+    close(chanOut)
+  }()
+  return chanOut
+}
+
+func readsFilterAll(cfg readsCoverageConfig, reads ReadChannel) ReadChannel {
+  if cfg.FilterDuplicates {
+    reads = readsFilter(cfg.Logger, reads, "duplicates", func(r Read) bool {
+      return !r.Duplicate
+    })
+  }
+  if cfg.FilterMapQ > 0 {
+    reads = readsFilter(cfg.Logger, reads, fmt.Sprintf("reads with mapping quality lower than %d", cfg.FilterMapQ), func(r Read) bool {
+      return r.MapQ >= cfg.FilterMapQ
+    })
+  }
+  return reads
+}
+
+/* -------------------------------------------------------------------------- */
+
+func readsCoverageOptions(options []interface{}) (readsCoverageConfig, error) {
+  cfg := readsCoverageConfig{BamCoverageDefaultConfig(), 0, 1}
+  for _, option := range options {
+    switch opt := option.(type) {
+    case OptionLogger:
+      cfg.Logger = opt.Value
+    case OptionBinningMethod:
+      cfg.BinningMethod = opt.Value
+    case OptionBinSize:
+      cfg.BinSize = opt.Value
+    case OptionPairedAsSingleEnd:
+      cfg.PairedAsSingleEnd = opt.Value
+    case OptionEstimateFraglen:
+      cfg.EstimateFraglen = opt.Value
+    case OptionFraglenRange:
+      cfg.FraglenRange = opt.Value
+    case OptionFraglenBinSize:
+      cfg.FraglenBinSize = opt.Value
+    case OptionFilterChroms:
+      cfg.FilterChroms = opt.Value
+    case OptionFilterMapQ:
+      cfg.FilterMapQ = opt.Value
+    case OptionFilterDuplicates:
+      cfg.FilterDuplicates = opt.Value
+    case OptionTargetDepth:
+      cfg.TargetDepth = opt.Value
+    case OptionSeed:
+      cfg.Seed = opt.Value
+    default:
+      return cfg, fmt.Errorf("readsCoverage(): invalid option: %v", opt)
+    }
+  }
+  return cfg, nil
+}
+
+func readsEstimateFraglen(config ConfigModHmm, cfg readsCoverageConfig, filename string, genome Genome) coverageFraglenEstimate {
+  cfg.Logger.Printf("Reading tags from `%s'", filename)
+  f, err := OpenAlignmentFile(config, filename); if err != nil {
+    return coverageFraglenEstimate{0, nil, nil, err}
+  }
+  defer f.Close()
+
+  reads := f.ReadSimple(false, false)
+  reads  = readsFilter(cfg.Logger, reads, "paired reads", func(r Read) bool {
+    return !r.PairedEnd
+  })
+  reads  = readsFilterAll(cfg, reads)
+
+  cfg.Logger.Printf("Estimating mean fragment length")
+  fraglen, x, y, n, err := EstimateFragmentLength(reads, genome, 2000, cfg.FraglenBinSize, cfg.FraglenRange)
+  // drain channel in case of an error
+  for _ = range reads {
+  }
+  if f.Err() != nil {
+    return coverageFraglenEstimate{0, nil, nil, fmt.Errorf("reading `%s' failed: %v", filename, f.Err())}
+  }
+  if err != nil {
+    if n == 0 {
+      // do not report an error if no single-end reads were found
+      return coverageFraglenEstimate{0, x, y, nil}
+    } else {
+      return coverageFraglenEstimate{0, x, y, err}
+    }
+  } else {
+    cfg.Logger.Printf("Estimated mean fragment length: %d", fraglen)
+    return coverageFraglenEstimate{fraglen, x, y, nil}
+  }
+}
+
+func readsOpen(config ConfigModHmm, cfg readsCoverageConfig, filename string) (*AlignmentFile, ReadChannel, error) {
+  f, err := OpenAlignmentFile(config, filename); if err != nil {
+    return nil, nil, err
+  }
+  reads := f.ReadSimple(!cfg.PairedAsSingleEnd, cfg.PairedEndStrandSpecific)
+  if cfg.PairedAsSingleEnd {
+    reads = readsPairedAsSingleEnd(reads)
+  }
+  if len(cfg.FilterChroms) != 0 {
+    // reads on filtered chromosomes must not count towards the target depth
+    reads = readsFilter(cfg.Logger, reads, fmt.Sprintf("reads on `%v'", cfg.FilterChroms), func(r Read) bool {
+      return !StringList(cfg.FilterChroms).Contains(r.Seqname)
+    })
+  }
+  return f, readsFilterAll(cfg, reads), nil
+}
+
+// Count all reads that pass the filters
+func readsCount(config ConfigModHmm, cfg readsCoverageConfig, filenames []string) (int, error) {
+  n := 0
+  // do not report filtered reads twice
+  cfg.Logger = log.New(ioutil.Discard, "", 0)
+  for _, filename := range filenames {
+    f, reads, err := readsOpen(config, cfg, filename); if err != nil {
+      return 0, err
+    }
+    for _ = range reads {
+      n++
+    }
+    if err := f.Close(); err != nil {
+      return 0, fmt.Errorf("reading `%s' failed: %v", filename, err)
+    }
+  }
+  return n, nil
+}
+
+// Select exactly k out of n reads at random (selection sampling). The state
+// is shared across all alignment files of a feature.
+type readsSampler struct {
+  k, n      int
+  generator *rand.Rand
+}
+
+func (obj *readsSampler) Sample(chanIn ReadChannel) ReadChannel {
+  chanOut := make(chan Read)
+  go func() {
+    for r := range chanIn {
+      if obj.n > 0 && obj.generator.Float64()*float64(obj.n) < float64(obj.k) {
+        chanOut <- r; obj.k--
+      }
+      obj.n--
+    }
+    close(chanOut)
+  }()
+  return chanOut
+}
+
+// Compute coverage from alignment files in any supported format (BAM, SAM,
+// CRAM). Reads are filtered in the same way as by BamCoverage.
+func readsCoverage(config ConfigModHmm, filenames []string, fraglen []int, options []interface{}) (SimpleTrack, []coverageFraglenEstimate, error) {
+  cfg, err := readsCoverageOptions(options); if err != nil {
+    return SimpleTrack{}, nil, err
+  }
+  // read genome
+  var genome Genome
+  for _, filename := range filenames {
+    g, err := ImportAlignmentGenome(config, filename); if err != nil {
+      return SimpleTrack{}, nil, err
+    }
+    if genome.Length() == 0 {
+      genome = g
+    } else {
+      if !genome.Equals(g) {
+        return SimpleTrack{}, nil, fmt.Errorf("alignment genomes are not equal")
+      }
+    }
+  }
+  estimates := make([]coverageFraglenEstimate, len(filenames))
+  for i, _ := range estimates {
+    estimates[i].Fraglen = fraglen[i]
+  }
+  // fragment length estimation
+  if cfg.EstimateFraglen {
+    for i, filename := range filenames {
+      if fraglen[i] != -1 {
+        estimates[i].Error = fmt.Errorf("estimate provided")
+        continue
+      }
+      estimates[i] = readsEstimateFraglen(config, cfg, filename, genome)
+      if estimates[i].Error != nil {
+        return SimpleTrack{}, estimates, fmt.Errorf("%s: %w", filename, estimates[i].Error)
+      }
+      fraglen[i] = estimates[i].Fraglen
+    }
+  }
+  // downsampling to target depth
+  var sampler *readsSampler
+  if cfg.TargetDepth > 0 {
+    n, err := readsCount(config, cfg, filenames); if err != nil {
+      return SimpleTrack{}, estimates, err
+    }
+    if n > cfg.TargetDepth {
+      cfg.Logger.Printf("Downsampling %d reads to target depth of %d reads (seed: %d)", n, cfg.TargetDepth, cfg.Seed)
+      sampler = &readsSampler{cfg.TargetDepth, n, rand.New(rand.NewSource(cfg.Seed))}
+    } else {
+      cfg.Logger.Printf("Number of reads (%d) does not exceed target depth of %d reads, no downsampling performed", n, cfg.TargetDepth)
+    }
+  }
+  track := AllocSimpleTrack("treatment", genome, cfg.BinSize)
+
+  for i, filename := range filenames {
+    cfg.Logger.Printf("Reading treatment tags from `%s'", filename)
+    f, reads, err := readsOpen(config, cfg, filename); if err != nil {
+      return SimpleTrack{}, estimates, err
+    }
+    if sampler != nil {
+      reads = sampler.Sample(reads)
+    }
+
+    GenericMutableTrack{track}.AddReads(reads, fraglen[i], cfg.BinningMethod)
+
+    if err := f.Close(); err != nil {
+      return SimpleTrack{}, estimates, fmt.Errorf("reading `%s' failed: %v", filename, err)
+    }
+  }
+  if len(cfg.FilterChroms) != 0 {
+    cfg.Logger.Printf("Removing all reads from `%v'", cfg.FilterChroms)
+    for _, chr := range cfg.FilterChroms {
+      if s, err := track.GetMutableSequence(chr); err == nil {
+        for i := 0; i < s.NBins(); i++ {
+          s.SetBin(i, 0.0)
+        }
+      }
+    }
+  }
+  return track, estimates, nil
+}
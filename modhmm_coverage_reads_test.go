@@ -0,0 +1,70 @@
+/* Copyright (C) 2020 Philipp Benner
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+/* -------------------------------------------------------------------------- */
+
+import   "math/rand"
+import   "testing"
+
+import . "github.com/pbenner/gonetics"
+
+/* -------------------------------------------------------------------------- */
+
+func testReadsSample(seed int64, k int, n []int) []int {
+  sampler := &readsSampler{k, n[0]+n[1], rand.New(rand.NewSource(seed))}
+  r := []int{}
+  // reads of two alignment files share the sampler state
+  for j := 0; j < 2; j++ {
+    reads := make(chan Read)
+    go func(j int) {
+      for i := 0; i < n[j]; i++ {
+        reads <- Read{GRange: GRange{Seqname: "chr1", Range: Range{From: 1000*j+i, To: 1000*j+i+1}}}
+      }
+      close(reads)
+    }(j)
+    for read := range sampler.Sample(reads) {
+      r = append(r, read.Range.From)
+    }
+  }
+  return r
+}
+
+func TestReadsSampler(t *testing.T) {
+  r1 := testReadsSample(1, 100, []int{300, 200})
+  r2 := testReadsSample(1, 100, []int{300, 200})
+  r3 := testReadsSample(2, 100, []int{300, 200})
+  if len(r1) != 100 || len(r3) != 100 {
+    t.Fatalf("test failed: %d reads selected", len(r1))
+  }
+  equal := true
+  for i := range r1 {
+    if r1[i] != r2[i] {
+      t.Fatal("test failed: sampling is not reproducible")
+    }
+    if r1[i] != r3[i] {
+      equal = false
+    }
+  }
+  if equal {
+    t.Error("test failed: seed has no effect")
+  }
+  // reads from both files must be selected
+  if r1[0] >= 1000 || r1[99] < 1000 {
+    t.Error("test failed")
+  }
+}
@@ -0,0 +1,86 @@
+/* Copyright (C) 2020 Philipp Benner
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+/* -------------------------------------------------------------------------- */
+
+import   "bytes"
+import   "crypto/md5"
+import   "encoding/hex"
+import   "fmt"
+import   "io/ioutil"
+import   "net/http"
+import   "net/http/httptest"
+import   "path/filepath"
+import   "testing"
+
+import . "github.com/pbenner/modhmm/config"
+
+/* -------------------------------------------------------------------------- */
+
+func TestEncodeDownload(t *testing.T) {
+  dir, cleanup := testTempDir(t)
+  defer cleanup()
+
+  data     := bytes.Repeat([]byte("bam"), 1000)
+  sum      := md5.Sum(data)
+  requests := 0
+  server   := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    switch r.URL.Path {
+    case "/files/ENCFF001ABC/":
+      fmt.Fprintf(w, `{"href": "/files/ENCFF001ABC/@@download/ENCFF001ABC.bam", "md5sum": "%s"}`, hex.EncodeToString(sum[:]))
+    case "/files/ENCFF001ABC/@@download/ENCFF001ABC.bam":
+      if requests++; requests == 1 {
+        // corrupt transfer, detected by md5 checksum
+        w.Write(data[0:100]); return
+      }
+      w.Write(data)
+    case "/files/ENCFF003ABC/@@download/ENCFF003ABC.cram":
+      w.Write(data)
+    default:
+      http.NotFound(w, r)
+    }
+  }))
+  defer server.Close()
+
+  config := DefaultModHmmConfig()
+  config.EncodeUrl       = server.URL
+  config.DownloadRetries = 3
+
+  filename := filepath.Join(dir, "ENCFF001ABC.bam")
+  if err := bam_download(config, filename); err != nil {
+    t.Fatal(err)
+  }
+  if r, err := ioutil.ReadFile(filename); err != nil || !bytes.Equal(r, data) {
+    t.Error("test failed")
+  }
+  if requests != 2 {
+    t.Errorf("test failed: %d requests", requests)
+  }
+  // CRAM file without metadata
+  filename = filepath.Join(dir, "ENCFF003ABC.cram")
+  if err := bam_download(config, filename); err != nil {
+    t.Fatal(err)
+  }
+  if r, err := ioutil.ReadFile(filename); err != nil || !bytes.Equal(r, data) {
+    t.Error("test failed")
+  }
+  // unknown accession
+  if err := bam_download(config, filepath.Join(dir, "ENCFF002ABC.bam")); err == nil {
+    t.Error("test failed")
+  }
+}
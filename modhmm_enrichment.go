@@ -20,6 +20,7 @@ package main
 
 import   "fmt"
 import   "log"
+import   "math"
 import   "os"
 import   "strings"
 
@@ -33,19 +34,17 @@ import   "github.com/pborman/getopt"
 
 /* -------------------------------------------------------------------------- */
 
-func enrichment_import_and_normalize(config ConfigModHmm, filenameData, filenameCnts string, normalize bool) MutableTrack {
-  if track, err := ImportTrack(config.SessionConfig, filenameData); err != nil {
+func enrichment_import_and_normalize(config ConfigModHmm, files EnrichmentFiles, normalize bool) MutableTrack {
+  if track, err := ImportTrack(config.SessionConfig, files.Coverage.Filename); err != nil {
     log.Fatal(err)
     return nil
   } else {
+    // bins with low mappability are treated as missing data
+    if err := mappabilityMask(config, track, math.NaN()); err != nil {
+      log.Fatal(err)
+    }
     if normalize {
-      counts := ImportCounts(config, filenameCnts)
-      printStderr(config, 1, "Quantile normalizing track to reference distribution... ")
-      if err := (GenericMutableTrack{track}).QuantileNormalizeToCounts(counts.X, counts.Y); err != nil {
-        printStderr(config, 1, "failed\n")
-        log.Fatal(err)
-      }
-      printStderr(config, 1, "done\n")
+      enrichment_normalize(config, files, track)
     }
     return track
   }
@@ -55,6 +54,9 @@ func enrichment_import_and_normalize(config ConfigModHmm, filenameData, filename
 
 func enrichment_eval_rna(config ConfigModHmm, result MutableTrack, data Track, t float64) {
   if err := (GenericMutableTrack{result}).Map(data, func(seqname string, position int, value float64) float64 {
+    if math.IsNaN(value) {
+      return value
+    }
     if value > t {
       return 1.0 - 1e-8
     } else {
@@ -69,8 +71,9 @@ func enrichment_eval_rna(config ConfigModHmm, result MutableTrack, data Track, t
 
 func enrichment_import(config ConfigModHmm, files EnrichmentFiles, normalize bool) Track {
   switch strings.ToLower(config.EnrichmentMethod) {
-  case "model"    : return enrichment_import_model    (config, files, normalize)
-  case "heuristic": return enrichment_import_heuristic(config, files)
+  case "model"        : return enrichment_import_model    (config, files, normalize)
+  case "heuristic"    : return enrichment_import_heuristic(config, files)
+  case "control-ratio": return enrichment_import_heuristic(config, files)
   default:
     log.Fatal("invalid single-feature method")
     panic("internal error")
@@ -78,15 +81,40 @@ func enrichment_import(config ConfigModHmm, files EnrichmentFiles, normalize boo
 }
 
 func enrichment_eval(config ConfigModHmm, files EnrichmentFiles) {
+  // use calibration map if available
+  if files.Calibration.Filename != "" {
+    if FileExists(files.Calibration.Filename) {
+      enrichment_eval_calibrated(config, files); return
+    }
+    printStderr(config, 1, "Warning: calibration map `%s' does not exist. Using uncalibrated enrichment probabilities for feature `%s'.\n", files.Calibration.Filename, files.Feature)
+  }
+  // gene-level evaluation of RNA-seq data if an annotation is available
+  if files.Annotation.Filename != "" {
+    enrichment_eval_rna_genes(config, files); return
+  }
   switch strings.ToLower(config.EnrichmentMethod) {
-  case "model"    : enrichment_eval_classifier(config, files)
-  case "heuristic": enrichment_eval_heuristic (config, files)
+  case "model"        : enrichment_eval_classifier(config, files)
+  case "heuristic"    : enrichment_eval_heuristic (config, files)
+  case "control-ratio": enrichment_eval_control   (config, files)
   default:
     log.Fatal("invalid single-feature method")
     panic("internal error")
   }
 }
 
+// Parameters that determine the enrichment probabilities of a feature
+func enrichment_parameters(feature string) targetParameters {
+  return func(config ConfigModHmm) string {
+    r := fmt.Sprintf("Enrichment Method: %s\n", strings.ToLower(config.EnrichmentMethod))
+    r += fmt.Sprintf("Enrichment Normalization: %s\n", config.EnrichmentNormalization)
+    if config.EnrichmentControlRatio(feature) {
+      r += fmt.Sprintf("Control Ratio Threshold: %v\n", config.ControlRatioThreshold)
+      r += fmt.Sprintf("Control Ratio Windows: %v\n", config.ControlRatioWindows)
+    }
+    return r + enrichment_broad_parameters(feature)(config)
+  }
+}
+
 func enrichment_filter_update(config ConfigModHmm, features []string) []string {
   r := []string{}
   for _, feature := range features {
@@ -97,7 +125,10 @@ func enrichment_filter_update(config ConfigModHmm, features []string) []string {
     dependencies := []string{}
     dependencies  = append(dependencies, files.Dependencies()...)
     dependencies  = append(dependencies, modhmm_coverage_dep(config, files.Feature)...)
-    if updateRequired(config, files.Probabilities, dependencies...) {
+    if config.EnrichmentControlRatio(files.Feature) {
+      dependencies = append(dependencies, modhmm_coverage_dep(config, "control")...)
+    }
+    if updateRequired(config, files.Probabilities, dependencies...) || updateRequiredParameters(config, files.Probabilities, enrichment_parameters(files.Feature)) {
       r = append(r, files.Feature)
     }
   }
@@ -119,13 +150,18 @@ func modhmm_enrichment_eval(config ConfigModHmm, feature string) {
 
   files := config.EnrichmentFiles(feature)
 
-  if updateRequired(config, files.Probabilities, files.Dependencies()...) {
+  if updateRequired(config, files.Probabilities, files.Dependencies()...) || updateRequiredParameters(config, files.Probabilities, enrichment_parameters(files.Feature)) {
 
     if EnrichmentIsOptional(files.Feature) && !FileExists(files.Coverage.Filename) {
       return
     }
     printStderr(config, 1, "==> Computing Enrichment Probabilities (%s) <==\n", feature)
     enrichment_eval(config, files)
+
+    if config.EnrichmentBroadDomains(files.Feature) {
+      enrichment_eval_broad(config, files)
+    }
+    saveTargetParameters(config, files.Probabilities, enrichment_parameters(files.Feature))
   }
 }
 
@@ -133,7 +169,11 @@ func modhmm_enrichment_eval_loop(config ConfigModHmm, features []string) {
   // reduce list of features to those that require an update
   features = enrichment_filter_update(config, features)
   // compute coverages here to make use of multi-threading
-  modhmm_coverage_loop(config, InsensitiveStringList(features).Intersection(CoverageList))
+  if strings.ToLower(config.EnrichmentMethod) == "control-ratio" && len(features) > 0 {
+    modhmm_coverage_loop(config, uniqueStrings(append(InsensitiveStringList(features).Intersection(CoverageList), "control")))
+  } else {
+    modhmm_coverage_loop(config, InsensitiveStringList(features).Intersection(CoverageList))
+  }
   // eval single features
   for _, feature := range features {
     modhmm_enrichment_eval(config, feature)
@@ -0,0 +1,225 @@
+/* Copyright (C) 2020 Philipp Benner
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+/* -------------------------------------------------------------------------- */
+
+import   "fmt"
+import   "log"
+import   "math"
+import   "os"
+import   "strconv"
+import   "strings"
+
+import . "github.com/pbenner/autodiff"
+import . "github.com/pbenner/autodiff/logarithmetic"
+import . "github.com/pbenner/autodiff/statistics"
+import   "github.com/pbenner/autodiff/statistics/scalarDistribution"
+
+import . "github.com/pbenner/gonetics"
+
+import . "github.com/pbenner/modhmm/config"
+import . "github.com/pbenner/modhmm/utility"
+
+/* Automatic selection of the number of mixture components. A grid of
+ * component counts is fitted to the data and the model with the smallest
+ * BIC or ICL is selected.
+ * -------------------------------------------------------------------------- */
+
+const defaultMixtureComponentsGrid = "delta:1,poisson:0-2,geometric:1-3"
+
+// Parse grid of component counts, e.g. `delta:1,poisson:0-2,negbin:1-3'
+func parseMixtureComponentsGrid(str string) ([]mixtureComponents, error) {
+  r := []mixtureComponents{{}}
+  for _, item := range strings.Split(str, ",") {
+    fields := strings.Split(strings.TrimSpace(item), ":")
+    if len(fields) != 2 {
+      return nil, fmt.Errorf("invalid component specification `%s'", item)
+    }
+    bounds := strings.Split(fields[1], "-")
+    if len(bounds) > 2 {
+      return nil, fmt.Errorf("invalid range of components in `%s'", item)
+    }
+    from, err := strconv.ParseInt(bounds[0], 10, 64); if err != nil || from < 0 {
+      return nil, fmt.Errorf("invalid range of components in `%s'", item)
+    }
+    to := from
+    if len(bounds) == 2 {
+      if to, err = strconv.ParseInt(bounds[1], 10, 64); err != nil || to < from {
+        return nil, fmt.Errorf("invalid range of components in `%s'", item)
+      }
+    }
+    // extend grid
+    s := []mixtureComponents{}
+    for _, c := range r {
+      for n := int(from); n <= int(to); n++ {
+        t := c
+        switch strings.ToLower(fields[0]) {
+        case "delta"    : t.Delta        += n
+        case "poisson"  : t.Poisson      += n
+        case "zinb"     : t.ZeroInflated += n
+        case "negbin"   : t.NegBin       += n
+        case "geometric": t.Geometric    += n
+        default:
+          return nil, fmt.Errorf("invalid component type `%s' [delta, poisson, zinb, negbin, geometric]", fields[0])
+        }
+        s = append(s, t)
+      }
+    }
+    r = s
+  }
+  // drop empty models
+  s := []mixtureComponents{}
+  for _, c := range r {
+    if c.Delta + c.Poisson + c.ZeroInflated + c.NegBin + c.Geometric > 0 {
+      s = append(s, c)
+    }
+  }
+  if len(s) == 0 {
+    return nil, fmt.Errorf("component grid `%s' contains no models", str)
+  }
+  return s, nil
+}
+
+/* -------------------------------------------------------------------------- */
+
+// Number of free parameters of a mixture component
+func mixtureComponentNParameters(pdf ScalarPdf) int {
+  switch a := pdf.(type) {
+  case *scalarDistribution.DeltaDistribution:
+    return 0
+  case *scalarDistribution.PdfTranslation:
+    return mixtureComponentNParameters(a.ScalarPdf)
+  default:
+    return pdf.GetParameters().Dim()
+  }
+}
+
+type mixtureCriteria struct {
+  Components    mixtureComponents
+  LogLikelihood float64
+  NParameters   int
+  BIC           float64
+  ICL           float64
+}
+
+// Compute log-likelihood, BIC and ICL on the histogram of the data
+func compute_mixture_criteria(mixture *scalarDistribution.Mixture, counts Counts) mixtureCriteria {
+  r := mixtureCriteria{}
+  r.NParameters = mixture.NComponents()-1
+  for k := 0; k < mixture.NComponents(); k++ {
+    r.NParameters += mixtureComponentNParameters(mixture.Edist[k])
+  }
+  n  := 0.0
+  en := 0.0
+  t  := NullFloat64()
+  lp := make([]float64, mixture.NComponents())
+  for i := range counts.X {
+    s := math.Inf(-1)
+    for k := 0; k < mixture.NComponents(); k++ {
+      if err := mixture.Edist[k].LogPdf(t, ConstFloat64(counts.X[i])); err != nil {
+        log.Fatal(err)
+      }
+      lp[k] = mixture.LogWeights.Float64At(k) + t.GetFloat64()
+      s     = LogAdd(s, lp[k])
+    }
+    c := float64(counts.Y[i])
+    n += c
+    r.LogLikelihood += c*s
+    // entropy of the classification
+    for k := range lp {
+      if tau := math.Exp(lp[k]-s); tau > 0.0 {
+        en -= c*tau*math.Log(tau)
+      }
+    }
+  }
+  r.BIC = -2.0*r.LogLikelihood + float64(r.NParameters)*math.Log(n)
+  r.ICL = r.BIC + 2.0*en
+  return r
+}
+
+func (obj mixtureCriteria) Get(criterion string) float64 {
+  switch strings.ToLower(criterion) {
+  case "bic": return obj.BIC
+  case "icl": return obj.ICL
+  default:
+    log.Fatalf("invalid model selection criterion `%s' [bic, icl]", criterion)
+    panic("internal error")
+  }
+}
+
+func print_mixture_criteria(feature, criterion string, table []mixtureCriteria, selected int) {
+  fmt.Printf("Model selection for feature `%s' (criterion: %s)\n", feature, strings.ToUpper(criterion))
+  fmt.Printf(": %-48s %6s %16s %16s %16s\n", "Components", "#Par", "LogLikelihood", "BIC", "ICL")
+  for i, c := range table {
+    fmt.Printf(": %-48s %6d %16.4f %16.4f %16.4f", c.Components, c.NParameters, c.LogLikelihood, c.BIC, c.ICL)
+    if i == selected {
+      fmt.Printf(" [selected]")
+    }
+    fmt.Println()
+  }
+}
+
+/* -------------------------------------------------------------------------- */
+
+func modhmm_enrichment_estimate_auto(config ConfigModHmm, feature string, grid []mixtureComponents, criterion string, force bool) {
+  if !EnrichmentModelList.Contains(strings.ToLower(feature)) {
+    log.Fatalf("unknown feature: %s", feature)
+  }
+  files := config.EnrichmentFiles(feature)
+  var track Track
+  // update model
+  if force || updateRequired(config, files.Model, files.DependenciesModel()...) || updateRequiredParameters(config, files.Model, enrichment_model_parameters) {
+    track = enrichment_import_model(config, files, false)
+    counts := compute_counts(config, track)
+
+    var best           *scalarDistribution.Mixture
+    var bestEstimation  mixtureEstimation
+    table    := []mixtureCriteria{}
+    selected := -1
+    for i, n := range grid {
+      printStderr(config, 1, "Estimating mixture model with components `%v' (%d/%d)...\n", n, i+1, len(grid))
+      mixture, estimation := enrichment_estimate_restarts(config, track, counts, n)
+      c := compute_mixture_criteria(mixture, counts)
+      c.Components = n
+      table = append(table, c)
+      if selected == -1 || c.Get(criterion) < table[selected].Get(criterion) {
+        selected       = i
+        best           = mixture
+        bestEstimation = estimation
+      }
+    }
+    print_mixture_criteria(feature, criterion, table, selected)
+
+    enrichment_export_mixture   (config, best, files)
+    enrichment_export_estimation(config, bestEstimation, files)
+    // foreground components of a previous model refer to a different number
+    // and order of mixture components and must be selected again
+    if !files.Components.Static && FileExists(files.Components.Filename) {
+      printStderr(config, 1, "Removing foreground components `%s' of previous model\n", files.Components.Filename)
+      os.Remove(files.Components.Filename)
+      component_selection_remove(files.Components.Filename)
+    }
+  }
+  // update counts
+  if force || updateRequired(config, files.CoverageCnts, files.DependenciesModel()...) {
+    if track == nil {
+      track = enrichment_import_model(config, files, false)
+    }
+    modhmm_compute_counts(config, track, files.CoverageCnts.Filename)
+  }
+}
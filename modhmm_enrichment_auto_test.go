@@ -0,0 +1,109 @@
+/* Copyright (C) 2020 Philipp Benner
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+/* -------------------------------------------------------------------------- */
+
+import   "math"
+import   "math/rand"
+import   "testing"
+
+import . "github.com/pbenner/ngstat/track"
+import . "github.com/pbenner/gonetics"
+
+import . "github.com/pbenner/modhmm/config"
+import . "github.com/pbenner/modhmm/utility"
+
+/* -------------------------------------------------------------------------- */
+
+func testPoisson(rng *rand.Rand, lambda float64) float64 {
+  k := 0.0
+  for p := rng.Float64(); p > math.Exp(-lambda); p *= rng.Float64() {
+    k++
+  }
+  return k
+}
+
+// Config with all files in dir and a coverage track for the given feature,
+// where a fraction of bins is enriched
+func testEnrichmentConfig(t *testing.T, dir, feature string, fraction float64) ConfigModHmm {
+  config := DefaultModHmmConfig()
+  config.Directory = dir
+  config.CompletePaths("")
+
+  rng   := rand.New(rand.NewSource(1))
+  track := AllocSimpleTrack("coverage", NewGenome([]string{"chr1"}, []int{400000}), config.BinSize)
+  seq, _ := track.GetMutableSequence("chr1")
+  for i := 0; i < seq.NBins(); i++ {
+    if rng.Float64() < fraction {
+      seq.SetBin(i, testPoisson(rng, 20.0))
+    } else {
+      seq.SetBin(i, testPoisson(rng, 0.5))
+    }
+  }
+  if err := ExportTrack(config.SessionConfig, track, config.EnrichmentFiles(feature).Coverage.Filename); err != nil {
+    t.Fatal(err)
+  }
+  return config
+}
+
+/* -------------------------------------------------------------------------- */
+
+func TestMixtureComponentsGrid(t *testing.T) {
+  if grid, err := parseMixtureComponentsGrid("delta:1,poisson:0-2,negbin:1-2"); err != nil {
+    t.Fatal(err)
+  } else
+  if len(grid) != 6 || grid[0] != (mixtureComponents{Delta: 1, NegBin: 1}) || grid[5] != (mixtureComponents{Delta: 1, Poisson: 2, NegBin: 2}) {
+    t.Errorf("test failed: %v", grid)
+  }
+  for _, str := range []string{"delta:0", "delta:2-1", "poisson:1-2-3", "normal:1"} {
+    if _, err := parseMixtureComponentsGrid(str); err == nil {
+      t.Errorf("test failed for `%s'", str)
+    }
+  }
+}
+
+func TestEnrichmentAuto(t *testing.T) {
+  dir, cleanup := testTempDir(t)
+  defer cleanup()
+
+  config := testEnrichmentConfig(t, dir, "h3k27ac", 0.1)
+  files  := config.EnrichmentFiles("h3k27ac")
+  // foreground components of a previous model
+  ExportComponents(config, files.Components.Filename, []int{1})
+
+  grid, err := parseMixtureComponentsGrid("delta:1,poisson:1-2"); if err != nil {
+    t.Fatal(err)
+  }
+  modhmm_enrichment_estimate_auto(config, "h3k27ac", grid, "bic", false)
+
+  if !FileExists(files.Model.Filename) {
+    t.Fatal("test failed: model not exported")
+  }
+  if FileExists(files.Components.Filename) {
+    t.Error("test failed: stale foreground components not removed")
+  }
+  mixture := ImportMixtureDistribution(config, files.Model.Filename)
+  if mixture.NComponents() != 3 {
+    t.Errorf("test failed: %d components", mixture.NComponents())
+  }
+  // select components for the new model
+  modhmm_enrichment_select(config, "h3k27ac", "fraction:0.1", 2.0)
+  if k, _ := ImportComponents(config, files.Components.Filename, mixture.NComponents()); len(k) != 1 || k[0] != 2 {
+    t.Errorf("test failed: %v", k)
+  }
+}
@@ -0,0 +1,223 @@
+/* Copyright (C) 2019 Philipp Benner
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+/* -------------------------------------------------------------------------- */
+
+import   "fmt"
+import   "io/ioutil"
+import   "log"
+import   "math"
+import   "os"
+import   "path/filepath"
+import   "strings"
+
+import . "github.com/pbenner/gonetics"
+import . "github.com/pbenner/ngstat/track"
+import   "github.com/pbenner/threadpool"
+
+import . "github.com/pbenner/modhmm/config"
+import . "github.com/pbenner/modhmm/utility"
+
+/* Broad domain mode. Marks such as H3K27me3 and H3K9me3 form domains that
+ * span many kilobases, but enrichment probabilities are computed for each
+ * bin independently, which fragments domains with moderate coverage. For
+ * selected features, the (normalized) coverage is therefore smoothed with
+ * windows of multiple sizes (scales) centered at each bin, and enrichment
+ * probabilities are computed on the smoothed coverage with the same
+ * method as for the original coverage, where the heuristic method uses
+ * the logistic function fitted to the original coverage. The resulting
+ * probability is the maximum of the original probability and the
+ * probabilities at all scales, such that sharp peaks are kept while
+ * domains with moderate but consistent coverage are called. Bins with
+ * missing values are ignored.
+ * -------------------------------------------------------------------------- */
+
+// Parameters of the broad domain mode that determine the enrichment
+// probabilities of a feature
+func enrichment_broad_parameters(feature string) targetParameters {
+  return func(config ConfigModHmm) string {
+    if !config.EnrichmentBroadDomains(feature) {
+      return ""
+    }
+    return fmt.Sprintf("Enrichment Broad Domain Scales: %v\n", config.EnrichmentBroadScales)
+  }
+}
+
+// Window sizes in number of bins
+func enrichment_broad_scales(config ConfigModHmm, binSize int) []int {
+  r := []int{}
+  for _, w := range config.EnrichmentBroadScales {
+    if w <= 0 {
+      log.Fatalf("invalid broad domain scale `%d'", w)
+    }
+    r = append(r, DivIntUp(w, binSize))
+  }
+  return r
+}
+
+// Mean coverage within windows of w bins centered at each bin, rounded
+// since enrichment models are discrete
+func enrichment_broad_smooth(config ConfigModHmm, track Track, w int) MutableTrack {
+  result := AllocSimpleTrack("coverage", track.GetGenome(), track.GetBinSize())
+
+  pool  := threadpool.New(config.Threads, 10000)
+  group := pool.NewJobGroup()
+
+  for _, name := range track.GetSeqNames() {
+    name := name
+    pool.AddJob(group, func(pool threadpool.ThreadPool, erf func() error) error {
+
+      seq1, err := track.GetSequence(name); if err != nil {
+        log.Fatal(err)
+      }
+      seq2, err := result.GetSequence(name); if err != nil {
+        log.Fatal(err)
+      }
+      nbins := seq1.NBins()
+
+      // cumulative sums for computing window means, missing values are
+      // skipped
+      cs := make([]float64, nbins+1)
+      cn := make([]float64, nbins+1)
+      for i := 0; i < nbins; i++ {
+        cs[i+1], cn[i+1] = cs[i], cn[i]
+        if x := seq1.AtBin(i); !math.IsNaN(x) {
+          cs[i+1] += x
+          cn[i+1] += 1.0
+        }
+      }
+      // loop over sequence
+      for i := 0; i < nbins; i++ {
+        if math.IsNaN(seq1.AtBin(i)) {
+          seq2.SetBin(i, math.NaN()); continue
+        }
+        i1 := i-w/2
+        i2 := i+w/2+1
+        if i1 < 0 {
+          i1 = 0
+        }
+        if i2 > nbins {
+          i2 = nbins
+        }
+        seq2.SetBin(i, math.Floor((cs[i2]-cs[i1])/(cn[i2]-cn[i1]) + 0.5))
+      }
+      return nil
+    })
+  }
+  pool.Wait(group)
+  return result
+}
+
+// Bin-wise maximum of probabilities, bins with missing values are kept
+func enrichment_broad_max(result MutableTrack, track Track) {
+  for _, name := range result.GetSeqNames() {
+    seq1, err := result.GetSequence(name); if err != nil {
+      log.Fatal(err)
+    }
+    seq2, err := track.GetSequence(name); if err != nil {
+      log.Fatal(err)
+    }
+    for i := 0; i < seq1.NBins(); i++ {
+      if p, q := seq1.AtBin(i), seq2.AtBin(i); !math.IsNaN(p) && q > p {
+        seq1.SetBin(i, q)
+      }
+    }
+  }
+}
+
+/* -------------------------------------------------------------------------- */
+
+func enrichment_broad_calibrated(files EnrichmentFiles) bool {
+  return files.Calibration.Filename != "" && FileExists(files.Calibration.Filename)
+}
+
+// Import coverage exactly as it is used by the enrichment method
+func enrichment_broad_import(config ConfigModHmm, files EnrichmentFiles) Track {
+  if enrichment_broad_calibrated(files) {
+    return enrichment_import_heuristic(config, files)
+  }
+  return enrichment_import(config, files, true)
+}
+
+func enrichment_eval_broad(config ConfigModHmm, files EnrichmentFiles) {
+  result, err := ImportTrack(config.SessionConfig, files.Probabilities.Filename); if err != nil {
+    log.Fatal(err)
+  }
+  data    := enrichment_broad_import(config, files)
+  control := Track(nil)
+  if config.EnrichmentControlRatio(files.Feature) && FileExists(files.Control.Filename) {
+    control = enrichment_import_heuristic(config, EnrichmentFiles{Feature: "control", Coverage: files.Control})
+  }
+  // smoothed tracks are evaluated from temporary files
+  dir, err := ioutil.TempDir("", "modhmm-broad"); if err != nil {
+    log.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+
+  tmpFiles := files
+  tmpFiles.Coverage      = TargetFile{Filename: filepath.Join(dir, "coverage.bw")}
+  tmpFiles.Control       = TargetFile{Filename: filepath.Join(dir, "control.bw")}
+  tmpFiles.Probabilities = TargetFile{Filename: filepath.Join(dir, "probabilities.bw")}
+  tmpFiles.Annotation    = TargetFile{}
+  // the model is up to date and must not be compared to the temporary
+  // coverage
+  tmpFiles.Model.Static  = true
+  // coverage is already normalized
+  tmpConfig := config
+  tmpConfig.EnrichmentNormalization = "none"
+  tmpConfig.Verbose = 0
+
+  // the heuristic method derives the logistic function from the coverage
+  // distribution, which must be the distribution of the original coverage
+  // and not the one of the smoothed coverage
+  heuristic := strings.ToLower(config.EnrichmentMethod) == "heuristic" && !enrichment_broad_calibrated(files)
+  a, b      := 0.0, 0.0
+  if heuristic {
+    a, b = enrichment_eval_heuristic_parameters(config, files, compute_counts(config, data))
+  }
+  for i, w := range enrichment_broad_scales(config, data.GetBinSize()) {
+    printStderr(config, 1, "Computing enrichment probabilities on coverage smoothed at scale %d bp (broad domains)... ", config.EnrichmentBroadScales[i])
+    smoothed := enrichment_broad_smooth(config, data, w)
+    if heuristic {
+      track := AllocSimpleTrack("classification", data.GetGenome(), data.GetBinSize())
+      enrichment_eval_heuristic_loop(config, track, smoothed, a, b)
+      enrichment_broad_max(result, track)
+      printStderr(config, 1, "done\n")
+      continue
+    }
+    if err := ExportTrack(config.SessionConfig, smoothed, tmpFiles.Coverage.Filename); err != nil {
+      log.Fatal(err)
+    }
+    if control != nil {
+      if err := ExportTrack(config.SessionConfig, enrichment_broad_smooth(config, control, w), tmpFiles.Control.Filename); err != nil {
+        log.Fatal(err)
+      }
+    }
+    enrichment_eval(tmpConfig, tmpFiles)
+
+    if track, err := ImportTrack(config.SessionConfig, tmpFiles.Probabilities.Filename); err != nil {
+      log.Fatal(err)
+    } else {
+      enrichment_broad_max(result, track)
+    }
+    printStderr(config, 1, "done\n")
+  }
+  if err := ExportTrack(config.SessionConfig, result, files.Probabilities.Filename); err != nil {
+    log.Fatal(err)
+  }
+}
@@ -0,0 +1,154 @@
+/* Copyright (C) 2020 Philipp Benner
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+/* -------------------------------------------------------------------------- */
+
+import   "math"
+import   "testing"
+
+import . "github.com/pbenner/autodiff/statistics"
+import . "github.com/pbenner/ngstat/track"
+import . "github.com/pbenner/gonetics"
+
+import . "github.com/pbenner/modhmm/config"
+
+/* -------------------------------------------------------------------------- */
+
+func TestEnrichmentBroadSmooth(t *testing.T) {
+  track := AllocSimpleTrack("test", NewGenome([]string{"chr1"}, []int{1000}), 100)
+  seq, _ := track.GetMutableSequence("chr1")
+  for i, v := range []float64{0, 4, 0, math.NaN(), 4, 0, 0, 0, 0, 9} {
+    seq.SetBin(i, v)
+  }
+  r, _ := enrichment_broad_smooth(DefaultModHmmConfig(), track, 3).GetSequence("chr1")
+  for i, v := range []float64{2, 1, 2, math.NaN(), 2, 1, 0, 0, 3, 5} {
+    if x := r.AtBin(i); x != v && !(math.IsNaN(x) && math.IsNaN(v)) {
+      t.Errorf("test failed for bin %d: %f != %f", i, x, v)
+    }
+  }
+}
+
+func TestEnrichmentBroad(t *testing.T) {
+  dir, cleanup := testTempDir(t)
+  defer cleanup()
+
+  config := DefaultModHmmConfig()
+  config.Directory = dir
+  config.EnrichmentModel.H3k27me3.Static = true
+  config.CompletePaths("")
+  config.EnrichmentMethod        = "model"
+  config.EnrichmentNormalization = "none"
+  config.EnrichmentBroad         = []string{"h3k27me3"}
+  config.EnrichmentBroadScales   = []int{2000}
+
+  files := config.EnrichmentFiles("h3k27me3")
+  // domain with moderate coverage at every second bin
+  track := AllocSimpleTrack("coverage", NewGenome([]string{"chr1"}, []int{100000}), config.BinSize)
+  seq, _ := track.GetMutableSequence("chr1")
+  for i := 200; i < 300; i += 2 {
+    seq.SetBin(i, 8)
+  }
+  if err := ExportTrack(config.SessionConfig, track, files.Coverage.Filename); err != nil {
+    t.Fatal(err)
+  }
+  if err := ExportDistribution(files.Model.Filename, testMixture(t, []float64{0.8, 0.15, 0.05}, testDeltaPdf(t, 0.0), testPoissonPdf(t, 1.0), testPoissonPdf(t, 6.0))); err != nil {
+    t.Fatal(err)
+  }
+  ExportComponents(config, files.Components.Filename, []int{2})
+
+  probabilities := func() TrackSequence {
+    r, err := ImportTrack(config.SessionConfig, files.Probabilities.Filename); if err != nil {
+      t.Fatal(err)
+    }
+    s, _ := r.GetSequence("chr1")
+    return s
+  }
+  modhmm_enrichment_eval(config, "h3k27me3")
+  // gaps within the domain are filled, while bins outside remain
+  // unenriched
+  if s := probabilities(); s.AtBin(250) < 0.99 || s.AtBin(251) < 0.7 || s.AtBin(100) > 0.01 {
+    t.Errorf("test failed: %f %f %f", s.AtBin(250), s.AtBin(251), s.AtBin(100))
+  }
+  if updateRequiredParameters(config, files.Probabilities, enrichment_parameters(files.Feature)) {
+    t.Error("test failed")
+  }
+  // changing scales or broad features requires an update
+  config.EnrichmentBroadScales = []int{1000, 2000}
+  if !updateRequiredParameters(config, files.Probabilities, enrichment_parameters(files.Feature)) {
+    t.Error("test failed")
+  }
+  config.EnrichmentBroad = []string{}
+  if !updateRequiredParameters(config, files.Probabilities, enrichment_parameters(files.Feature)) {
+    t.Error("test failed")
+  }
+  modhmm_enrichment_eval(config, "h3k27me3")
+
+  if s := probabilities(); s.AtBin(251) > 0.01 {
+    t.Errorf("test failed: %f", s.AtBin(251))
+  }
+}
+
+func TestEnrichmentBroadHeuristic(t *testing.T) {
+  dir, cleanup := testTempDir(t)
+  defer cleanup()
+
+  config := DefaultModHmmConfig()
+  config.Directory = dir
+  config.CompletePaths("")
+  config.EnrichmentBroadScales = []int{2000}
+  files := config.EnrichmentFiles("h3k27me3")
+
+  // background coverage and a domain with high coverage at every second
+  // bin
+  track := AllocSimpleTrack("coverage", NewGenome([]string{"chr1"}, []int{200000}), config.BinSize)
+  seq, _ := track.GetMutableSequence("chr1")
+  for i := 0; i < seq.NBins(); i++ {
+    seq.SetBin(i, float64((7*i) % 5))
+  }
+  for i := 200; i < 300; i++ {
+    seq.SetBin(i, float64(12*(i % 2)))
+  }
+  if err := ExportTrack(config.SessionConfig, track, files.Coverage.Filename); err != nil {
+    t.Fatal(err)
+  }
+  enriched := func() (int, TrackSequence) {
+    r, err := ImportTrack(config.SessionConfig, files.Probabilities.Filename); if err != nil {
+      t.Fatal(err)
+    }
+    s, _ := r.GetSequence("chr1")
+    n := 0
+    for i := 0; i < s.NBins(); i++ {
+      if s.AtBin(i) > 0.5 {
+        n++
+      }
+    }
+    return n, s
+  }
+  modhmm_enrichment_eval(config, "h3k27me3")
+  n1, s1 := enriched()
+  p1 := s1.AtBin(251)
+
+  config.EnrichmentBroad = []string{"h3k27me3"}
+  modhmm_enrichment_eval(config, "h3k27me3")
+  n2, s2 := enriched()
+  // probabilities increase within the domain, while smoothed background
+  // coverage remains unenriched
+  if s2.AtBin(251) < 10*p1 || n2 > n1 + 100 {
+    t.Errorf("test failed: %f %f %d %d", p1, s2.AtBin(251), n1, n2)
+  }
+}
@@ -0,0 +1,521 @@
+/* Copyright (C) 2020 Philipp Benner
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+/* -------------------------------------------------------------------------- */
+
+import   "fmt"
+import   "io"
+import   "log"
+import   "math"
+import   "os"
+import   "sort"
+import   "strings"
+
+import . "github.com/pbenner/gonetics"
+import . "github.com/pbenner/ngstat/config"
+import . "github.com/pbenner/ngstat/track"
+import   "github.com/pbenner/threadpool"
+
+import . "github.com/pbenner/modhmm/config"
+import . "github.com/pbenner/modhmm/utility"
+
+import   "github.com/pborman/getopt"
+
+import   "gonum.org/v1/plot"
+import   "gonum.org/v1/plot/plotter"
+import   "gonum.org/v1/plot/plotutil"
+import   "gonum.org/v1/plot/vg"
+
+/* Supervised calibration of enrichment probabilities. Coverage values are
+ * labeled by a set of trusted peaks and a calibration map from coverage
+ * values to enrichment probabilities is estimated, either by isotonic
+ * regression or by logistic regression on log coverage (Platt scaling).
+ * -------------------------------------------------------------------------- */
+
+// Probabilities of calibration maps are restricted to [eps, 1-eps]
+const calibrationEpsilon = 1e-6
+
+// Number of bins of calibration curves
+const calibrationBins = 10
+
+/* -------------------------------------------------------------------------- */
+
+type calibrationBin struct {
+  From      float64
+  To        float64
+  Predicted float64
+  Observed  float64
+  N         float64
+}
+
+type calibrationReport struct {
+  BrierScore float64
+  Curve      []calibrationBin
+}
+
+type enrichmentCalibration struct {
+  Feature      string
+  Method       string
+  PeaksFile    string
+  // parameters of the logistic function (Platt scaling)
+  A            float64 `json:",omitempty"`
+  B            float64 `json:",omitempty"`
+  // step function (isotonic regression), where Y[i] is the probability
+  // for all coverage values in [X[i], X[i+1])
+  X          []float64 `json:",omitempty"`
+  Y          []float64 `json:",omitempty"`
+  Calibrated   calibrationReport
+  Uncalibrated *calibrationReport `json:",omitempty"`
+}
+
+func (obj *enrichmentCalibration) Import(reader io.Reader, args... interface{}) error {
+  return JsonImport(reader, obj)
+}
+
+func (obj *enrichmentCalibration) Export(writer io.Writer) error {
+  return JsonExport(writer, obj)
+}
+
+func (obj enrichmentCalibration) Eval(x float64) float64 {
+  if math.IsNaN(x) {
+    return x
+  }
+  p := 0.0
+  switch obj.Method {
+  case "platt":
+    p = 1.0/(1.0 + math.Exp(-obj.A*math.Log1p(math.Max(x, 0.0)) - obj.B))
+  case "isotonic":
+    // find last step that starts at or before x
+    i := sort.SearchFloat64s(obj.X, x)
+    if i == len(obj.X) || obj.X[i] != x {
+      i--
+    }
+    if i < 0 {
+      i = 0
+    }
+    p = obj.Y[i]
+  default:
+    log.Fatalf("invalid calibration method `%s'", obj.Method)
+  }
+  return math.Min(math.Max(p, calibrationEpsilon), 1.0-calibrationEpsilon)
+}
+
+/* -------------------------------------------------------------------------- */
+
+// Histogram of coverage values with the number of bins within peaks
+type calibrationData struct {
+  X   []float64
+  N   []float64
+  Pos []float64
+}
+
+func calibration_data(data Track, peaks peakRegions) (calibrationData, error) {
+  n   := make(map[float64]float64)
+  pos := make(map[float64]float64)
+  binSize := data.GetBinSize()
+  if err := (GenericMutableTrack{}).Map(data, func(seqname string, position int, value float64) float64 {
+    if !math.IsNaN(value) {
+      n[value] += 1.0
+      if peaks.Contains(seqname, position + binSize/2) {
+        pos[value] += 1.0
+      }
+    }
+    return 0.0
+  }); err != nil {
+    return calibrationData{}, err
+  }
+  r := calibrationData{}
+  for x := range n {
+    r.X = append(r.X, x)
+  }
+  sort.Float64s(r.X)
+  for _, x := range r.X {
+    r.N   = append(r.N  , n  [x])
+    r.Pos = append(r.Pos, pos[x])
+  }
+  return r, nil
+}
+
+/* -------------------------------------------------------------------------- */
+
+// Logistic regression on log coverage values, fitted with Newton's method
+func calibration_fit_platt(data calibrationData) (float64, float64) {
+  loglik := func(a, b float64) float64 {
+    r := 0.0
+    for i, x := range data.X {
+      t := a*math.Log1p(x) + b
+      // log sigmoid(t) and log (1-sigmoid(t))
+      l1 := -math.Log1p(math.Exp(-t))
+      l0 := -math.Log1p(math.Exp( t))
+      r  += data.Pos[i]*l1 + (data.N[i]-data.Pos[i])*l0
+    }
+    return r
+  }
+  // initialize intercept with the fraction of bins within peaks
+  n, m := 0.0, 0.0
+  for i := range data.X {
+    n += data.N  [i]
+    m += data.Pos[i]
+  }
+  a, b := 0.0, math.Log((m+0.5)/(n-m+0.5))
+  l    := loglik(a, b)
+  for iter := 0; iter < 100; iter++ {
+    g1, g2      := 0.0, 0.0
+    h11, h12, h22 := 0.0, 0.0, 0.0
+    for i, x := range data.X {
+      z := math.Log1p(x)
+      p := 1.0/(1.0 + math.Exp(-a*z-b))
+      w := data.N[i]*p*(1.0-p)
+      g1  += (data.Pos[i] - data.N[i]*p)*z
+      g2  += (data.Pos[i] - data.N[i]*p)
+      h11 += w*z*z
+      h12 += w*z
+      h22 += w
+    }
+    // add small ridge for numerical stability
+    h11 += 1e-8
+    h22 += 1e-8
+    det := h11*h22 - h12*h12
+    if det <= 0.0 {
+      break
+    }
+    da := ( h22*g1 - h12*g2)/det
+    db := (-h12*g1 + h11*g2)/det
+    // step halving
+    s := 1.0
+    for ; s > 1e-8; s /= 2.0 {
+      if lnew := loglik(a+s*da, b+s*db); lnew >= l {
+        a, b, l = a+s*da, b+s*db, lnew
+        break
+      }
+    }
+    if s <= 1e-8 || math.Abs(s*da) + math.Abs(s*db) < 1e-10 {
+      break
+    }
+  }
+  return a, b
+}
+
+// Isotonic regression using the pool adjacent violators algorithm
+func calibration_fit_isotonic(data calibrationData) ([]float64, []float64) {
+  type block struct {
+    x float64
+    w float64
+    s float64
+  }
+  blocks := []block{}
+  for i, x := range data.X {
+    blocks = append(blocks, block{x, data.N[i], data.Pos[i]})
+    // merge blocks that violate monotonicity
+    for k := len(blocks)-1; k > 0 && blocks[k-1].s/blocks[k-1].w >= blocks[k].s/blocks[k].w; k-- {
+      blocks[k-1].w += blocks[k].w
+      blocks[k-1].s += blocks[k].s
+      blocks = blocks[0:k]
+    }
+  }
+  x := make([]float64, len(blocks))
+  y := make([]float64, len(blocks))
+  for i, b := range blocks {
+    x[i] = b.x
+    y[i] = b.s/b.w
+  }
+  return x, y
+}
+
+/* -------------------------------------------------------------------------- */
+
+type calibrationAccumulator struct {
+  brier float64
+  n     float64
+  bins  []calibrationBin
+}
+
+func newCalibrationAccumulator() calibrationAccumulator {
+  r := calibrationAccumulator{}
+  r.bins = make([]calibrationBin, calibrationBins)
+  for i := range r.bins {
+    r.bins[i].From = float64(i  )/calibrationBins
+    r.bins[i].To   = float64(i+1)/calibrationBins
+  }
+  return r
+}
+
+// Add n observations with predicted probability p, of which pos are
+// within peaks
+func (obj *calibrationAccumulator) Add(p, n, pos float64) {
+  obj.brier += pos*(1.0-p)*(1.0-p) + (n-pos)*p*p
+  obj.n     += n
+  i := int(p*calibrationBins)
+  if i >= calibrationBins {
+    i = calibrationBins-1
+  }
+  obj.bins[i].Predicted += n*p
+  obj.bins[i].Observed  += pos
+  obj.bins[i].N         += n
+}
+
+func (obj calibrationAccumulator) Report() calibrationReport {
+  r := calibrationReport{}
+  if obj.n > 0.0 {
+    r.BrierScore = obj.brier/obj.n
+  }
+  for _, b := range obj.bins {
+    if b.N > 0.0 {
+      b.Predicted /= b.N
+      b.Observed  /= b.N
+      r.Curve = append(r.Curve, b)
+    }
+  }
+  return r
+}
+
+func calibration_report(calibration enrichmentCalibration, data calibrationData) calibrationReport {
+  r := newCalibrationAccumulator()
+  for i, x := range data.X {
+    r.Add(calibration.Eval(x), data.N[i], data.Pos[i])
+  }
+  return r.Report()
+}
+
+// Evaluate current enrichment probabilities against the reference peaks
+func calibration_report_probabilities(config ConfigModHmm, filename string, peaks peakRegions) (calibrationReport, error) {
+  track, err := ImportTrack(config.SessionConfig, filename); if err != nil {
+    return calibrationReport{}, err
+  }
+  r := newCalibrationAccumulator()
+  binSize := track.GetBinSize()
+  if err := (GenericMutableTrack{}).Map(track, func(seqname string, position int, value float64) float64 {
+    if !math.IsNaN(value) {
+      if peaks.Contains(seqname, position + binSize/2) {
+        r.Add(value, 1.0, 1.0)
+      } else {
+        r.Add(value, 1.0, 0.0)
+      }
+    }
+    return 0.0
+  }); err != nil {
+    return calibrationReport{}, err
+  }
+  return r.Report(), nil
+}
+
+/* -------------------------------------------------------------------------- */
+
+func calibration_print_report(name string, report calibrationReport) {
+  fmt.Printf("%s (Brier score: %f)\n", name, report.BrierScore)
+  fmt.Printf(": %-11s %12s %12s %12s\n", "Probability", "Predicted", "Observed", "N")
+  for _, b := range report.Curve {
+    fmt.Printf(": [%.1f, %.1f]  %12.6f %12.6f %12.0f\n", b.From, b.To, b.Predicted, b.Observed, b.N)
+  }
+}
+
+func calibration_print(calibration enrichmentCalibration) {
+  fmt.Printf("Calibration of feature `%s' (method: %s, reference peaks: %s)\n", calibration.Feature, calibration.Method, calibration.PeaksFile)
+  if calibration.Method == "platt" {
+    fmt.Printf(": p(x) = 1/(1 + exp(-%f*log(1+x) - %f))\n", calibration.A, calibration.B)
+  }
+  fmt.Println()
+  if calibration.Uncalibrated != nil {
+    calibration_print_report("Uncalibrated enrichment probabilities", *calibration.Uncalibrated)
+    fmt.Println()
+  }
+  calibration_print_report("Calibrated enrichment probabilities", calibration.Calibrated)
+}
+
+func calibration_plot(config ConfigModHmm, calibration enrichmentCalibration, save string) {
+  p, err := plot.New()
+  if err != nil {
+    log.Fatal(err)
+  }
+  p.Title.Text    = calibration.Feature
+  p.Legend.Top    = true
+  p.Legend.Left   = true
+  p.X.Label.Text  = "predicted probability"
+  p.Y.Label.Text  = "observed frequency"
+  p.X.Min, p.X.Max = 0.0, 1.0
+  p.Y.Min, p.Y.Max = 0.0, 1.0
+  // set font size
+  p.Title .Font.Size       = vg.Length(config.FontSize)
+  p.Legend.Font.Size       = vg.Length(config.FontSize)
+  p.X.Label.Font.Size      = vg.Length(config.FontSize)
+  p.Y.Label.Font.Size      = vg.Length(config.FontSize)
+  p.X.Tick.Label.Font.Size = vg.Length(config.FontSize)
+  p.Y.Tick.Label.Font.Size = vg.Length(config.FontSize)
+
+  curve := func(report calibrationReport) plotter.XYs {
+    xy := make(plotter.XYs, len(report.Curve))
+    for i, b := range report.Curve {
+      xy[i].X = b.Predicted
+      xy[i].Y = b.Observed
+    }
+    return xy
+  }
+  lines := []interface{}{"identity", plotter.XYs{{0.0, 0.0}, {1.0, 1.0}}}
+  if calibration.Uncalibrated != nil {
+    lines = append(lines, "uncalibrated", curve(*calibration.Uncalibrated))
+  }
+  lines = append(lines, "calibrated", curve(calibration.Calibrated))
+
+  plotutil.DefaultColors = plotutil.SoftColors
+  if err := plotutil.AddLinePoints(p, lines...); err != nil {
+    log.Fatal("plotting calibration curves failed: ", err)
+  }
+  if _, err := plot_result([][]*plot.Plot{{p}}, save); err != nil {
+    log.Fatal(err)
+  }
+}
+
+/* -------------------------------------------------------------------------- */
+
+func ImportCalibration(config ConfigModHmm, filename string) enrichmentCalibration {
+  calibration := enrichmentCalibration{}
+  printStderr(config, 1, "Importing calibration map from `%s'... ", filename)
+  if err := ImportFile(&calibration, filename); err != nil {
+    printStderr(config, 1, "failed\n")
+    log.Fatal(err)
+  }
+  printStderr(config, 1, "done\n")
+  return calibration
+}
+
+func ExportCalibration(config ConfigModHmm, filename string, calibration enrichmentCalibration) {
+  printStderr(config, 1, "Exporting calibration map to `%s'... ", filename)
+  if err := ExportFile(&calibration, filename); err != nil {
+    printStderr(config, 1, "failed\n")
+    log.Fatal(err)
+  }
+  printStderr(config, 1, "done\n")
+}
+
+/* -------------------------------------------------------------------------- */
+
+func enrichment_eval_calibrated(config ConfigModHmm, files EnrichmentFiles) {
+  calibration := ImportCalibration(config, files.Calibration.Filename)
+
+  data   := enrichment_import_heuristic(config, files)
+  result := AllocSimpleTrack("classification", data.GetGenome(), data.GetBinSize())
+
+  pool  := threadpool.New(config.Threads, 10000)
+  group := pool.NewJobGroup()
+
+  for _, name := range data.GetSeqNames() {
+    name := name
+    pool.AddJob(group, func(pool threadpool.ThreadPool, erf func() error) error {
+      seq1, err := data.GetSequence(name); if err != nil {
+        log.Fatal(err)
+      }
+      seq2, err := result.GetSequence(name); if err != nil {
+        log.Fatal(err)
+      }
+      for i := 0; i < seq2.NBins(); i++ {
+        seq2.SetBin(i, calibration.Eval(seq1.AtBin(i)))
+      }
+      return nil
+    })
+  }
+  pool.Wait(group)
+
+  if err := ExportTrack(config.SessionConfig, result, files.Probabilities.Filename); err != nil {
+    log.Fatal(err)
+  }
+}
+
+/* -------------------------------------------------------------------------- */
+
+func modhmm_enrichment_calibrate(config ConfigModHmm, feature, filenamePeaks, method string) enrichmentCalibration {
+  feature = config.CoerceOpenChromatinAssay(feature)
+
+  files    := config.EnrichmentFiles(feature)
+  filename := config.EnrichmentCalib.GetTargetFile(feature).Filename
+
+  // compute coverage if required
+  modhmm_coverage_loop(config, InsensitiveStringList([]string{files.Feature}).Intersection(CoverageList))
+
+  peaks, err := importPeakRegions(filenamePeaks); if err != nil {
+    log.Fatal(err)
+  }
+  data, err := calibration_data(enrichment_import_heuristic(config, files), peaks); if err != nil {
+    log.Fatal(err)
+  }
+  calibration := enrichmentCalibration{Feature: files.Feature, Method: method, PeaksFile: filenamePeaks}
+
+  printStderr(config, 1, "Estimating calibration map (%s)... ", method)
+  switch method {
+  case "platt":
+    calibration.A, calibration.B = calibration_fit_platt(data)
+  case "isotonic":
+    calibration.X, calibration.Y = calibration_fit_isotonic(data)
+  default:
+    printStderr(config, 1, "failed\n")
+    log.Fatalf("invalid calibration method `%s' [isotonic, platt]", method)
+  }
+  printStderr(config, 1, "done\n")
+
+  calibration.Calibrated = calibration_report(calibration, data)
+
+  if FileExists(files.Probabilities.Filename) {
+    if report, err := calibration_report_probabilities(config, files.Probabilities.Filename, peaks); err != nil {
+      log.Fatal(err)
+    } else {
+      calibration.Uncalibrated = &report
+    }
+  }
+  ExportCalibration(config, filename, calibration)
+
+  if !config.EnrichmentCalibration {
+    printStderr(config, 1, "Warning: calibration maps are not applied unless `Enrichment Calibration' is enabled in the config file.\n")
+  }
+  return calibration
+}
+
+/* -------------------------------------------------------------------------- */
+
+func modhmm_enrichment_calibrate_main(config ConfigModHmm, args []string) {
+
+  options := getopt.New()
+  options.SetProgram(fmt.Sprintf("%s calibrate-enrichment", os.Args[0]))
+  options.SetParameters("FEATURE\n")
+
+  optPeaks  := options.StringLong("peaks",   0 , "",         "BED file or ModHMM peak table with trusted peaks (required)")
+  optMethod := options.StringLong("method",  0 , "isotonic", "calibration method [isotonic, platt]")
+  optPlot   := options.StringLong("plot",    0 , "",         "save calibration curves to file (png or pdf)")
+  optHelp   := options.  BoolLong("help",   'h',             "print help")
+
+  options.Parse(args)
+
+  // command options
+  if *optHelp {
+    options.PrintUsage(os.Stdout)
+    os.Exit(0)
+  }
+  if len(options.Args()) != 1 || *optPeaks == "" {
+    options.PrintUsage(os.Stderr)
+    os.Exit(1)
+  }
+  method := strings.ToLower(*optMethod)
+  if method != "isotonic" && method != "platt" {
+    log.Fatalf("invalid calibration method `%s' [isotonic, platt]", *optMethod)
+  }
+  calibration := modhmm_enrichment_calibrate(config, options.Args()[0], *optPeaks, method)
+
+  calibration_print(calibration)
+
+  if *optPlot != "" {
+    calibration_plot(config, calibration, *optPlot)
+  }
+}
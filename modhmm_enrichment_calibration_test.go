@@ -0,0 +1,106 @@
+/* Copyright (C) 2020 Philipp Benner
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+/* -------------------------------------------------------------------------- */
+
+import   "math"
+import   "testing"
+
+import . "github.com/pbenner/gonetics"
+
+/* -------------------------------------------------------------------------- */
+
+func TestCalibrationIsotonic(t *testing.T) {
+  data := calibrationData{
+    X  : []float64{ 0,  1,  2,  3,  4},
+    N  : []float64{10, 10, 10, 10, 10},
+    Pos: []float64{ 1,  3,  2,  6,  9} }
+  x, y := calibration_fit_isotonic(data)
+  // the violation at coverage 2 is pooled with coverage 1
+  rx := []float64{0, 1, 3, 4}
+  ry := []float64{0.1, 0.25, 0.6, 0.9}
+  if len(x) != len(rx) {
+    t.Fatalf("test failed: %v %v", x, y)
+  }
+  for i := range rx {
+    if x[i] != rx[i] || math.Abs(y[i]-ry[i]) > 1e-12 {
+      t.Errorf("test failed: %v %v", x, y)
+    }
+  }
+  calibration := enrichmentCalibration{Method: "isotonic", X: x, Y: y}
+  for value, p := range map[float64]float64{-1: 0.1, 0: 0.1, 1.5: 0.25, 2: 0.25, 3: 0.6, 100: 0.9} {
+    if r := calibration.Eval(value); math.Abs(r-p) > 1e-12 {
+      t.Errorf("test failed for value %f: %f", value, r)
+    }
+  }
+  if !math.IsNaN(calibration.Eval(math.NaN())) {
+    t.Error("test failed")
+  }
+}
+
+func TestCalibrationPlatt(t *testing.T) {
+  // expected counts of a logistic model, for which the maximum likelihood
+  // estimate is exact
+  data := calibrationData{}
+  for x := 0.0; x <= 50.0; x++ {
+    p := 1.0/(1.0 + math.Exp(-2.0*math.Log1p(x) + 3.0))
+    data.X   = append(data.X  , x)
+    data.N   = append(data.N  , 1000.0)
+    data.Pos = append(data.Pos, 1000.0*p)
+  }
+  a, b := calibration_fit_platt(data)
+  if math.Abs(a-2.0) > 1e-4 || math.Abs(b+3.0) > 1e-4 {
+    t.Errorf("test failed: a=%f b=%f", a, b)
+  }
+  calibration := enrichmentCalibration{Method: "platt", A: a, B: b}
+  // calibrated probabilities have a smaller Brier score than a constant
+  // probability of 0.5
+  r1 := calibration_report(calibration, data)
+  r2 := calibration_report(enrichmentCalibration{Method: "platt"}, data)
+  if r1.BrierScore >= r2.BrierScore {
+    t.Errorf("test failed: %f >= %f", r1.BrierScore, r2.BrierScore)
+  }
+  for _, c := range r1.Curve {
+    if math.Abs(c.Predicted - c.Observed) > 1e-3 {
+      t.Errorf("test failed: %v", c)
+    }
+  }
+}
+
+func TestCalibrationData(t *testing.T) {
+  track := AllocSimpleTrack("test", NewGenome([]string{"chr1"}, []int{1000}), 100)
+  seq, _ := track.GetMutableSequence("chr1")
+  for i, v := range []float64{0, 1, 5, 5, 1, 0, math.NaN(), 5, 0, 0} {
+    seq.SetBin(i, v)
+  }
+  peaks := peakRegions{"chr1": {{200, 400}, {700, 800}}}
+  data, err := calibration_data(track, peaks); if err != nil {
+    t.Fatal(err)
+  }
+  rx := []float64{0, 1, 5}
+  rn := []float64{4, 2, 3}
+  rp := []float64{0, 0, 3}
+  if len(data.X) != len(rx) {
+    t.Fatalf("test failed: %v", data)
+  }
+  for i := range rx {
+    if data.X[i] != rx[i] || data.N[i] != rn[i] || data.Pos[i] != rp[i] {
+      t.Errorf("test failed: %v", data)
+    }
+  }
+}
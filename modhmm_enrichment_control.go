@@ -0,0 +1,231 @@
+/* Copyright (C) 2020 Philipp Benner
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+/* -------------------------------------------------------------------------- */
+
+import   "fmt"
+import   "log"
+import   "math"
+
+import . "github.com/pbenner/gonetics"
+import . "github.com/pbenner/ngstat/track"
+import   "github.com/pbenner/threadpool"
+
+import . "github.com/pbenner/modhmm/config"
+import . "github.com/pbenner/modhmm/utility"
+
+/* Enrichment relative to a control (WCE/IgG) experiment. Coverage values
+ * are modeled as Poisson counts with a local lambda, which is estimated
+ * from the depth-scaled control coverage in windows of increasing size
+ * around each bin (similar to MACS). The Poisson p-value is translated
+ * into an enrichment probability using a logistic function.
+ * -------------------------------------------------------------------------- */
+
+// log P(X >= k) for X ~ Poisson(lambda)
+func poisson_log_upper_tail(k, lambda float64) float64 {
+  if k <= 0.0 {
+    return 0.0
+  }
+  if lambda <= 0.0 {
+    return math.Inf(-1)
+  }
+  logPdf := func(j float64) float64 {
+    g, _ := math.Lgamma(j+1.0)
+    return j*math.Log(lambda) - lambda - g
+  }
+  if k > lambda {
+    // terms are decreasing, sum tail directly
+    t := logPdf(k)
+    s := 1.0
+    r := 1.0
+    for j := k+1.0; ; j++ {
+      r *= lambda/j
+      s += r
+      if r < 1e-16*s {
+        break
+      }
+    }
+    return t + math.Log(s)
+  } else {
+    // tail probability is large, use complement
+    s := 0.0
+    for j := 0.0; j < k; j++ {
+      s += math.Exp(logPdf(j))
+    }
+    return math.Log1p(-math.Min(s, 1.0))
+  }
+}
+
+/* -------------------------------------------------------------------------- */
+
+// Scaling factor that equalizes the sequencing depth of data and control
+func enrichment_control_scale(data, control Track) (float64, error) {
+  s1 := 0.0
+  s2 := 0.0
+  for _, name := range data.GetSeqNames() {
+    seq1, err := data.GetSequence(name); if err != nil {
+      return 0.0, err
+    }
+    seq2, err := control.GetSequence(name); if err != nil {
+      return 0.0, err
+    }
+    for i := 0; i < seq1.NBins() && i < seq2.NBins(); i++ {
+      if x, y := seq1.AtBin(i), seq2.AtBin(i); !math.IsNaN(x) && !math.IsNaN(y) {
+        s1 += x
+        s2 += y
+      }
+    }
+  }
+  if s2 == 0.0 {
+    return 0.0, fmt.Errorf("control coverage is zero")
+  }
+  return s1/s2, nil
+}
+
+// Genome-wide mean of the data, used as lower bound for the local lambda
+func enrichment_control_lambda_bg(data Track) float64 {
+  s := 0.0
+  n := 0.0
+  if err := (GenericMutableTrack{}).Map(data, func(seqname string, position int, value float64) float64 {
+    if !math.IsNaN(value) {
+      s += value
+      n += 1.0
+    }
+    return 0.0
+  }); err != nil {
+    log.Fatal(err)
+  }
+  if n == 0.0 {
+    return 0.0
+  }
+  return s/n
+}
+
+// Window sizes in number of bins
+func enrichment_control_windows(config ConfigModHmm, binSize int) []int {
+  r := []int{}
+  for _, w := range config.ControlRatioWindows {
+    if w <= 0 {
+      log.Fatalf("invalid control ratio window size `%d'", w)
+    }
+    r = append(r, DivIntUp(w, binSize))
+  }
+  return r
+}
+
+/* -------------------------------------------------------------------------- */
+
+func enrichment_eval_control_loop(config ConfigModHmm, result MutableTrack, data, control Track, scale, lambdaBg float64) {
+  windows := enrichment_control_windows(config, data.GetBinSize())
+  // logistic function mapping -log10 p-values to probabilities, such
+  // that p = 1 gives 1e-4 and the threshold gives 0.5
+  a := math.Log((1.0-1e-4)/1e-4)/config.ControlRatioThreshold
+  b := -a*config.ControlRatioThreshold
+
+  pool  := threadpool.New(config.Threads, 10000)
+  group := pool.NewJobGroup()
+
+  for _, name := range data.GetSeqNames() {
+    name := name
+    pool.AddJob(group, func(pool threadpool.ThreadPool, erf func() error) error {
+
+      seq1, err := data.GetSequence(name); if err != nil {
+        log.Fatal(err)
+      }
+      seq2, err := control.GetSequence(name); if err != nil {
+        log.Fatal(err)
+      }
+      seq3, err := result.GetSequence(name); if err != nil {
+        log.Fatal(err)
+      }
+      nbins := seq3.NBins()
+
+      // cumulative sums of control coverage for computing window means,
+      // missing values are skipped
+      cs := make([]float64, nbins+1)
+      cn := make([]float64, nbins+1)
+      for i := 0; i < nbins; i++ {
+        cs[i+1], cn[i+1] = cs[i], cn[i]
+        if i < seq2.NBins() && !math.IsNaN(seq2.AtBin(i)) {
+          cs[i+1] += seq2.AtBin(i)
+          cn[i+1] += 1.0
+        }
+      }
+      // loop over sequence
+      for i := 0; i < nbins; i++ {
+        x := seq1.AtBin(i)
+        if math.IsNaN(x) {
+          seq3.SetBin(i, math.NaN()); continue
+        }
+        lambda := lambdaBg
+        if i < seq2.NBins() && !math.IsNaN(seq2.AtBin(i)) {
+          lambda = math.Max(lambda, scale*seq2.AtBin(i))
+        }
+        for _, w := range windows {
+          i1 := i-w/2
+          i2 := i+w/2+1
+          if i1 < 0 {
+            i1 = 0
+          }
+          if i2 > nbins {
+            i2 = nbins
+          }
+          if n := cn[i2]-cn[i1]; n > 0.0 {
+            lambda = math.Max(lambda, scale*(cs[i2]-cs[i1])/n)
+          }
+        }
+        // -log10 p-value
+        s := -poisson_log_upper_tail(math.Floor(x+0.5), lambda)/math.Ln10
+        // apply logistic function
+        seq3.SetBin(i, 1.0/(1.0 + math.Exp(-a*s-b)))
+      }
+      return nil
+    })
+  }
+  pool.Wait(group)
+}
+
+func enrichment_eval_control(config ConfigModHmm, files EnrichmentFiles) {
+  if !config.EnrichmentControlRatio(files.Feature) {
+    // no control-ratio model for this feature
+    enrichment_eval_heuristic(config, files); return
+  }
+  if !FileExists(files.Control.Filename) {
+    printStderr(config, 1, "Warning: control coverage `%s' does not exist. Using heuristic method for feature `%s'.\n", files.Control.Filename, files.Feature)
+    enrichment_eval_heuristic(config, files); return
+  }
+  if config.ControlRatioThreshold <= 0.0 {
+    log.Fatalf("invalid control ratio threshold `%v'", config.ControlRatioThreshold)
+  }
+  data    := enrichment_import_heuristic(config, files)
+  control := enrichment_import_heuristic(config, EnrichmentFiles{Feature: "control", Coverage: files.Control})
+  result  := AllocSimpleTrack("classification", data.GetGenome(), data.GetBinSize())
+
+  scale, err := enrichment_control_scale(data, control); if err != nil {
+    log.Fatal(err)
+  }
+  lambdaBg := enrichment_control_lambda_bg(data)
+
+  printStderr(config, 1, "Control scaling factor: %f, background lambda: %f\n", scale, lambdaBg)
+
+  enrichment_eval_control_loop(config, result, data, control, scale, lambdaBg)
+
+  if err := ExportTrack(config.SessionConfig, result, files.Probabilities.Filename); err != nil {
+    log.Fatal(err)
+  }
+}
@@ -0,0 +1,123 @@
+/* Copyright (C) 2020 Philipp Benner
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+/* -------------------------------------------------------------------------- */
+
+import   "io/ioutil"
+import   "math"
+import   "path/filepath"
+import   "testing"
+
+import . "github.com/pbenner/gonetics"
+
+import . "github.com/pbenner/modhmm/config"
+
+/* -------------------------------------------------------------------------- */
+
+func TestPoissonUpperTail(t *testing.T) {
+  for _, lambda := range []float64{0.5, 4.0, 30.0} {
+    for _, k := range []float64{1, 3, 10, 50} {
+      // sum of the upper tail
+      s := 0.0
+      for j := k; j < 1000.0; j++ {
+        g, _ := math.Lgamma(j+1.0)
+        s += math.Exp(j*math.Log(lambda) - lambda - g)
+      }
+      if r := poisson_log_upper_tail(k, lambda); math.Abs(r - math.Log(s)) > 1e-8*math.Max(1.0, math.Abs(r)) {
+        t.Errorf("test failed for k=%f and lambda=%f: %f != %f", k, lambda, r, math.Log(s))
+      }
+    }
+  }
+  if poisson_log_upper_tail(0.0, 2.0) != 0.0 || !math.IsInf(poisson_log_upper_tail(1.0, 0.0), -1) {
+    t.Error("test failed")
+  }
+}
+
+func TestEnrichmentControl(t *testing.T) {
+  config := DefaultModHmmConfig()
+  config.ControlRatioThreshold = 5.0
+  config.ControlRatioWindows   = []int{1000}
+
+  genome  := NewGenome([]string{"chr1"}, []int{20000})
+  data    := AllocSimpleTrack("data",    genome, 100)
+  control := AllocSimpleTrack("control", genome, 100)
+  result  := AllocSimpleTrack("result",  genome, 100)
+  seq1, _ := data   .GetMutableSequence("chr1")
+  seq2, _ := control.GetMutableSequence("chr1")
+  for i := 0; i < seq1.NBins(); i++ {
+    seq1.SetBin(i, 2.0)
+    seq2.SetBin(i, 1.0)
+  }
+  // identical peaks, where the second lies within a region of high control
+  // coverage
+  seq1.SetBin( 50, 30.0)
+  seq1.SetBin(150, 30.0)
+  for i := 145; i < 155; i++ {
+    seq2.SetBin(i, 20.0)
+  }
+  seq1.SetBin(10, math.NaN())
+
+  scale, err := enrichment_control_scale(data, control); if err != nil {
+    t.Fatal(err)
+  }
+  lambdaBg := enrichment_control_lambda_bg(data)
+  enrichment_eval_control_loop(config, result, data, control, scale, lambdaBg)
+
+  seq3, _ := result.GetSequence("chr1")
+  if p := seq3.AtBin(50); p < 0.99 {
+    t.Errorf("test failed: %f", p)
+  }
+  if p := seq3.AtBin(150); p > 0.01 {
+    t.Errorf("test failed: %f", p)
+  }
+  if p := seq3.AtBin(100); p > 0.01 {
+    t.Errorf("test failed: %f", p)
+  }
+  if !math.IsNaN(seq3.AtBin(10)) {
+    t.Error("test failed")
+  }
+}
+
+func TestEnrichmentControlParameters(t *testing.T) {
+  dir, cleanup := testTempDir(t)
+  defer cleanup()
+
+  config := DefaultModHmmConfig()
+  target := TargetFile{Filename: filepath.Join(dir, "h3k27ac.bw")}
+  if err := ioutil.WriteFile(target.Filename, []byte{}, 0666); err != nil {
+    t.Fatal(err)
+  }
+  // switching the method requires an update of probabilities
+  config.EnrichmentMethod = "control-ratio"
+  if !updateRequiredParameters(config, target, enrichment_parameters("h3k27ac")) {
+    t.Error("test failed")
+  }
+  saveTargetParameters(config, target, enrichment_parameters("h3k27ac"))
+  if updateRequiredParameters(config, target, enrichment_parameters("h3k27ac")) {
+    t.Error("test failed")
+  }
+  c1 := config
+  c1.ControlRatioThreshold = 3.0
+  c2 := config
+  c2.ControlRatioWindows = []int{5000}
+  for _, c := range []ConfigModHmm{c1, c2} {
+    if !updateRequiredParameters(c, target, enrichment_parameters("h3k27ac")) {
+      t.Error("test failed")
+    }
+  }
+}
@@ -0,0 +1,452 @@
+/* Copyright (C) 2020 Philipp Benner
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+/* -------------------------------------------------------------------------- */
+
+import   "fmt"
+import   "log"
+import   "math"
+import   "os"
+import   "strconv"
+import   "strings"
+
+import . "github.com/pbenner/autodiff"
+import . "github.com/pbenner/autodiff/logarithmetic"
+import   "github.com/pbenner/autodiff/statistics/scalarDistribution"
+
+import . "github.com/pbenner/modhmm/config"
+
+import   "github.com/pborman/getopt"
+
+import   "gonum.org/v1/plot"
+import   "gonum.org/v1/plot/plotter"
+import   "gonum.org/v1/plot/plotutil"
+import   "gonum.org/v1/plot/vg"
+
+/* Goodness-of-fit diagnostics of enrichment mixture models. The mixture
+ * distribution is compared to the histogram of coverage values (Counts)
+ * using the Kolmogorov-Smirnov distance and a chi-square statistic, where
+ * cells are pooled until the expected count is at least five. Since both
+ * statistics become significant for any misfit on genome-wide data, the
+ * chi-square statistic is also reported as effect size w = sqrt(X^2/n).
+ * -------------------------------------------------------------------------- */
+
+type diagnosticsThresholds struct {
+  MaxKS            float64
+  MaxW             float64
+  MinForeground    float64
+  MaxForeground    float64
+  MinWeight        float64
+}
+
+type diagnosticsComponent struct {
+  Component  int
+  Type       string
+  Weight     float64
+  Posterior  float64
+  Mean       float64
+  Foreground bool
+}
+
+type enrichmentDiagnostics struct {
+  Feature             string
+  N                   float64
+  LogLikelihood       float64
+  BIC                 float64
+  KS                  float64
+  ChiSquare           float64
+  ChiSquareDf         int
+  W                   float64
+  ForegroundPrior     float64
+  ForegroundPosterior float64
+  Components          []diagnosticsComponent
+  Warnings            []string
+  // observed and expected counts at integer coverage values, and model
+  // cumulative distribution function
+  observed            []float64
+  expected            []float64
+  cdf                 []float64
+}
+
+/* -------------------------------------------------------------------------- */
+
+func enrichment_diagnose(mixture *scalarDistribution.Mixture, k_fg []int, counts Counts, thresholds diagnosticsThresholds) enrichmentDiagnostics {
+  r := enrichmentDiagnostics{}
+  c := compute_mixture_criteria(mixture, counts)
+  r.LogLikelihood = c.LogLikelihood
+  r.BIC           = c.BIC
+
+  fg := make([]bool, mixture.NComponents())
+  for _, k := range k_fg {
+    fg[k] = true
+  }
+  // observed counts at integer coverage values
+  x_max := 0
+  for i := range counts.X {
+    if x := int(math.Floor(counts.X[i]+0.5)); x > x_max {
+      x_max = x
+    }
+  }
+  r.observed = make([]float64, x_max+1)
+  for i := range counts.X {
+    if x := int(math.Floor(counts.X[i]+0.5)); x >= 0 {
+      r.observed[x] += float64(counts.Y[i])
+      r.N           += float64(counts.Y[i])
+    }
+  }
+  // model probabilities and posterior masses of components
+  t  := NullFloat64()
+  lp := make([]float64, mixture.NComponents())
+  pm := make([]float64, mixture.NComponents())
+  r.expected = make([]float64, x_max+1)
+  r.cdf      = make([]float64, x_max+1)
+  for x := 0; x <= x_max; x++ {
+    s := math.Inf(-1)
+    for k := 0; k < mixture.NComponents(); k++ {
+      if err := mixture.Edist[k].LogPdf(t, ConstFloat64(x)); err != nil {
+        log.Fatal(err)
+      }
+      lp[k] = mixture.LogWeights.Float64At(k) + t.GetFloat64()
+      s     = LogAdd(s, lp[k])
+    }
+    r.expected[x] = r.N*math.Exp(s)
+    r.cdf     [x] = math.Exp(s)
+    if x > 0 {
+      r.cdf[x] += r.cdf[x-1]
+    }
+    if r.observed[x] > 0.0 && !math.IsInf(s, -1) {
+      for k := range lp {
+        tau := math.Exp(lp[k]-s)
+        pm[k] += r.observed[x]*tau
+        if fg[k] {
+          r.ForegroundPosterior += r.observed[x]*tau
+        }
+      }
+    }
+  }
+  r.ForegroundPosterior /= r.N
+  // Kolmogorov-Smirnov distance
+  s := 0.0
+  for x := 0; x <= x_max; x++ {
+    s   += r.observed[x]
+    r.KS = math.Max(r.KS, math.Abs(s/r.N - r.cdf[x]))
+  }
+  // chi-square statistic, where the last cell also contains the tail
+  // probability of the model
+  o, e  := 0.0, 0.0
+  cells := 0
+  for x := 0; x <= x_max; x++ {
+    o += r.observed[x]
+    e += r.expected[x]
+    if x == x_max {
+      e += r.N*math.Max(1.0 - r.cdf[x_max], 0.0)
+    }
+    if e >= 5.0 || x == x_max {
+      if e > 0.0 {
+        r.ChiSquare += (o-e)*(o-e)/e
+        cells++
+      }
+      o, e = 0.0, 0.0
+    }
+  }
+  r.ChiSquareDf = cells - 1 - c.NParameters
+  if r.ChiSquareDf < 1 {
+    r.ChiSquareDf = 1
+  }
+  r.W = math.Sqrt(r.ChiSquare/r.N)
+  // component table
+  for k := 0; k < mixture.NComponents(); k++ {
+    d := diagnosticsComponent{}
+    d.Component  = k+1
+    d.Type       = mixtureComponentType(mixture.Edist[k])
+    d.Weight     = math.Exp(mixture.LogWeights.Float64At(k))
+    d.Posterior  = pm[k]/r.N
+    d.Mean       = mixtureComponentMean(mixture.Edist[k])
+    d.Foreground = fg[k]
+    if fg[k] {
+      r.ForegroundPrior += d.Weight
+    }
+    r.Components = append(r.Components, d)
+  }
+  // warnings
+  if r.KS > thresholds.MaxKS {
+    r.Warnings = append(r.Warnings, fmt.Sprintf("KS distance %f exceeds threshold %f", r.KS, thresholds.MaxKS))
+  }
+  if r.W > thresholds.MaxW {
+    r.Warnings = append(r.Warnings, fmt.Sprintf("chi-square effect size %f exceeds threshold %f", r.W, thresholds.MaxW))
+  }
+  if r.ForegroundPosterior < thresholds.MinForeground {
+    r.Warnings = append(r.Warnings, fmt.Sprintf("posterior foreground fraction %f is below %f", r.ForegroundPosterior, thresholds.MinForeground))
+  }
+  if r.ForegroundPosterior > thresholds.MaxForeground {
+    r.Warnings = append(r.Warnings, fmt.Sprintf("posterior foreground fraction %f is above %f", r.ForegroundPosterior, thresholds.MaxForeground))
+  }
+  for _, d := range r.Components {
+    if d.Weight < thresholds.MinWeight {
+      r.Warnings = append(r.Warnings, fmt.Sprintf("component %d has negligible weight %e", d.Component, d.Weight))
+    }
+  }
+  if len(k_fg) == 0 {
+    r.Warnings = append(r.Warnings, "no foreground components")
+  }
+  if len(k_fg) == mixture.NComponents() {
+    r.Warnings = append(r.Warnings, "no background components")
+  }
+  return r
+}
+
+/* -------------------------------------------------------------------------- */
+
+func enrichment_diagnose_print(r enrichmentDiagnostics) {
+  fmt.Printf("Diagnostics for feature `%s'\n", r.Feature)
+  fmt.Printf(": Number of bins               : %.0f\n", r.N)
+  fmt.Printf(": Log-likelihood               : %f\n", r.LogLikelihood)
+  fmt.Printf(": BIC                          : %f\n", r.BIC)
+  fmt.Printf(": KS distance                  : %f\n", r.KS)
+  fmt.Printf(": Chi-square (df)              : %f (%d)\n", r.ChiSquare, r.ChiSquareDf)
+  fmt.Printf(": Chi-square effect size (w)   : %f\n", r.W)
+  fmt.Printf(": Foreground fraction (prior)  : %f\n", r.ForegroundPrior)
+  fmt.Printf(": Foreground fraction (post.)  : %f\n", r.ForegroundPosterior)
+  fmt.Printf(":  # %-9s %12s %12s %12s\n", "Type", "Weight", "Posterior", "Mean")
+  for _, d := range r.Components {
+    fmt.Printf(": %2d %-9s %12e %12e %12e", d.Component, d.Type, d.Weight, d.Posterior, d.Mean)
+    if d.Foreground {
+      fmt.Printf(" [foreground]\n")
+    } else {
+      fmt.Printf(" [background]\n")
+    }
+  }
+  for _, w := range r.Warnings {
+    fmt.Printf("Warning: %s\n", w)
+  }
+  fmt.Println()
+}
+
+/* -------------------------------------------------------------------------- */
+
+// Hanging rootogram bars, which hang from the square root of the expected
+// counts and have the square root of the observed counts as length
+type rootogramBars struct {
+  plotter.XYs
+  plotter.YErrors
+}
+
+func enrichment_diagnose_plot_axes(config ConfigModHmm, p *plot.Plot) {
+  p.Title .Font.Size       = vg.Length(config.FontSize)
+  p.Legend.Font.Size       = vg.Length(config.FontSize)
+  p.X.Label.Font.Size      = vg.Length(config.FontSize)
+  p.Y.Label.Font.Size      = vg.Length(config.FontSize)
+  p.X.Tick.Label.Font.Size = vg.Length(config.FontSize)
+  p.Y.Tick.Label.Font.Size = vg.Length(config.FontSize)
+}
+
+// Largest coverage value shown in plots
+func enrichment_diagnose_plot_xmax(config ConfigModHmm, r enrichmentDiagnostics) int {
+  if config.XLim[1] != 0 {
+    return int(math.Min(config.XLim[1], float64(len(r.observed)-1)))
+  }
+  s := 0.0
+  for x := range r.observed {
+    if s += r.observed[x]; s >= 0.999*r.N {
+      return x
+    }
+  }
+  return len(r.observed)-1
+}
+
+func enrichment_diagnose_plot_rootogram(config ConfigModHmm, r enrichmentDiagnostics) *plot.Plot {
+  p, err := plot.New()
+  if err != nil {
+    log.Fatal(err)
+  }
+  p.Title.Text   = fmt.Sprintf("%s (hanging rootogram)", r.Feature)
+  p.Legend.Top   = true
+  p.X.Label.Text = "coverage value"
+  p.Y.Label.Text = "sqrt(frequency)"
+  enrichment_diagnose_plot_axes(config, p)
+
+  x_max := enrichment_diagnose_plot_xmax(config, r)
+  bars  := rootogramBars{}
+  line  := plotter.XYs{}
+  zero  := plotter.XYs{{float64(0), 0.0}, {float64(x_max), 0.0}}
+  for x := int(config.XLim[0]); x <= x_max; x++ {
+    e := math.Sqrt(r.expected[x])
+    o := math.Sqrt(r.observed[x])
+    bars.XYs     = append(bars.XYs    , plotter.XY{float64(x), e - o/2.0})
+    bars.YErrors = append(bars.YErrors, struct{ Low, High float64 }{o/2.0, o/2.0})
+    line         = append(line        , plotter.XY{float64(x), e})
+  }
+  if b, err := plotter.NewYErrorBars(bars); err != nil {
+    log.Fatal("plotting rootogram failed: ", err)
+  } else {
+    b.Color = plotutil.SoftColors[0]
+    b.Width = vg.Points(3)
+    b.CapWidth = 0
+    p.Add(b)
+  }
+  if l, err := plotter.NewLine(zero); err != nil {
+    log.Fatal("plotting rootogram failed: ", err)
+  } else {
+    p.Add(l)
+  }
+  plotutil.DefaultColors = plotutil.SoftColors[1:]
+  if err := plotutil.AddLines(p, "expected", line); err != nil {
+    log.Fatal("plotting rootogram failed: ", err)
+  }
+  return p
+}
+
+func enrichment_diagnose_plot_qq(config ConfigModHmm, r enrichmentDiagnostics) *plot.Plot {
+  p, err := plot.New()
+  if err != nil {
+    log.Fatal(err)
+  }
+  p.Title.Text   = fmt.Sprintf("%s (QQ plot)", r.Feature)
+  p.Legend.Top   = true
+  p.Legend.Left  = true
+  p.X.Label.Text = "model quantile"
+  p.Y.Label.Text = "empirical quantile"
+  enrichment_diagnose_plot_axes(config, p)
+
+  // smallest coverage value with F(x) >= q
+  quantile := func(f func(int) float64, q float64) float64 {
+    for x := range r.observed {
+      if f(x) >= q {
+        return float64(x)
+      }
+    }
+    return float64(len(r.observed)-1)
+  }
+  ecdf := make([]float64, len(r.observed))
+  for x := range r.observed {
+    ecdf[x] = r.observed[x]/r.N
+    if x > 0 {
+      ecdf[x] += ecdf[x-1]
+    }
+  }
+  xy := plotter.XYs{}
+  for i := 1; i < 1000; i++ {
+    q := float64(i)/1000.0
+    xy = append(xy, plotter.XY{
+      quantile(func(x int) float64 { return r.cdf[x] }, q),
+      quantile(func(x int) float64 { return ecdf [x] }, q) })
+  }
+  x_max := math.Max(xy[len(xy)-1].X, xy[len(xy)-1].Y)
+  plotutil.DefaultColors = plotutil.SoftColors
+  if err := plotutil.AddLines(p, "identity", plotter.XYs{{0.0, 0.0}, {x_max, x_max}}); err != nil {
+    log.Fatal("plotting QQ plot failed: ", err)
+  }
+  plotutil.DefaultColors = plotutil.SoftColors[1:]
+  if err := plotutil.AddScatters(p, "quantiles", xy); err != nil {
+    log.Fatal("plotting QQ plot failed: ", err)
+  }
+  return p
+}
+
+/* -------------------------------------------------------------------------- */
+
+func modhmm_enrichment_diagnose(config ConfigModHmm, feature string, thresholds diagnosticsThresholds) enrichmentDiagnostics {
+  feature = config.CoerceOpenChromatinAssay(feature)
+
+  if !EnrichmentList.Contains(strings.ToLower(feature)) {
+    log.Fatalf("unknown feature: %s", feature)
+  }
+  files   := config.EnrichmentFiles(feature)
+  mixture := ImportMixtureDistribution(config, files.Model.Filename)
+  k, _    := ImportComponents(config, files.Components.Filename, mixture.NComponents())
+  counts  := ImportCounts(config, files.CoverageCnts.Filename)
+
+  r := enrichment_diagnose(mixture, k, counts, thresholds)
+  r.Feature = feature
+
+  for _, w := range r.Warnings {
+    printStderr(config, 1, "Warning: enrichment model of feature `%s' is suspect: %s\n", feature, w)
+  }
+  return r
+}
+
+func modhmm_enrichment_diagnose_loop(config ConfigModHmm, features []string, thresholds diagnosticsThresholds, save string) {
+  plots := [][]*plot.Plot{}
+  for _, feature := range features {
+    r := modhmm_enrichment_diagnose(config, feature, thresholds)
+    enrichment_diagnose_print(r)
+    if save != "" {
+      plots = append(plots, []*plot.Plot{
+        enrichment_diagnose_plot_rootogram(config, r),
+        enrichment_diagnose_plot_qq       (config, r) })
+    }
+  }
+  if save != "" && len(plots) > 0 {
+    if _, err := plot_result(plots, save); err != nil {
+      log.Fatal(err)
+    }
+  }
+}
+
+/* -------------------------------------------------------------------------- */
+
+func modhmm_enrichment_diagnose_main(config ConfigModHmm, args []string) {
+
+  options := getopt.New()
+  options.SetProgram(fmt.Sprintf("%s diagnose-enrichment-model", os.Args[0]))
+  options.SetParameters("[FEATURE]...\n")
+
+  optSave      := options.StringLong("save",           0 , "",      "save rootogram and QQ plots to file (png or pdf)")
+  optXlim      := options.StringLong("xlim",           0 , "",      "range of the x-axis of rootograms (e.g. 0-100)")
+  optMaxKS     := options.StringLong("max-ks",         0 , "0.02",  "warn if the KS distance exceeds this value")
+  optMaxW      := options.StringLong("max-w",          0 , "0.1",   "warn if the chi-square effect size exceeds this value")
+  optMinFg     := options.StringLong("min-foreground", 0 , "0.001", "warn if the posterior foreground fraction is below this value")
+  optMaxFg     := options.StringLong("max-foreground", 0 , "0.5",   "warn if the posterior foreground fraction is above this value")
+  optMinWeight := options.StringLong("min-weight",     0 , "1e-5",  "warn if a component has a weight below this value")
+  optHelp      := options.  BoolLong("help",          'h',          "print help")
+
+  options.Parse(args)
+
+  // command options
+  if *optHelp {
+    options.PrintUsage(os.Stdout)
+    os.Exit(0)
+  }
+  parse := func(name, str string) float64 {
+    v, err := strconv.ParseFloat(str, 64); if err != nil {
+      log.Fatalf("invalid value for option --%s: %v", name, err)
+    }
+    return v
+  }
+  thresholds := diagnosticsThresholds{}
+  thresholds.MaxKS         = parse("max-ks"        , *optMaxKS)
+  thresholds.MaxW          = parse("max-w"         , *optMaxW)
+  thresholds.MinForeground = parse("min-foreground", *optMinFg)
+  thresholds.MaxForeground = parse("max-foreground", *optMaxFg)
+  thresholds.MinWeight     = parse("min-weight"    , *optMinWeight)
+
+  if *optXlim != "" {
+    r := strings.Split(*optXlim, "-")
+    if len(r) != 2 {
+      options.PrintUsage(os.Stdout)
+      os.Exit(1)
+    }
+    config.XLim[0] = parse("xlim", r[0])
+    config.XLim[1] = parse("xlim", r[1])
+  }
+  if len(options.Args()) == 0 {
+    modhmm_enrichment_diagnose_loop(config, EnrichmentList, thresholds, *optSave)
+  } else {
+    modhmm_enrichment_diagnose_loop(config, options.Args(), thresholds, *optSave)
+  }
+}
@@ -0,0 +1,71 @@
+/* Copyright (C) 2020 Philipp Benner
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+/* -------------------------------------------------------------------------- */
+
+import   "math"
+import   "testing"
+
+import . "github.com/pbenner/autodiff"
+import . "github.com/pbenner/autodiff/statistics"
+
+/* -------------------------------------------------------------------------- */
+
+// Expected counts of n observations drawn from a distribution
+func testExpectedCounts(t *testing.T, pdf ScalarPdf, n float64) Counts {
+  r := Counts{}
+  s := NullFloat64()
+  for x := 0; x < 200; x++ {
+    if err := pdf.LogPdf(s, ConstFloat64(float64(x))); err != nil {
+      t.Fatal(err)
+    }
+    if y := int(math.Floor(n*math.Exp(s.GetFloat64()) + 0.5)); y > 0 {
+      r.X = append(r.X, float64(x))
+      r.Y = append(r.Y, y)
+    }
+  }
+  return r
+}
+
+/* -------------------------------------------------------------------------- */
+
+func TestEnrichmentDiagnose(t *testing.T) {
+  thresholds := diagnosticsThresholds{MaxKS: 0.05, MaxW: 0.1, MinForeground: 0.01, MaxForeground: 0.5, MinWeight: 1e-4}
+  mixture    := testMixture(t, []float64{0.6, 0.3, 0.1}, testDeltaPdf(t, 0.0), testPoissonPdf(t, 2.0), testPoissonPdf(t, 20.0))
+
+  // data drawn from the model
+  r := enrichment_diagnose(mixture, []int{2}, testExpectedCounts(t, mixture, 1e6), thresholds)
+  if r.KS > 1e-4 || r.W > 1e-2 || len(r.Warnings) != 0 {
+    t.Errorf("test failed: %v", r)
+  }
+  if math.Abs(r.ForegroundPrior - 0.1) > 1e-8 || math.Abs(r.ForegroundPosterior - 0.1) > 1e-3 {
+    t.Errorf("test failed: %v", r)
+  }
+  if len(r.Components) != 3 || r.Components[1].Type != "Poisson" || math.Abs(r.Components[2].Mean - 20.0) > 1e-8 || !r.Components[2].Foreground {
+    t.Errorf("test failed: %v", r.Components)
+  }
+  // data that does not fit the model
+  r = enrichment_diagnose(mixture, []int{2}, testExpectedCounts(t, testPoissonPdf(t, 8.0), 1e6), thresholds)
+  if r.KS < 0.1 || r.W < 0.1 || len(r.Warnings) < 2 {
+    t.Errorf("test failed: %v", r)
+  }
+  // no foreground or background components
+  if r := enrichment_diagnose(mixture, []int{}, testExpectedCounts(t, mixture, 1e6), thresholds); len(r.Warnings) != 2 {
+    t.Errorf("test failed: %v", r.Warnings)
+  }
+}
@@ -19,15 +19,19 @@ package main
 /* -------------------------------------------------------------------------- */
 
 import   "fmt"
+import   "io"
 import   "log"
+import   "math"
 import   "math/rand"
 import   "os"
 import   "sort"
 import   "strconv"
 import   "strings"
 
+import . "github.com/pbenner/ngstat/config"
 import . "github.com/pbenner/ngstat/estimation"
 
+import . "github.com/pbenner/autodiff"
 import . "github.com/pbenner/autodiff/statistics"
 import   "github.com/pbenner/autodiff/statistics/scalarDistribution"
 import   "github.com/pbenner/autodiff/statistics/scalarEstimator"
@@ -35,6 +39,7 @@ import   "github.com/pbenner/autodiff/statistics/vectorDistribution"
 import   "github.com/pbenner/autodiff/statistics/vectorEstimator"
 
 import . "github.com/pbenner/gonetics"
+import   "github.com/pbenner/threadpool"
 
 import . "github.com/pbenner/modhmm/config"
 import . "github.com/pbenner/modhmm/utility"
@@ -74,8 +79,13 @@ func distToValue(dist ScalarPdf) (int, float64) {
     return 1, a.GetParameters().Float64At(0)
   case *scalarDistribution.PdfTranslation:
     return distToValue(a.ScalarPdf)
+  case *ZeroInflatedNegativeBinomialDistribution:
+    // sort by mean of the negative binomial
+    return 2, a.R.GetFloat64()*a.P.GetFloat64()/(1.0-a.P.GetFloat64())
+  case *scalarDistribution.NegativeBinomialDistribution:
+    return 3, a.R.GetFloat64()*a.P.GetFloat64()/(1.0-a.P.GetFloat64())
   case *scalarDistribution.GeometricDistribution:
-    return 2, -a.GetParameters().Float64At(0)
+    return 4, -a.GetParameters().Float64At(0)
   default:
     panic("internal error")
   }
@@ -83,33 +93,110 @@ func distToValue(dist ScalarPdf) (int, float64) {
 
 /* -------------------------------------------------------------------------- */
 
-func newEstimator(config ConfigModHmm, n_delta, n_poisson, n_geometric int) VectorEstimator {
+// Number of mixture components of each type
+type mixtureComponents struct {
+  Delta        int
+  Poisson      int
+  ZeroInflated int
+  NegBin       int
+  Geometric    int
+}
+
+// Parse component specification, e.g. `delta:1,poisson:2,negbin:3'
+func parseMixtureComponents(str string) (mixtureComponents, error) {
+  r := mixtureComponents{}
+  for _, item := range strings.Split(str, ",") {
+    fields := strings.Split(strings.TrimSpace(item), ":")
+    if len(fields) != 2 {
+      return r, fmt.Errorf("invalid component specification `%s'", item)
+    }
+    n, err := strconv.ParseInt(fields[1], 10, 64); if err != nil || n < 0 {
+      return r, fmt.Errorf("invalid number of components in `%s'", item)
+    }
+    switch strings.ToLower(fields[0]) {
+    case "delta"    : r.Delta        += int(n)
+    case "poisson"  : r.Poisson      += int(n)
+    case "zinb"     : r.ZeroInflated += int(n)
+    case "negbin"   : r.NegBin       += int(n)
+    case "geometric": r.Geometric    += int(n)
+    default:
+      return r, fmt.Errorf("invalid component type `%s' [delta, poisson, zinb, negbin, geometric]", fields[0])
+    }
+  }
+  if r.Delta + r.Poisson + r.ZeroInflated + r.NegBin + r.Geometric == 0 {
+    return r, fmt.Errorf("component specification `%s' contains no components", str)
+  }
+  return r, nil
+}
+
+func (obj mixtureComponents) String() string {
+  r := []string{}
+  for i, n := range []int{obj.Delta, obj.Poisson, obj.ZeroInflated, obj.NegBin, obj.Geometric} {
+    if n > 0 {
+      r = append(r, fmt.Sprintf("%s:%d", []string{"delta", "poisson", "zinb", "negbin", "geometric"}[i], n))
+    }
+  }
+  return strings.Join(r, ",")
+}
+
+/* -------------------------------------------------------------------------- */
+
+func newEstimatorComponents(config ConfigModHmm, n mixtureComponents, rng *rand.Rand) []ScalarEstimator {
   components := []ScalarEstimator{}
-  for i := 0; i < n_delta; i++ {
+  for i := 0; i < n.Delta; i++ {
     if delta, err := scalarEstimator.NewDeltaEstimator(float64(i)); err != nil {
       log.Fatal(err)
     } else {
       components = append(components, delta)
     }
   }
-  for i := 0; i < n_poisson; i++ {
-    if poisson, err := scalarEstimator.NewPoissonEstimator(rand.Float64()); err != nil {
+  for i := 0; i < n.Poisson; i++ {
+    if poisson, err := scalarEstimator.NewPoissonEstimator(rng.Float64()); err != nil {
+      log.Fatal(err)
+    } else {
+      if t, err := scalarEstimator.NewTranslationEstimator(poisson, -float64(n.Delta)); err != nil {
+        log.Fatal(err)
+      } else {
+        components = append(components, t)
+      }
+    }
+  }
+  for i := 0; i < n.ZeroInflated; i++ {
+    if zinb, err := newZeroInflatedNegativeBinomialEstimator(0.5*rng.Float64(), 1.0+rng.Float64(), rng.Float64()); err != nil {
       log.Fatal(err)
     } else {
-      if t, err := scalarEstimator.NewTranslationEstimator(poisson, -float64(n_delta)); err != nil {
+      if t, err := scalarEstimator.NewTranslationEstimator(zinb, -float64(n.Delta)); err != nil {
         log.Fatal(err)
       } else {
         components = append(components, t)
       }
     }
   }
-  for i := 0; i < n_geometric; i++ {
-    if geometric, err := scalarEstimator.NewGeometricEstimator(0.01*rand.Float64()); err != nil {
+  for i := 0; i < n.NegBin; i++ {
+    if negbin, err := newNegativeBinomialEstimator(1.0+rng.Float64(), rng.Float64()); err != nil {
+      log.Fatal(err)
+    } else {
+      if t, err := scalarEstimator.NewTranslationEstimator(negbin, -float64(n.Delta)); err != nil {
+        log.Fatal(err)
+      } else {
+        components = append(components, t)
+      }
+    }
+  }
+  for i := 0; i < n.Geometric; i++ {
+    if geometric, err := scalarEstimator.NewGeometricEstimator(0.01*rng.Float64()); err != nil {
       log.Fatal(err)
     } else {
       components = append(components, geometric)
     }
   }
+  return components
+}
+
+// Mixture estimator for discrete data, which summarizes observations by
+// unique values
+func newEstimator(config ConfigModHmm, n mixtureComponents, rng *rand.Rand) VectorEstimator {
+  components := newEstimatorComponents(config, n, rng)
   if mixture, err := scalarEstimator.NewDiscreteMixtureEstimator(nil, components, 1e-8, -1); err != nil {
     log.Fatal(err)
   } else {
@@ -122,46 +209,268 @@ func newEstimator(config ConfigModHmm, n_delta, n_poisson, n_geometric int) Vect
   return nil
 }
 
+// Mixture estimator for weighted observations, used for estimating the
+// mixture on the histogram of coverage values
+func newHistogramEstimator(config ConfigModHmm, n mixtureComponents, rng *rand.Rand) VectorEstimator {
+  components := newEstimatorComponents(config, n, rng)
+  if mixture, err := scalarEstimator.NewMixtureEstimator(nil, components, 1e-8, -1); err != nil {
+    log.Fatal(err)
+  } else {
+    if estimator, err := vectorEstimator.NewScalarIid(mixture, -1); err != nil {
+      log.Fatal(err)
+    } else {
+      return estimator
+    }
+  }
+  return nil
+}
+
 /* -------------------------------------------------------------------------- */
 
-func enrichment_estimate(config ConfigModHmm, track Track, estimator VectorEstimator, files EnrichmentFiles) {
-  if err := EstimateOnSingleTrack(config.SessionConfig, estimator, track); err != nil {
-    log.Fatal(err)
+// Estimate mixture with weighted EM on the histogram of coverage values,
+// which is equivalent to estimating the mixture on the full track. Since
+// the EM implementation performs a single step when observations are
+// weighted, the iteration is performed here
+func enrichment_estimate_on_counts(config ConfigModHmm, estimator VectorEstimator, counts Counts) error {
+  if config.EnrichmentModelMaxIter <= 0 {
+    return fmt.Errorf("invalid maximum number of iterations `%d'", config.EnrichmentModelMaxIter)
+  }
+  x := NullDenseFloat64Vector(len(counts.X))
+  w := NullDenseFloat64Vector(len(counts.X))
+  for i := range counts.X {
+    x[i] = counts.X[i]
+    w[i] = math.Log(float64(counts.Y[i]))
+  }
+  pool := threadpool.New(config.Threads, config.Threads*1000)
+  if err := estimator.SetData([]ConstVector{x}, 1); err != nil {
+    return err
+  }
+  logLikOld := math.Inf(-1)
+  for i := 1; ; i++ {
+    if i > config.EnrichmentModelMaxIter {
+      printStderr(config, 1, "Warning: EM did not converge within %d iterations\n", config.EnrichmentModelMaxIter)
+      break
+    }
+    if err := estimator.Estimate(w, pool); err != nil {
+      return err
+    }
+    d, err := estimator.GetEstimate(); if err != nil {
+      return err
+    }
+    mixture   := d.(*vectorDistribution.ScalarIid).Distribution.(*scalarDistribution.Mixture)
+    logLikNew := compute_mixture_criteria(mixture, counts).LogLikelihood
+    if config.Verbose > 1 {
+      printStderr(config, 2, "EM step %d: log-likelihood %f\n", i, logLikNew)
+    }
+    // check convergence (and cycles)
+    if !(logLikNew - logLikOld >= 1e-8) {
+      break
+    }
+    logLikOld = logLikNew
+  }
+  return nil
+}
+
+// Estimate mixture on a random subsample of bins, where the number of
+// bins drawn from each sequence is proportional to its length
+func enrichment_estimate_on_subsample(config ConfigModHmm, estimator VectorEstimator, track Track, rng *rand.Rand) error {
+  if config.EnrichmentModelSample <= 0 {
+    return fmt.Errorf("invalid subsample size `%d'", config.EnrichmentModelSample)
+  }
+  n := 0
+  for _, name := range track.GetSeqNames() {
+    if seq, err := track.GetSequence(name); err != nil {
+      return err
+    } else {
+      n += seq.NBins()
+    }
+  }
+  x := []float64{}
+  for _, name := range track.GetSeqNames() {
+    seq, err := track.GetSequence(name); if err != nil {
+      return err
+    }
+    m := int(math.Floor(float64(config.EnrichmentModelSample)*float64(seq.NBins())/float64(n) + 0.5))
+    if m >= seq.NBins() {
+      // use all bins
+      for i := 0; i < seq.NBins(); i++ {
+        if v := seq.AtBin(i); !math.IsNaN(v) {
+          x = append(x, v)
+        }
+      }
+    } else {
+      for _, i := range rng.Perm(seq.NBins())[0:m] {
+        if v := seq.AtBin(i); !math.IsNaN(v) {
+          x = append(x, v)
+        }
+      }
+    }
+  }
+  return EstimateOnSingleTrackConstData(config.SessionConfig, estimator, []ConstVector{DenseFloat64Vector(x)})
+}
+
+func enrichment_estimate_mixture(config ConfigModHmm, track Track, counts Counts, n mixtureComponents, rng *rand.Rand) *scalarDistribution.Mixture {
+  var estimator VectorEstimator
+  switch strings.ToLower(config.EnrichmentModelData) {
+  case "histogram":
+    estimator = newHistogramEstimator(config, n, rng)
+    if err := enrichment_estimate_on_counts(config, estimator, counts); err != nil {
+      log.Fatal(err)
+    }
+  case "subsample":
+    estimator = newEstimator(config, n, rng)
+    if err := enrichment_estimate_on_subsample(config, estimator, track, rng); err != nil {
+      log.Fatal(err)
+    }
+  case "track":
+    estimator = newEstimator(config, n, rng)
+    if err := EstimateOnSingleTrack(config.SessionConfig, estimator, track); err != nil {
+      log.Fatal(err)
+    }
+  default:
+    log.Fatalf("invalid estimation method `%s' [histogram, subsample, track]", config.EnrichmentModelData)
   }
   if d, err := estimator.GetEstimate(); err != nil {
     log.Fatal(err)
+    panic("internal error")
   } else {
     result := d.(*vectorDistribution.ScalarIid).Distribution.(*scalarDistribution.Mixture)
 
     sort.Sort(SortableMixture{result})
 
-    printStderr(config, 1, "Exporting distribution to `%s'... ", files.Model.Filename)
-    if err := ExportDistribution(files.Model.Filename, result); err != nil {
-      printStderr(config, 1, "failed\n")
-      log.Fatal(err)
-    }
-    printStderr(config, 1, "done\n")
+    return result
+  }
+}
+
+func enrichment_export_mixture(config ConfigModHmm, mixture *scalarDistribution.Mixture, files EnrichmentFiles) {
+  printStderr(config, 1, "Exporting distribution to `%s'... ", files.Model.Filename)
+  if err := ExportDistribution(files.Model.Filename, mixture); err != nil {
+    printStderr(config, 1, "failed\n")
+    log.Fatal(err)
   }
+  printStderr(config, 1, "done\n")
+  saveTargetParameters(config, files.Model, enrichment_model_parameters)
 }
 
 /* -------------------------------------------------------------------------- */
 
-func modhmm_enrichment_estimate(config ConfigModHmm, feature string, n []int, force bool) {
-  var estimator VectorEstimator
+type mixtureRestart struct {
+  Seed          int64
+  LogLikelihood float64
+}
+
+// Summary of the EM restarts, saved alongside the mixture model
+type mixtureEstimation struct {
+  Components string
+  Seed       int64
+  Restarts   []mixtureRestart
+  // restart with the largest log-likelihood (starting at 1)
+  Selected   int
+}
+
+func (obj *mixtureEstimation) Import(reader io.Reader, args... interface{}) error {
+  return JsonImport(reader, obj)
+}
+
+func (obj *mixtureEstimation) Export(writer io.Writer) error {
+  return JsonExport(writer, obj)
+}
+
+func mixtureEstimationFilename(filenameModel string) string {
+  return strings.TrimSuffix(filenameModel, ".json") + ".estimation.json"
+}
+
+func mixture_estimation_print(estimation mixtureEstimation) {
+  fmt.Printf("Estimation with components `%s' (seed: %d)\n", estimation.Components, estimation.Seed)
+  fmt.Printf(": %8s %12s %16s\n", "Restart", "Seed", "LogLikelihood")
+  for i, r := range estimation.Restarts {
+    fmt.Printf(": %8d %12d %16.4f", i+1, r.Seed, r.LogLikelihood)
+    if i+1 == estimation.Selected {
+      fmt.Printf(" [selected]")
+    }
+    fmt.Println()
+  }
+}
+
+// Run the EM algorithm from several random initializations and keep the
+// model with the largest log-likelihood. Restart i uses seed `seed+i', so
+// that each restart can be reproduced individually.
+func enrichment_estimate_restarts(config ConfigModHmm, track Track, counts Counts, n mixtureComponents) (*scalarDistribution.Mixture, mixtureEstimation) {
+  restarts := config.EnrichmentModelRestarts
+  if restarts < 1 {
+    log.Fatalf("invalid number of restarts `%d'", restarts)
+  }
+  estimation := mixtureEstimation{Components: n.String(), Seed: config.EnrichmentModelSeed}
 
+  var best *scalarDistribution.Mixture
+  for i := 0; i < restarts; i++ {
+    seed := config.EnrichmentModelSeed + int64(i)
+    if restarts > 1 {
+      printStderr(config, 1, "EM restart %d/%d (seed: %d)...\n", i+1, restarts, seed)
+    }
+    mixture := enrichment_estimate_mixture(config, track, counts, n, rand.New(rand.NewSource(seed)))
+    logLik  := compute_mixture_criteria(mixture, counts).LogLikelihood
+    // degenerate solutions are never selected
+    if math.IsNaN(logLik) || math.IsInf(logLik, 0) {
+      logLik = -math.MaxFloat64
+    }
+    if restarts > 1 {
+      printStderr(config, 1, "EM restart %d/%d (seed: %d) has log-likelihood %f\n", i+1, restarts, seed, logLik)
+    }
+    estimation.Restarts = append(estimation.Restarts, mixtureRestart{seed, logLik})
+    if best == nil || logLik > estimation.Restarts[estimation.Selected-1].LogLikelihood {
+      best = mixture
+      estimation.Selected = i+1
+    }
+  }
+  return best, estimation
+}
+
+// Parameters of the enrichment model that are not stored in coverage files
+func enrichment_model_parameters(config ConfigModHmm) string {
+  r := fmt.Sprintf("Enrichment Model Seed: %d\nEnrichment Model Restarts: %d\n", config.EnrichmentModelSeed, config.EnrichmentModelRestarts)
+  r += fmt.Sprintf("Enrichment Model Estimation: %s\n", strings.ToLower(config.EnrichmentModelData))
+  if strings.ToLower(config.EnrichmentModelData) == "subsample" {
+    r += fmt.Sprintf("Enrichment Model Subsample Size: %d\n", config.EnrichmentModelSample)
+  }
+  if strings.ToLower(config.EnrichmentModelData) == "histogram" {
+    r += fmt.Sprintf("Enrichment Model Max Iterations: %d\n", config.EnrichmentModelMaxIter)
+  }
+  return r
+}
+
+func enrichment_export_estimation(config ConfigModHmm, estimation mixtureEstimation, files EnrichmentFiles) {
+  filename := mixtureEstimationFilename(files.Model.Filename)
+  printStderr(config, 1, "Exporting estimation summary to `%s'... ", filename)
+  if err := ExportFile(&estimation, filename); err != nil {
+    printStderr(config, 1, "failed\n")
+    log.Fatal(err)
+  }
+  printStderr(config, 1, "done\n")
+}
+
+func enrichment_estimate(config ConfigModHmm, track Track, n mixtureComponents, files EnrichmentFiles) {
+  mixture, estimation := enrichment_estimate_restarts(config, track, compute_counts(config, track), n)
+  enrichment_export_mixture   (config, mixture, files)
+  enrichment_export_estimation(config, estimation, files)
+}
+
+/* -------------------------------------------------------------------------- */
+
+func modhmm_enrichment_estimate(config ConfigModHmm, feature string, n mixtureComponents, force bool) {
   if !EnrichmentModelList.Contains(strings.ToLower(feature)) {
     log.Fatalf("unknown feature: %s", feature)
   }
   files := config.EnrichmentFiles(feature)
   var track Track
   // update model
-  if force || updateRequired(config, files.Model, files.DependenciesModel()...) {
+  if force || updateRequired(config, files.Model, files.DependenciesModel()...) || updateRequiredParameters(config, files.Model, enrichment_model_parameters) {
     if track == nil {
       track = enrichment_import_model(config, files, false)
     }
-    estimator = newEstimator(config, n[0], n[1], n[2])
+    printStderr(config, 1, "Estimating mixture model with components `%v'...\n", n)
 
-    enrichment_estimate(config, track, estimator, files)
+    enrichment_estimate(config, track, n, files)
   }
   // update counts
   if force || updateRequired(config, files.CoverageCnts, files.DependenciesModel()...) {
@@ -174,6 +483,7 @@ func modhmm_enrichment_estimate(config ConfigModHmm, feature string, n []int, fo
 
 func modhmm_enrichment_estimate_default(config ConfigModHmm, feature string, force bool, defcomp string) {
   var n, components []int
+  var m mixtureComponents
   switch strings.ToLower(defcomp) {
   case "mm10":
     switch strings.ToLower(feature) {
@@ -204,9 +514,12 @@ func modhmm_enrichment_estimate_default(config ConfigModHmm, feature string, for
   default:
     log.Fatalf("unknown default comonents specifier: %s", defcomp)
   }
+  m.Delta     = n[0]
+  m.Poisson   = n[1]
+  m.Geometric = n[2]
   // estimate mixture
   if EnrichmentModelList.Contains(strings.ToLower(feature)) {
-    modhmm_enrichment_estimate(config, feature, n, force)
+    modhmm_enrichment_estimate(config, feature, m, force)
   }
   // export foreground mixture components
   files := config.EnrichmentFiles(feature)
@@ -236,9 +549,20 @@ func modhmm_enrichment_estimate_main(config ConfigModHmm, args []string) {
   options.SetProgram(fmt.Sprintf("%s estimate-single-feature", os.Args[0]))
   options.SetParameters("[<FEATURE> [<N_DELTA> <N_POISSON> <N_GEOMETRIC>]]\n")
 
-  optDefComp := options. StringLong("default-components",  0 , "mm10", "default number of components [mm10, hg19]")
-  optForce   := options.   BoolLong("force",               0 ,         "always overwrite existing files")
-  optHelp    := options.   BoolLong("help",               'h',         "print help")
+  optComponents := options. StringLong("components",          0 , "",     "mixture components, e.g. delta:1,negbin:3 [delta, poisson, zinb, negbin, geometric]")
+  optAuto       := options.   BoolLong("auto",                0 ,         "select number of components automatically")
+  optAutoGrid   := options. StringLong("auto-grid",           0 , defaultMixtureComponentsGrid, "grid of component counts for automatic model selection")
+  optCriterion  := options. StringLong("criterion",           0 , "bic",  "model selection criterion [bic, icl]")
+  optForeground := options. StringLong("foreground",          0 , "",     "comma separated list of foreground components (starting at 1)")
+  optSelect     := options. StringLong("select-foreground",   0 , "",     "select foreground components from data [control, peaks:FILE, fraction:VALUE]")
+  optMinEnrich  := options. StringLong("min-enrichment",      0 , "2.0",  "minimal score of foreground components for --select-foreground control/peaks")
+  optDefComp    := options. StringLong("default-components",  0 , "mm10", "default number of components [mm10, hg19]")
+  optSeed       := options. StringLong("seed",                0 , "",     "seed for initializing the EM algorithm (overrides config)")
+  optRestarts   := options. StringLong("restarts",            0 , "",     "number of EM restarts, the model with the largest likelihood is kept (overrides config)")
+  optData       := options. StringLong("estimation",          0 , "",     "estimate on [histogram, subsample, track] (overrides config)")
+  optSample     := options. StringLong("subsample-size",      0 , "",     "number of bins used for --estimation subsample (overrides config)")
+  optForce      := options.   BoolLong("force",               0 ,         "always overwrite existing files")
+  optHelp       := options.   BoolLong("help",               'h',         "print help")
 
   options.Parse(args)
 
@@ -252,13 +576,73 @@ func modhmm_enrichment_estimate_main(config ConfigModHmm, args []string) {
     options.PrintUsage(os.Stderr)
     os.Exit(1)
   }
+  if (*optComponents != "" || *optForeground != "" || *optSelect != "" || *optAuto) && len(options.Args()) == 0 {
+    log.Fatal("options --components, --foreground, --select-foreground, and --auto require a feature")
+  }
+  if *optForeground != "" && *optSelect != "" {
+    log.Fatal("options --foreground and --select-foreground cannot be used together")
+  }
+  minEnrichment, err := strconv.ParseFloat(*optMinEnrich, 64); if err != nil {
+    log.Fatalf("invalid value for option --min-enrichment: %v", err)
+  }
+  if (*optComponents != "" || *optAuto) && len(options.Args()) == 4 {
+    log.Fatal("options --components and --auto cannot be used together with the number of components as arguments")
+  }
+  if *optComponents != "" && *optAuto {
+    log.Fatal("options --components and --auto cannot be used together")
+  }
+  if *optAuto && *optForeground == "" && *optSelect == "" {
+    log.Fatal("option --auto requires --select-foreground or --foreground, since the number and order of mixture components is not known in advance")
+  }
+  if *optSeed != "" {
+    if seed, err := strconv.ParseInt(*optSeed, 10, 64); err != nil {
+      log.Fatalf("invalid value for option --seed: %v", err)
+    } else {
+      config.EnrichmentModelSeed = seed
+    }
+  }
+  if *optRestarts != "" {
+    if restarts, err := strconv.ParseInt(*optRestarts, 10, 64); err != nil || restarts < 1 {
+      log.Fatalf("invalid number of restarts `%s'", *optRestarts)
+    } else {
+      config.EnrichmentModelRestarts = int(restarts)
+    }
+  }
+  if *optData != "" {
+    switch strings.ToLower(*optData) {
+    case "histogram", "subsample", "track":
+      config.EnrichmentModelData = strings.ToLower(*optData)
+    default:
+      log.Fatalf("invalid estimation method `%s' [histogram, subsample, track]", *optData)
+    }
+  }
+  if *optSample != "" {
+    if n, err := strconv.ParseInt(*optSample, 10, 64); err != nil || n < 1 {
+      log.Fatalf("invalid subsample size `%s'", *optSample)
+    } else {
+      config.EnrichmentModelSample = int(n)
+    }
+  }
+  if c := strings.ToLower(*optCriterion); c != "bic" && c != "icl" {
+    log.Fatalf("invalid model selection criterion `%s' [bic, icl]", *optCriterion)
+  }
   var feature string
   if len(options.Args()) > 0 {
     feature = config.CoerceOpenChromatinAssay(options.Args()[0])
   }
+  var foreground []int
+  if *optForeground != "" {
+    for _, str := range strings.Split(*optForeground, ",") {
+      if k, err := strconv.ParseInt(strings.TrimSpace(str), 10, 64); err != nil {
+        log.Fatalf("invalid foreground component `%s'", str)
+      } else {
+        foreground = append(foreground, int(k)-1)
+      }
+    }
+  }
 
-  switch len(options.Args()) {
-  case 4:
+  switch {
+  case len(options.Args()) == 4:
     n := []int{}
     if m, err := strconv.ParseInt(options.Args()[1], 10, 64); err != nil {
       log.Fatal(err)
@@ -275,10 +659,35 @@ func modhmm_enrichment_estimate_main(config ConfigModHmm, args []string) {
     } else {
       n = append(n, int(m))
     }
-    modhmm_enrichment_estimate(config, feature, n, *optForce)
-  case 1:
+    modhmm_enrichment_estimate(config, feature, mixtureComponents{Delta: n[0], Poisson: n[1], Geometric: n[2]}, *optForce)
+  case *optAuto:
+    if grid, err := parseMixtureComponentsGrid(*optAutoGrid); err != nil {
+      log.Fatal(err)
+    } else {
+      modhmm_enrichment_estimate_auto(config, feature, grid, *optCriterion, *optForce)
+    }
+  case *optComponents != "":
+    if n, err := parseMixtureComponents(*optComponents); err != nil {
+      log.Fatal(err)
+    } else {
+      modhmm_enrichment_estimate(config, feature, n, *optForce)
+    }
+  case len(options.Args()) == 1:
     modhmm_enrichment_estimate_default(config, feature, *optForce, *optDefComp)
-  case 0:
+  case len(options.Args()) == 0:
     modhmm_enrichment_estimate_default_all(config, *optForce, *optDefComp)
   }
+  // export user-defined foreground components
+  if len(foreground) > 0 {
+    files   := config.EnrichmentFiles(feature)
+    mixture := ImportMixtureDistribution(config, files.Model.Filename)
+    if err := Components(foreground).Check(mixture.NComponents()); err != nil {
+      log.Fatal(err)
+    }
+    ExportComponents(config, files.Components.Filename, foreground)
+  }
+  // select foreground components from data
+  if *optSelect != "" {
+    modhmm_enrichment_select(config, feature, *optSelect, minEnrichment)
+  }
 }
@@ -0,0 +1,128 @@
+/* Copyright (C) 2020 Philipp Benner
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+/* -------------------------------------------------------------------------- */
+
+import   "math"
+import   "math/rand"
+import   "testing"
+
+import . "github.com/pbenner/ngstat/config"
+
+/* -------------------------------------------------------------------------- */
+
+func TestEnrichmentModelParameters(t *testing.T) {
+  dir, cleanup := testTempDir(t)
+  defer cleanup()
+
+  config := testEnrichmentConfig(t, dir, "h3k27ac", 0.1)
+  files  := config.EnrichmentFiles("h3k27ac")
+  n      := mixtureComponents{Delta: 1, Poisson: 2}
+
+  estimation := func() mixtureEstimation {
+    r := mixtureEstimation{}
+    if err := ImportFile(&r, mixtureEstimationFilename(files.Model.Filename)); err != nil {
+      t.Fatal(err)
+    }
+    return r
+  }
+  modhmm_enrichment_estimate(config, "h3k27ac", n, false)
+  if r := estimation(); r.Seed != config.EnrichmentModelSeed || len(r.Restarts) != 1 {
+    t.Errorf("test failed: %v", r)
+  }
+  if updateRequiredParameters(config, files.Model, enrichment_model_parameters) {
+    t.Error("test failed")
+  }
+  // a new seed or number of restarts requires a new estimate
+  config.EnrichmentModelSeed     = 7
+  config.EnrichmentModelRestarts = 2
+  if !updateRequiredParameters(config, files.Model, enrichment_model_parameters) {
+    t.Error("test failed")
+  }
+  modhmm_enrichment_estimate(config, "h3k27ac", n, false)
+  if r := estimation(); r.Seed != 7 || len(r.Restarts) != 2 {
+    t.Errorf("test failed: %v", r)
+  }
+}
+
+func TestEnrichmentModelEstimation(t *testing.T) {
+  dir, cleanup := testTempDir(t)
+  defer cleanup()
+
+  config := testEnrichmentConfig(t, dir, "h3k27ac", 0.1)
+  files  := config.EnrichmentFiles("h3k27ac")
+  track  := enrichment_import_model(config, files, false)
+  counts := compute_counts(config, track)
+  n      := mixtureComponents{Delta: 1, Poisson: 2, Geometric: 1}
+
+  // estimates on the histogram and on the full track are equivalent
+  config.EnrichmentModelData = "histogram"
+  m1 := enrichment_estimate_mixture(config, track, counts, n, rand.New(rand.NewSource(1)))
+  config.EnrichmentModelData = "track"
+  m2 := enrichment_estimate_mixture(config, track, counts, n, rand.New(rand.NewSource(1)))
+  l1 := compute_mixture_criteria(m1, counts).LogLikelihood
+  l2 := compute_mixture_criteria(m2, counts).LogLikelihood
+  if math.Abs(l1-l2) > 1e-4*math.Abs(l1) {
+    t.Errorf("test failed: %f != %f", l1, l2)
+  }
+  for k := 0; k < n.Delta+n.Poisson+n.Geometric; k++ {
+    if w1, w2 := m1.LogWeights.Float64At(k), m2.LogWeights.Float64At(k); math.Abs(math.Exp(w1)-math.Exp(w2)) > 1e-3 {
+      t.Errorf("test failed for component %d: %f != %f", k+1, math.Exp(w1), math.Exp(w2))
+    }
+    if v1, v2 := mixtureComponentMean(m1.Edist[k]), mixtureComponentMean(m2.Edist[k]); math.Abs(v1-v2) > 1e-2*math.Max(1.0, v1) {
+      t.Errorf("test failed for component %d: %f != %f", k+1, v1, v2)
+    }
+  }
+  // changing the estimation method requires a new estimate
+  config.EnrichmentModelData = "histogram"
+  enrichment_export_mixture(config, m1, files)
+  config.EnrichmentModelData = "subsample"
+  if !updateRequiredParameters(config, files.Model, enrichment_model_parameters) {
+    t.Error("test failed")
+  }
+  saveTargetParameters(config, files.Model, enrichment_model_parameters)
+  config.EnrichmentModelSample = 1000
+  if !updateRequiredParameters(config, files.Model, enrichment_model_parameters) {
+    t.Error("test failed")
+  }
+}
+
+func TestEnrichmentModelMaxIterations(t *testing.T) {
+  dir, cleanup := testTempDir(t)
+  defer cleanup()
+
+  config := testEnrichmentConfig(t, dir, "h3k27ac", 0.1)
+  files  := config.EnrichmentFiles("h3k27ac")
+  track  := enrichment_import_model(config, files, false)
+  counts := compute_counts(config, track)
+  n      := mixtureComponents{Delta: 1, Poisson: 2, Geometric: 1}
+
+  m1 := enrichment_estimate_mixture(config, track, counts, n, rand.New(rand.NewSource(1)))
+  // EM stops after the maximum number of iterations
+  config.EnrichmentModelMaxIter = 2
+  m2 := enrichment_estimate_mixture(config, track, counts, n, rand.New(rand.NewSource(1)))
+  l1 := compute_mixture_criteria(m1, counts).LogLikelihood
+  l2 := compute_mixture_criteria(m2, counts).LogLikelihood
+  if !(l2 < l1) {
+    t.Errorf("test failed: %f %f", l1, l2)
+  }
+  config.EnrichmentModelMaxIter = 0
+  if err := enrichment_estimate_on_counts(config, newHistogramEstimator(config, n, rand.New(rand.NewSource(1))), counts); err == nil {
+    t.Error("test failed")
+  }
+}
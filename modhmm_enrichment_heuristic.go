@@ -35,7 +35,7 @@ import   "github.com/pbenner/autodiff/algorithm/rprop"
 
 func enrichment_import_heuristic(config ConfigModHmm, files EnrichmentFiles) Track {
   config.BinSummaryStatistics = "discrete mean"
-  return enrichment_import_and_normalize(config, files.Coverage.Filename, files.CoverageCnts.Filename, false)
+  return enrichment_import_and_normalize(config, files, false)
 }
 
 /* -------------------------------------------------------------------------- */
@@ -103,23 +103,29 @@ func enrichment_eval_heuristic_loop(config ConfigModHmm, result MutableTrack, da
   pool.Wait(group)
 }
 
-func enrichment_eval_heuristic_parameters(config ConfigModHmm, files EnrichmentFiles, counts Counts) (float64, float64) {
-  if files.Feature == "rna" {
-    q := config.EnrichmentParameters.GetParameters(files.Feature)[0]
-    p := config.EnrichmentParameters.GetParameters(files.Feature)[1]
+// Points (m1, p1) and (m2, p2) through which the logistic function passes
+func enrichment_eval_heuristic_points(feature string, parameters []float64, counts Counts) (float64, float64, float64, float64) {
+  if feature == "rna" {
+    q := parameters[0]
+    p := parameters[1]
     m1 := counts.Quantile(0.0)
     m2 := counts.Quantile(q)
-    return compute_sigmoid_parameters(m1, m2, 0.01, p)
+    return m1, m2, 0.01, p
   } else {
-    q  := config.EnrichmentParameters.GetParameters(files.Feature)[0]
-    p1 := config.EnrichmentParameters.GetParameters(files.Feature)[1]
-    p2 := config.EnrichmentParameters.GetParameters(files.Feature)[2]
+    q  := parameters[0]
+    p1 := parameters[1]
+    p2 := parameters[2]
     m1 := counts.Quantile(q)
     m2 := counts.ThresholdedMean(m1)
-    return compute_sigmoid_parameters(m1, m2, p1, p2)
+    return m1, m2, p1, p2
   }
 }
 
+func enrichment_eval_heuristic_parameters(config ConfigModHmm, files EnrichmentFiles, counts Counts) (float64, float64) {
+  m1, m2, p1, p2 := enrichment_eval_heuristic_points(files.Feature, config.EnrichmentParameters.GetParameters(files.Feature), counts)
+  return compute_sigmoid_parameters(m1, m2, p1, p2)
+}
+
 func enrichment_eval_heuristic(config ConfigModHmm, files EnrichmentFiles) {
   data   := enrichment_import_heuristic(config, files)
   counts := compute_counts(config, data)
@@ -46,12 +46,16 @@ func enrichment_import_model(config ConfigModHmm, files EnrichmentFiles, normali
       "in the config file prevent this check.", files.Feature)
   }
   config.BinSummaryStatistics = "discrete mean"
-  return enrichment_import_and_normalize(config, files.Coverage.Filename, files.CoverageCnts.Filename, normalize)
+  return enrichment_import_and_normalize(config, files, normalize)
 }
 
 /* -------------------------------------------------------------------------- */
 
 func enrichment_eval_classifier(config ConfigModHmm, files EnrichmentFiles) {
+  // select fallback model before models are imported
+  if config.ModelFallbackAuto() && !FileExists(files.Model.Filename) {
+    model_fallback_select(config, files.Feature)
+  }
   mixture := ImportMixtureDistribution(config, files.Model.Filename)
   k, _    := ImportComponents(config, files.Components.Filename, mixture.NComponents())
 
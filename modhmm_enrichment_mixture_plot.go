@@ -231,11 +231,24 @@ func modhmm_enrichment_plot_isolated(config ConfigModHmm, p *plot.Plot, mixture
   var list_points []interface{}
   var list_lines  []interface{}
   for k := 0; k < mixture.NComponents(); k ++ {
-    switch mixture.Edist[k].(type) {
+    pdf := mixture.Edist[k]
+    // negative binomial components are translated by the mixture model
+    if a, ok := pdf.(*scalarDistribution.PdfTranslation); ok {
+      pdf = a.ScalarPdf
+    }
+    switch pdf.(type) {
     case *scalarDistribution.DeltaDistribution:
       xys := eval_delta_component(mixture, k, config.XLim, y_min)
       list_points = append(list_points, fmt.Sprintf("component %d", k+1))
       list_points = append(list_points, xys)
+    case *scalarDistribution.NegativeBinomialDistribution:
+      xys := eval_component(mixture, []int{k}, counts, config.XLim, y_min)
+      list_lines = append(list_lines, fmt.Sprintf("component %d (negbin)", k+1))
+      list_lines = append(list_lines, xys)
+    case *ZeroInflatedNegativeBinomialDistribution:
+      xys := eval_component(mixture, []int{k}, counts, config.XLim, y_min)
+      list_lines = append(list_lines, fmt.Sprintf("component %d (zinb)", k+1))
+      list_lines = append(list_lines, xys)
     default:
       xys := eval_component(mixture, []int{k}, counts, config.XLim, y_min)
       list_lines = append(list_lines, fmt.Sprintf("component %d", k+1))
@@ -261,9 +274,31 @@ func modhmm_enrichment_plot_joined(config ConfigModHmm, p *plot.Plot, mixture *s
   }
 }
 
+// Compare the distribution of coverage values before and after normalization
+// to the reference distribution
+func modhmm_enrichment_plot_normalization(config ConfigModHmm, p *plot.Plot, files EnrichmentFiles, counts Counts) {
+  config.BinSummaryStatistics = "discrete mean"
+  track  := enrichment_import_and_normalize(config, files, false)
+  before := compute_counts(config, track)
+  enrichment_normalize(config, files, track)
+  after  := compute_counts(config, track)
+
+  xys_ref, _ := eval_counts(counts, config.XLim)
+  xys_bef, _ := eval_counts(before, config.XLim)
+  xys_aft, _ := eval_counts(after,  config.XLim)
+  plotutil.DefaultColors = []color.Color{color.RGBA{0, 0, 0, 255}}
+  if err := plotutil.AddLines(p, "reference", xys_ref); err != nil {
+    log.Fatal("plotting normalization failed: ", err)
+  }
+  plotutil.DefaultColors = plotutil.SoftColors
+  if err := plotutil.AddLines(p, "before normalization", xys_bef, fmt.Sprintf("after normalization (%s)", config.EnrichmentNormalization), xys_aft); err != nil {
+    log.Fatal("plotting normalization failed: ", err)
+  }
+}
+
 /* -------------------------------------------------------------------------- */
 
-func modhmm_enrichment_plot(config ConfigModHmm, ignoreModel, ignoreComponents bool, feature string) *plot.Plot {
+func modhmm_enrichment_plot(config ConfigModHmm, ignoreModel, ignoreComponents, normalization bool, feature string) *plot.Plot {
   feature = config.CoerceOpenChromatinAssay(feature)
 
   if !EnrichmentList.Contains(strings.ToLower(feature)) {
@@ -291,7 +326,9 @@ func modhmm_enrichment_plot(config ConfigModHmm, ignoreModel, ignoreComponents b
   files  := config.EnrichmentFiles(feature)
   counts := ImportCounts(config, files.CoverageCnts.Filename)
 
-  if ignoreModel {
+  if normalization {
+    modhmm_enrichment_plot_normalization(config, p, files, counts)
+  } else if ignoreModel {
     modhmm_enrichment_plot_counts(config, p, counts)
   } else {
     mixture := ImportMixtureDistribution(config, files.Model.Filename)
@@ -309,7 +346,7 @@ func modhmm_enrichment_plot(config ConfigModHmm, ignoreModel, ignoreComponents b
 
 /* -------------------------------------------------------------------------- */
 
-func modhmm_enrichment_plot_loop(config ConfigModHmm, save string, ignoreModel, ignoreComponents bool, features []string) {
+func modhmm_enrichment_plot_loop(config ConfigModHmm, save string, ignoreModel, ignoreComponents, normalization bool, features []string) {
   n1, n2 := nrc(len(features))
   plots := make([][]*plot.Plot, n1)
   for i := 0; i < n1; i++ {
@@ -318,7 +355,7 @@ func modhmm_enrichment_plot_loop(config ConfigModHmm, save string, ignoreModel,
       if i*n2+j >= len(features) {
         break
       }
-      plots[i][j] = modhmm_enrichment_plot(config, ignoreModel, ignoreComponents, features[i*n2+j])
+      plots[i][j] = modhmm_enrichment_plot(config, ignoreModel, ignoreComponents, normalization, features[i*n2+j])
     }
   }
   if filename, err := plot_result(plots, save); err != nil {
@@ -333,8 +370,8 @@ func modhmm_enrichment_plot_loop(config ConfigModHmm, save string, ignoreModel,
   }
 }
 
-func modhmm_enrichment_plot_all(config ConfigModHmm, save string, ignoreModel, ignoreComponents bool) {
-  modhmm_enrichment_plot_loop(config, save, ignoreModel, ignoreComponents, EnrichmentList)
+func modhmm_enrichment_plot_all(config ConfigModHmm, save string, ignoreModel, ignoreComponents, normalization bool) {
+  modhmm_enrichment_plot_loop(config, save, ignoreModel, ignoreComponents, normalization, EnrichmentList)
 }
 
 /* -------------------------------------------------------------------------- */
@@ -350,6 +387,7 @@ func modhmm_enrichment_plot_main(config ConfigModHmm, args []string) {
   optFontSize    := options.StringLong("font-size",         0 , "", "size of the font")
   optIgnoreModel := options.  BoolLong("ignore-model",      0 ,     "do not plot mixture model")
   optIgnoreComp  := options.  BoolLong("ignore-components", 0 ,     "ignore components file")
+  optNormalize   := options.  BoolLong("normalization",     0 ,     "plot coverage distribution before and after normalization")
   optHelp        := options.  BoolLong("help",             'h',     "print help")
 
   options.Parse(args)
@@ -384,8 +422,8 @@ func modhmm_enrichment_plot_main(config ConfigModHmm, args []string) {
     }
   }
   if len(options.Args()) == 0 {
-    modhmm_enrichment_plot_all(config, *optSave, *optIgnoreModel, *optIgnoreComp)
+    modhmm_enrichment_plot_all(config, *optSave, *optIgnoreModel, *optIgnoreComp, *optNormalize)
   } else {
-    modhmm_enrichment_plot_loop(config, *optSave, *optIgnoreModel, *optIgnoreComp, options.Args())
+    modhmm_enrichment_plot_loop(config, *optSave, *optIgnoreModel, *optIgnoreComp, *optNormalize, options.Args())
   }
 }
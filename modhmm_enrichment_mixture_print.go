@@ -23,6 +23,8 @@ import   "log"
 import   "os"
 import   "strings"
 
+import . "github.com/pbenner/ngstat/config"
+
 import . "github.com/pbenner/autodiff/statistics"
 import   "github.com/pbenner/autodiff/statistics/scalarDistribution"
 
@@ -40,6 +42,10 @@ func modhmm_enrichment_print_component(k int, pdf ScalarPdf) {
     fmt.Printf(": %2d Poisson   %e", k+1, a.GetParameters().Float64At(0))
   case *scalarDistribution.GeometricDistribution:
     fmt.Printf(": %2d Geometric %e", k+1, a.GetParameters().Float64At(0))
+  case *scalarDistribution.NegativeBinomialDistribution:
+    fmt.Printf(": %2d NegBin    %e %e", k+1, a.R.GetFloat64(), a.P.GetFloat64())
+  case *ZeroInflatedNegativeBinomialDistribution:
+    fmt.Printf(": %2d ZINB      %e %e %e", k+1, a.Pi.GetFloat64(), a.R.GetFloat64(), a.P.GetFloat64())
   case *scalarDistribution.PdfTranslation:
     modhmm_enrichment_print_component(k, a.ScalarPdf)
   default:
@@ -52,7 +58,7 @@ func modhmm_enrichment_print_components(config ConfigModHmm, mixture *scalarDist
   for _, k := range k_fg {
     fg[k] = true
   }
-  fmt.Println(":  # Type      Parameter")
+  fmt.Println(":  # Type      Parameters")
   for k := 0; k < mixture.NComponents(); k ++ {
     modhmm_enrichment_print_component(k, mixture.Edist[k])
     if fg[k] {
@@ -78,6 +84,13 @@ func modhmm_enrichment_print(config ConfigModHmm, feature string) {
 
   fmt.Printf("Mixture components for feature `%s'\n", feature)
   modhmm_enrichment_print_components(config, mixture, k)
+  if selection, ok := component_selection_import(config, files.Components.Filename, k); ok {
+    component_selection_print(selection)
+  }
+  estimation := mixtureEstimation{}
+  if err := ImportFile(&estimation, mixtureEstimationFilename(files.Model.Filename)); err == nil {
+    mixture_estimation_print(estimation)
+  }
 }
 
 /* -------------------------------------------------------------------------- */
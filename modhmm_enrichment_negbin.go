@@ -0,0 +1,473 @@
+/* Copyright (C) 2020 Philipp Benner
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+/* -------------------------------------------------------------------------- */
+
+import   "fmt"
+import   "math"
+
+import . "github.com/pbenner/autodiff"
+import . "github.com/pbenner/autodiff/statistics"
+import   "github.com/pbenner/autodiff/statistics/scalarDistribution"
+import . "github.com/pbenner/threadpool"
+
+/* Negative binomial and zero-inflated negative binomial mixture components
+ * for overdispersed data. The estimator of the autodiff library keeps the
+ * size parameter r fixed, therefore both parameters are estimated here.
+ * -------------------------------------------------------------------------- */
+
+func init() {
+  ScalarPdfRegistry["scalar:zero-inflated negative binomial distribution"] = new(ZeroInflatedNegativeBinomialDistribution)
+}
+
+/* -------------------------------------------------------------------------- */
+
+func digamma(x float64) float64 {
+  r := 0.0
+  for ; x < 6.0; x++ {
+    r -= 1.0/x
+  }
+  f := 1.0/(x*x)
+  return r + math.Log(x) - 0.5/x - f*(1.0/12.0 - f*(1.0/120.0 - f*(1.0/252.0 - f*(1.0/240.0 - f/132.0))))
+}
+
+func trigamma(x float64) float64 {
+  r := 0.0
+  for ; x < 6.0; x++ {
+    r += 1.0/(x*x)
+  }
+  f := 1.0/(x*x)
+  return r + 1.0/x + f/2.0 + f/x*(1.0/6.0 - f*(1.0/30.0 - f*(1.0/42.0 - f/30.0)))
+}
+
+// Convert log weights to weights, where the largest weight is one
+func negbin_weights(x, gamma ConstVector) ([]float64, []float64) {
+  values  := make([]float64, x.Dim())
+  weights := make([]float64, x.Dim())
+  g_max   := math.Inf(-1)
+  if gamma != nil {
+    for i := 0; i < gamma.Dim(); i++ {
+      g_max = math.Max(g_max, gamma.ConstAt(i).GetFloat64())
+    }
+  }
+  for i := 0; i < x.Dim(); i++ {
+    values[i] = x.ConstAt(i).GetFloat64()
+    if gamma == nil {
+      weights[i] = 1.0
+    } else {
+      weights[i] = math.Exp(gamma.ConstAt(i).GetFloat64() - g_max)
+    }
+  }
+  return values, weights
+}
+
+// Weighted maximum likelihood estimate of negative binomial parameters. The
+// size parameter r is the root of the score function, where p is replaced
+// by its maximum likelihood estimate given r. The root is found with a
+// safeguarded Newton method on log r, starting at r0.
+func negbin_fit(values, weights []float64, r0 float64) (float64, float64, bool) {
+  w := 0.0
+  m := 0.0
+  for i := range values {
+    w += weights[i]
+    m += weights[i]*values[i]
+  }
+  if w == 0.0 || math.IsNaN(w) {
+    return 0.0, 0.0, false
+  }
+  m /= w
+  if m == 0.0 {
+    return 1.0, 1e-10, true
+  }
+  // score function and its derivative with respect to log r
+  score := func(r float64) (float64, float64) {
+    s  := w*math.Log(r/(r+m))
+    d  := w*(1.0/r - 1.0/(r+m))
+    w1 := 0.0
+    for i := range values {
+      if values[i] > 0.0 && weights[i] > 0.0 {
+        s  += weights[i]*digamma (values[i]+r)
+        d  += weights[i]*trigamma(values[i]+r)
+        w1 += weights[i]
+      }
+    }
+    s -= w1*digamma (r)
+    d -= w1*trigamma(r)
+    return s, r*d
+  }
+  t1 := math.Log(1e-4)
+  t2 := math.Log(1e6)
+  if s, _ := score(math.Exp(t2)); s > 0.0 {
+    // data is not overdispersed, which is the Poisson limit
+    return 1e6, m/(1e6+m), true
+  }
+  t := math.Log(r0)
+  if math.IsNaN(t) || t <= t1 || t >= t2 {
+    t = (t1+t2)/2.0
+  }
+  for i := 0; i < 100 && t2-t1 > 1e-10; i++ {
+    s, d := score(math.Exp(t))
+    if s > 0.0 {
+      t1 = t
+    } else {
+      t2 = t
+    }
+    if math.Abs(s) < 1e-10*w {
+      break
+    }
+    // Newton step, or bisection if the step leaves the bracket
+    if tn := t - s/d; d < 0.0 && tn > t1 && tn < t2 {
+      if math.Abs(tn-t) < 1e-12 {
+        t = tn; break
+      }
+      t = tn
+    } else {
+      t = (t1+t2)/2.0
+    }
+  }
+  r := math.Exp(t)
+  p := math.Min(math.Max(m/(r+m), 1e-10), 1.0-1e-10)
+  return r, p, true
+}
+
+/* -------------------------------------------------------------------------- */
+
+// Observations collected through the batch interface, which is used by the
+// translation estimator. Each thread has its own buffer.
+type negbinBatch struct {
+  values [][]float64
+  gammas [][]float64
+}
+
+func (obj *negbinBatch) initialize(p ThreadPool) {
+  obj.values = make([][]float64, p.NumberOfThreads())
+  obj.gammas = make([][]float64, p.NumberOfThreads())
+}
+
+func (obj *negbinBatch) newObservation(x, gamma ConstScalar, p ThreadPool) {
+  // translated values below zero are outside the support
+  if x.GetFloat64() < 0.0 {
+    return
+  }
+  i := p.GetThreadId()
+  g := 0.0
+  if gamma != nil {
+    g = gamma.GetFloat64()
+  }
+  obj.values[i] = append(obj.values[i], x.GetFloat64())
+  obj.gammas[i] = append(obj.gammas[i], g)
+}
+
+// Return collected observations with weights, where the largest weight is
+// one, and reset the batch. The last value is false if there are no pending
+// observations.
+func (obj *negbinBatch) data() ([]float64, []float64, bool) {
+  if obj.values == nil {
+    return nil, nil, false
+  }
+  values  := []float64{}
+  weights := []float64{}
+  g_max   := math.Inf(-1)
+  for i := range obj.values {
+    values  = append(values,  obj.values[i]...)
+    weights = append(weights, obj.gammas[i]...)
+  }
+  for i := range weights {
+    g_max = math.Max(g_max, weights[i])
+  }
+  for i := range weights {
+    weights[i] = math.Exp(weights[i] - g_max)
+  }
+  obj.values = nil
+  obj.gammas = nil
+  return values, weights, true
+}
+
+/* -------------------------------------------------------------------------- */
+
+type negativeBinomialEstimator struct {
+  *scalarDistribution.NegativeBinomialDistribution
+  x     ConstVector
+  batch negbinBatch
+}
+
+func newNegativeBinomialEstimator(r, p float64) (*negativeBinomialEstimator, error) {
+  if dist, err := scalarDistribution.NewNegativeBinomialDistribution(NewFloat64(r), NewFloat64(p)); err != nil {
+    return nil, err
+  } else {
+    return &negativeBinomialEstimator{NegativeBinomialDistribution: dist}, nil
+  }
+}
+
+func (obj *negativeBinomialEstimator) Clone() *negativeBinomialEstimator {
+  return &negativeBinomialEstimator{NegativeBinomialDistribution: obj.NegativeBinomialDistribution.Clone(), x: obj.x}
+}
+
+func (obj *negativeBinomialEstimator) CloneScalarEstimator() ScalarEstimator {
+  return obj.Clone()
+}
+
+func (obj *negativeBinomialEstimator) CloneScalarBatchEstimator() ScalarBatchEstimator {
+  return obj.Clone()
+}
+
+func (obj *negativeBinomialEstimator) SetData(x ConstVector, n int) error {
+  obj.x = x
+  return nil
+}
+
+func (obj *negativeBinomialEstimator) fit(values, weights []float64) error {
+  r, q, ok := negbin_fit(values, weights, obj.R.GetFloat64())
+  if !ok {
+    // component has no weight, keep current parameters
+    return nil
+  }
+  if dist, err := scalarDistribution.NewNegativeBinomialDistribution(NewFloat64(r), NewFloat64(q)); err != nil {
+    return err
+  } else {
+    *obj.NegativeBinomialDistribution = *dist
+  }
+  return nil
+}
+
+func (obj *negativeBinomialEstimator) Estimate(gamma ConstVector, p ThreadPool) error {
+  values, weights := negbin_weights(obj.x, gamma)
+  return obj.fit(values, weights)
+}
+
+func (obj *negativeBinomialEstimator) EstimateOnData(x, gamma ConstVector, p ThreadPool) error {
+  if err := obj.SetData(x, x.Dim()); err != nil {
+    return err
+  }
+  return obj.Estimate(gamma, p)
+}
+
+func (obj *negativeBinomialEstimator) Initialize(p ThreadPool) error {
+  obj.batch.initialize(p)
+  return nil
+}
+
+func (obj *negativeBinomialEstimator) NewObservation(x, gamma ConstScalar, p ThreadPool) error {
+  obj.batch.newObservation(x, gamma, p)
+  return nil
+}
+
+func (obj *negativeBinomialEstimator) GetEstimate() (ScalarPdf, error) {
+  if values, weights, ok := obj.batch.data(); ok {
+    if err := obj.fit(values, weights); err != nil {
+      return nil, err
+    }
+  }
+  return obj.NegativeBinomialDistribution, nil
+}
+
+/* -------------------------------------------------------------------------- */
+
+type ZeroInflatedNegativeBinomialDistribution struct {
+  *scalarDistribution.NegativeBinomialDistribution
+  Pi Scalar
+}
+
+func NewZeroInflatedNegativeBinomialDistribution(pi, r, p Scalar) (*ZeroInflatedNegativeBinomialDistribution, error) {
+  if pi.GetFloat64() < 0.0 || pi.GetFloat64() > 1.0 {
+    return nil, fmt.Errorf("invalid value for parameter pi: %f", pi.GetFloat64())
+  }
+  if dist, err := scalarDistribution.NewNegativeBinomialDistribution(r, p); err != nil {
+    return nil, err
+  } else {
+    return &ZeroInflatedNegativeBinomialDistribution{dist, pi.CloneScalar()}, nil
+  }
+}
+
+func (dist *ZeroInflatedNegativeBinomialDistribution) Clone() *ZeroInflatedNegativeBinomialDistribution {
+  return &ZeroInflatedNegativeBinomialDistribution{dist.NegativeBinomialDistribution.Clone(), dist.Pi.CloneScalar()}
+}
+
+func (dist *ZeroInflatedNegativeBinomialDistribution) CloneScalarPdf() ScalarPdf {
+  return dist.Clone()
+}
+
+func (dist *ZeroInflatedNegativeBinomialDistribution) LogPdf(r Scalar, x ConstScalar) error {
+  if err := dist.NegativeBinomialDistribution.LogPdf(r, x); err != nil {
+    return err
+  }
+  pi := dist.Pi.GetFloat64()
+  if x.GetFloat64() == 0.0 {
+    r.SetFloat64(math.Log(pi + (1.0-pi)*math.Exp(r.GetFloat64())))
+  } else {
+    r.SetFloat64(math.Log1p(-pi) + r.GetFloat64())
+  }
+  return nil
+}
+
+func (dist *ZeroInflatedNegativeBinomialDistribution) Pdf(r Scalar, x ConstScalar) error {
+  if err := dist.LogPdf(r, x); err != nil {
+    return err
+  }
+  r.Exp(r)
+  return nil
+}
+
+func (dist *ZeroInflatedNegativeBinomialDistribution) GetParameters() Vector {
+  p := NullDenseVector(dist.ScalarType(), 3)
+  p.At(0).Set(dist.Pi)
+  p.At(1).Set(dist.R)
+  p.At(2).Set(dist.P)
+  return p
+}
+
+func (dist *ZeroInflatedNegativeBinomialDistribution) SetParameters(parameters Vector) error {
+  if tmp, err := NewZeroInflatedNegativeBinomialDistribution(parameters.At(0), parameters.At(1), parameters.At(2)); err != nil {
+    return err
+  } else {
+    *dist = *tmp
+  }
+  return nil
+}
+
+func (dist *ZeroInflatedNegativeBinomialDistribution) ImportConfig(config ConfigDistribution, t ScalarType) error {
+  if parameters, ok := config.GetParametersAsFloats(); !ok || len(parameters) != 3 {
+    return fmt.Errorf("invalid config file")
+  } else {
+    if tmp, err := NewZeroInflatedNegativeBinomialDistribution(NewScalar(t, parameters[0]), NewScalar(t, parameters[1]), NewScalar(t, parameters[2])); err != nil {
+      return err
+    } else {
+      *dist = *tmp
+    }
+    return nil
+  }
+}
+
+func (dist *ZeroInflatedNegativeBinomialDistribution) ExportConfig() ConfigDistribution {
+  return NewConfigDistribution("scalar:zero-inflated negative binomial distribution", dist.GetParameters())
+}
+
+/* -------------------------------------------------------------------------- */
+
+type zeroInflatedNegativeBinomialEstimator struct {
+  *ZeroInflatedNegativeBinomialDistribution
+  x     ConstVector
+  batch negbinBatch
+}
+
+func newZeroInflatedNegativeBinomialEstimator(pi, r, p float64) (*zeroInflatedNegativeBinomialEstimator, error) {
+  if dist, err := NewZeroInflatedNegativeBinomialDistribution(NewFloat64(pi), NewFloat64(r), NewFloat64(p)); err != nil {
+    return nil, err
+  } else {
+    return &zeroInflatedNegativeBinomialEstimator{ZeroInflatedNegativeBinomialDistribution: dist}, nil
+  }
+}
+
+func (obj *zeroInflatedNegativeBinomialEstimator) Clone() *zeroInflatedNegativeBinomialEstimator {
+  return &zeroInflatedNegativeBinomialEstimator{ZeroInflatedNegativeBinomialDistribution: obj.ZeroInflatedNegativeBinomialDistribution.Clone(), x: obj.x}
+}
+
+func (obj *zeroInflatedNegativeBinomialEstimator) CloneScalarEstimator() ScalarEstimator {
+  return obj.Clone()
+}
+
+func (obj *zeroInflatedNegativeBinomialEstimator) CloneScalarBatchEstimator() ScalarBatchEstimator {
+  return obj.Clone()
+}
+
+func (obj *zeroInflatedNegativeBinomialEstimator) SetData(x ConstVector, n int) error {
+  obj.x = x
+  return nil
+}
+
+// The zero-inflation is estimated with an inner EM algorithm, where each
+// zero is assigned partially to the point mass and the negative binomial
+func (obj *zeroInflatedNegativeBinomialEstimator) fit(values, weights []float64) error {
+  pi := obj.Pi.GetFloat64()
+  r  := obj.R .GetFloat64()
+  q  := obj.P .GetFloat64()
+  w  := 0.0
+  w0 := 0.0
+  for i := range values {
+    w += weights[i]
+    if values[i] == 0.0 {
+      w0 += weights[i]
+    }
+  }
+  if w == 0.0 || math.IsNaN(w) {
+    // component has no weight, keep current parameters
+    return nil
+  }
+  tmp := make([]float64, len(weights))
+  for iter := 0; iter < 100; iter++ {
+    // posterior probability that a zero belongs to the point mass
+    z := 0.0
+    if pi > 0.0 {
+      z = pi/(pi + (1.0-pi)*math.Exp(r*math.Log1p(-q)))
+    }
+    pi_ := pi
+    pi   = z*w0/w
+    for i := range values {
+      if values[i] == 0.0 {
+        tmp[i] = (1.0-z)*weights[i]
+      } else {
+        tmp[i] = weights[i]
+      }
+    }
+    if r_, q_, ok := negbin_fit(values, tmp, r); !ok {
+      break
+    } else {
+      r, q = r_, q_
+    }
+    if math.Abs(pi-pi_) < 1e-8 {
+      break
+    }
+  }
+  if dist, err := NewZeroInflatedNegativeBinomialDistribution(NewFloat64(pi), NewFloat64(r), NewFloat64(q)); err != nil {
+    return err
+  } else {
+    *obj.ZeroInflatedNegativeBinomialDistribution = *dist
+  }
+  return nil
+}
+
+func (obj *zeroInflatedNegativeBinomialEstimator) Estimate(gamma ConstVector, p ThreadPool) error {
+  values, weights := negbin_weights(obj.x, gamma)
+  return obj.fit(values, weights)
+}
+
+func (obj *zeroInflatedNegativeBinomialEstimator) EstimateOnData(x, gamma ConstVector, p ThreadPool) error {
+  if err := obj.SetData(x, x.Dim()); err != nil {
+    return err
+  }
+  return obj.Estimate(gamma, p)
+}
+
+func (obj *zeroInflatedNegativeBinomialEstimator) Initialize(p ThreadPool) error {
+  obj.batch.initialize(p)
+  return nil
+}
+
+func (obj *zeroInflatedNegativeBinomialEstimator) NewObservation(x, gamma ConstScalar, p ThreadPool) error {
+  obj.batch.newObservation(x, gamma, p)
+  return nil
+}
+
+func (obj *zeroInflatedNegativeBinomialEstimator) GetEstimate() (ScalarPdf, error) {
+  if values, weights, ok := obj.batch.data(); ok {
+    if err := obj.fit(values, weights); err != nil {
+      return nil, err
+    }
+  }
+  return obj.ZeroInflatedNegativeBinomialDistribution, nil
+}
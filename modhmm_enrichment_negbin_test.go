@@ -0,0 +1,164 @@
+/* Copyright (C) 2020 Philipp Benner
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+/* -------------------------------------------------------------------------- */
+
+import   "math"
+import   "math/rand"
+import   "testing"
+
+import . "github.com/pbenner/autodiff"
+import   "github.com/pbenner/autodiff/statistics/scalarDistribution"
+import   "github.com/pbenner/autodiff/statistics/scalarEstimator"
+import   "github.com/pbenner/threadpool"
+
+import . "github.com/pbenner/modhmm/config"
+
+/* -------------------------------------------------------------------------- */
+
+func testNegBinLogPmf(r, p float64, k float64) float64 {
+  a, _ := math.Lgamma(k+r)
+  b, _ := math.Lgamma(k+1)
+  c, _ := math.Lgamma(r)
+  return a - b - c + k*math.Log(p) + r*math.Log1p(-p)
+}
+
+// Expected counts of a zero-inflated negative binomial distribution, for
+// which the weighted maximum likelihood estimate is exact
+func testNegBinData(pi, r, p float64, n int) ([]float64, []float64) {
+  values  := make([]float64, n)
+  weights := make([]float64, n)
+  for k := 0; k < n; k++ {
+    values [k] = float64(k)
+    weights[k] = (1.0-pi)*math.Exp(testNegBinLogPmf(r, p, float64(k)))
+  }
+  weights[0] += pi
+  return values, weights
+}
+
+/* -------------------------------------------------------------------------- */
+
+func TestNegBinFit(t *testing.T) {
+  values, weights := testNegBinData(0.0, 3.0, 0.6, 200)
+  for _, r0 := range []float64{0.1, 1.0, 100.0} {
+    if r, p, ok := negbin_fit(values, weights, r0); !ok || math.Abs(r-3.0) > 1e-4 || math.Abs(p-0.6) > 1e-4 {
+      t.Errorf("test failed: r=%f p=%f", r, p)
+    }
+  }
+  // Poisson data is not overdispersed
+  for k := range weights {
+    c, _ := math.Lgamma(float64(k)+1.0)
+    weights[k] = math.Exp(float64(k)*math.Log(5.0) - 5.0 - c)
+  }
+  if r, p, ok := negbin_fit(values, weights, 1.0); !ok || r < 1e5 || math.Abs(r*p/(1.0-p)-5.0) > 1e-4 {
+    t.Errorf("test failed: r=%f p=%f", r, p)
+  }
+  // no weight
+  if _, _, ok := negbin_fit(values, make([]float64, len(values)), 1.0); ok {
+    t.Error("test failed")
+  }
+}
+
+func TestZinbEstimate(t *testing.T) {
+  values, weights := testNegBinData(0.3, 2.0, 0.8, 500)
+  x     := NullDenseFloat64Vector(len(values))
+  gamma := NullDenseFloat64Vector(len(values))
+  for i := range values {
+    x    .At(i).SetFloat64(values[i])
+    gamma.At(i).SetFloat64(math.Log(weights[i]))
+  }
+  estimator, err := newZeroInflatedNegativeBinomialEstimator(0.1, 1.0, 0.5); if err != nil {
+    t.Fatal(err)
+  }
+  if err := estimator.EstimateOnData(x, gamma, threadpool.Nil()); err != nil {
+    t.Fatal(err)
+  }
+  if pi := estimator.Pi.GetFloat64(); math.Abs(pi-0.3) > 1e-3 {
+    t.Errorf("test failed: pi=%f", pi)
+  }
+  if r := estimator.R.GetFloat64(); math.Abs(r-2.0) > 1e-2 {
+    t.Errorf("test failed: r=%f", r)
+  }
+  if p := estimator.P.GetFloat64(); math.Abs(p-0.8) > 1e-3 {
+    t.Errorf("test failed: p=%f", p)
+  }
+}
+
+func TestZinbPdf(t *testing.T) {
+  dist, err := NewZeroInflatedNegativeBinomialDistribution(NewFloat64(0.2), NewFloat64(2.0), NewFloat64(0.5)); if err != nil {
+    t.Fatal(err)
+  }
+  r1 := NullFloat64()
+  r2 := NullFloat64()
+  s  := 0.0
+  for k := 0; k < 200; k++ {
+    if err := dist.LogPdf(r1, ConstFloat64(float64(k))); err != nil {
+      t.Fatal(err)
+    }
+    if err := dist.Pdf(r2, ConstFloat64(float64(k))); err != nil {
+      t.Fatal(err)
+    }
+    if math.Abs(math.Exp(r1.GetFloat64()) - r2.GetFloat64()) > 1e-12 {
+      t.Errorf("test failed for x=%d", k)
+    }
+    s += r2.GetFloat64()
+  }
+  if math.Abs(s-1.0) > 1e-8 {
+    t.Errorf("test failed: pdf sums to %f", s)
+  }
+  if dist.Pdf(r2, ConstFloat64(0.0)); math.Abs(r2.GetFloat64() - (0.2 + 0.8*0.25)) > 1e-12 {
+    t.Error("test failed")
+  }
+}
+
+func TestNegBinTranslation(t *testing.T) {
+  // negative binomial data shifted by two delta components
+  values, weights := testNegBinData(0.0, 3.0, 0.6, 200)
+  x     := NullDenseFloat64Vector(len(values)+2)
+  gamma := NullDenseFloat64Vector(len(values)+2)
+  x    .At(1).SetFloat64(1.0)
+  gamma.At(0).SetFloat64(math.Inf(-1))
+  gamma.At(1).SetFloat64(math.Inf(-1))
+  for i := range values {
+    x    .At(i+2).SetFloat64(values[i]+2.0)
+    gamma.At(i+2).SetFloat64(math.Log(weights[i]))
+  }
+  components := newEstimatorComponents(DefaultModHmmConfig(), mixtureComponents{Delta: 2, NegBin: 1}, rand.New(rand.NewSource(1)))
+  estimator, ok := components[2].(*scalarEstimator.TranslationEstimator); if !ok {
+    t.Fatal("test failed")
+  }
+  if err := estimator.EstimateOnData(x, gamma, threadpool.Nil()); err != nil {
+    t.Fatal(err)
+  }
+  pdf, err := estimator.GetEstimate(); if err != nil {
+    t.Fatal(err)
+  }
+  if tr, ok := pdf.(*scalarDistribution.PdfTranslation); !ok {
+    t.Fatal("test failed")
+  } else
+  if nb, ok := tr.ScalarPdf.(*scalarDistribution.NegativeBinomialDistribution); !ok || math.Abs(nb.R.GetFloat64()-3.0) > 1e-3 || math.Abs(nb.P.GetFloat64()-0.6) > 1e-3 {
+    t.Errorf("test failed: %v", tr.ScalarPdf.GetParameters())
+  }
+  r := NullFloat64()
+  if pdf.LogPdf(r, ConstFloat64(1.0)); !math.IsInf(r.GetFloat64(), -1) {
+    t.Error("test failed")
+  }
+  if pdf.LogPdf(r, ConstFloat64(2.0)); math.Abs(r.GetFloat64() - testNegBinLogPmf(3.0, 0.6, 0.0)) > 1e-3 {
+    t.Error("test failed")
+  }
+}
@@ -0,0 +1,208 @@
+/* Copyright (C) 2019 Philipp Benner
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+/* -------------------------------------------------------------------------- */
+
+import   "fmt"
+import   "log"
+import   "math"
+import   "sort"
+import   "strings"
+
+import . "github.com/pbenner/gonetics"
+
+import . "github.com/pbenner/modhmm/config"
+
+/* Normalization of coverage tracks to the reference counts of the
+ * enrichment model:
+ *  - quantile           : full quantile normalization, i.e. the data
+ *                         distribution is replaced by the reference
+ *  - median-of-ratios   : data is scaled by the median ratio between
+ *                         reference and data quantiles
+ *  - background-quantile: quantile normalization of background values,
+ *                         i.e. values below the quantile given by the
+ *                         background weight of the model, while enriched
+ *                         values are scaled such that the fraction of
+ *                         enriched bins is not forced to match the reference
+ *  - none               : no normalization
+ * Normalized values are rounded, since enrichment models are discrete.
+ * -------------------------------------------------------------------------- */
+
+// Quantile function of counts evaluated on a regular grid of size n
+func counts_quantiles(counts Counts, n int) []float64 {
+  t := 0
+  for i := range counts.Y {
+    t += counts.Y[i]
+  }
+  r := make([]float64, n)
+  j := 0
+  s := counts.Y[0]
+  for i := 0; i < n; i++ {
+    u := (float64(i)+0.5)/float64(n)*float64(t)
+    for j < len(counts.X)-1 && float64(s) < u {
+      j++; s += counts.Y[j]
+    }
+    r[i] = counts.X[j]
+  }
+  return r
+}
+
+// Smallest value at which the cumulative frequency reaches u
+func counts_quantile(counts Counts, u float64) float64 {
+  t := 0
+  for i := range counts.Y {
+    t += counts.Y[i]
+  }
+  s := 0
+  for i := range counts.X {
+    if s += counts.Y[i]; float64(s) >= u*float64(t) {
+      return counts.X[i]
+    }
+  }
+  return counts.X[len(counts.X)-1]
+}
+
+// Median ratio between reference and data quantiles, quantiles where
+// either value is zero are ignored
+func normalize_median_of_ratios_factor(data, reference Counts) (float64, error) {
+  if len(data.X) == 0 || len(reference.X) == 0 {
+    return 1.0, fmt.Errorf("counts are empty")
+  }
+  qd := counts_quantiles(data,      1000)
+  qr := counts_quantiles(reference, 1000)
+  r  := []float64{}
+  for i := range qd {
+    if qd[i] > 0.0 && qr[i] > 0.0 {
+      r = append(r, qr[i]/qd[i])
+    }
+  }
+  if len(r) == 0 {
+    return 1.0, fmt.Errorf("data and reference have no positive quantiles in common")
+  }
+  sort.Float64s(r)
+  if n := len(r); n % 2 == 1 {
+    return r[n/2], nil
+  } else {
+    return (r[n/2-1] + r[n/2])/2.0, nil
+  }
+}
+
+// Map from data values to normalized values for background quantile
+// normalization, where rho is the background fraction
+func normalize_background_quantile_map(data, reference Counts, rho float64) map[float64]float64 {
+  n := 0
+  for i := range data.Y {
+    n += data.Y[i]
+  }
+  // scaling factor for values above the background quantile
+  s := 1.0
+  if q := counts_quantile(data, rho); q > 0.0 {
+    s = counts_quantile(reference, rho)/q
+  } else {
+    if f, err := normalize_median_of_ratios_factor(data, reference); err == nil {
+      s = f
+    }
+  }
+  m := make(map[float64]float64)
+  c := 0
+  y := math.Inf(-1)
+  for i := range data.X {
+    // mid-rank of this value
+    u := (float64(c) + float64(data.Y[i])/2.0)/float64(n)
+    x := 0.0
+    if u <= rho {
+      x = counts_quantile(reference, u)
+    } else {
+      x = math.Floor(s*data.X[i] + 0.5)
+    }
+    // keep mapping monotonic
+    y    = math.Max(x, y)
+    m[data.X[i]] = y
+    c   += data.Y[i]
+  }
+  return m
+}
+
+/* -------------------------------------------------------------------------- */
+
+func enrichment_normalize_quantile(config ConfigModHmm, files EnrichmentFiles, track MutableTrack) error {
+  counts := ImportCounts(config, files.CoverageCnts.Filename)
+  printStderr(config, 1, "Quantile normalizing track to reference distribution... ")
+  if err := (GenericMutableTrack{track}).QuantileNormalizeToCounts(counts.X, counts.Y); err != nil {
+    printStderr(config, 1, "failed\n")
+    return err
+  }
+  printStderr(config, 1, "done\n")
+  return nil
+}
+
+func enrichment_normalize_median_of_ratios(config ConfigModHmm, files EnrichmentFiles, track MutableTrack) error {
+  counts := ImportCounts(config, files.CoverageCnts.Filename)
+  printStderr(config, 1, "Scaling track to reference distribution (median-of-ratios)... ")
+  s, err := normalize_median_of_ratios_factor(compute_counts(config, track), counts)
+  if err != nil {
+    printStderr(config, 1, "failed\n")
+    return err
+  }
+  if err := (GenericMutableTrack{track}).Map(track, func(seqname string, position int, value float64) float64 {
+    if math.IsNaN(value) {
+      return value
+    }
+    return math.Floor(s*value + 0.5)
+  }); err != nil {
+    printStderr(config, 1, "failed\n")
+    return err
+  }
+  printStderr(config, 1, "done (scaling factor: %f)\n", s)
+  return nil
+}
+
+func enrichment_normalize_background_quantile(config ConfigModHmm, files EnrichmentFiles, track MutableTrack) error {
+  counts := ImportCounts(config, files.CoverageCnts.Filename)
+  // fraction of background bins in the reference model
+  _, q   := ImportMixtureWeights(config, files.Model.Filename, files.Components.Filename)
+  rho    := math.Exp(q)
+  printStderr(config, 1, "Quantile normalizing background of track to reference distribution (background fraction: %f)... ", rho)
+  m := normalize_background_quantile_map(compute_counts(config, track), counts, rho)
+  if err := (GenericMutableTrack{track}).Map(track, func(seqname string, position int, value float64) float64 {
+    if math.IsNaN(value) {
+      return value
+    }
+    return m[value]
+  }); err != nil {
+    printStderr(config, 1, "failed\n")
+    return err
+  }
+  printStderr(config, 1, "done\n")
+  return nil
+}
+
+func enrichment_normalize(config ConfigModHmm, files EnrichmentFiles, track MutableTrack) {
+  var err error
+  switch strings.ToLower(config.EnrichmentNormalization) {
+  case "quantile"           : err = enrichment_normalize_quantile           (config, files, track)
+  case "median-of-ratios"   : err = enrichment_normalize_median_of_ratios   (config, files, track)
+  case "background-quantile": err = enrichment_normalize_background_quantile(config, files, track)
+  case "none"               :
+  default:
+    log.Fatalf("invalid enrichment normalization `%s' [quantile, median-of-ratios, background-quantile, none]", config.EnrichmentNormalization)
+  }
+  if err != nil {
+    log.Fatal(err)
+  }
+}
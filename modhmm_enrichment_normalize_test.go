@@ -0,0 +1,99 @@
+/* Copyright (C) 2020 Philipp Benner
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+/* -------------------------------------------------------------------------- */
+
+import   "io/ioutil"
+import   "math"
+import   "path/filepath"
+import   "testing"
+
+import . "github.com/pbenner/modhmm/config"
+
+/* -------------------------------------------------------------------------- */
+
+func TestCountsQuantiles(t *testing.T) {
+  counts := Counts{X: []float64{0, 1, 5}, Y: []int{2, 1, 1}}
+  r := []float64{0, 0, 1, 5}
+  q := counts_quantiles(counts, 4)
+  for i := range r {
+    if q[i] != r[i] {
+      t.Errorf("test failed: %v", q)
+    }
+  }
+}
+
+func TestNormalizeMedianOfRatios(t *testing.T) {
+  reference := Counts{X: []float64{0, 2, 4, 6}, Y: []int{100, 60, 30, 10}}
+  // data at half the sequencing depth of the reference
+  data := Counts{X: []float64{0, 1, 2, 3}, Y: []int{100, 60, 30, 10}}
+  if s, err := normalize_median_of_ratios_factor(data, reference); err != nil || math.Abs(s - 2.0) > 1e-8 {
+    t.Errorf("test failed: %f %v", s, err)
+  }
+  if _, err := normalize_median_of_ratios_factor(Counts{X: []float64{0}, Y: []int{10}}, reference); err == nil {
+    t.Error("test failed")
+  }
+  if _, err := normalize_median_of_ratios_factor(Counts{}, reference); err == nil {
+    t.Error("test failed")
+  }
+}
+
+func TestNormalizeBackgroundQuantile(t *testing.T) {
+  reference := Counts{X: []float64{0, 1, 2, 10, 20}, Y: []int{50, 30, 10, 5, 5}}
+  data      := Counts{X: []float64{0, 1, 5, 10}, Y: []int{30, 50, 10, 10}}
+  if q := counts_quantile(reference, 0.5); q != 0 {
+    t.Errorf("test failed: %f", q)
+  }
+  if q := counts_quantile(reference, 0.85); q != 2 {
+    t.Errorf("test failed: %f", q)
+  }
+  m := normalize_background_quantile_map(data, reference, 0.9)
+  // background values are mapped to reference quantiles at their mid-ranks,
+  // while enriched values are scaled by the ratio of the background
+  // quantiles (2/5)
+  r := map[float64]float64{0: 0, 1: 1, 5: 2, 10: 4}
+  for x := range r {
+    if m[x] != r[x] {
+      t.Errorf("test failed: %v", m)
+    }
+  }
+  // mapping is monotonic
+  m = normalize_background_quantile_map(Counts{X: []float64{0, 1, 2, 3}, Y: []int{90, 5, 3, 2}}, reference, 0.5)
+  for _, x := range []float64{1, 2, 3} {
+    if m[x] < m[x-1] {
+      t.Errorf("test failed: %v", m)
+    }
+  }
+}
+
+func TestNormalizeParameters(t *testing.T) {
+  dir, cleanup := testTempDir(t)
+  defer cleanup()
+
+  config := DefaultModHmmConfig()
+  target := TargetFile{Filename: filepath.Join(dir, "h3k27ac.bw")}
+  if err := ioutil.WriteFile(target.Filename, []byte{}, 0666); err != nil {
+    t.Fatal(err)
+  }
+  saveTargetParameters(config, target, enrichment_parameters("h3k27ac"))
+  // changing the normalization requires an update of probabilities
+  config.EnrichmentNormalization = "median-of-ratios"
+  if !updateRequiredParameters(config, target, enrichment_parameters("h3k27ac")) {
+    t.Error("test failed")
+  }
+}
@@ -0,0 +1,229 @@
+/* Copyright (C) 2019 Philipp Benner
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+/* -------------------------------------------------------------------------- */
+
+import   "log"
+import   "math"
+import   "path"
+import   "sort"
+import   "strings"
+
+import . "github.com/pbenner/gonetics"
+import . "github.com/pbenner/ngstat/track"
+
+import . "github.com/pbenner/modhmm/config"
+
+/* Gene-level RNA enrichment. If a gene annotation (GTF) is given, RNA-seq
+ * coverage is summarized over the exons of each gene and converted to
+ * TPM-like expression values. Bins within the body of a gene receive the
+ * transcription probability of the gene
+ *   p = tpm^2/(tpm^2 + t^2)
+ * where t is the TPM threshold at which p = 0.5. Bins outside of genes
+ * receive a low probability. Genes together with their strand, expression
+ * and probability are saved in a table next to the enrichment track.
+ * -------------------------------------------------------------------------- */
+
+type rnaGene struct {
+  Name        string
+  Seqname     string
+  From        int
+  To          int
+  Strand      byte
+  // merged exons of all transcripts
+  Exons       []Range
+  TPM         float64
+  Probability float64
+}
+
+func rnaGenesFilename(filenameProbabilities string) string {
+  return strings.TrimSuffix(filenameProbabilities, path.Ext(filenameProbabilities)) + ".genes.table"
+}
+
+/* -------------------------------------------------------------------------- */
+
+func rna_merge_exons(exons []Range) []Range {
+  sort.Slice(exons, func(i, j int) bool { return exons[i].From < exons[j].From })
+  r := []Range{}
+  for _, exon := range exons {
+    if n := len(r); n > 0 && exon.From <= r[n-1].To {
+      if exon.To > r[n-1].To {
+        r[n-1].To = exon.To
+      }
+    } else {
+      r = append(r, exon)
+    }
+  }
+  return r
+}
+
+func import_rna_genes(config ConfigModHmm, filename string) []rnaGene {
+  granges := GRanges{}
+  printStderr(config, 1, "Importing gene annotation from `%s'... ", filename)
+  if err := granges.ImportGTF(filename, []string{"gene_id"}, []string{"[]string"}, []interface{}{""}); err != nil {
+    printStderr(config, 1, "failed\n")
+    log.Fatal(err)
+  }
+  printStderr(config, 1, "done\n")
+
+  feature := granges.GetMetaStr("feature")
+  geneId  := granges.GetMetaStr("gene_id")
+  index   := make(map[string]int)
+  genes   := []rnaGene{}
+  for i := 0; i < granges.Length(); i++ {
+    if feature[i] != "exon" || geneId[i] == "" {
+      continue
+    }
+    // GTF coordinates are 1-based and inclusive
+    from := granges.Ranges[i].From-1
+    to   := granges.Ranges[i].To
+    j, ok := index[geneId[i]]
+    if !ok {
+      j = len(genes)
+      index[geneId[i]] = j
+      genes = append(genes, rnaGene{Name: geneId[i], Seqname: granges.Seqnames[i], From: from, To: to, Strand: granges.Strand[i]})
+    }
+    if from < genes[j].From {
+      genes[j].From = from
+    }
+    if to > genes[j].To {
+      genes[j].To = to
+    }
+    genes[j].Exons = append(genes[j].Exons, NewRange(from, to))
+  }
+  for j := range genes {
+    genes[j].Exons = rna_merge_exons(genes[j].Exons)
+  }
+  return genes
+}
+
+/* -------------------------------------------------------------------------- */
+
+// Compute TPM-like expression values, i.e. exon coverage per bp normalized
+// to sum to one million over all genes
+func rna_genes_expression(config ConfigModHmm, genes []rnaGene, data Track) {
+  binSize := data.GetBinSize()
+  rates   := make([]float64, len(genes))
+  total   := 0.0
+  for j, gene := range genes {
+    seq, err := data.GetSequence(gene.Seqname); if err != nil {
+      continue
+    }
+    sum := 0.0
+    n   := 0
+    for _, exon := range gene.Exons {
+      for i := exon.From/binSize; i <= (exon.To-1)/binSize && i < seq.NBins(); i++ {
+        x := seq.AtBin(i)
+        // ignore bins with low mappability
+        if math.IsNaN(x) {
+          continue
+        }
+        from, to := i*binSize, (i+1)*binSize
+        if exon.From > from {
+          from = exon.From
+        }
+        if exon.To < to {
+          to = exon.To
+        }
+        sum += x*float64(to-from)/float64(binSize)
+        n   += to-from
+      }
+    }
+    if n > 0 {
+      rates[j] = sum/float64(n)
+      total   += rates[j]
+    }
+  }
+  t := config.RnaTpmThreshold
+  for j := range genes {
+    if total > 0.0 {
+      genes[j].TPM = 1e6*rates[j]/total
+    }
+    p := genes[j].TPM*genes[j].TPM/(genes[j].TPM*genes[j].TPM + t*t)
+    genes[j].Probability = math.Min(math.Max(p, 0.01), 1.0 - 1e-8)
+  }
+}
+
+func rna_genes_eval(config ConfigModHmm, result MutableTrack, data Track, genes []rnaGene) {
+  if err := (GenericMutableTrack{result}).Map(data, func(seqname string, position int, value float64) float64 {
+    if math.IsNaN(value) {
+      return value
+    }
+    return 0.01
+  }); err != nil {
+    log.Fatal(err)
+  }
+  binSize := result.GetBinSize()
+  for _, gene := range genes {
+    seq, err := result.GetSequence(gene.Seqname); if err != nil {
+      continue
+    }
+    for i := gene.From/binSize; i <= (gene.To-1)/binSize && i < seq.NBins(); i++ {
+      if x := seq.AtBin(i); !math.IsNaN(x) && gene.Probability > x {
+        seq.SetBin(i, gene.Probability)
+      }
+    }
+  }
+}
+
+func rna_genes_export(config ConfigModHmm, genes []rnaGene, filename string) {
+  n        := len(genes)
+  seqnames := make([]string,  n)
+  from     := make([]int,     n)
+  to       := make([]int,     n)
+  strand   := make([]byte,    n)
+  names    := make([]string,  n)
+  tpm      := make([]float64, n)
+  prob     := make([]float64, n)
+  for j, gene := range genes {
+    seqnames[j] = gene.Seqname
+    from    [j] = gene.From
+    to      [j] = gene.To
+    strand  [j] = gene.Strand
+    names   [j] = gene.Name
+    tpm     [j] = gene.TPM
+    prob    [j] = gene.Probability
+  }
+  granges := NewGRanges(seqnames, from, to, strand)
+  granges.AddMeta("gene_id",     names)
+  granges.AddMeta("tpm",         tpm)
+  granges.AddMeta("probability", prob)
+  printStderr(config, 1, "Exporting gene-level RNA enrichment to `%s'... ", filename)
+  if err := granges.ExportTable(filename, true, true, false, OptionPrintScientific{true}); err != nil {
+    printStderr(config, 1, "failed\n")
+    log.Fatal(err)
+  }
+  printStderr(config, 1, "done\n")
+}
+
+/* -------------------------------------------------------------------------- */
+
+func enrichment_eval_rna_genes(config ConfigModHmm, files EnrichmentFiles) {
+  genes  := import_rna_genes(config, files.Annotation.Filename)
+  data   := enrichment_import_heuristic(config, files)
+  result := AllocSimpleTrack("classification", data.GetGenome(), data.GetBinSize())
+
+  rna_genes_expression(config, genes, data)
+  rna_genes_eval(config, result, data, genes)
+
+  rna_genes_export(config, genes, rnaGenesFilename(files.Probabilities.Filename))
+
+  if err := ExportTrack(config.SessionConfig, result, files.Probabilities.Filename); err != nil {
+    log.Fatal(err)
+  }
+}
@@ -0,0 +1,89 @@
+/* Copyright (C) 2020 Philipp Benner
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+/* -------------------------------------------------------------------------- */
+
+import   "io/ioutil"
+import   "math"
+import   "path/filepath"
+import   "testing"
+
+import . "github.com/pbenner/gonetics"
+
+import . "github.com/pbenner/modhmm/config"
+
+/* -------------------------------------------------------------------------- */
+
+func TestRnaGenes(t *testing.T) {
+  dir, cleanup := testTempDir(t)
+  defer cleanup()
+
+  config := DefaultModHmmConfig()
+  config.RnaTpmThreshold = 1e5
+
+  // gene g1 with two transcripts and overlapping exons, gene g2 without
+  // expression
+  filename := filepath.Join(dir, "genes.gtf")
+  if err := ioutil.WriteFile(filename, []byte(
+    "chr1\ttest\tgene\t101\t1000\t.\t+\t.\tgene_id \"g1\";\n" +
+    "chr1\ttest\texon\t101\t300\t.\t+\t.\tgene_id \"g1\"; transcript_id \"t1\";\n" +
+    "chr1\ttest\texon\t201\t400\t.\t+\t.\tgene_id \"g1\"; transcript_id \"t2\";\n" +
+    "chr1\ttest\texon\t801\t1000\t.\t+\t.\tgene_id \"g1\"; transcript_id \"t2\";\n" +
+    "chr1\ttest\texon\t1501\t1600\t.\t-\t.\tgene_id \"g2\"; transcript_id \"t3\";\n"), 0666); err != nil {
+    t.Fatal(err)
+  }
+  genes := import_rna_genes(config, filename)
+  if len(genes) != 2 || genes[0].Name != "g1" || genes[0].From != 100 || genes[0].To != 1000 || len(genes[0].Exons) != 2 || genes[0].Exons[0] != NewRange(100, 400) {
+    t.Fatalf("test failed: %v", genes)
+  }
+  if genes[1].Strand != '-' {
+    t.Errorf("test failed: %v", genes[1])
+  }
+  // coverage within exons of g1 and in the intron of g1
+  data := AllocSimpleTrack("data", NewGenome([]string{"chr1"}, []int{2000}), 100)
+  seq, _ := data.GetMutableSequence("chr1")
+  for _, i := range []int{1, 2, 3, 8, 9} {
+    seq.SetBin(i, 10.0)
+  }
+  seq.SetBin(5, 100.0)
+  seq.SetBin(19, math.NaN())
+  rna_genes_expression(config, genes, data)
+
+  if math.Abs(genes[0].TPM - 1e6) > 1e-8 || genes[1].TPM != 0.0 {
+    t.Errorf("test failed: %v", genes)
+  }
+  if math.Abs(genes[0].Probability - 1.0/1.01) > 1e-8 || genes[1].Probability != 0.01 {
+    t.Errorf("test failed: %v", genes)
+  }
+  result := AllocSimpleTrack("result", data.GetGenome(), 100)
+  rna_genes_eval(config, result, data, genes)
+
+  r, _ := result.GetSequence("chr1")
+  for i := 0; i < r.NBins(); i++ {
+    p := 0.01
+    switch {
+    case i >= 1 && i < 10:
+      p = genes[0].Probability
+    case i == 19:
+      p = math.NaN()
+    }
+    if x := r.AtBin(i); x != p && !(math.IsNaN(x) && math.IsNaN(p)) {
+      t.Errorf("test failed for bin %d: %f", i, x)
+    }
+  }
+}
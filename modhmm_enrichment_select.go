@@ -0,0 +1,430 @@
+/* Copyright (C) 2020 Philipp Benner
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+/* -------------------------------------------------------------------------- */
+
+import   "fmt"
+import   "io"
+import   "log"
+import   "math"
+import   "os"
+import   "sort"
+import   "strconv"
+import   "strings"
+
+import . "github.com/pbenner/ngstat/config"
+
+import . "github.com/pbenner/autodiff"
+import . "github.com/pbenner/autodiff/logarithmetic"
+import . "github.com/pbenner/autodiff/statistics"
+import   "github.com/pbenner/autodiff/statistics/scalarDistribution"
+
+import . "github.com/pbenner/gonetics"
+
+import . "github.com/pbenner/modhmm/config"
+import . "github.com/pbenner/modhmm/utility"
+
+/* Data-driven selection of foreground components. Each component receives
+ * a score and components with a score above a threshold are selected:
+ *  - control : ratio between the weight of a component on the data and on
+ *              the depth-scaled control data
+ *  - peaks   : enrichment of the posterior mass of a component within
+ *              reference peaks relative to the genome fraction of peaks
+ *  - fraction: components with the largest means are selected, such that
+ *              their total weight is closest to the target genome fraction
+ * -------------------------------------------------------------------------- */
+
+type componentSelectionEntry struct {
+  Component  int     `json:"Component"`
+  Type       string  `json:"Type"`
+  Weight     float64 `json:"Weight"`
+  Mean       float64 `json:"Mean"`
+  Score      float64 `json:"Score"`
+  Foreground bool    `json:"Foreground"`
+}
+
+type componentSelection struct {
+  Method      string                    `json:"Method"`
+  Threshold   float64                   `json:"Threshold"`
+  Explanation string                    `json:"Explanation"`
+  Components  []componentSelectionEntry `json:"Components"`
+}
+
+func (obj *componentSelection) Import(reader io.Reader, args... interface{}) error {
+  return JsonImport(reader, obj)
+}
+
+func (obj *componentSelection) Export(writer io.Writer) error {
+  return JsonExport(writer, obj)
+}
+
+func (obj componentSelection) Foreground() []int {
+  r := []int{}
+  for _, c := range obj.Components {
+    if c.Foreground {
+      r = append(r, c.Component-1)
+    }
+  }
+  return r
+}
+
+/* -------------------------------------------------------------------------- */
+
+// The selection is stored next to the components file
+func componentSelectionFilename(filenameComponents string) string {
+  return strings.TrimSuffix(filenameComponents, ".json") + ".selection.json"
+}
+
+/* -------------------------------------------------------------------------- */
+
+func mixtureComponentType(pdf ScalarPdf) string {
+  switch a := pdf.(type) {
+  case *scalarDistribution.DeltaDistribution           : return "Delta"
+  case *scalarDistribution.PoissonDistribution         : return "Poisson"
+  case *scalarDistribution.GeometricDistribution       : return "Geometric"
+  case *scalarDistribution.NegativeBinomialDistribution: return "NegBin"
+  case *ZeroInflatedNegativeBinomialDistribution       : return "ZINB"
+  case *scalarDistribution.PdfTranslation              : return mixtureComponentType(a.ScalarPdf)
+  default:
+    return "Unknown"
+  }
+}
+
+// Mean of a discrete mixture component
+func mixtureComponentMean(pdf ScalarPdf) float64 {
+  switch a := pdf.(type) {
+  case *scalarDistribution.DeltaDistribution:
+    return a.X.GetFloat64()
+  case *scalarDistribution.PoissonDistribution:
+    return a.Lambda.GetFloat64()
+  case *scalarDistribution.GeometricDistribution:
+    p := a.GetParameters().Float64At(0)
+    return (1.0-p)/p
+  case *scalarDistribution.NegativeBinomialDistribution:
+    return a.R.GetFloat64()*a.P.GetFloat64()/(1.0-a.P.GetFloat64())
+  case *ZeroInflatedNegativeBinomialDistribution:
+    return (1.0-a.Pi.GetFloat64())*a.R.GetFloat64()*a.P.GetFloat64()/(1.0-a.P.GetFloat64())
+  case *scalarDistribution.PdfTranslation:
+    // the translated density evaluates the inner density at x + c
+    if c, ok := a.ExportConfig().Parameters.([]float64); ok && len(c) == 1 {
+      return mixtureComponentMean(a.ScalarPdf) - c[0]
+    }
+  }
+  // compute mean numerically for other distributions
+  t := NullFloat64()
+  s := 0.0
+  m := 0.0
+  for x := 0.0; x < 1e7 && s < 1.0-1e-10; x++ {
+    if err := pdf.LogPdf(t, ConstFloat64(x)); err != nil {
+      log.Fatal(err)
+    }
+    p := math.Exp(t.GetFloat64())
+    s += p
+    m += p*x
+  }
+  return m
+}
+
+// Posterior probabilities of mixture components for value x
+func mixturePosterior(mixture *scalarDistribution.Mixture, x float64) []float64 {
+  t := NullFloat64()
+  r := make([]float64, mixture.NComponents())
+  s := math.Inf(-1)
+  for k := 0; k < mixture.NComponents(); k++ {
+    if err := mixture.Edist[k].LogPdf(t, ConstFloat64(x)); err != nil {
+      log.Fatal(err)
+    }
+    r[k] = mixture.LogWeights.Float64At(k) + t.GetFloat64()
+    s    = LogAdd(s, r[k])
+  }
+  for k := range r {
+    r[k] = math.Exp(r[k] - s)
+  }
+  return r
+}
+
+// Cache posterior probabilities, since coverage values are discrete
+type mixturePosteriorCache struct {
+  mixture *scalarDistribution.Mixture
+  cache   map[float64][]float64
+}
+
+func (obj mixturePosteriorCache) Get(x float64) []float64 {
+  if r, ok := obj.cache[x]; ok {
+    return r
+  }
+  r := mixturePosterior(obj.mixture, x)
+  obj.cache[x] = r
+  return r
+}
+
+/* -------------------------------------------------------------------------- */
+
+func component_selection_new(mixture *scalarDistribution.Mixture, method string, threshold float64) componentSelection {
+  r := componentSelection{Method: method, Threshold: threshold}
+  for k := 0; k < mixture.NComponents(); k++ {
+    c := componentSelectionEntry{}
+    c.Component = k+1
+    c.Type      = mixtureComponentType(mixture.Edist[k])
+    c.Weight    = math.Exp(mixture.LogWeights.Float64At(k))
+    c.Mean      = mixtureComponentMean(mixture.Edist[k])
+    r.Components = append(r.Components, c)
+  }
+  return r
+}
+
+// Select components with scores above the threshold, making sure that
+// at least one foreground and one background component exist
+func component_selection_threshold(r *componentSelection) {
+  n := 0
+  for i := range r.Components {
+    r.Components[i].Foreground = r.Components[i].Score >= r.Threshold
+    if r.Components[i].Foreground {
+      n++
+    }
+  }
+  if len(r.Components) < 2 {
+    return
+  }
+  if n == 0 || n == len(r.Components) {
+    i_max, i_min := 0, 0
+    for i, c := range r.Components {
+      if c.Score > r.Components[i_max].Score {
+        i_max = i
+      }
+      if c.Score < r.Components[i_min].Score {
+        i_min = i
+      }
+    }
+    if n == 0 {
+      r.Components[i_max].Foreground = true
+      r.Explanation += fmt.Sprintf(" No component passed the threshold, selected component %d with the largest score.", i_max+1)
+    } else {
+      r.Components[i_min].Foreground = false
+      r.Explanation += fmt.Sprintf(" All components passed the threshold, component %d with the smallest score is used as background.", i_min+1)
+    }
+  }
+}
+
+func component_selection_control(config ConfigModHmm, mixture *scalarDistribution.Mixture, data Track, files EnrichmentFiles, threshold float64) (componentSelection, error) {
+  r := component_selection_new(mixture, "control", threshold)
+  filesControl := config.EnrichmentFiles("control")
+  if files.Feature == "control" {
+    return r, fmt.Errorf("control data cannot be used for selecting foreground components of feature `control'")
+  }
+  if !FileExists(filesControl.Coverage.Filename) {
+    return r, fmt.Errorf("control coverage `%s' does not exist", filesControl.Coverage.Filename)
+  }
+  control := enrichment_import_model(config, filesControl, false)
+
+  scale, err := enrichment_control_scale(data, control); if err != nil {
+    return r, err
+  }
+  cache := mixturePosteriorCache{mixture, make(map[float64][]float64)}
+  w := make([]float64, mixture.NComponents())
+  n := 0.0
+  if err := (GenericMutableTrack{}).Map(control, func(seqname string, position int, value float64) float64 {
+    if !math.IsNaN(value) {
+      for k, p := range cache.Get(math.Floor(scale*value+0.5)) {
+        w[k] += p
+      }
+      n += 1.0
+    }
+    return 0.0
+  }); err != nil {
+    return r, err
+  }
+  for k := range r.Components {
+    // components without any weight on the control data receive a large
+    // but finite score
+    r.Components[k].Score = r.Components[k].Weight/math.Max(w[k]/n, 1e-12)
+  }
+  r.Explanation = fmt.Sprintf("Score is the ratio between the weight of each component on the data and on the control data (scaled by %.4f). Components with a ratio of at least %.2f are foreground.", scale, threshold)
+  component_selection_threshold(&r)
+  return r, nil
+}
+
+func component_selection_peaks(config ConfigModHmm, mixture *scalarDistribution.Mixture, data Track, filenamePeaks string, threshold float64) (componentSelection, error) {
+  r := component_selection_new(mixture, "peaks", threshold)
+  peaks, err := importPeakRegions(filenamePeaks); if err != nil {
+    return r, err
+  }
+  cache := mixturePosteriorCache{mixture, make(map[float64][]float64)}
+  w_in  := make([]float64, mixture.NComponents())
+  w_all := make([]float64, mixture.NComponents())
+  n_in  := 0.0
+  n_all := 0.0
+  binSize := data.GetBinSize()
+  if err := (GenericMutableTrack{}).Map(data, func(seqname string, position int, value float64) float64 {
+    if !math.IsNaN(value) {
+      in := peaks.Contains(seqname, position + binSize/2)
+      for k, p := range cache.Get(value) {
+        w_all[k] += p
+        if in {
+          w_in[k] += p
+        }
+      }
+      n_all += 1.0
+      if in {
+        n_in += 1.0
+      }
+    }
+    return 0.0
+  }); err != nil {
+    return r, err
+  }
+  if n_in == 0.0 {
+    return r, fmt.Errorf("reference peaks `%s' do not overlap with any bins", filenamePeaks)
+  }
+  for k := range r.Components {
+    if w_all[k] > 0.0 {
+      r.Components[k].Score = (w_in[k]/w_all[k])/(n_in/n_all)
+    }
+  }
+  r.Explanation = fmt.Sprintf("Score is the enrichment of each component within reference peaks `%s' (%.2f%% of the genome). Components with an enrichment of at least %.2f are foreground.", filenamePeaks, 100.0*n_in/n_all, threshold)
+  component_selection_threshold(&r)
+  return r, nil
+}
+
+func component_selection_fraction(mixture *scalarDistribution.Mixture, fraction float64) componentSelection {
+  r := component_selection_new(mixture, "fraction", fraction)
+  // sort components by decreasing mean
+  idx := make([]int, len(r.Components))
+  for i := range idx {
+    idx[i] = i
+  }
+  sort.SliceStable(idx, func(i, j int) bool { return r.Components[idx[i]].Mean > r.Components[idx[j]].Mean })
+  // find number of components closest to the target fraction, using at
+  // least one foreground and one background component
+  cum := make([]float64, len(idx))
+  for n := range idx {
+    cum[n] = r.Components[idx[n]].Weight
+    if n > 0 {
+      cum[n] += cum[n-1]
+    }
+  }
+  n_best := 0
+  for n := 1; n < len(idx)-1; n++ {
+    if math.Abs(cum[n]-fraction) < math.Abs(cum[n_best]-fraction) {
+      n_best = n
+    }
+  }
+  for n := 0; n <= n_best; n++ {
+    r.Components[idx[n]].Foreground = true
+  }
+  for i := range r.Components {
+    r.Components[i].Score = r.Components[i].Mean
+  }
+  s := cum[n_best]
+  r.Explanation = fmt.Sprintf("Score is the mean of each component. Components with the largest means are foreground, covering %.2f%% of the genome (target: %.2f%%).", 100.0*s, 100.0*fraction)
+  if len(idx) == 2 {
+    r.Explanation += " The mixture has only two components, therefore the component with the largest mean is foreground regardless of the target fraction."
+  }
+  return r
+}
+
+/* -------------------------------------------------------------------------- */
+
+func component_selection_print(selection componentSelection) {
+  fmt.Printf("Foreground selection (%s): %s\n", selection.Method, selection.Explanation)
+  fmt.Printf(":  # %-9s %12s %12s %12s\n", "Type", "Weight", "Mean", "Score")
+  for _, c := range selection.Components {
+    fmt.Printf(": %2d %-9s %12e %12e %12e", c.Component, c.Type, c.Weight, c.Mean, c.Score)
+    if c.Foreground {
+      fmt.Printf(" [foreground]\n")
+    } else {
+      fmt.Printf(" [background]\n")
+    }
+  }
+}
+
+// Import selection if it is consistent with the given foreground components
+func component_selection_import(config ConfigModHmm, filenameComponents string, k []int) (componentSelection, bool) {
+  selection := componentSelection{}
+  if err := ImportFile(&selection, componentSelectionFilename(filenameComponents)); err != nil {
+    return selection, false
+  }
+  s := selection.Foreground()
+  if len(s) != len(k) {
+    return selection, false
+  }
+  for i := range s {
+    if s[i] != k[i] {
+      return selection, false
+    }
+  }
+  return selection, true
+}
+
+// Select foreground components, where method is either `control',
+// `fraction:VALUE' or `peaks:FILE'
+func modhmm_enrichment_select(config ConfigModHmm, feature, method string, threshold float64) {
+  files   := config.EnrichmentFiles(feature)
+  mixture := ImportMixtureDistribution(config, files.Model.Filename)
+  data    := enrichment_import_model(config, files, false)
+
+  var selection componentSelection
+  var err error
+
+  fields := strings.SplitN(method, ":", 2)
+  switch strings.ToLower(fields[0]) {
+  case "control":
+    selection, err = component_selection_control(config, mixture, data, files, threshold)
+  case "peaks":
+    if len(fields) != 2 {
+      log.Fatalf("peaks file missing in foreground selection method `%s'", method)
+    }
+    selection, err = component_selection_peaks(config, mixture, data, fields[1], threshold)
+  case "fraction":
+    if len(fields) != 2 {
+      log.Fatalf("target fraction missing in foreground selection method `%s'", method)
+    }
+    if f, e := strconv.ParseFloat(fields[1], 64); e != nil || f <= 0.0 || f >= 1.0 {
+      log.Fatalf("invalid target fraction in foreground selection method `%s'", method)
+    } else {
+      selection = component_selection_fraction(mixture, f)
+    }
+  default:
+    log.Fatalf("invalid foreground selection method `%s' [control, peaks:FILE, fraction:VALUE]", method)
+  }
+  if err != nil {
+    log.Fatal(err)
+  }
+  printStderr(config, 1, "Foreground selection for feature `%s': %s\n", feature, selection.Explanation)
+  for _, c := range selection.Components {
+    if c.Foreground {
+      printStderr(config, 1, " -> selected component %d (%s, weight: %e, mean: %e, score: %e)\n", c.Component, c.Type, c.Weight, c.Mean, c.Score)
+    }
+  }
+
+  ExportComponents(config, files.Components.Filename, selection.Foreground())
+
+  filename := componentSelectionFilename(files.Components.Filename)
+  printStderr(config, 1, "Exporting foreground selection to `%s'... ", filename)
+  if err := ExportFile(&selection, filename); err != nil {
+    printStderr(config, 1, "failed\n")
+    log.Fatal(err)
+  }
+  printStderr(config, 1, "done\n")
+}
+
+/* -------------------------------------------------------------------------- */
+
+func component_selection_remove(filenameComponents string) {
+  os.Remove(componentSelectionFilename(filenameComponents))
+}
@@ -0,0 +1,110 @@
+/* Copyright (C) 2020 Philipp Benner
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+/* -------------------------------------------------------------------------- */
+
+import   "math"
+import   "strings"
+import   "testing"
+
+import . "github.com/pbenner/autodiff"
+import . "github.com/pbenner/autodiff/statistics"
+import   "github.com/pbenner/autodiff/statistics/scalarDistribution"
+
+/* -------------------------------------------------------------------------- */
+
+func testMixture(t *testing.T, weights []float64, edist ...ScalarPdf) *scalarDistribution.Mixture {
+  if mixture, err := scalarDistribution.NewMixture(NewDenseFloat64Vector(weights), edist); err != nil {
+    t.Fatal(err); return nil
+  } else {
+    return mixture
+  }
+}
+
+func testPoissonPdf(t *testing.T, lambda float64) ScalarPdf {
+  if pdf, err := scalarDistribution.NewPoissonDistribution(NewFloat64(lambda)); err != nil {
+    t.Fatal(err); return nil
+  } else {
+    return pdf
+  }
+}
+
+func testDeltaPdf(t *testing.T, x float64) ScalarPdf {
+  if pdf, err := scalarDistribution.NewDeltaDistribution(NewFloat64(x)); err != nil {
+    t.Fatal(err); return nil
+  } else {
+    return pdf
+  }
+}
+
+/* -------------------------------------------------------------------------- */
+
+func TestMixtureComponentMean(t *testing.T) {
+  geometric, _ := scalarDistribution.NewGeometricDistribution(NewFloat64(0.05))
+  negbin   , _ := scalarDistribution.NewNegativeBinomialDistribution(NewFloat64(2.5), NewFloat64(0.7))
+  zinb     , _ := NewZeroInflatedNegativeBinomialDistribution(NewFloat64(0.3), NewFloat64(2.5), NewFloat64(0.7))
+  translated, _ := scalarDistribution.NewPdfTranslation(negbin, -2.0)
+  for _, pdf := range []ScalarPdf{testDeltaPdf(t, 3.0), testPoissonPdf(t, 4.5), geometric, negbin, zinb, translated} {
+    // compare closed form with the numerical mean
+    r := NullFloat64()
+    m := 0.0
+    for x := 0.0; x < 10000.0; x++ {
+      if err := pdf.LogPdf(r, ConstFloat64(x)); err != nil {
+        t.Fatal(err)
+      }
+      m += x*math.Exp(r.GetFloat64())
+    }
+    if v := mixtureComponentMean(pdf); math.Abs(v-m) > 1e-6 {
+      t.Errorf("test failed for %s: %f != %f", mixtureComponentType(pdf), v, m)
+    }
+  }
+}
+
+func TestSelectionFraction(t *testing.T) {
+  mixture := testMixture(t, []float64{0.6, 0.3, 0.1}, testDeltaPdf(t, 0.0), testPoissonPdf(t, 20.0), testPoissonPdf(t, 2.0))
+  for fraction, result := range map[float64][]int{0.1: {1}, 0.38: {1, 2}, 0.9: {1, 2}} {
+    k := component_selection_fraction(mixture, fraction).Foreground()
+    if len(k) != len(result) {
+      t.Errorf("test failed for fraction %f: %v", fraction, k)
+      continue
+    }
+    for i := range k {
+      if k[i] != result[i] {
+        t.Errorf("test failed for fraction %f: %v", fraction, k)
+      }
+    }
+  }
+  // with two components the target fraction cannot be used
+  mixture = testMixture(t, []float64{0.5, 0.5}, testDeltaPdf(t, 0.0), testPoissonPdf(t, 20.0))
+  if r := component_selection_fraction(mixture, 0.9); len(r.Foreground()) != 1 || r.Foreground()[0] != 1 || !strings.Contains(r.Explanation, "only two components") {
+    t.Errorf("test failed: %v", r)
+  }
+}
+
+func TestSelectionThreshold(t *testing.T) {
+  r := componentSelection{Threshold: 2.0, Components: []componentSelectionEntry{{Component: 1, Score: 0.5}, {Component: 2, Score: 1.0}, {Component: 3, Score: 1.5}}}
+  // no component passes the threshold
+  if component_selection_threshold(&r); len(r.Foreground()) != 1 || r.Foreground()[0] != 2 {
+    t.Errorf("test failed: %v", r.Foreground())
+  }
+  // all components pass the threshold
+  r.Threshold = 0.1
+  if component_selection_threshold(&r); len(r.Foreground()) != 2 || r.Foreground()[0] != 1 {
+    t.Errorf("test failed: %v", r.Foreground())
+  }
+}
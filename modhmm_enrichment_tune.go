@@ -0,0 +1,312 @@
+/* Copyright (C) 2019 Philipp Benner
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+/* -------------------------------------------------------------------------- */
+
+import   "fmt"
+import   "io"
+import   "log"
+import   "math"
+import   "os"
+import   "strconv"
+import   "strings"
+
+import . "github.com/pbenner/ngstat/config"
+import . "github.com/pbenner/gonetics"
+
+import . "github.com/pbenner/modhmm/config"
+import . "github.com/pbenner/modhmm/utility"
+
+import   "github.com/pborman/getopt"
+
+/* Tuning of the quantile parameter of the heuristic enrichment method. The
+ * quantile is selected such that
+ *  - fraction: the expected fraction of enriched bins matches a target
+ *  - model   : the mean squared difference to enrichment probabilities of
+ *              the mixture model method is minimal
+ * All other heuristic parameters are kept fixed. For efficiency, the
+ * logistic function is computed in closed form during the search.
+ * -------------------------------------------------------------------------- */
+
+type enrichmentTuning struct {
+  Feature  string
+  Method   string
+  Target   float64
+  Default  float64
+  Quantile float64
+  Fraction float64
+  Loss     float64
+}
+
+type enrichmentParametersFragment struct {
+  EnrichmentParameters ConfigEnrichmentParameters `json:"Enrichment Parameters"`
+}
+
+func (obj *enrichmentParametersFragment) Import(reader io.Reader, args... interface{}) error {
+  return JsonImport(reader, obj)
+}
+
+func (obj *enrichmentParametersFragment) Export(writer io.Writer) error {
+  return JsonExport(writer, obj)
+}
+
+/* -------------------------------------------------------------------------- */
+
+func logit(p float64) float64 {
+  return math.Log(p/(1.0-p))
+}
+
+// Logistic function for the given quantile parameter, returns false if the
+// function is degenerate
+func enrichment_tune_sigmoid(feature string, parameters []float64, q float64, counts Counts) (func(float64) float64, bool) {
+  p := append([]float64{}, parameters...)
+  p[0] = q
+  m1, m2, p1, p2 := enrichment_eval_heuristic_points(feature, p, counts)
+  if m2 <= m1 {
+    // all bins above m1 are enriched
+    return func(x float64) float64 {
+      if x > m1 {
+        return 1.0
+      }
+      return 0.0
+    }, false
+  }
+  a := (logit(p2) - logit(p1))/(m2 - m1)
+  b := logit(p1) - a*m1
+  return func(x float64) float64 {
+    return 1.0/(1.0 + math.Exp(-a*x-b))
+  }, true
+}
+
+func enrichment_tune_fraction_eval(feature string, parameters []float64, q float64, counts Counts) float64 {
+  f, _ := enrichment_tune_sigmoid(feature, parameters, q, counts)
+  n := 0
+  r := 0.0
+  for i := range counts.X {
+    r += float64(counts.Y[i])*f(counts.X[i])
+    n += counts.Y[i]
+  }
+  return r/float64(n)
+}
+
+// The expected fraction of enriched bins is not necessarily monotonic in
+// the quantile, which is therefore selected on a grid
+func enrichment_tune_fraction(config ConfigModHmm, files EnrichmentFiles, counts Counts, target float64) enrichmentTuning {
+  parameters := config.EnrichmentParameters.GetParameters(files.Feature)
+  r := enrichmentTuning{Feature: files.Feature, Method: "fraction", Target: target, Default: parameters[0], Fraction: math.Inf(1), Loss: math.NaN()}
+  for i := 1; i < 1000; i++ {
+    q := float64(i)/1000.0
+    f := enrichment_tune_fraction_eval(files.Feature, parameters, q, counts)
+    if math.Abs(f - target) < math.Abs(r.Fraction - target) {
+      r.Quantile = q
+      r.Fraction = f
+    }
+  }
+  return r
+}
+
+func enrichment_tune_model(config ConfigModHmm, files EnrichmentFiles, counts Counts, data Track) enrichmentTuning {
+  parameters := config.EnrichmentParameters.GetParameters(files.Feature)
+  r := enrichmentTuning{Feature: files.Feature, Method: "model", Target: math.NaN(), Default: parameters[0], Loss: math.Inf(1)}
+
+  mixture := ImportMixtureDistribution(config, files.Model.Filename)
+  k, _    := ImportComponents(config, files.Components.Filename, mixture.NComponents())
+  cache   := mixturePosteriorCache{mixture, make(map[float64][]float64)}
+  // the model method is applied to normalized data
+  normalized := enrichment_import_model(config, files, true)
+
+  // joint counts of raw and normalized coverage values
+  joint := make(map[[2]float64]int)
+  for _, name := range data.GetSeqNames() {
+    seq1, err := data      .GetSequence(name); if err != nil {
+      log.Fatal(err)
+    }
+    seq2, err := normalized.GetSequence(name); if err != nil {
+      log.Fatal(err)
+    }
+    for i := 0; i < seq1.NBins(); i++ {
+      if x, y := seq1.AtBin(i), seq2.AtBin(i); !math.IsNaN(x) && !math.IsNaN(y) {
+        joint[[2]float64{x, y}]++
+      }
+    }
+  }
+  // posterior probabilities of foreground components
+  posterior := make(map[float64]float64)
+  for xy := range joint {
+    if _, ok := posterior[xy[1]]; !ok {
+      p := 0.0
+      for _, j := range k {
+        p += cache.Get(xy[1])[j]
+      }
+      posterior[xy[1]] = p
+    }
+  }
+  for i := 1; i < 200; i++ {
+    q    := float64(i)/200.0
+    f, _ := enrichment_tune_sigmoid(files.Feature, parameters, q, counts)
+    n := 0
+    s := 0.0
+    for xy, c := range joint {
+      d := f(xy[0]) - posterior[xy[1]]
+      s += float64(c)*d*d
+      n += c
+    }
+    if s /= float64(n); s < r.Loss {
+      r.Quantile = q
+      r.Loss     = s
+    }
+  }
+  r.Fraction = enrichment_tune_fraction_eval(files.Feature, parameters, r.Quantile, counts)
+  return r
+}
+
+/* -------------------------------------------------------------------------- */
+
+func enrichment_tune_print(config ConfigModHmm, tunings []enrichmentTuning) {
+  printStderr(config, 0, "Tuned enrichment parameters:\n")
+  printStderr(config, 0, ": %-8s %8s %10s %10s %10s %10s %10s\n", "Feature", "Method", "Target", "Default", "Quantile", "Fraction", "MSE")
+  for _, r := range tunings {
+    printStderr(config, 0, ": %-8s %8s %10.4f %10.4f %10.4f %10.4f %10.4f\n", r.Feature, r.Method, r.Target, r.Default, r.Quantile, r.Fraction, r.Loss)
+  }
+}
+
+func modhmm_enrichment_tune(config ConfigModHmm, method string, targets map[string]float64, features []string) []enrichmentTuning {
+  r := []enrichmentTuning{}
+  for _, feature := range features {
+    files := config.EnrichmentFiles(feature)
+    if !FileExists(files.Coverage.Filename) {
+      if EnrichmentIsOptional(files.Feature) {
+        continue
+      }
+      log.Fatalf("coverage file `%s' for feature `%s' does not exist", files.Coverage.Filename, files.Feature)
+    }
+    target, ok := targets[files.Feature]
+    if !ok {
+      target, ok = targets[""]
+    }
+    if method == "fraction" && !ok {
+      continue
+    }
+    // RNA-seq data is thresholded by the model method
+    if method == "model" && files.Feature == "rna" {
+      printStderr(config, 1, "Warning: parameters of feature `rna' cannot be tuned with the model method\n")
+      continue
+    }
+    printStderr(config, 1, "==> Tuning Enrichment Parameters (%s) <==\n", files.Feature)
+    data   := enrichment_import_heuristic(config, files)
+    counts := compute_counts(config, data)
+    switch method {
+    case "fraction":
+      r = append(r, enrichment_tune_fraction(config, files, counts, target))
+    case "model":
+      r = append(r, enrichment_tune_model(config, files, counts, data))
+    }
+  }
+  return r
+}
+
+/* -------------------------------------------------------------------------- */
+
+// Parse target fractions, given either as a single value or as a list of
+// FEATURE:VALUE pairs
+func parse_enrichment_tune_targets(config ConfigModHmm, str string) (map[string]float64, error) {
+  r := make(map[string]float64)
+  for _, s := range strings.Split(str, ",") {
+    feature := ""
+    if i := strings.Index(s, ":"); i != -1 {
+      feature, s = s[0:i], s[i+1:]
+      if !EnrichmentList.Contains(strings.ToLower(config.CoerceOpenChromatinAssay(feature))) {
+        return nil, fmt.Errorf("unknown feature: %s", feature)
+      }
+      feature = config.EnrichmentFiles(config.CoerceOpenChromatinAssay(feature)).Feature
+    }
+    v, err := strconv.ParseFloat(s, 64)
+    if err != nil {
+      return nil, err
+    }
+    if v <= 0.0 || v >= 1.0 {
+      return nil, fmt.Errorf("target fraction `%v' must be in (0, 1)", v)
+    }
+    r[feature] = v
+  }
+  return r, nil
+}
+
+func modhmm_enrichment_tune_main(config ConfigModHmm, args []string) {
+
+  options := getopt.New()
+  options.SetProgram(fmt.Sprintf("%s tune-enrichment-parameters", os.Args[0]))
+  options.SetParameters("[FEATURE]...\n")
+
+  optMethod   := options.StringLong("method",   0 , "fraction", "tuning method [fraction, model]")
+  optFraction := options.StringLong("fraction", 0 , "",         "target fraction of enriched bins (e.g. 0.02 or h3k27ac:0.02,h3k4me3:0.01)")
+  optSave     := options.StringLong("save",     0 , "",         "save config fragment to file [default: stdout]")
+  optHelp     := options.  BoolLong("help",    'h',             "print help")
+
+  options.Parse(args)
+
+  // command options
+  if *optHelp {
+    options.PrintUsage(os.Stdout)
+    os.Exit(0)
+  }
+  method  := strings.ToLower(*optMethod)
+  targets := map[string]float64{}
+  switch method {
+  case "fraction":
+    if *optFraction == "" {
+      log.Fatal("tuning method `fraction' requires option --fraction")
+    }
+    if r, err := parse_enrichment_tune_targets(config, *optFraction); err != nil {
+      log.Fatal(err)
+    } else {
+      targets = r
+    }
+  case "model":
+  default:
+    log.Fatalf("invalid tuning method `%s' [fraction, model]", *optMethod)
+  }
+  features := append([]string{}, EnrichmentList...)
+  if len(options.Args()) > 0 {
+    features = options.Args()
+  }
+  for i, feature := range features {
+    features[i] = config.CoerceOpenChromatinAssay(feature)
+  }
+  tunings := modhmm_enrichment_tune(config, method, targets, features)
+
+  enrichment_tune_print(config, tunings)
+
+  // write config fragment with tuned parameters
+  fragment := enrichmentParametersFragment{config.EnrichmentParameters}
+  for _, r := range tunings {
+    p := append([]float64{}, config.EnrichmentParameters.GetParameters(r.Feature)...)
+    p[0] = r.Quantile
+    fragment.EnrichmentParameters.SetParameters(r.Feature, p)
+  }
+  if *optSave == "" {
+    if err := fragment.Export(os.Stdout); err != nil {
+      log.Fatal(err)
+    }
+    fmt.Println()
+  } else {
+    if err := ExportFile(&fragment, *optSave); err != nil {
+      log.Fatal(err)
+    }
+  }
+}
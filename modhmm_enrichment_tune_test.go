@@ -0,0 +1,79 @@
+/* Copyright (C) 2020 Philipp Benner
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+/* -------------------------------------------------------------------------- */
+
+import   "math"
+import   "testing"
+
+import . "github.com/pbenner/modhmm/config"
+
+/* -------------------------------------------------------------------------- */
+
+func TestEnrichmentTuneSigmoid(t *testing.T) {
+  config     := DefaultModHmmConfig()
+  parameters := config.EnrichmentParameters.GetParameters("h3k27ac")
+  counts     := testExpectedCounts(t, testMixture(t, []float64{0.9, 0.1}, testPoissonPdf(t, 2.0), testPoissonPdf(t, 20.0)), 1e6)
+
+  // logistic function passes through the points of the heuristic method
+  f, ok := enrichment_tune_sigmoid("h3k27ac", parameters, parameters[0], counts)
+  if !ok {
+    t.Fatal("test failed")
+  }
+  m1, m2, p1, p2 := enrichment_eval_heuristic_points("h3k27ac", parameters, counts)
+  if math.Abs(f(m1) - p1) > 1e-8 || math.Abs(f(m2) - p2) > 1e-8 || f(0.0) >= f(m1) {
+    t.Errorf("test failed: %f %f", f(m1), f(m2))
+  }
+  // degenerate data
+  if _, ok := enrichment_tune_sigmoid("h3k27ac", parameters, 0.5, Counts{X: []float64{3}, Y: []int{100}}); ok {
+    t.Error("test failed")
+  }
+}
+
+func TestEnrichmentTuneFraction(t *testing.T) {
+  config := DefaultModHmmConfig()
+  files  := config.EnrichmentFiles("h3k27ac")
+  counts := testExpectedCounts(t, testMixture(t, []float64{0.9, 0.1}, testPoissonPdf(t, 2.0), testPoissonPdf(t, 20.0)), 1e6)
+
+  for _, target := range []float64{0.02, 0.05, 0.1} {
+    r := enrichment_tune_fraction(config, files, counts, target)
+    if math.Abs(r.Fraction - target) > 0.01 || r.Quantile <= 0.0 || r.Quantile >= 1.0 {
+      t.Errorf("test failed for target %f: %v", target, r)
+    }
+    parameters := config.EnrichmentParameters.GetParameters("h3k27ac")
+    if f := enrichment_tune_fraction_eval("h3k27ac", parameters, r.Quantile, counts); f != r.Fraction {
+      t.Errorf("test failed: %f != %f", f, r.Fraction)
+    }
+  }
+}
+
+func TestParseEnrichmentTuneTargets(t *testing.T) {
+  config := DefaultModHmmConfig()
+  config.OpenChromatinAssay = "atac"
+  r, err := parse_enrichment_tune_targets(config, "0.1,h3k27ac:0.05,atac:0.2"); if err != nil {
+    t.Fatal(err)
+  }
+  if len(r) != 3 || r[""] != 0.1 || r["h3k27ac"] != 0.05 || r["open"] != 0.2 {
+    t.Errorf("test failed: %v", r)
+  }
+  for _, str := range []string{"1.0", "0.0", "abc", "foo:0.1", "h3k27ac:"} {
+    if _, err := parse_enrichment_tune_targets(config, str); err == nil {
+      t.Errorf("test failed for `%s'", str)
+    }
+  }
+}
@@ -0,0 +1,245 @@
+/* Copyright (C) 2019 Philipp Benner
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+/* -------------------------------------------------------------------------- */
+
+import   "bufio"
+import   "compress/gzip"
+import   "fmt"
+import   "io"
+import   "log"
+import   "math"
+import   "os"
+import   "strconv"
+import   "strings"
+
+import . "github.com/pbenner/autodiff"
+import . "github.com/pbenner/gonetics"
+import . "github.com/pbenner/ngstat/track"
+
+import . "github.com/pbenner/modhmm/config"
+import . "github.com/pbenner/modhmm/utility"
+
+import   "github.com/pborman/getopt"
+
+/* Per-locus breakdown of chromatin state calls. For a single bin, the
+ * enrichment probabilities of all features within the classifier window,
+ * the factors of all chromatin state classifiers, and (if available) the
+ * posterior marginals and the Viterbi state of the HMM are printed.
+ * -------------------------------------------------------------------------- */
+
+type explainableClassifier interface {
+  Factors(x ConstMatrix, f *classifierFactors) float64
+  Dims() (int, int)
+}
+
+/* -------------------------------------------------------------------------- */
+
+// Parse a locus of the form chr:pos, where pos is 1-based
+func parse_explain_locus(str string) (string, int, error) {
+  i := strings.LastIndex(str, ":")
+  if i == -1 {
+    return "", 0, fmt.Errorf("invalid locus `%s' (expected chr:pos)", str)
+  }
+  pos, err := strconv.Atoi(strings.Replace(str[i+1:], ",", "", -1))
+  if err != nil || pos < 1 {
+    return "", 0, fmt.Errorf("invalid position in locus `%s'", str)
+  }
+  return str[0:i], pos-1, nil
+}
+
+// Window of enrichment probabilities with m columns around bin i, as used
+// by BatchClassifyMultiTrack, positions outside the sequence are missing
+func explain_window(sequences []TrackSequence, i, m int) Matrix {
+  x := NullDenseMatrix(Float64Type, len(sequences), m)
+  for j, seq := range sequences {
+    for k := 0; k < m; k++ {
+      if l := i-DivIntUp(m-1, 2)+k; l >= 0 && l < seq.NBins() {
+        x.At(j, k).SetFloat64(seq.AtBin(l))
+      } else {
+        x.At(j, k).SetFloat64(math.NaN())
+      }
+    }
+  }
+  return x
+}
+
+// Value of a track at the given bin, returns false if the track does not
+// exist
+func explain_track_value(config ConfigModHmm, filename, seqname string, i int) (float64, bool) {
+  if !FileExists(filename) {
+    return math.NaN(), false
+  }
+  track, err := ImportTrack(config.SessionConfig, filename); if err != nil {
+    log.Fatal(err)
+  }
+  seq, err := track.GetSequence(seqname); if err != nil || i >= seq.NBins() {
+    return math.NaN(), true
+  }
+  return seq.AtBin(i), true
+}
+
+// Name of the segment of a segmentation BED file that contains the given
+// position
+func explain_viterbi_state(filename, seqname string, position int) (string, error) {
+  f, err := os.Open(filename)
+  if err != nil {
+    return "", err
+  }
+  defer f.Close()
+
+  var reader io.Reader = f
+  if strings.HasSuffix(filename, ".gz") {
+    g, err := gzip.NewReader(f)
+    if err != nil {
+      return "", err
+    }
+    defer g.Close()
+    reader = g
+  }
+  scanner := bufio.NewScanner(reader)
+  for scanner.Scan() {
+    fields := strings.Fields(scanner.Text())
+    // skip track line and comments
+    if len(fields) < 4 || fields[0] == "track" || strings.HasPrefix(fields[0], "#") || fields[0] != seqname {
+      continue
+    }
+    from, err1 := strconv.Atoi(fields[1])
+    to,   err2 := strconv.Atoi(fields[2])
+    if err1 != nil || err2 != nil {
+      return "", fmt.Errorf("invalid segmentation file `%s'", filename)
+    }
+    if from <= position && position < to {
+      return fields[3], nil
+    }
+  }
+  if err := scanner.Err(); err != nil {
+    return "", err
+  }
+  return "", nil
+}
+
+/* -------------------------------------------------------------------------- */
+
+func explain_print_window(config ConfigModHmm, sequences []TrackSequence, seqname string, i int) {
+  n := newClassifierWindow(config.BinSize, classifierWidthWide).n
+  x := explain_window(sequences, i, n)
+  fmt.Printf("Enrichment probabilities (bins relative to %s:%d-%d):\n", seqname, i*config.BinSize+1, (i+1)*config.BinSize)
+  fmt.Printf(": %-10s", "")
+  for k := 0; k < n; k++ {
+    fmt.Printf(" %6d", k-DivIntUp(n-1, 2))
+  }
+  fmt.Println()
+  for j, feature := range EnrichmentList {
+    fmt.Printf(": %-10s", feature)
+    for k := 0; k < n; k++ {
+      fmt.Printf(" %6.3f", x.Float64At(j, k))
+    }
+    fmt.Println()
+  }
+  fmt.Println()
+}
+
+func explain_print_classifiers(config ConfigModHmm, sequences []TrackSequence, i int) {
+  fmt.Printf("Chromatin state classifiers:\n")
+  for _, state := range ChromatinStateList {
+    classifier, ok := get_chromatin_state_model(config, state).(explainableClassifier); if !ok {
+      continue
+    }
+    _, m := classifier.Dims()
+    f    := classifierFactors{}
+    p    := classifier.Factors(explain_window(sequences, i, m), &f)
+    fmt.Printf(": %-2s %-40s %10.6f\n", strings.ToUpper(state), fmt.Sprintf("(window: %d bins)", m), p)
+    for _, factor := range f {
+      fmt.Printf(":    %-40s %10.6f\n", factor.Name, factor.Value)
+    }
+  }
+  fmt.Println()
+}
+
+func explain_print_hmm(config ConfigModHmm, seqname string, i int) {
+  fmt.Printf("HMM posterior marginals:\n")
+  for _, state := range ChromatinStateList {
+    filename := config.PosteriorProb.GetTargetFile(state).Filename
+    if v, ok := explain_track_value(config, filename, seqname, i); ok {
+      fmt.Printf(": %-2s %10.6f\n", strings.ToUpper(state), v)
+    } else {
+      fmt.Printf(": %-2s %10s (run eval-posterior-marginals)\n", strings.ToUpper(state), "-")
+    }
+  }
+  fmt.Println()
+  if FileExists(config.Segmentation.Filename) {
+    if name, err := explain_viterbi_state(config.Segmentation.Filename, seqname, i*config.BinSize); err != nil {
+      log.Fatal(err)
+    } else {
+      fmt.Printf("Viterbi state: %s\n", name)
+    }
+  } else {
+    fmt.Printf("Viterbi state: - (run segmentation)\n")
+  }
+}
+
+/* -------------------------------------------------------------------------- */
+
+func modhmm_explain(config ConfigModHmm, seqname string, position int) {
+  // compute enrichment probabilities if required
+  modhmm_enrichment_eval_all(config)
+
+  localConfig := config
+  localConfig.BinSummaryStatistics = "mean"
+
+  tracks := chromatin_state_import_tracks(localConfig, modhmm_chromatin_state_eval_dep(config))
+
+  sequences, ok := classifier_training_sequences(tracks, seqname); if !ok {
+    log.Fatalf("sequence `%s' not found", seqname)
+  }
+  i := position/config.BinSize
+  if i >= sequences[0].NBins() {
+    log.Fatalf("position `%d' exceeds length of sequence `%s'", position+1, seqname)
+  }
+  explain_print_window     (config, sequences, seqname, i)
+  explain_print_classifiers(config, sequences, i)
+  explain_print_hmm        (config, seqname, i)
+}
+
+/* -------------------------------------------------------------------------- */
+
+func modhmm_explain_main(config ConfigModHmm, args []string) {
+
+  options := getopt.New()
+  options.SetProgram(fmt.Sprintf("%s explain", os.Args[0]))
+  options.SetParameters("CHR:POS\n")
+
+  optHelp := options.BoolLong("help", 'h', "print help")
+
+  options.Parse(args)
+
+  // command options
+  if *optHelp {
+    options.PrintUsage(os.Stdout)
+    os.Exit(0)
+  }
+  if len(options.Args()) != 1 {
+    options.PrintUsage(os.Stderr)
+    os.Exit(1)
+  }
+  seqname, position, err := parse_explain_locus(options.Args()[0]); if err != nil {
+    log.Fatal(err)
+  }
+  modhmm_explain(config, seqname, position)
+}
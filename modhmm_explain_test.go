@@ -0,0 +1,121 @@
+/* Copyright (C) 2020 Philipp Benner
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+/* -------------------------------------------------------------------------- */
+
+import   "compress/gzip"
+import   "io/ioutil"
+import   "math"
+import   "os"
+import   "path/filepath"
+import   "testing"
+
+import . "github.com/pbenner/ngstat/classification"
+import . "github.com/pbenner/ngstat/config"
+
+import . "github.com/pbenner/autodiff/statistics"
+import . "github.com/pbenner/gonetics"
+
+/* -------------------------------------------------------------------------- */
+
+func TestParseExplainLocus(t *testing.T) {
+  if seqname, position, err := parse_explain_locus("chr1:1,001"); err != nil || seqname != "chr1" || position != 1000 {
+    t.Errorf("test failed: %s %d %v", seqname, position, err)
+  }
+  for _, str := range []string{"chr1", "chr1:0", "chr1:abc"} {
+    if _, _, err := parse_explain_locus(str); err == nil {
+      t.Errorf("test failed for `%s'", str)
+    }
+  }
+}
+
+func TestExplainWindow(t *testing.T) {
+  // the window must agree with the window evaluated by the batch
+  // classifier
+  genome := NewGenome([]string{"chr1"}, []int{4000})
+  tracks := make([]Track, 8)
+  for j := range tracks {
+    track := AllocSimpleTrack("data", genome, 100)
+    seq, _ := track.GetMutableSequence("chr1")
+    for i := 0; i < seq.NBins(); i++ {
+      _, f := math.Modf(0.37*float64(j) + 0.13*float64(i))
+      seq.SetBin(i, 0.05 + 0.9*f)
+    }
+    tracks[j] = track
+  }
+  sequences, ok := classifier_training_sequences(tracks, "chr1"); if !ok {
+    t.Fatal("test failed")
+  }
+  for _, classifier := range []explainableClassifier{NewClassifierPA(100, nil), NewClassifierTR(nil), NewClassifierEA(100, nil)} {
+    result, err := BatchClassifyMultiTrack(SessionConfig{Threads: 1, BinSize: 100}, classifier.(MatrixBatchClassifier), tracks, false); if err != nil {
+      t.Fatal(err)
+    }
+    seq, _ := result.GetSequence("chr1")
+    for _, i := range []int{10, 20, 30} {
+      _, m := classifier.Dims()
+      f    := classifierFactors{}
+      if p := classifier.Factors(explain_window(sequences, i, m), &f); math.Abs(p - seq.AtBin(i)) > 1e-12 || len(f) == 0 {
+        t.Errorf("test failed for bin %d: %f != %f", i, p, seq.AtBin(i))
+      }
+    }
+  }
+  // positions outside the sequence are missing
+  x := explain_window(sequences, 0, 5)
+  if !math.IsNaN(x.Float64At(0, 0)) || !math.IsNaN(x.Float64At(0, 1)) || x.Float64At(0, 2) != sequences[0].AtBin(0) {
+    t.Errorf("test failed: %v", x)
+  }
+}
+
+func TestExplainViterbiState(t *testing.T) {
+  dir, cleanup := testTempDir(t)
+  defer cleanup()
+
+  content := []byte(
+    "track name=\"segmentation\"\n" +
+    "chr1\t0\t200\tPA\t0\t.\n" +
+    "chr1\t200\t1000\tNS\t0\t.\n" +
+    "chr2\t0\t1000\tTR\t0\t.\n")
+  filename1 := filepath.Join(dir, "segmentation.bed")
+  if err := ioutil.WriteFile(filename1, content, 0666); err != nil {
+    t.Fatal(err)
+  }
+  filename2 := filepath.Join(dir, "segmentation.bed.gz")
+  if f, err := os.Create(filename2); err != nil {
+    t.Fatal(err)
+  } else {
+    w := gzip.NewWriter(f)
+    w.Write(content)
+    w.Close()
+    f.Close()
+  }
+  for _, filename := range []string{filename1, filename2} {
+    for _, test := range []struct{seqname string; position int; state string}{
+      {"chr1",  199, "PA"},
+      {"chr1",  200, "NS"},
+      {"chr2",  500, "TR"},
+      {"chr1", 1000, ""  },
+      {"chr3",    0, ""  }} {
+      if state, err := explain_viterbi_state(filename, test.seqname, test.position); err != nil || state != test.state {
+        t.Errorf("test failed for `%s:%d': %s %v", test.seqname, test.position, state, err)
+      }
+    }
+  }
+  if _, err := explain_viterbi_state(filepath.Join(dir, "missing.bed"), "chr1", 0); err == nil {
+    t.Error("test failed")
+  }
+}
@@ -0,0 +1,162 @@
+/* Copyright (C) 2020 Philipp Benner
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+/* -------------------------------------------------------------------------- */
+
+import   "fmt"
+import   "math"
+import   "strings"
+import   "sync"
+
+import . "github.com/pbenner/ngstat/track"
+
+import . "github.com/pbenner/gonetics"
+
+import . "github.com/pbenner/modhmm/config"
+
+/* -------------------------------------------------------------------------- */
+
+// mappability tracks are shared by all features, but imported only once
+// for each bin size
+var mappabilityMutex sync.Mutex
+var mappabilityCache = make(map[int]SimpleTrack)
+
+func mappabilityIsBigWig(filename string) bool {
+  filename = strings.ToLower(filename)
+  return strings.HasSuffix(filename, ".bw") || strings.HasSuffix(filename, ".bigwig")
+}
+
+// Import mappability from a BED file, where all listed regions are
+// considered mappable. The value of each bin is the fraction of
+// mappable positions. Sequences without any listed region are not
+// part of the track.
+func importMappabilityBed(filename string, genome Genome, binSize int) (SimpleTrack, error) {
+  regions := GRanges{}
+  if err := regions.ImportBed3(filename); err != nil {
+    return SimpleTrack{}, err
+  }
+  listed := make(map[string]bool)
+  for _, seqname := range regions.Seqnames {
+    listed[seqname] = true
+  }
+  seqnames := []string{}
+  lengths  := []int{}
+  for i, seqname := range genome.Seqnames {
+    if listed[seqname] {
+      seqnames = append(seqnames, seqname)
+      lengths  = append(lengths,  genome.Lengths[i])
+    }
+  }
+  track := AllocSimpleTrack("mappability", NewGenome(seqnames, lengths), binSize)
+  for i := 0; i < regions.Length(); i++ {
+    s, err := track.GetMutableSequence(regions.Seqnames[i]); if err != nil {
+      continue
+    }
+    from := regions.Ranges[i].From
+    to   := regions.Ranges[i].To
+    for j := from/binSize; j < s.NBins() && j*binSize < to; j++ {
+      a := j*binSize
+      b := a + binSize
+      if a < from { a = from }
+      if b > to   { b = to   }
+      s.SetBin(j, math.Min(1.0, s.AtBin(j) + float64(b-a)/float64(binSize)))
+    }
+  }
+  return track, nil
+}
+
+func importMappability(config ConfigModHmm, genome Genome, binSize int) (SimpleTrack, error) {
+  mappabilityMutex.Lock()
+  defer mappabilityMutex.Unlock()
+
+  if track, ok := mappabilityCache[binSize]; ok {
+    return track, nil
+  }
+  var track SimpleTrack
+  var err   error
+
+  printStderr(config, 1, "Importing mappability from `%s'\n", config.Mappability)
+  if mappabilityIsBigWig(config.Mappability) {
+    localConfig := config
+    localConfig.BinSize              = binSize
+    localConfig.BinSummaryStatistics = "mean"
+    localConfig.TrackInit            = 0.0
+    localConfig.Verbose              = 0
+    track, err = ImportTrack(localConfig.SessionConfig, config.Mappability)
+  } else {
+    track, err = importMappabilityBed(config.Mappability, genome, binSize)
+  }
+  if err != nil {
+    return track, fmt.Errorf("importing mappability `%s' failed: %v", config.Mappability, err)
+  }
+  mappabilityCache[binSize] = track
+  return track, nil
+}
+
+/* -------------------------------------------------------------------------- */
+
+// Apply f to all bins of the track. The second argument of f is the
+// mappability of the bin, or NaN if the bin has low mappability.
+// Sequences that are not covered by the mappability track are left
+// unchanged.
+func mappabilityMap(config ConfigModHmm, track MutableTrack, f func(float64, float64) float64) error {
+  if config.Mappability == "" {
+    return nil
+  }
+  mappability, err := importMappability(config, track.GetGenome(), track.GetBinSize()); if err != nil {
+    return err
+  }
+  for _, name := range track.GetSeqNames() {
+    dst, err := track.GetMutableSequence(name); if err != nil {
+      return err
+    }
+    src, err := mappability.GetSequence(name); if err != nil {
+      continue
+    }
+    for i := 0; i < dst.NBins(); i++ {
+      m := 1.0
+      if i < src.NBins() {
+        m = src.AtBin(i)
+      }
+      if math.IsNaN(m) || m < config.MappabilityThreshold {
+        m = math.NaN()
+      }
+      dst.SetBin(i, f(dst.AtBin(i), m))
+    }
+  }
+  return nil
+}
+
+// Set all bins with low mappability to the given value.
+func mappabilityMask(config ConfigModHmm, track MutableTrack, value float64) error {
+  return mappabilityMap(config, track, func(x, m float64) float64 {
+    if math.IsNaN(m) {
+      return value
+    } else {
+      return x
+    }
+  })
+}
+
+// Mask bins with low mappability as missing data and rescale the
+// coverage of all remaining bins by their mappability.
+func mappabilityRescale(config ConfigModHmm, track MutableTrack) error {
+  return mappabilityMap(config, track, func(x, m float64) float64 {
+    return x/m
+  })
+}
@@ -0,0 +1,97 @@
+/* Copyright (C) 2020 Philipp Benner
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+/* -------------------------------------------------------------------------- */
+
+import   "io/ioutil"
+import   "math"
+import   "path/filepath"
+import   "testing"
+
+import . "github.com/pbenner/gonetics"
+
+import . "github.com/pbenner/modhmm/config"
+
+/* -------------------------------------------------------------------------- */
+
+func TestMappabilityMask(t *testing.T) {
+  dir, cleanup := testTempDir(t)
+  defer cleanup()
+
+  filename := filepath.Join(dir, "mappability.bed")
+  if err := ioutil.WriteFile(filename, []byte("chr1\t0\t500\nchr1\t700\t1000\n"), 0666); err != nil {
+    t.Fatal(err)
+  }
+  config := DefaultModHmmConfig()
+  config.Verbose              = 0
+  config.Mappability          = filename
+  config.MappabilityThreshold = 0.5
+  // do not use mappability tracks of other tests
+  mappabilityCache = make(map[int]SimpleTrack)
+  defer func() { mappabilityCache = make(map[int]SimpleTrack) }()
+
+  track := AllocSimpleTrack("test", NewGenome([]string{"chr1", "chr2"}, []int{1000, 1000}), 100)
+  for _, name := range track.GetSeqNames() {
+    seq, _ := track.GetMutableSequence(name)
+    for i := 0; i < seq.NBins(); i++ {
+      seq.SetBin(i, 1.0)
+    }
+  }
+  if err := mappabilityMask(config, track, math.NaN()); err != nil {
+    t.Fatal(err)
+  }
+  seq1, _ := track.GetSequence("chr1")
+  for i := 0; i < seq1.NBins(); i++ {
+    if masked := math.IsNaN(seq1.AtBin(i)); masked != (i == 5 || i == 6) {
+      t.Errorf("test failed for bin %d on chr1", i)
+    }
+  }
+  // chr2 is not covered by the mappability track
+  seq2, _ := track.GetSequence("chr2")
+  for i := 0; i < seq2.NBins(); i++ {
+    if seq2.AtBin(i) != 1.0 {
+      t.Errorf("test failed for bin %d on chr2", i)
+    }
+  }
+}
+
+func TestMappabilityParameters(t *testing.T) {
+  dir, cleanup := testTempDir(t)
+  defer cleanup()
+
+  target := TargetFile{Filename: filepath.Join(dir, "coverage-h3k27ac.bw")}
+  if err := ioutil.WriteFile(target.Filename, []byte{}, 0666); err != nil {
+    t.Fatal(err)
+  }
+  config := DefaultModHmmConfig()
+  // the threshold is irrelevant without mappability track
+  config.MappabilityThreshold = 0.8
+  if updateRequiredParameters(config, target, coverage_parameters) {
+    t.Error("test failed")
+  }
+  config.Mappability = filepath.Join(dir, "mappability.bw")
+  saveTargetParameters(config, target, coverage_parameters)
+  if updateRequiredParameters(config, target, coverage_parameters) {
+    t.Error("test failed")
+  }
+  // rescaled coverage depends on the threshold
+  config.MappabilityThreshold = 0.5
+  if !updateRequiredParameters(config, target, coverage_parameters) {
+    t.Error("test failed")
+  }
+}
@@ -24,7 +24,6 @@ import   "io"
 import   "io/ioutil"
 import   "log"
 import   "math"
-import   "path"
 
 import . "github.com/pbenner/ngstat/config"
 
@@ -38,14 +37,14 @@ import . "github.com/pbenner/modhmm/config"
 /* -------------------------------------------------------------------------- */
 
 func ImportDefaultFile(config ConfigModHmm, object Serializable, filename string, args... interface{}) error {
-  // remove directory from filename
-  _, filename = path.Split(filename)
-  filename = path.Join(config.ModelFallbackPath(), filename)
+  // files are stored under their default names
+  filename = modelPackName(config, filename)
 
-  f, err := assets.Open(filename)
+  f, err := modelFallbackOpen(config, filename)
   if err != nil {
     return err
   }
+  defer f.Close()
   str, err := ioutil.ReadAll(f)
   if err != nil {
     return err
@@ -55,11 +54,14 @@ func ImportDefaultFile(config ConfigModHmm, object Serializable, filename string
 
 func ImportDefaultDistribution(config ConfigModHmm, filename string, distribution BasicDistribution, t ScalarType) error {
   cfg := ConfigDistribution{}
+  // files are stored under their default names
+  filename = modelPackName(config, filename)
 
-  f, err := assets.Open(filename)
+  f, err := modelFallbackOpen(config, filename)
   if err != nil {
     return err
   }
+  defer f.Close()
   if err := cfg.ReadJson(f); err != nil {
     return err
   }
@@ -74,9 +76,6 @@ func ImportMixtureDistribution(config ConfigModHmm, filename string) *scalarDist
   printStderr(config, 1, "Importing mixture model from `%s'... ", filename)
   if err := ImportDistribution(filename, mixture, Float64Type); err != nil {
     printStderr(config, 1, "failed\n")
-    // remove directory from filename
-    _, filename = path.Split(filename)
-    filename = path.Join(config.ModelFallbackPath(), filename)
     printStderr(config, 1, "Importing `%s' fallback mixture model... ", config.ModelFallback)
     if err := ImportDefaultDistribution(config, filename, mixture, Float64Type); err != nil {
       printStderr(config, 1, "failed\n")
@@ -154,6 +153,8 @@ func ImportComponents(config ConfigModHmm, filename string, n int) ([]int, []int
 }
 
 func ExportComponents(config ConfigModHmm, filename string, k []int) {
+  // remove selection of a previous data-driven foreground selection
+  component_selection_remove(filename)
   printStderr(config, 1, "Exporting foreground components to `%s'... ", filename)
   if err := ExportFile((*Components)(&k), filename); err != nil {
     printStderr(config, 1, "failed\n")
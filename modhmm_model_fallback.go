@@ -0,0 +1,292 @@
+/* Copyright (C) 2019 Philipp Benner
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+/* -------------------------------------------------------------------------- */
+
+import   "fmt"
+import   "io"
+import   "log"
+import   "math"
+import   "sort"
+import   "strings"
+import   "sync"
+
+import . "github.com/pbenner/ngstat/config"
+
+import . "github.com/pbenner/modhmm/config"
+import . "github.com/pbenner/modhmm/utility"
+
+/* Automatic selection of fallback models. The distribution of coverage
+ * values of a feature is compared to the reference counts of all compiled
+ * fallback models and the closest model is selected. Coverage values are
+ * first scaled to unit mean, such that differences in sequencing depth do
+ * not affect the comparison. Distances:
+ *  - wasserstein: mean absolute difference between the quantile functions
+ *  - kl         : Kullback-Leibler divergence of the reference from the
+ *                 data distribution, both discretized on data quantiles
+ * -------------------------------------------------------------------------- */
+
+type modelFallbackSelection struct {
+  Feature   string             `json:"Feature"`
+  Distance  string             `json:"Distance"`
+  Distances map[string]float64 `json:"Distances"`
+  Selected  string             `json:"Selected"`
+}
+
+func (obj *modelFallbackSelection) Import(reader io.Reader, args... interface{}) error {
+  return JsonImport(reader, obj)
+}
+
+func (obj *modelFallbackSelection) Export(writer io.Writer) error {
+  return JsonExport(writer, obj)
+}
+
+// The selection is stored next to the (missing) enrichment model
+func modelFallbackSelectionFilename(filenameModel string) string {
+  return strings.TrimSuffix(filenameModel, ".json") + ".fallback.json"
+}
+
+// Selections are cached, since fallback files are opened repeatedly
+var modelFallbackCache = struct {
+  sync.Mutex
+  selected map[string]string
+}{selected: make(map[string]string)}
+
+/* -------------------------------------------------------------------------- */
+
+type scaledCounts struct {
+  X []float64
+  P []float64
+}
+
+// Scale counts to unit mean and convert frequencies to probabilities
+func counts_scaled(counts Counts) (scaledCounts, error) {
+  n := 0
+  m := 0.0
+  for i := range counts.X {
+    n += counts.Y[i]
+    m += float64(counts.Y[i])*counts.X[i]
+  }
+  if n == 0 {
+    return scaledCounts{}, fmt.Errorf("counts are empty")
+  }
+  if m /= float64(n); m <= 0.0 {
+    m = 1.0
+  }
+  r := scaledCounts{}
+  r.X = make([]float64, len(counts.X))
+  r.P = make([]float64, len(counts.X))
+  for i := range counts.X {
+    r.X[i] = counts.X[i]/m
+    r.P[i] = float64(counts.Y[i])/float64(n)
+  }
+  return r, nil
+}
+
+// Quantile function evaluated on a regular grid of size n
+func (obj scaledCounts) Quantiles(n int) []float64 {
+  r := make([]float64, n)
+  j := 0
+  s := obj.P[0]
+  for i := 0; i < n; i++ {
+    u := (float64(i)+0.5)/float64(n)
+    for j < len(obj.X)-1 && s < u {
+      j++; s += obj.P[j]
+    }
+    r[i] = obj.X[j]
+  }
+  return r
+}
+
+// Probability of values smaller or equal to x (up to rounding errors from
+// scaling)
+func (obj scaledCounts) Cdf(x float64) float64 {
+  k := sort.SearchFloat64s(obj.X, x + 1e-8*math.Max(1.0, math.Abs(x)))
+  r := 0.0
+  for i := 0; i < k; i++ {
+    r += obj.P[i]
+  }
+  return r
+}
+
+func counts_distance_wasserstein(a, b scaledCounts) float64 {
+  n  := 1000
+  qa := a.Quantiles(n)
+  qb := b.Quantiles(n)
+  r  := 0.0
+  for i := 0; i < n; i++ {
+    r += math.Abs(qa[i] - qb[i])
+  }
+  return r/float64(n)
+}
+
+func counts_distance_kl(a, b scaledCounts) float64 {
+  // bin boundaries are given by quantiles of the data
+  q := a.Quantiles(100)
+  e := []float64{}
+  for i := range q {
+    if len(e) == 0 || q[i] > e[len(e)-1] {
+      e = append(e, q[i])
+    }
+  }
+  e[len(e)-1] = math.Inf(1)
+  r  := 0.0
+  ca := 0.0
+  cb := 0.0
+  for i := range e {
+    pa := 1.0 - ca
+    pb := 1.0 - cb
+    if !math.IsInf(e[i], 1) {
+      pa = a.Cdf(e[i]) - ca
+      pb = b.Cdf(e[i]) - cb
+    }
+    ca += pa
+    cb += pb
+    if pa > 0.0 {
+      r += pa*math.Log(pa/math.Max(pb, 1e-10))
+    }
+  }
+  return r
+}
+
+func counts_distance(config ConfigModHmm, data, reference Counts) (float64, error) {
+  a, err := counts_scaled(data); if err != nil {
+    return 0.0, err
+  }
+  b, err := counts_scaled(reference); if err != nil {
+    return 0.0, err
+  }
+  switch strings.ToLower(config.ModelFallbackDistance) {
+  case "wasserstein": return counts_distance_wasserstein(a, b), nil
+  case "kl"         : return counts_distance_kl         (a, b), nil
+  default:
+    return 0.0, fmt.Errorf("invalid model fallback distance `%s' [wasserstein, kl]", config.ModelFallbackDistance)
+  }
+}
+
+/* -------------------------------------------------------------------------- */
+
+func model_fallback_compute(config ConfigModHmm, files EnrichmentFiles) modelFallbackSelection {
+  var counts Counts
+  // use reference counts of this data set if available
+  if err := counts.ImportFile(files.CoverageCnts.Filename); err != nil {
+    counts = compute_counts(config, enrichment_import_model(config, files, false))
+  }
+  r := modelFallbackSelection{}
+  r.Feature   = files.Feature
+  r.Distance  = strings.ToLower(config.ModelFallbackDistance)
+  r.Distances = make(map[string]float64)
+  for _, name := range ModelFallbackList {
+    c := config
+    c.ModelFallback = name
+    reference := Counts{}
+    // skip fallback models that do not cover this feature
+    if err := ImportDefaultFile(c, &reference, files.CoverageCnts.Filename); err != nil {
+      continue
+    }
+    d, err := counts_distance(config, counts, reference); if err != nil {
+      log.Fatal(err)
+    }
+    r.Distances[name] = d
+    if r.Selected == "" || d < r.Distances[r.Selected] {
+      r.Selected = name
+    }
+  }
+  if r.Selected == "" {
+    log.Fatalf("no fallback model available for feature `%s'", files.Feature)
+  }
+  return r
+}
+
+func model_fallback_print_selection(config ConfigModHmm, selection modelFallbackSelection) {
+  printStderr(config, 1, "Selected fallback model `%s' for feature `%s' (%s distances:", selection.Selected, selection.Feature, selection.Distance)
+  for _, name := range ModelFallbackList {
+    if d, ok := selection.Distances[name]; ok {
+      printStderr(config, 1, " %s=%.4f", name, d)
+    }
+  }
+  printStderr(config, 1, ")\n")
+}
+
+// Select the fallback model for a feature. The selection is recomputed only
+// if the coverage is more recent.
+func model_fallback_select(config ConfigModHmm, feature string) string {
+  files := config.EnrichmentFiles(feature)
+
+  modelFallbackCache.Lock()
+  defer modelFallbackCache.Unlock()
+
+  if name, ok := modelFallbackCache.selected[files.Feature]; ok {
+    return name
+  }
+  filename  := modelFallbackSelectionFilename(files.Model.Filename)
+  selection := modelFallbackSelection{}
+  if !updateRequired(config, TargetFile{Filename: filename}, files.Coverage.Filename) {
+    if err := ImportFile(&selection, filename); err != nil || selection.Distance != strings.ToLower(config.ModelFallbackDistance) {
+      selection.Selected = ""
+    }
+  }
+  if selection.Selected == "" {
+    printStderr(config, 1, "==> Selecting Fallback Model (%s) <==\n", files.Feature)
+    selection = model_fallback_compute(config, files)
+    model_fallback_print_selection(config, selection)
+    if err := ExportFile(&selection, filename); err != nil {
+      printStderr(config, 1, "Warning: could not export fallback model selection to `%s': %v\n", filename, err)
+    }
+  }
+  modelFallbackCache.selected[files.Feature] = selection.Selected
+  return selection.Selected
+}
+
+// The HMM fallback is the model selected for most features
+func model_fallback_select_hmm(config ConfigModHmm) string {
+  votes := make(map[string]int)
+  for _, feature := range EnrichmentList {
+    files := config.EnrichmentFiles(feature)
+    if !FileExists(files.Coverage.Filename) {
+      continue
+    }
+    votes[model_fallback_select(config, feature)]++
+  }
+  r := ModelFallbackList[0]
+  for _, name := range ModelFallbackList {
+    if votes[name] > votes[r] {
+      r = name
+    }
+  }
+  printStderr(config, 2, "Selected HMM fallback model `%s' (selected for %d features)\n", r, votes[r])
+  return r
+}
+
+// Resolve automatic selection of the fallback model for the given model
+// file, which is identified by its base name
+func model_fallback_auto(config ConfigModHmm, filename string) string {
+  if filename == modelPackHMM {
+    return model_fallback_select_hmm(config)
+  }
+  for _, feature := range EnrichmentList {
+    files := config.EnrichmentFiles(feature)
+    for _, file := range []TargetFile{files.Model, files.Components, files.CoverageCnts} {
+      if modelPackName(config, file.Filename) == filename {
+        return model_fallback_select(config, feature)
+      }
+    }
+  }
+  printStderr(config, 1, "Warning: could not determine feature of `%s'; using fallback model `%s'\n", filename, ModelFallbackList[0])
+  return ModelFallbackList[0]
+}
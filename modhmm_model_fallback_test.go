@@ -0,0 +1,81 @@
+/* Copyright (C) 2020 Philipp Benner
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+/* -------------------------------------------------------------------------- */
+
+import   "math"
+import   "testing"
+
+import . "github.com/pbenner/modhmm/config"
+
+/* -------------------------------------------------------------------------- */
+
+func TestCountsDistance(t *testing.T) {
+  config := DefaultModHmmConfig()
+  a := Counts{X: []float64{0, 1, 2, 3}, Y: []int{50, 30, 15, 5}}
+  // same distribution at twice the sequencing depth
+  b := Counts{X: []float64{0, 2, 4, 6}, Y: []int{100, 60, 30, 10}}
+  // different distribution
+  c := Counts{X: []float64{0, 1, 2, 3}, Y: []int{10, 20, 30, 40}}
+  for _, distance := range []string{"wasserstein", "kl"} {
+    config.ModelFallbackDistance = distance
+    d1, err := counts_distance(config, a, b); if err != nil {
+      t.Fatal(err)
+    }
+    d2, err := counts_distance(config, a, c); if err != nil {
+      t.Fatal(err)
+    }
+    if math.Abs(d1) > 1e-8 || d2 < 0.05 {
+      t.Errorf("test failed for distance `%s': %f %f", distance, d1, d2)
+    }
+  }
+  config.ModelFallbackDistance = "l1"
+  if _, err := counts_distance(config, a, b); err == nil {
+    t.Error("test failed")
+  }
+  if _, err := counts_distance(DefaultModHmmConfig(), Counts{}, b); err == nil {
+    t.Error("test failed")
+  }
+}
+
+func TestModelFallbackCompute(t *testing.T) {
+  dir, cleanup := testTempDir(t)
+  defer cleanup()
+
+  config := DefaultModHmmConfig()
+  config.Directory = dir
+  config.CompletePaths("")
+  files := config.EnrichmentFiles("h3k27ac")
+
+  // data with the distribution of a compiled fallback model
+  for _, name := range ModelFallbackList {
+    c := config
+    c.ModelFallback = name
+    counts := Counts{}
+    if err := ImportDefaultFile(c, &counts, files.CoverageCnts.Filename); err != nil {
+      t.Fatal(err)
+    }
+    if err := counts.ExportFile(files.CoverageCnts.Filename); err != nil {
+      t.Fatal(err)
+    }
+    r := model_fallback_compute(config, files)
+    if r.Selected != name || r.Distances[name] > 1e-8 || len(r.Distances) != len(ModelFallbackList) {
+      t.Errorf("test failed for `%s': %v", name, r)
+    }
+  }
+}
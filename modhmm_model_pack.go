@@ -0,0 +1,351 @@
+/* Copyright (C) 2019 Philipp Benner
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+/* -------------------------------------------------------------------------- */
+
+import   "fmt"
+import   "archive/tar"
+import   "archive/zip"
+import   "bytes"
+import   "compress/gzip"
+import   "io"
+import   "io/ioutil"
+import   "log"
+import   "os"
+import   "path"
+import   "strings"
+
+import . "github.com/pbenner/modhmm/config"
+import . "github.com/pbenner/modhmm/utility"
+
+import   "github.com/pborman/getopt"
+
+/* A model pack bundles the enrichment models, foreground components and
+ * reference counts of all features together with the HMM. Packs are either
+ * directories or archives (tar, tar.gz or zip) and contain files named like
+ * the default model files (e.g. atac.json, atac.components.json,
+ * atac.counts.json and segmentation.json), independent of the file names
+ * in the config. Any pack can be used as model fallback.
+ * -------------------------------------------------------------------------- */
+
+const modelPackHMM = "segmentation.json"
+
+type modelPackEntry struct {
+  Name     string
+  Filename string
+}
+
+// Name of a model file within model packs and compiled models. Files are
+// stored under the default names of the features (e.g. h3k27ac.json), so
+// that packs do not depend on the file names of the exporting config.
+func modelPackName(config ConfigModHmm, filename string) string {
+  if filename == config.Model.Filename {
+    return modelPackHMM
+  }
+  for _, feature := range EnrichmentModelList {
+    files := config.EnrichmentFiles(feature)
+    switch filename {
+    case files.Model       .Filename: return fmt.Sprintf("%s.json", files.Feature)
+    case files.Components  .Filename: return fmt.Sprintf("%s.components.json", files.Feature)
+    case files.CoverageCnts.Filename: return fmt.Sprintf("%s.counts.json", files.Feature)
+    }
+  }
+  return path.Base(filename)
+}
+
+/* -------------------------------------------------------------------------- */
+
+func modelPackFormat(filename string) string {
+  switch {
+  case strings.HasSuffix(filename, ".tar.gz"): return "tar.gz"
+  case strings.HasSuffix(filename, ".tgz"   ): return "tar.gz"
+  case strings.HasSuffix(filename, ".tar"   ): return "tar"
+  case strings.HasSuffix(filename, ".zip"   ): return "zip"
+  default:
+    return ""
+  }
+}
+
+func modelPackReadTar(pack, filename string, compressed bool) ([]byte, error) {
+  f, err := os.Open(pack)
+  if err != nil {
+    return nil, err
+  }
+  defer f.Close()
+
+  var reader io.Reader = f
+  if compressed {
+    g, err := gzip.NewReader(f)
+    if err != nil {
+      return nil, err
+    }
+    defer g.Close()
+    reader = g
+  }
+  r := tar.NewReader(reader)
+  for {
+    header, err := r.Next()
+    if err == io.EOF {
+      break
+    }
+    if err != nil {
+      return nil, err
+    }
+    // files may be stored in a sub-directory of the archive
+    if header.Typeflag == tar.TypeReg && path.Base(header.Name) == filename {
+      return ioutil.ReadAll(r)
+    }
+  }
+  return nil, fmt.Errorf("file `%s' not found in model pack `%s'", filename, pack)
+}
+
+func modelPackReadZip(pack, filename string) ([]byte, error) {
+  r, err := zip.OpenReader(pack)
+  if err != nil {
+    return nil, err
+  }
+  defer r.Close()
+
+  for _, file := range r.File {
+    // files may be stored in a sub-directory of the archive
+    if file.FileInfo().IsDir() || path.Base(file.Name) != filename {
+      continue
+    }
+    f, err := file.Open()
+    if err != nil {
+      return nil, err
+    }
+    defer f.Close()
+    return ioutil.ReadAll(f)
+  }
+  return nil, fmt.Errorf("file `%s' not found in model pack `%s'", filename, pack)
+}
+
+func modelPackOpen(pack, filename string) (io.ReadCloser, error) {
+  info, err := os.Stat(pack)
+  if err != nil {
+    return nil, fmt.Errorf("invalid model fallback `%s': %v", pack, err)
+  }
+  if info.IsDir() {
+    return os.Open(path.Join(pack, filename))
+  }
+  var data []byte
+  switch modelPackFormat(pack) {
+  case "tar.gz": data, err = modelPackReadTar(pack, filename, true)
+  case "tar"   : data, err = modelPackReadTar(pack, filename, false)
+  case "zip"   : data, err = modelPackReadZip(pack, filename)
+  default:
+    return nil, fmt.Errorf("invalid model fallback `%s': neither a directory nor a tar, tar.gz or zip archive", pack)
+  }
+  if err != nil {
+    return nil, err
+  }
+  return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+// Open a file of the model fallback, which is either one of the models
+// compiled into ModHMM (possibly selected automatically) or a model pack.
+func modelFallbackOpen(config ConfigModHmm, filename string) (io.ReadCloser, error) {
+  if config.ModelFallbackAuto() {
+    config.ModelFallback = model_fallback_auto(config, filename)
+  }
+  if config.ModelFallbackBuiltin() {
+    // compiled HMMs are stored next to the single-feature models
+    if filename == modelPackHMM {
+      return assets.Open(fmt.Sprintf("%s.json", config.ModelFallbackPath()))
+    }
+    return assets.Open(path.Join(config.ModelFallbackPath(), filename))
+  }
+  return modelPackOpen(config.ModelFallbackPath(), filename)
+}
+
+/* -------------------------------------------------------------------------- */
+
+func modelPackCopy(writer io.Writer, filename string) error {
+  f, err := os.Open(filename)
+  if err != nil {
+    return err
+  }
+  defer f.Close()
+  _, err = io.Copy(writer, f)
+  return err
+}
+
+func modelPackWriteDir(target string, entries []modelPackEntry) error {
+  if err := os.MkdirAll(target, 0755); err != nil {
+    return err
+  }
+  for _, entry := range entries {
+    f, err := os.Create(path.Join(target, entry.Name))
+    if err != nil {
+      return err
+    }
+    if err := modelPackCopy(f, entry.Filename); err != nil {
+      f.Close(); return err
+    }
+    if err := f.Close(); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+func modelPackWriteTar(writer io.Writer, entries []modelPackEntry) error {
+  w := tar.NewWriter(writer)
+  for _, entry := range entries {
+    info, err := os.Stat(entry.Filename)
+    if err != nil {
+      return err
+    }
+    header, err := tar.FileInfoHeader(info, "")
+    if err != nil {
+      return err
+    }
+    header.Name = entry.Name
+    if err := w.WriteHeader(header); err != nil {
+      return err
+    }
+    if err := modelPackCopy(w, entry.Filename); err != nil {
+      return err
+    }
+  }
+  return w.Close()
+}
+
+func modelPackWriteZip(writer io.Writer, entries []modelPackEntry) error {
+  w := zip.NewWriter(writer)
+  for _, entry := range entries {
+    info, err := os.Stat(entry.Filename)
+    if err != nil {
+      return err
+    }
+    header, err := zip.FileInfoHeader(info)
+    if err != nil {
+      return err
+    }
+    header.Name   = entry.Name
+    header.Method = zip.Deflate
+    f, err := w.CreateHeader(header)
+    if err != nil {
+      return err
+    }
+    if err := modelPackCopy(f, entry.Filename); err != nil {
+      return err
+    }
+  }
+  return w.Close()
+}
+
+func modelPackWrite(target string, entries []modelPackEntry) error {
+  format := modelPackFormat(target)
+  if format == "" {
+    return modelPackWriteDir(target, entries)
+  }
+  f, err := os.Create(target)
+  if err != nil {
+    return err
+  }
+  switch format {
+  case "tar.gz":
+    g := gzip.NewWriter(f)
+    if err = modelPackWriteTar(g, entries); err == nil {
+      err = g.Close()
+    }
+  case "tar":
+    err = modelPackWriteTar(f, entries)
+  case "zip":
+    err = modelPackWriteZip(f, entries)
+  }
+  if err != nil {
+    f.Close(); return err
+  }
+  return f.Close()
+}
+
+/* -------------------------------------------------------------------------- */
+
+func model_pack_entries(config ConfigModHmm, features []string) []modelPackEntry {
+  entries := []modelPackEntry{}
+  visited := make(map[string]bool)
+  add     := func(name, filename string) {
+    if visited[name] {
+      return
+    }
+    visited[name] = true
+    if !FileExists(filename) {
+      printStderr(config, 1, "Warning: file `%s' does not exist and is not included in the model pack\n", filename)
+      return
+    }
+    entries = append(entries, modelPackEntry{Name: name, Filename: filename})
+  }
+  for _, feature := range features {
+    files := config.EnrichmentFiles(feature)
+    for _, file := range []TargetFile{files.Model, files.Components, files.CoverageCnts} {
+      // use the same file names as the fallback lookup
+      add(modelPackName(config, file.Filename), file.Filename)
+    }
+  }
+  add(modelPackHMM, config.Model.Filename)
+  return entries
+}
+
+func modhmm_export_model_pack(config ConfigModHmm, target string, features []string) {
+  entries := model_pack_entries(config, features)
+  if len(entries) == 0 {
+    log.Fatal("no model files found that could be exported")
+  }
+  printStderr(config, 1, "Exporting model pack to `%s'... ", target)
+  if err := modelPackWrite(target, entries); err != nil {
+    printStderr(config, 1, "failed\n")
+    log.Fatalf("ERROR: could not export model pack to `%s': %v", target, err)
+  }
+  printStderr(config, 1, "done\n")
+  for _, entry := range entries {
+    printStderr(config, 2, " -> %-25s (%s)\n", entry.Name, entry.Filename)
+  }
+}
+
+/* -------------------------------------------------------------------------- */
+
+func modhmm_export_model_pack_main(config ConfigModHmm, args []string) {
+
+  options := getopt.New()
+  options.SetProgram(fmt.Sprintf("%s export-model-pack", os.Args[0]))
+  options.SetParameters("TARGET [FEATURE]...\n\n" +
+    " TARGET is either a directory or an archive (.tar, .tar.gz, .tgz or .zip).\n" +
+    " If no features are given, models of all features are exported.\n")
+
+  optHelp := options.BoolLong("help", 'h', "print help")
+
+  options.Parse(args)
+
+  // command options
+  if *optHelp {
+    options.PrintUsage(os.Stdout)
+    os.Exit(0)
+  }
+  if len(options.Args()) < 1 {
+    options.PrintUsage(os.Stderr)
+    os.Exit(1)
+  }
+  if len(options.Args()) == 1 {
+    modhmm_export_model_pack(config, options.Args()[0], EnrichmentList)
+  } else {
+    modhmm_export_model_pack(config, options.Args()[0], options.Args()[1:])
+  }
+}
@@ -0,0 +1,99 @@
+/* Copyright (C) 2020 Philipp Benner
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+/* -------------------------------------------------------------------------- */
+
+import   "io/ioutil"
+import   "math"
+import   "os"
+import   "path/filepath"
+import   "testing"
+
+import . "github.com/pbenner/autodiff/statistics"
+
+import . "github.com/pbenner/modhmm/config"
+
+/* -------------------------------------------------------------------------- */
+
+// Config with custom file names for the h3k27ac models
+func testModelPackConfig(dir, prefix string) ConfigModHmm {
+  config := DefaultModHmmConfig()
+  config.Directory = dir
+  config.EnrichmentModel.H3k27ac.Filename = prefix + "-model.json"
+  config.EnrichmentComp .H3k27ac.Filename = prefix + "-foreground.json"
+  config.CoverageCnts   .H3k27ac.Filename = prefix + "-counts.json"
+  config.CompletePaths("")
+  return config
+}
+
+/* -------------------------------------------------------------------------- */
+
+func TestModelPackRoundTrip(t *testing.T) {
+  dir, cleanup := testTempDir(t)
+  defer cleanup()
+
+  dirExport := filepath.Join(dir, "export")
+  dirImport := filepath.Join(dir, "import")
+  for _, d := range []string{dirExport, dirImport} {
+    if err := os.Mkdir(d, 0777); err != nil {
+      t.Fatal(err)
+    }
+  }
+  config := testModelPackConfig(dirExport, "run1")
+  files  := config.EnrichmentFiles("h3k27ac")
+  if err := ExportDistribution(files.Model.Filename, testMixture(t, []float64{0.7, 0.2, 0.1}, testDeltaPdf(t, 0.0), testPoissonPdf(t, 2.0), testPoissonPdf(t, 20.0))); err != nil {
+    t.Fatal(err)
+  }
+  ExportComponents(config, files.Components.Filename, []int{2})
+  if err := (&Counts{X: []float64{0, 1, 2}, Y: []int{10, 5, 1}}).ExportFile(files.CoverageCnts.Filename); err != nil {
+    t.Fatal(err)
+  }
+  entries := model_pack_entries(config, []string{"h3k27ac"})
+  names   := map[string]bool{}
+  for _, entry := range entries {
+    names[entry.Name] = true
+  }
+  for _, name := range []string{"h3k27ac.json", "h3k27ac.components.json", "h3k27ac.counts.json"} {
+    if !names[name] {
+      t.Errorf("test failed: `%s' missing in model pack", name)
+    }
+  }
+  for _, pack := range []string{"pack", "pack.tar", "pack.tar.gz", "pack.zip"} {
+    if err := modelPackWrite(filepath.Join(dir, pack), entries); err != nil {
+      t.Fatal(err)
+    }
+    // import with different file names, where no local models exist
+    c := testModelPackConfig(dirImport, "run2")
+    c.ModelFallback = filepath.Join(dir, pack)
+    f := c.EnrichmentFiles("h3k27ac")
+
+    mixture := ImportMixtureDistribution(c, f.Model.Filename)
+    if mixture.NComponents() != 3 || math.Abs(mixtureComponentMean(mixture.Edist[2]) - 20.0) > 1e-8 {
+      t.Errorf("test failed for `%s'", pack)
+    }
+    if k, _ := ImportComponents(c, f.Components.Filename, mixture.NComponents()); len(k) != 1 || k[0] != 2 {
+      t.Errorf("test failed for `%s': %v", pack, k)
+    }
+    if counts := ImportCounts(c, f.CoverageCnts.Filename); len(counts.X) != 3 || counts.Y[1] != 5 {
+      t.Errorf("test failed for `%s': %v", pack, counts)
+    }
+  }
+  if r, err := ioutil.ReadDir(filepath.Join(dir, "pack")); err != nil || len(r) != 3 {
+    t.Error("test failed")
+  }
+}
@@ -0,0 +1,400 @@
+/* Copyright (C) 2020 Philipp Benner
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+/* -------------------------------------------------------------------------- */
+
+import   "fmt"
+import   "io"
+import   "log"
+import   "math"
+import   "os"
+import   "path/filepath"
+import   "sort"
+import   "strconv"
+import   "strings"
+
+import . "github.com/pbenner/ngstat/config"
+
+import   "github.com/pborman/getopt"
+import . "github.com/pbenner/gonetics"
+import   "github.com/pbenner/threadpool"
+import . "github.com/pbenner/modhmm/config"
+import . "github.com/pbenner/modhmm/utility"
+
+/* -------------------------------------------------------------------------- */
+
+type QcThresholds struct {
+  MinNSC        float64
+  MinRSC        float64
+  MinFRiP       float64
+  MaxDuplicates float64
+}
+
+type QcReport struct {
+  Feature           string   `json:"Feature"`
+  Filename          string   `json:"Filename"`
+  Reads             int      `json:"Reads"`
+  Duplicates        int      `json:"Duplicates"`
+  DuplicateFraction float64  `json:"Duplicate Fraction"`
+  LowMapQ           int      `json:"Low MAPQ"`
+  LowMapQFraction   float64  `json:"Low MAPQ Fraction"`
+  UsableReads       int      `json:"Usable Reads"`
+  UsableFraction    float64  `json:"Usable Fraction"`
+  ReadLength        int      `json:"Read Length"`
+  Fraglen           int      `json:"Fragment Length"`
+  NSC               float64  `json:"NSC"`
+  RSC               float64  `json:"RSC"`
+  PeaksFile         string   `json:"Peaks File"`
+  ReadsInPeaks      int      `json:"Reads in Peaks"`
+  FRiP              float64  `json:"FRiP"`
+  Warnings        []string   `json:"Warnings"`
+}
+
+/* -------------------------------------------------------------------------- */
+
+func (report *QcReport) Import(reader io.Reader, args... interface{}) error {
+  return JsonImport(reader, report)
+}
+
+func (report *QcReport) Export(writer io.Writer) error {
+  return JsonExport(writer, report)
+}
+
+func (report *QcReport) ExportTable(writer io.Writer) error {
+  rows := [][2]string{
+    {"Feature"           , report.Feature},
+    {"Filename"          , report.Filename},
+    {"Reads"             , fmt.Sprintf("%d", report.Reads)},
+    {"Duplicates"        , fmt.Sprintf("%d", report.Duplicates)},
+    {"Duplicate Fraction", fmt.Sprintf("%.4f", report.DuplicateFraction)},
+    {"Low MAPQ"          , fmt.Sprintf("%d", report.LowMapQ)},
+    {"Low MAPQ Fraction" , fmt.Sprintf("%.4f", report.LowMapQFraction)},
+    {"Usable Reads"      , fmt.Sprintf("%d", report.UsableReads)},
+    {"Usable Fraction"   , fmt.Sprintf("%.4f", report.UsableFraction)},
+    {"Read Length"       , fmt.Sprintf("%d", report.ReadLength)},
+    {"Fragment Length"   , fmt.Sprintf("%d", report.Fraglen)},
+    {"NSC"               , fmt.Sprintf("%.4f", report.NSC)},
+    {"RSC"               , fmt.Sprintf("%.4f", report.RSC)},
+    {"Peaks File"        , report.PeaksFile},
+    {"Reads in Peaks"    , fmt.Sprintf("%d", report.ReadsInPeaks)},
+    {"FRiP"              , fmt.Sprintf("%.4f", report.FRiP)},
+    {"Warnings"          , strings.Join(report.Warnings, "; ")},
+  }
+  for _, row := range rows {
+    if _, err := fmt.Fprintf(writer, "%-20s %s\n", row[0], row[1]); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+func (report *QcReport) ExportTableFile(filename string) error {
+  f, err := os.Create(filename); if err != nil {
+    return err
+  }
+  defer f.Close()
+  return report.ExportTable(f)
+}
+
+func (report *QcReport) Check(thresholds QcThresholds) {
+  report.Warnings = []string{}
+  if report.NSC < thresholds.MinNSC {
+    report.Warnings = append(report.Warnings, fmt.Sprintf("NSC %.4f is lower than %.4f", report.NSC, thresholds.MinNSC))
+  }
+  if report.RSC < thresholds.MinRSC {
+    report.Warnings = append(report.Warnings, fmt.Sprintf("RSC %.4f is lower than %.4f", report.RSC, thresholds.MinRSC))
+  }
+  if report.PeaksFile != "" && report.FRiP < thresholds.MinFRiP {
+    report.Warnings = append(report.Warnings, fmt.Sprintf("FRiP %.4f is lower than %.4f", report.FRiP, thresholds.MinFRiP))
+  }
+  if report.DuplicateFraction > thresholds.MaxDuplicates {
+    report.Warnings = append(report.Warnings, fmt.Sprintf("duplicate fraction %.4f is higher than %.4f", report.DuplicateFraction, thresholds.MaxDuplicates))
+  }
+}
+
+/* peak lookup
+ * -------------------------------------------------------------------------- */
+
+type peakRegions map[string][][2]int
+
+// Import peaks from a ModHMM peak table or a BED file
+func importPeakRegions(filename string) (peakRegions, error) {
+  granges := GRanges{}
+  if err := granges.ImportTable(filename, []string{}, []string{}); err != nil {
+    if err := granges.ImportBed3(filename); err != nil {
+      return nil, fmt.Errorf("importing peaks from `%s' failed: %v", filename, err)
+    }
+  }
+  peaks := make(peakRegions)
+  for i := 0; i < granges.Length(); i++ {
+    peaks[granges.Seqnames[i]] = append(peaks[granges.Seqnames[i]], [2]int{granges.Ranges[i].From, granges.Ranges[i].To})
+  }
+  for _, r := range peaks {
+    sort.Slice(r, func(i, j int) bool { return r[i][0] < r[j][0] })
+  }
+  return peaks, nil
+}
+
+func (peaks peakRegions) Contains(seqname string, position int) bool {
+  r := peaks[seqname]
+  // find first peak that starts after the given position
+  i := sort.Search(len(r), func(i int) bool { return r[i][0] > position })
+  return i > 0 && position < r[i-1][1]
+}
+
+/* cross-correlation statistics
+ * -------------------------------------------------------------------------- */
+
+func qcCrossCorrStatistics(x []int, y []float64, readLength, fraglen int) (int, float64, float64) {
+  if len(x) == 0 {
+    return fraglen, 0.0, 0.0
+  }
+  // find fragment length peak if it is not known
+  if fraglen <= 0 {
+    v_max := math.Inf(-1)
+    for i := 1; i < len(x)-1; i++ {
+      // skip phantom peak at the read length
+      if x[i] < readLength + readLength/2 {
+        continue
+      }
+      if y[i-1] < y[i] && y[i] > y[i+1] && y[i] > v_max {
+        fraglen, v_max = x[i], y[i]
+      }
+    }
+  }
+  ccFrag    := math.NaN()
+  ccPhantom := math.Inf(-1)
+  ccMin     := math.Inf( 1)
+  binSize   := 1
+  if len(x) > 1 {
+    binSize = x[1]-x[0]
+  }
+  for i := 0; i < len(x); i++ {
+    if x[i] <= fraglen && fraglen < x[i]+binSize {
+      ccFrag = y[i]
+    }
+    if x[i]+binSize > readLength-binSize && x[i] <= readLength+binSize && y[i] > ccPhantom {
+      ccPhantom = y[i]
+    }
+    if y[i] < ccMin {
+      ccMin = y[i]
+    }
+  }
+  nsc := ccFrag/ccMin
+  rsc := (ccFrag-ccMin)/(ccPhantom-ccMin)
+  if math.IsNaN(nsc) || math.IsInf(nsc, 0) {
+    nsc = 0.0
+  }
+  if math.IsNaN(rsc) || math.IsInf(rsc, 0) {
+    rsc = 0.0
+  }
+  return fraglen, nsc, rsc
+}
+
+/* -------------------------------------------------------------------------- */
+
+func qcFilename(filename, suffix string) string {
+  basename := strings.TrimSuffix(filename, filepath.Ext(filename))
+  return fmt.Sprintf("%s.qc.%s", basename, suffix)
+}
+
+func qc(config ConfigModHmm, feature, filename, filenamePeaks string, filterChroms []string, thresholds QcThresholds) (QcReport, error) {
+  report := QcReport{Feature: feature, Filename: filename}
+
+  var peaks peakRegions
+  if filenamePeaks != "" {
+    if p, err := importPeakRegions(filenamePeaks); err != nil {
+      return report, err
+    } else {
+      peaks = p
+      report.PeaksFile = filenamePeaks
+    }
+  }
+  if err := fetch_alignment_file(config, filename); err != nil {
+    return report, err
+  }
+  genome, err := ImportAlignmentGenome(config, filename); if err != nil {
+    return report, err
+  }
+  f, err := OpenAlignmentFile(config, filename); if err != nil {
+    return report, err
+  }
+  defer f.Close()
+
+  printStderr(config, 1, "[%s] Reading tags from `%s'\n", feature, filename)
+
+  // count reads and pass usable reads on for computing the cross-correlation
+  readLength := 0
+  reads      := make(chan Read)
+  go func() {
+    for r := range f.ReadSimple(false, false) {
+      if StringList(filterChroms).Contains(r.Seqname) {
+        continue
+      }
+      report.Reads++
+      if r.Duplicate {
+        report.Duplicates++
+      }
+      if r.MapQ < config.CoverageMAPQ {
+        report.LowMapQ++
+      }
+      if r.Duplicate || r.MapQ < config.CoverageMAPQ {
+        continue
+      }
+      report.UsableReads++
+      readLength += r.Range.To - r.Range.From
+      if peaks != nil && peaks.Contains(r.Seqname, (r.Range.From+r.Range.To)/2) {
+        report.ReadsInPeaks++
+      }
+      reads <- r
+    }
+    close(reads)
+  }()
+  x, y, _, _, err := CrosscorrelateReads(reads, genome, 2000, 10)
+  // drain channel in case of an error
+  for _ = range reads {
+  }
+  if f.Err() != nil {
+    return report, fmt.Errorf("reading `%s' failed: %v", filename, f.Err())
+  }
+  if err != nil {
+    return report, err
+  }
+  if report.Reads > 0 {
+    report.DuplicateFraction = float64(report.Duplicates )/float64(report.Reads)
+    report.LowMapQFraction   = float64(report.LowMapQ    )/float64(report.Reads)
+    report.UsableFraction    = float64(report.UsableReads)/float64(report.Reads)
+  }
+  if report.UsableReads > 0 {
+    report.ReadLength = readLength/report.UsableReads
+    report.FRiP       = float64(report.ReadsInPeaks)/float64(report.UsableReads)
+  }
+  report.Fraglen, report.NSC, report.RSC = qcCrossCorrStatistics(x, y, report.ReadLength, importFraglen(config, feature, filename))
+  report.Check(thresholds)
+
+  return report, nil
+}
+
+/* -------------------------------------------------------------------------- */
+
+func modhmm_qc(config ConfigModHmm, feature string, thresholds QcThresholds) error {
+
+  if !CoverageList.Contains(strings.ToLower(feature)) {
+    return fmt.Errorf("unknown feature: %s", feature)
+  }
+  filenameBam   := config.Bam.GetTargetFiles(feature)
+  filenamePeaks := ""
+  filterChroms  := []string{}
+  logPrefix     := feature
+
+  if strings.ToLower(feature) == "open" {
+    logPrefix    = strings.ToLower(config.OpenChromatinAssay)
+    filterChroms = []string{"chrM", "M"}
+  }
+  if len(filenameBam) == 0 {
+    if EnrichmentIsOptional(feature) {
+      printStderr(config, 1, "Warning: no bam files specified for optional feature `%s'. This feature will be ignored.\n", logPrefix)
+      return nil
+    } else {
+      return fmt.Errorf("ERROR: no bam files specified for feature `%s'", logPrefix)
+    }
+  }
+  // FRiP is computed only if enrichment peaks are available
+  if filename := config.EnrichmentPeak.GetTargetFile(feature).Filename; FileExists(filename) {
+    filenamePeaks = filename
+  } else {
+    printStderr(config, 1, "[%s] Enrichment peaks `%s' not found (see call-enrichment-peaks). FRiP will not be computed.\n", logPrefix, filename)
+  }
+  for _, filename := range filenameBam {
+    filenameJson  := qcFilename(filename, "json")
+    filenameTable := qcFilename(filename, "table")
+
+    report, err := qc(config, logPrefix, filename, filenamePeaks, filterChroms, thresholds); if err != nil {
+      return fmt.Errorf("quality control of `%s' failed: %v", filename, err)
+    }
+    for _, warning := range report.Warnings {
+      printStderr(config, 0, "[%s] Warning: `%s': %s\n", logPrefix, filename, warning)
+    }
+    printStderr(config, 1, "[%s] Writing quality control report `%s'\n", logPrefix, filenameJson)
+    if err := ExportFile(&report, filenameJson); err != nil {
+      return err
+    }
+    printStderr(config, 1, "[%s] Writing quality control report `%s'\n", logPrefix, filenameTable)
+    if err := report.ExportTableFile(filenameTable); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+func modhmm_qc_loop(config ConfigModHmm, features []string, thresholds QcThresholds) {
+  pool := threadpool.New(config.CoverageThreads, 10)
+  for _, feature := range features {
+    f := config.CoerceOpenChromatinAssay(feature)
+    pool.AddJob(0, func(pool threadpool.ThreadPool, erf func() error) error {
+      return modhmm_qc(config, f, thresholds)
+    })
+  }
+  if err := pool.Wait(0); err != nil {
+    log.Fatal(err)
+  }
+}
+
+func modhmm_qc_all(config ConfigModHmm, thresholds QcThresholds) {
+  modhmm_qc_loop(config, CoverageList, thresholds)
+}
+
+/* -------------------------------------------------------------------------- */
+
+func modhmm_qc_main(config ConfigModHmm, args []string) {
+
+  options := getopt.New()
+  options.SetProgram(fmt.Sprintf("%s qc", os.Args[0]))
+  options.SetParameters("[FEATURE]...\n")
+
+  optMinNSC     := options.StringLong("min-nsc",        0 , "1.05", "flag libraries with a lower normalized strand cross-correlation [default 1.05]")
+  optMinRSC     := options.StringLong("min-rsc",        0 , "0.8",  "flag libraries with a lower relative strand cross-correlation [default 0.8]")
+  optMinFRiP    := options.StringLong("min-frip",       0 , "0.01", "flag libraries with a lower fraction of reads in peaks [default 0.01]")
+  optMaxDups    := options.StringLong("max-duplicates", 0 , "0.5",  "flag libraries with a higher fraction of duplicates [default 0.5]")
+  optHelp       := options.  BoolLong("help",          'h',         "print help")
+
+  options.Parse(args)
+
+  // command options
+  if *optHelp {
+    options.PrintUsage(os.Stdout)
+    os.Exit(0)
+  }
+  thresholds := QcThresholds{}
+  for _, opt := range []struct{ name string; value *string; target *float64 } {
+    {"min-nsc"       , optMinNSC , &thresholds.MinNSC       },
+    {"min-rsc"       , optMinRSC , &thresholds.MinRSC       },
+    {"min-frip"      , optMinFRiP, &thresholds.MinFRiP      },
+    {"max-duplicates", optMaxDups, &thresholds.MaxDuplicates} } {
+    if v, err := strconv.ParseFloat(*opt.value, 64); err != nil {
+      log.Fatalf("parsing option `%s' failed: %v", opt.name, err)
+    } else {
+      *opt.target = v
+    }
+  }
+  if len(options.Args()) == 0 {
+    modhmm_qc_all(config, thresholds)
+  } else {
+    modhmm_qc_loop(config, options.Args(), thresholds)
+  }
+}
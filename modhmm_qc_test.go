@@ -0,0 +1,101 @@
+/* Copyright (C) 2020 Philipp Benner
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+/* -------------------------------------------------------------------------- */
+
+import   "io/ioutil"
+import   "math"
+import   "path/filepath"
+import   "testing"
+
+/* -------------------------------------------------------------------------- */
+
+func TestQcFilename(t *testing.T) {
+  for filename, result := range map[string]string{
+    "sample.bam"        : "sample.qc.json",
+    "ab.b.bam"          : "ab.b.qc.json",
+    "lamb.bam"          : "lamb.qc.json",
+    "data/h3k27ac.sam"  : "data/h3k27ac.qc.json" } {
+    if r := qcFilename(filename, "json"); r != result {
+      t.Errorf("test failed for `%s': %s", filename, r)
+    }
+  }
+}
+
+func TestPeakRegions(t *testing.T) {
+  dir, cleanup := testTempDir(t)
+  defer cleanup()
+
+  filename := filepath.Join(dir, "peaks.bed")
+  if err := ioutil.WriteFile(filename, []byte("chr1\t500\t600\nchr1\t100\t200\n"), 0666); err != nil {
+    t.Fatal(err)
+  }
+  peaks, err := importPeakRegions(filename); if err != nil {
+    t.Fatal(err)
+  }
+  for position, result := range map[int]bool{99: false, 100: true, 199: true, 200: false, 550: true, 700: false} {
+    if peaks.Contains("chr1", position) != result {
+      t.Errorf("test failed for position %d", position)
+    }
+  }
+  if peaks.Contains("chr2", 150) {
+    t.Error("test failed")
+  }
+  if _, err := importPeakRegions(filepath.Join(dir, "missing.bed")); err == nil {
+    t.Error("test failed")
+  }
+}
+
+func TestQcCrossCorr(t *testing.T) {
+  x := []int{}
+  y := []float64{}
+  for i := 0; i <= 300; i += 10 {
+    v := 0.2
+    switch i {
+    case  40,  60: v = 0.3
+    case  50     : v = 0.5
+    case 190, 210: v = 0.6
+    case 200     : v = 0.8
+    }
+    x = append(x, i)
+    y = append(y, v)
+  }
+  fraglen, nsc, rsc := qcCrossCorrStatistics(x, y, 50, -1)
+  if fraglen != 200 {
+    t.Errorf("test failed: fraglen %d", fraglen)
+  }
+  if math.Abs(nsc - 4.0) > 1e-8 || math.Abs(rsc - 2.0) > 1e-8 {
+    t.Errorf("test failed: nsc %f, rsc %f", nsc, rsc)
+  }
+}
+
+func TestQcCheck(t *testing.T) {
+  thresholds := QcThresholds{MinNSC: 1.05, MinRSC: 0.8, MinFRiP: 0.01, MaxDuplicates: 0.5}
+  report := QcReport{NSC: 1.2, RSC: 1.0, FRiP: 0.0, DuplicateFraction: 0.1}
+  report.Check(thresholds)
+  // FRiP is checked only if peaks are available
+  if len(report.Warnings) != 0 {
+    t.Errorf("test failed: %v", report.Warnings)
+  }
+  report.PeaksFile         = "peaks.table"
+  report.DuplicateFraction = 0.7
+  report.Check(thresholds)
+  if len(report.Warnings) != 2 {
+    t.Errorf("test failed: %v", report.Warnings)
+  }
+}
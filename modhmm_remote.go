@@ -0,0 +1,216 @@
+/* Copyright (C) 2020 Philipp Benner
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+/* -------------------------------------------------------------------------- */
+
+import   "encoding/json"
+import   "fmt"
+import   "net/http"
+import   "os"
+import   "regexp"
+import   "strings"
+
+import . "github.com/pbenner/modhmm/config"
+import . "github.com/pbenner/modhmm/utility"
+
+/* -------------------------------------------------------------------------- */
+
+type remoteMetadata struct {
+  Uri  string `json:"URI"`
+  Size int64  `json:"Size"`
+  ETag string `json:"ETag"`
+}
+
+func (obj *remoteMetadata) ImportFile(filename string) error {
+  f, err := os.Open(filename); if err != nil {
+    return err
+  }
+  defer f.Close()
+  return json.NewDecoder(f).Decode(obj)
+}
+
+func (obj *remoteMetadata) ExportFile(filename string) error {
+  f, err := os.Create(filename); if err != nil {
+    return err
+  }
+  defer f.Close()
+  return json.NewEncoder(f).Encode(obj)
+}
+
+/* -------------------------------------------------------------------------- */
+
+func getenv(keys ...string) string {
+  for _, key := range keys {
+    if value := os.Getenv(key); value != "" {
+      return value
+    }
+  }
+  return ""
+}
+
+// S3 settings from the config file take precedence over environment variables
+func remote_s3_config(config ConfigModHmm) S3Config {
+  r := S3Config{}
+  r.Endpoint     = config.S3Endpoint
+  r.Region       = config.S3Region
+  r.AccessKey    = config.S3AccessKey
+  r.SecretKey    = config.S3SecretKey
+  r.SessionToken = getenv("AWS_SESSION_TOKEN")
+  if r.Endpoint == "" {
+    r.Endpoint = getenv("S3_ENDPOINT", "AWS_ENDPOINT_URL")
+  }
+  if r.Region == "" {
+    r.Region = getenv("AWS_REGION", "AWS_DEFAULT_REGION")
+  }
+  if r.AccessKey == "" {
+    r.AccessKey = getenv("AWS_ACCESS_KEY_ID")
+  }
+  if r.SecretKey == "" {
+    r.SecretKey = getenv("AWS_SECRET_ACCESS_KEY")
+  }
+  return r
+}
+
+// Translate URI into a HTTP(S) URL and a function for preparing requests
+func remote_url(config ConfigModHmm, uri string) (string, func(*http.Request) error, error) {
+  if strings.HasPrefix(strings.ToLower(uri), "s3://") {
+    bucket, key, err := S3ParseUri(uri); if err != nil {
+      return "", nil, err
+    }
+    s3 := remote_s3_config(config)
+    return s3.Url(bucket, key), s3.Sign, nil
+  }
+  return uri, func(*http.Request) error { return nil }, nil
+}
+
+func remote_head(config ConfigModHmm, uri string) (remoteMetadata, error) {
+  r := remoteMetadata{Uri: uri, Size: -1}
+  url, prepare, err := remote_url(config, uri); if err != nil {
+    return r, err
+  }
+  req, err := http.NewRequest("HEAD", url, nil); if err != nil {
+    return r, err
+  }
+  if err := prepare(req); err != nil {
+    return r, err
+  }
+  resp, err := HttpClient.Do(req); if err != nil {
+    return r, err
+  }
+  resp.Body.Close()
+  if resp.StatusCode != http.StatusOK {
+    return r, fmt.Errorf("accessing `%s' failed: %s", uri, resp.Status)
+  }
+  r.Size = resp.ContentLength
+  r.ETag = strings.Trim(resp.Header.Get("ETag"), "\"")
+  return r, nil
+}
+
+/* -------------------------------------------------------------------------- */
+
+// Fetch remote file into the local cache, unless the cached copy has the
+// same size and ETag as the remote file
+func remote_fetch(config ConfigModHmm, filename string) error {
+  uri, ok := config.RemoteFiles[filename]; if !ok {
+    return nil
+  }
+  filenameMeta := filename + ".meta.json"
+
+  remote, err := remote_head(config, uri); if err != nil {
+    if FileExists(filename) {
+      printStderr(config, 1, "Warning: %v. Using cached file `%s'.\n", err, filename)
+      return nil
+    }
+    return err
+  }
+  if FileExists(filename) {
+    cached := remoteMetadata{}
+    if err := cached.ImportFile(filenameMeta); err == nil {
+      if info, err := os.Stat(filename); err == nil && cached.Uri == uri && info.Size() == remote.Size && cached.ETag == remote.ETag {
+        printStderr(config, 2, "Cached file `%s' is up to date...\n", filename)
+        return nil
+      }
+    }
+    printStderr(config, 1, "Cached file `%s' is outdated\n", filename)
+  }
+  // the remote file is downloaded to a temporary file, which replaces the
+  // cached copy only after a successful download
+  filenameTmp     := filename + ".fetch"
+  filenameTmpMeta := filenameTmp + ".meta.json"
+  // partial downloads are resumed only if they belong to the same version
+  // of the remote file
+  partial := remoteMetadata{}
+  if err := partial.ImportFile(filenameTmpMeta); err != nil || partial != remote || remote.ETag == "" {
+    os.Remove(filenameTmp + ".part")
+  }
+  if err := os.MkdirAll(config.CacheDir, 0777); err != nil {
+    return err
+  }
+  if err := remote.ExportFile(filenameTmpMeta); err != nil {
+    return err
+  }
+  url, prepare, err := remote_url(config, uri); if err != nil {
+    return err
+  }
+  options := DefaultDownloadOptions()
+  options.Retries = config.DownloadRetries
+  options.Prepare = prepare
+  options.Logger  = func(format string, args ...interface{}) {
+    printStderr(config, 1, format, args...)
+  }
+  // ETags of objects uploaded in a single part are md5 checksums
+  if r, _ := regexp.Compile("^[0-9a-fA-F]{32}$"); strings.HasPrefix(strings.ToLower(uri), "s3://") && r.MatchString(remote.ETag) {
+    options.MD5 = remote.ETag
+  }
+  printStderr(config, 1, "Fetching `%s' into `%s'...\n", uri, filename)
+  if err := DownloadFile(filenameTmp, url, options); err != nil {
+    if FileExists(filename) {
+      printStderr(config, 1, "Warning: %v. Using cached file `%s'.\n", err, filename)
+      return nil
+    }
+    return err
+  }
+  if info, err := os.Stat(filenameTmp); err != nil {
+    return err
+  } else
+  if remote.Size >= 0 && info.Size() != remote.Size {
+    os.Remove(filenameTmp)
+    return fmt.Errorf("fetching `%s' failed: received %d of %d bytes", uri, info.Size(), remote.Size)
+  }
+  if err := os.Rename(filenameTmp, filename); err != nil {
+    return err
+  }
+  os.Remove(filenameTmpMeta)
+  if err := remote.ExportFile(filenameMeta); err != nil {
+    return err
+  }
+  printStderr(config, 1, "Fetched `%s'\n", uri)
+  return nil
+}
+
+// Make sure that an alignment file is available locally, either by fetching
+// it from a remote location or by downloading it from ENCODE
+func fetch_alignment_file(config ConfigModHmm, filename string) error {
+  if _, ok := config.RemoteFiles[filename]; ok {
+    return remote_fetch(config, filename)
+  }
+  if !FileExists(filename) && alignmentFormat(filename) != "sam" {
+    return bam_download(config, filename)
+  }
+  return nil
+}
@@ -0,0 +1,91 @@
+/* Copyright (C) 2020 Philipp Benner
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+/* -------------------------------------------------------------------------- */
+
+import   "io/ioutil"
+import   "net/http"
+import   "net/http/httptest"
+import   "path/filepath"
+import   "strings"
+import   "testing"
+import   "time"
+
+import . "github.com/pbenner/modhmm/config"
+import . "github.com/pbenner/modhmm/utility"
+
+/* -------------------------------------------------------------------------- */
+
+func TestRemoteFetch(t *testing.T) {
+  dir, cleanup := testTempDir(t)
+  defer cleanup()
+
+  content := "version 1"
+  etag    := "v1"
+  fail    := false
+  server  := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("ETag", "\"" + etag + "\"")
+    if r.Method == "GET" && fail {
+      http.Error(w, "not found", http.StatusNotFound); return
+    }
+    http.ServeContent(w, r, "", time.Time{}, strings.NewReader(content))
+  }))
+  defer server.Close()
+
+  config := DefaultModHmmConfig()
+  config.CacheDir        = dir
+  config.DownloadRetries = 1
+  filename := filepath.Join(dir, "h3k27ac.bam")
+  config.RemoteFiles = map[string]string{filename: server.URL + "/h3k27ac.bam"}
+
+  cached := func() string {
+    buf, err := ioutil.ReadFile(filename); if err != nil {
+      t.Fatal(err)
+    }
+    return string(buf)
+  }
+  if err := remote_fetch(config, filename); err != nil || cached() != "version 1" {
+    t.Fatalf("test failed: %v", err)
+  }
+  // a failed refresh keeps the cached copy
+  content, etag, fail = "version 2", "v2", true
+  if err := remote_fetch(config, filename); err != nil || cached() != "version 1" {
+    t.Errorf("test failed: %v", err)
+  }
+  // partial downloads of the same version are resumed
+  if err := ioutil.WriteFile(filename + ".fetch.part", []byte("vers"), 0666); err != nil {
+    t.Fatal(err)
+  }
+  fail = false
+  if err := remote_fetch(config, filename); err != nil || cached() != "version 2" {
+    t.Errorf("test failed: %v", err)
+  }
+  if FileExists(filename + ".fetch.part") || FileExists(filename + ".fetch.meta.json") {
+    t.Error("test failed")
+  }
+  // partial downloads of other versions are discarded
+  content, etag, fail = "version 3", "v3", true
+  remote_fetch(config, filename)
+  if err := ioutil.WriteFile(filename + ".fetch.part", []byte("XXXX"), 0666); err != nil {
+    t.Fatal(err)
+  }
+  content, etag, fail = "version 4", "v4", false
+  if err := remote_fetch(config, filename); err != nil || cached() != "version 4" {
+    t.Errorf("test failed: %v", err)
+  }
+}
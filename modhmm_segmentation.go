@@ -20,9 +20,9 @@ package main
 
 import   "fmt"
 import   "log"
-import   "path"
 import   "os"
 import   "math"
+import   "strings"
 
 import . "github.com/pbenner/gonetics"
 import . "github.com/pbenner/ngstat/classification"
@@ -46,11 +46,8 @@ func ImportHMM(config ConfigModHmm) ModHmm {
   printStderr(config, 2, "Importing HMM model from `%s'... ", config.Model.Filename)
   if err := ImportDistribution(filename, &modhmm, Float64Type); err != nil {
     printStderr(config, 2, "failed\n")
-    // remove directory from filename
-    _, filename = path.Split(filename)
-    filename = fmt.Sprintf("%s.json", config.ModelFallbackPath())
     printStderr(config, 2, "Importing HMM fallback model (%s)... ", config.ModelFallback)
-    if err := ImportDefaultDistribution(config, filename, &modhmm, Float64Type); err != nil {
+    if err := ImportDefaultDistribution(config, modelPackHMM, &modhmm, Float64Type); err != nil {
       printStderr(config, 2, "failed\n")
       log.Fatal(err)
     }
@@ -67,12 +64,31 @@ func import_chromatin_state_tracks(config ConfigModHmm, tracks []Track, trackFil
   if len(tracks) == 0 {
     tracks = make([]Track, len(trackFiles))
   }
+  // states that cannot be identified must remain excluded
+  unidentifiable := make(map[string]bool)
+  for _, state := range chromatin_state_unidentifiable(config) {
+    unidentifiable[config.ChromatinStateProb.GetTargetFile(state).Filename] = true
+  }
   // import track files (do not use ImportAndEstimateOnMultiTrack, which uses lazy imports)
   for i := 0; i < len(trackFiles); i++ {
     if tracks[i] == nil {
       track, err := ImportTrack(config.SessionConfig, trackFiles[i]); if err != nil {
         log.Fatal(err)
       }
+      if unidentifiable[trackFiles[i]] {
+        // emissions are zero at all bins, also if the track was computed
+        // before data of a required feature was removed
+        if err := (GenericMutableTrack{track}).Map(track, func(seqname string, position int, value float64) float64 {
+          return 0.0
+        }); err != nil {
+          log.Fatal(err)
+        }
+      } else {
+        // bins with low mappability have uninformative emissions
+        if err := mappabilityMask(config, track, 1.0); err != nil {
+          log.Fatal(err)
+        }
+      }
       tracks[i] = track
     }
   }
@@ -157,6 +173,10 @@ func segment(config ConfigModHmm, tracks []Track, trackFiles []string) {
       name = fmt.Sprintf("ModHMM [%s]", config.Description)
       desc = fmt.Sprintf("Segmentation ModHMM:%s [%s]", Version, config.Description)
     }
+    // record states that could not be identified because of missing data
+    if states := chromatin_state_unidentifiable(config); len(states) > 0 {
+      desc = fmt.Sprintf("%s (unidentifiable states: %s)", desc, strings.Join(states, ","))
+    }
     tracksEquivalent := make([]Track, modhmm.NStates())
     for i, state := range ChromatinStateList {
       for _, j := range getStateIndices(modhmm, state) {
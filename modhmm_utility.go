@@ -18,10 +18,12 @@ package main
 
 /* -------------------------------------------------------------------------- */
 
+import   "io/ioutil"
 import   "log"
 import   "os"
 
 import . "github.com/pbenner/modhmm/config"
+import . "github.com/pbenner/modhmm/utility"
 
 /* file utilities
  * -------------------------------------------------------------------------- */
@@ -52,6 +54,40 @@ func updateRequired(config ConfigModHmm, target TargetFile, deps ...string) bool
   return false
 }
 
+/* Parameters that determine the content of a target, but which are not
+ * stored in any of its dependencies, are saved next to the target. A
+ * target requires an update if its parameters change. Targets without a
+ * parameter file are assumed to be computed with default parameters.
+ * -------------------------------------------------------------------------- */
+
+type targetParameters func(config ConfigModHmm) string
+
+func targetParametersFilename(target TargetFile) string {
+  return target.Filename + ".parameters"
+}
+
+func updateRequiredParameters(config ConfigModHmm, target TargetFile, parameters targetParameters) bool {
+  if target.Static || !FileExists(target.Filename) {
+    return false
+  }
+  current := parameters(DefaultModHmmConfig())
+  if buf, err := ioutil.ReadFile(targetParametersFilename(target)); err == nil {
+    current = string(buf)
+  }
+  if current != parameters(config) {
+    printStderr(config, 2, "Target `%s' requires update...\n", target.Filename)
+    printStderr(config, 3, " -> parameters have changed\n")
+    return true
+  }
+  return false
+}
+
+func saveTargetParameters(config ConfigModHmm, target TargetFile, parameters targetParameters) {
+  if err := ioutil.WriteFile(targetParametersFilename(target), []byte(parameters(config)), 0666); err != nil {
+    log.Fatal(err)
+  }
+}
+
 /* string slice utilities
  * -------------------------------------------------------------------------- */
 
@@ -0,0 +1,63 @@
+/* Copyright (C) 2020 Philipp Benner
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+/* -------------------------------------------------------------------------- */
+
+import   "io/ioutil"
+import   "path/filepath"
+import   "testing"
+
+import . "github.com/pbenner/modhmm/config"
+
+/* -------------------------------------------------------------------------- */
+
+func TestTargetParameters(t *testing.T) {
+  dir, cleanup := testTempDir(t)
+  defer cleanup()
+
+  target := TargetFile{Filename: filepath.Join(dir, "coverage-h3k27ac.bw")}
+  if err := ioutil.WriteFile(target.Filename, []byte{}, 0666); err != nil {
+    t.Fatal(err)
+  }
+  config := DefaultModHmmConfig()
+  // targets without parameter file are computed with default parameters
+  if updateRequiredParameters(config, target, coverage_parameters) {
+    t.Error("test failed")
+  }
+  config.CoverageTargetDepth = 1000
+  if !updateRequiredParameters(config, target, coverage_parameters) {
+    t.Error("test failed")
+  }
+  saveTargetParameters(config, target, coverage_parameters)
+  if updateRequiredParameters(config, target, coverage_parameters) {
+    t.Error("test failed")
+  }
+  config.CoverageSeed = 2
+  if !updateRequiredParameters(config, target, coverage_parameters) {
+    t.Error("test failed")
+  }
+  config.CoverageTargetDepth = 0
+  if !updateRequiredParameters(config, target, coverage_parameters) {
+    t.Error("test failed")
+  }
+  // static targets are never updated
+  target.Static = true
+  if updateRequiredParameters(config, target, coverage_parameters) {
+    t.Error("test failed")
+  }
+}
@@ -0,0 +1,217 @@
+/* Copyright (C) 2018 Philipp Benner
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package utility
+
+/* -------------------------------------------------------------------------- */
+
+import "context"
+import "crypto/md5"
+import "encoding/hex"
+import "fmt"
+import "io"
+import "net/http"
+import "os"
+import "strings"
+import "time"
+
+/* -------------------------------------------------------------------------- */
+
+type DownloadOptions struct {
+  // number of attempts before giving up
+  Retries int
+  // waiting time before the first retry, doubled after each attempt
+  Backoff time.Duration
+  // expected md5 checksum (hex encoded), not checked if empty
+  MD5     string
+  // maximum time without receiving any data
+  Timeout time.Duration
+  // called before each retry
+  Logger  func(format string, args ...interface{})
+  // called before sending a request (e.g. for signing)
+  Prepare func(req *http.Request) error
+}
+
+func DefaultDownloadOptions() DownloadOptions {
+  return DownloadOptions{Retries: 5, Backoff: time.Second, Timeout: time.Minute}
+}
+
+// Client for small requests (e.g. metadata), downloads use an idle timeout
+// instead, since large transfers may take arbitrarily long
+var HttpClient = &http.Client{Timeout: time.Minute}
+
+/* -------------------------------------------------------------------------- */
+
+// errors that should not be retried
+type downloadPermanentError struct {
+  error
+}
+
+// Reader that cancels a request if no data is received within the given
+// time
+type downloadIdleReader struct {
+  io.Reader
+  timer   *time.Timer
+  timeout  time.Duration
+}
+
+func (obj downloadIdleReader) Read(p []byte) (int, error) {
+  n, err := obj.Reader.Read(p)
+  obj.timer.Reset(obj.timeout)
+  return n, err
+}
+
+func FileMD5(filename string) (string, error) {
+  f, err := os.Open(filename); if err != nil {
+    return "", err
+  }
+  defer f.Close()
+  h := md5.New()
+  if _, err := io.Copy(h, f); err != nil {
+    return "", err
+  }
+  return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func downloadAttempt(filename, url string, options DownloadOptions) error {
+  // resume partial download if possible
+  offset := int64(0)
+  if info, err := os.Stat(filename); err == nil {
+    offset = info.Size()
+  }
+  req, err := http.NewRequest("GET", url, nil); if err != nil {
+    return downloadPermanentError{err}
+  }
+  if offset > 0 {
+    req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+  }
+  if options.Prepare != nil {
+    if err := options.Prepare(req); err != nil {
+      return downloadPermanentError{err}
+    }
+  }
+  // cancel request if no data is received for too long
+  ctx, cancel := context.WithCancel(context.Background())
+  defer cancel()
+  var timer *time.Timer
+  if options.Timeout > 0 {
+    timer = time.AfterFunc(options.Timeout, cancel)
+    defer timer.Stop()
+  }
+  resp, err := (&http.Client{}).Do(req.WithContext(ctx)); if err != nil {
+    return err
+  }
+  defer resp.Body.Close()
+
+  var body io.Reader = resp.Body
+  if timer != nil {
+    body = downloadIdleReader{resp.Body, timer, options.Timeout}
+  }
+
+  flags := os.O_CREATE | os.O_WRONLY
+  switch {
+  case resp.StatusCode == http.StatusPartialContent && offset > 0:
+    flags |= os.O_APPEND
+  case resp.StatusCode == http.StatusOK:
+    // server does not support range requests, start from scratch
+    flags |= os.O_TRUNC
+  case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+    if options.MD5 != "" {
+      // partial file is probably complete, which is verified by the
+      // md5 checksum
+      return nil
+    }
+    // partial file cannot be verified, start from scratch
+    resp.Body.Close()
+    if err := os.Remove(filename); err != nil {
+      return downloadPermanentError{err}
+    }
+    return downloadAttempt(filename, url, options)
+  case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+    return fmt.Errorf("downloading `%s' failed: %s", url, resp.Status)
+  default:
+    return downloadPermanentError{fmt.Errorf("downloading `%s' failed: %s", url, resp.Status)}
+  }
+  out, err := os.OpenFile(filename, flags, 0666); if err != nil {
+    return downloadPermanentError{err}
+  }
+  if _, err := io.Copy(out, body); err != nil {
+    out.Close()
+    return fmt.Errorf("downloading `%s' failed: %v", url, err)
+  }
+  if err := out.Close(); err != nil {
+    return downloadPermanentError{err}
+  }
+  // check for truncated transfers
+  if resp.ContentLength >= 0 {
+    expected := resp.ContentLength
+    if resp.StatusCode == http.StatusPartialContent {
+      expected += offset
+    }
+    if info, err := os.Stat(filename); err == nil && info.Size() != expected {
+      return fmt.Errorf("downloading `%s' failed: received %d of %d bytes", url, info.Size(), expected)
+    }
+  }
+  return nil
+}
+
+// Download a file to a temporary location and move it to its final
+// destination once the transfer is complete and the checksum is verified.
+// Interrupted transfers are resumed with range requests.
+func DownloadFile(filename string, url string, args ...DownloadOptions) error {
+  options := DefaultDownloadOptions()
+  if len(args) > 0 {
+    options = args[0]
+  }
+  if options.Retries < 1 {
+    options.Retries = 1
+  }
+  filenameTmp := filename + ".part"
+  backoff     := options.Backoff
+
+  var err error
+  for i := 0; i < options.Retries; i++ {
+    if i > 0 {
+      if options.Logger != nil {
+        options.Logger("%v (retrying in %v)\n", err, backoff)
+      }
+      time.Sleep(backoff)
+      backoff *= 2
+    }
+    if err = downloadAttempt(filenameTmp, url, options); err != nil {
+      if _, ok := err.(downloadPermanentError); ok {
+        break
+      }
+      continue
+    }
+    if options.MD5 != "" {
+      if sum, e := FileMD5(filenameTmp); e != nil {
+        err = e; break
+      } else
+      if !strings.EqualFold(sum, options.MD5) {
+        // corrupt file, start from scratch
+        os.Remove(filenameTmp)
+        err = fmt.Errorf("downloading `%s' failed: md5 checksum mismatch (expected %s, got %s)", url, options.MD5, sum)
+        continue
+      }
+    }
+    return os.Rename(filenameTmp, filename)
+  }
+  if e, ok := err.(downloadPermanentError); ok {
+    return e.error
+  }
+  return err
+}
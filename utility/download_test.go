@@ -0,0 +1,225 @@
+/* Copyright (C) 2018 Philipp Benner
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package utility
+
+/* -------------------------------------------------------------------------- */
+
+import "bytes"
+import "crypto/md5"
+import "encoding/hex"
+import "fmt"
+import "io/ioutil"
+import "net/http"
+import "net/http/httptest"
+import "os"
+import "path/filepath"
+import "strconv"
+import "strings"
+import "sync"
+import "testing"
+import "time"
+
+/* -------------------------------------------------------------------------- */
+
+var testDownloadData = bytes.Repeat([]byte("0123456789abcdef"), 4096)
+
+func testDownloadMD5(data []byte) string {
+  sum := md5.Sum(data)
+  return hex.EncodeToString(sum[:])
+}
+
+func testDownloadOptions() DownloadOptions {
+  options := DefaultDownloadOptions()
+  options.Backoff = time.Millisecond
+  return options
+}
+
+// Serve data, where handler may intercept the n-th request (starting at
+// zero) by returning true
+func testDownloadServer(handler func(n int, w http.ResponseWriter, r *http.Request) bool) (*httptest.Server, *[]string) {
+  mutex  := sync.Mutex{}
+  ranges := []string{}
+  server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    mutex.Lock()
+    n := len(ranges)
+    ranges = append(ranges, r.Header.Get("Range"))
+    mutex.Unlock()
+    if handler(n, w, r) {
+      return
+    }
+    offset := 0
+    if s := r.Header.Get("Range"); s != "" {
+      offset, _ = strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(s, "bytes="), "-"))
+      if offset >= len(testDownloadData) {
+        w.WriteHeader(http.StatusRequestedRangeNotSatisfiable); return
+      }
+      w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, len(testDownloadData)-1, len(testDownloadData)))
+      w.Header().Set("Content-Length", strconv.Itoa(len(testDownloadData)-offset))
+      w.WriteHeader(http.StatusPartialContent)
+    } else {
+      w.Header().Set("Content-Length", strconv.Itoa(len(testDownloadData)))
+    }
+    w.Write(testDownloadData[offset:])
+  }))
+  return server, &ranges
+}
+
+func testDownload(t *testing.T, server *httptest.Server, partial []byte, options DownloadOptions) error {
+  dir, err := ioutil.TempDir("", "modhmm-test"); if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+  filename := filepath.Join(dir, "test.bam")
+  if partial != nil {
+    if err := ioutil.WriteFile(filename+".part", partial, 0666); err != nil {
+      t.Fatal(err)
+    }
+  }
+  if err := DownloadFile(filename, server.URL+"/test.bam", options); err != nil {
+    return err
+  }
+  if data, err := ioutil.ReadFile(filename); err != nil {
+    t.Fatal(err)
+  } else
+  if !bytes.Equal(data, testDownloadData) {
+    t.Errorf("test failed: downloaded file differs (%d bytes)", len(data))
+  }
+  if _, err := os.Stat(filename+".part"); err == nil {
+    t.Error("test failed: partial file not removed")
+  }
+  return nil
+}
+
+/* -------------------------------------------------------------------------- */
+
+func TestDownloadRetry(t *testing.T) {
+  server, ranges := testDownloadServer(func(n int, w http.ResponseWriter, r *http.Request) bool {
+    if n < 2 {
+      w.WriteHeader(http.StatusServiceUnavailable); return true
+    }
+    return false
+  })
+  defer server.Close()
+  if err := testDownload(t, server, nil, testDownloadOptions()); err != nil {
+    t.Fatal(err)
+  }
+  if len(*ranges) != 3 {
+    t.Errorf("test failed: %d requests", len(*ranges))
+  }
+}
+
+func TestDownloadPermanentError(t *testing.T) {
+  server, ranges := testDownloadServer(func(n int, w http.ResponseWriter, r *http.Request) bool {
+    w.WriteHeader(http.StatusNotFound); return true
+  })
+  defer server.Close()
+  if err := testDownload(t, server, nil, testDownloadOptions()); err == nil {
+    t.Error("test failed")
+  }
+  if len(*ranges) != 1 {
+    t.Errorf("test failed: %d requests", len(*ranges))
+  }
+}
+
+func TestDownloadResume(t *testing.T) {
+  server, ranges := testDownloadServer(func(n int, w http.ResponseWriter, r *http.Request) bool {
+    if n == 0 {
+      // interrupt transfer after half of the data
+      w.Header().Set("Content-Length", strconv.Itoa(len(testDownloadData)))
+      w.Write(testDownloadData[0:len(testDownloadData)/2])
+      w.(http.Flusher).Flush()
+      panic(http.ErrAbortHandler)
+    }
+    return false
+  })
+  defer server.Close()
+  options := testDownloadOptions()
+  options.MD5 = testDownloadMD5(testDownloadData)
+  if err := testDownload(t, server, nil, options); err != nil {
+    t.Fatal(err)
+  }
+  if len(*ranges) != 2 || (*ranges)[1] != fmt.Sprintf("bytes=%d-", len(testDownloadData)/2) {
+    t.Errorf("test failed: %v", *ranges)
+  }
+}
+
+func TestDownloadMD5(t *testing.T) {
+  server, ranges := testDownloadServer(func(n int, w http.ResponseWriter, r *http.Request) bool {
+    if n == 0 {
+      // corrupt data
+      w.Write(bytes.ToUpper(testDownloadData)); return true
+    }
+    return false
+  })
+  defer server.Close()
+  options := testDownloadOptions()
+  options.MD5 = testDownloadMD5(testDownloadData)
+  if err := testDownload(t, server, nil, options); err != nil {
+    t.Fatal(err)
+  }
+  // corrupt file must be downloaded again from scratch
+  if len(*ranges) != 2 || (*ranges)[1] != "" {
+    t.Errorf("test failed: %v", *ranges)
+  }
+}
+
+func TestDownloadStalePartial(t *testing.T) {
+  server, ranges := testDownloadServer(func(n int, w http.ResponseWriter, r *http.Request) bool {
+    return false
+  })
+  defer server.Close()
+  // stale partial file that cannot be verified without md5 checksum
+  stale := bytes.Repeat([]byte("x"), len(testDownloadData)+10)
+  if err := testDownload(t, server, stale, testDownloadOptions()); err != nil {
+    t.Fatal(err)
+  }
+  if len(*ranges) != 2 || (*ranges)[0] == "" || (*ranges)[1] != "" {
+    t.Errorf("test failed: %v", *ranges)
+  }
+}
+
+func TestDownloadTimeout(t *testing.T) {
+  done := make(chan struct{})
+  server, ranges := testDownloadServer(func(n int, w http.ResponseWriter, r *http.Request) bool {
+    if n == 0 {
+      // stall transfer
+      w.Header().Set("Content-Length", strconv.Itoa(len(testDownloadData)))
+      w.Write(testDownloadData[0:100])
+      w.(http.Flusher).Flush()
+      select {
+      case <-done:
+      case <-time.After(10*time.Second):
+      }
+      return true
+    }
+    return false
+  })
+  defer server.Close()
+  defer close(done)
+  options := testDownloadOptions()
+  options.Timeout = 100*time.Millisecond
+  start := time.Now()
+  if err := testDownload(t, server, nil, options); err != nil {
+    t.Fatal(err)
+  }
+  if time.Since(start) > 5*time.Second {
+    t.Error("test failed: stalled transfer was not cancelled")
+  }
+  if len(*ranges) != 2 || (*ranges)[1] != "bytes=100-" {
+    t.Errorf("test failed: %v", *ranges)
+  }
+}
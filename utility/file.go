@@ -18,8 +18,6 @@ package utility
 
 /* -------------------------------------------------------------------------- */
 
-import "io"
-import "net/http"
 import "os"
 
 /* -------------------------------------------------------------------------- */
@@ -39,20 +37,3 @@ func FileCheckMark(filename string) string {
     return "\xE2\x9C\x93"
   }
 }
-
-func DownloadFile(filepath string, url string) error {
-  resp, err := http.Get(url)
-  if err != nil {
-    return err
-  }
-  defer resp.Body.Close()
-
-  out, err := os.Create(filepath)
-  if err != nil {
-    return err
-  }
-  defer out.Close()
-
-  _, err = io.Copy(out, resp.Body)
-  return err
-}
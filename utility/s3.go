@@ -0,0 +1,177 @@
+/* Copyright (C) 2020 Philipp Benner
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package utility
+
+/* -------------------------------------------------------------------------- */
+
+import "crypto/hmac"
+import "crypto/sha256"
+import "encoding/hex"
+import "fmt"
+import "net/http"
+import "sort"
+import "strings"
+import "time"
+
+/* -------------------------------------------------------------------------- */
+
+func IsRemoteFile(filename string) bool {
+  filename = strings.ToLower(filename)
+  return strings.HasPrefix(filename, "http://") || strings.HasPrefix(filename, "https://") || strings.HasPrefix(filename, "s3://")
+}
+
+/* -------------------------------------------------------------------------- */
+
+// Minimal client for S3-compatible object stores (AWS, MinIO), which
+// supports signed GET and HEAD requests (AWS signature version 4).
+type S3Config struct {
+  Endpoint     string
+  Region       string
+  AccessKey    string
+  SecretKey    string
+  SessionToken string
+}
+
+// Split an s3://bucket/key URI into bucket and key.
+func S3ParseUri(uri string) (string, string, error) {
+  if !strings.HasPrefix(strings.ToLower(uri), "s3://") {
+    return "", "", fmt.Errorf("invalid S3 URI `%s'", uri)
+  }
+  fields := strings.SplitN(uri[5:], "/", 2)
+  if len(fields) != 2 || fields[0] == "" || fields[1] == "" {
+    return "", "", fmt.Errorf("invalid S3 URI `%s'", uri)
+  }
+  return fields[0], fields[1], nil
+}
+
+func s3Escape(s string) string {
+  var b strings.Builder
+  for i := 0; i < len(s); i++ {
+    c := s[i]
+    if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') || c == '-' || c == '.' || c == '_' || c == '~' || c == '/' {
+      b.WriteByte(c)
+    } else {
+      fmt.Fprintf(&b, "%%%02X", c)
+    }
+  }
+  return b.String()
+}
+
+// Path-style URL of an object, which is also supported by MinIO.
+func (config S3Config) Url(bucket, key string) string {
+  endpoint := config.Endpoint
+  if endpoint == "" {
+    endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", config.region())
+  }
+  return fmt.Sprintf("%s/%s/%s", strings.TrimRight(endpoint, "/"), s3Escape(bucket), s3Escape(key))
+}
+
+func (config S3Config) region() string {
+  if config.Region == "" {
+    return "us-east-1"
+  }
+  return config.Region
+}
+
+func s3Hmac(key []byte, data string) []byte {
+  h := hmac.New(sha256.New, key)
+  h.Write([]byte(data))
+  return h.Sum(nil)
+}
+
+// Sign request. Anonymous requests are sent if no credentials are given.
+// The payload is not signed, since only GET and HEAD requests are sent.
+func (config S3Config) Sign(req *http.Request) error {
+  return config.sign(req, time.Now(), "UNSIGNED-PAYLOAD")
+}
+
+// Canonical query string with sorted and encoded parameters
+func s3CanonicalQuery(req *http.Request) string {
+  query := req.URL.Query()
+  keys  := []string{}
+  for key := range query {
+    keys = append(keys, key)
+  }
+  sort.Strings(keys)
+  r := []string{}
+  for _, key := range keys {
+    values := query[key]
+    sort.Strings(values)
+    for _, value := range values {
+      r = append(r, strings.Replace(s3Escape(key), "/", "%2F", -1)+"="+strings.Replace(s3Escape(value), "/", "%2F", -1))
+    }
+  }
+  return strings.Join(r, "&")
+}
+
+// Host and all x-amz-* headers are signed, as well as range headers of
+// resumed downloads
+func s3CanonicalHeaders(req *http.Request) (string, string) {
+  host := req.Host
+  if host == "" {
+    host = req.URL.Host
+  }
+  values  := map[string]string{"host": host}
+  headers := []string{"host"}
+  for key := range req.Header {
+    if k := strings.ToLower(key); k == "range" || strings.HasPrefix(k, "x-amz-") {
+      values [k] = strings.TrimSpace(strings.Join(req.Header[key], ","))
+      headers    = append(headers, k)
+    }
+  }
+  sort.Strings(headers)
+  canonicalHeaders := ""
+  for _, k := range headers {
+    canonicalHeaders += k + ":" + values[k] + "\n"
+  }
+  return canonicalHeaders, strings.Join(headers, ";")
+}
+
+func (config S3Config) sign(req *http.Request, now time.Time, payload string) error {
+  if config.AccessKey == "" || config.SecretKey == "" {
+    return nil
+  }
+  now   = now.UTC()
+  date := now.Format("20060102T150405Z")
+  day  := now.Format("20060102")
+  req.Header.Set("X-Amz-Date", date)
+  req.Header.Set("X-Amz-Content-Sha256", payload)
+  if config.SessionToken != "" {
+    req.Header.Set("X-Amz-Security-Token", config.SessionToken)
+  }
+  canonicalHeaders, signedHeaders := s3CanonicalHeaders(req)
+  canonicalRequest := strings.Join([]string{
+    req.Method,
+    req.URL.EscapedPath(),
+    s3CanonicalQuery(req),
+    canonicalHeaders,
+    signedHeaders,
+    payload }, "\n")
+  scope := fmt.Sprintf("%s/%s/s3/aws4_request", day, config.region())
+  hash  := sha256.Sum256([]byte(canonicalRequest))
+  stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", date, scope, hex.EncodeToString(hash[:])}, "\n")
+
+  key := s3Hmac([]byte("AWS4"+config.SecretKey), day)
+  key  = s3Hmac(key, config.region())
+  key  = s3Hmac(key, "s3")
+  key  = s3Hmac(key, "aws4_request")
+  signature := hex.EncodeToString(s3Hmac(key, stringToSign))
+
+  req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+    config.AccessKey, scope, signedHeaders, signature))
+  return nil
+}